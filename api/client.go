@@ -43,6 +43,12 @@ type RegistrationRequest struct {
 	Affiliation string `json:"affiliation" help:"The identity's affiliation"`
 	// Attributes associated with this identity
 	Attributes []Attribute `json:"attrs,omitempty"`
+	// SecretExpiry is when the secret expires, either as an RFC3339 timestamp
+	// or as a duration (e.g. "24h") relative to the time of registration.
+	// If not specified, the secret does not expire.
+	SecretExpiry string `json:"secret_expiry,omitempty" help:"When the enrollment secret expires, as an RFC3339 timestamp or a duration such as '24h' (default no expiry)"`
+	// SecretOneTime is true if the secret can only be used to enroll once
+	SecretOneTime bool `json:"secret_one_time,omitempty" help:"The enrollment secret can only be used to enroll once"`
 	// CAName is the name of the CA to connect to
 	CAName string `json:"caname,omitempty" skip:"true"`
 }
@@ -74,6 +80,11 @@ type EnrollmentRequest struct {
 	// AttrReqs are requests for attributes to add to the certificate.
 	// Each attribute is added only if the requestor owns the attribute.
 	AttrReqs []*AttributeRequest `json:"attr_reqs,omitempty"`
+	// Type is the type of enrollment request: "x509" for an enrollment
+	// certificate or "idemix" for an Idemix credential
+	Type string `json:"type,omitempty" def:"x509" help:"The type of enrollment request: 'x509' or 'idemix'"`
+	// IDToken is an OIDC ID token with which to enroll instead of the secret
+	IDToken string `json:"-" skip:"true" mask:"password"`
 }
 
 func (er EnrollmentRequest) String() string {
@@ -98,8 +109,8 @@ type ReenrollmentRequest struct {
 
 // RevocationRequest is a revocation request for a single certificate or all certificates
 // associated with an identity.
-// To revoke a single certificate, both the Serial and AKI fields must be set;
-// otherwise, to revoke all certificates and the identity associated with an enrollment ID,
+// To revoke a single certificate, either the Certificate field or both the Serial and AKI fields must be set;
+// to revoke a single Idemix credential, the RevocationHandle field must be set; otherwise, to revoke all certificates and the identity associated with an enrollment ID,
 // the Name field must be set to an existing enrollment ID.
 // A RevocationRequest can only be performed by a user with the "hf.Revoker" attribute.
 type RevocationRequest struct {
@@ -118,14 +129,24 @@ type RevocationRequest struct {
 	CAName string `json:"caname,omitempty" skip:"true"`
 	// GenCRL specifies whether to generate a CRL
 	GenCRL bool `def:"false" skip:"true" json:"gencrl,omitempty"`
+	// Certificate is the PEM-encoded X.509 or SM2 certificate to be revoked.
+	// If set, the server derives the serial number and AKI from the certificate,
+	// so Serial and AKI may be omitted.
+	Certificate string `json:"certificate,omitempty" skip:"true"`
+	// RevocationHandle is the revocation handle of a single Idemix credential to be revoked
+	RevocationHandle string `json:"rh,omitempty" help:"Revocation handle of the Idemix credential to be revoked"`
 }
 
 // RevocationResponse represents response from the server for a revocation request
 type RevocationResponse struct {
 	// RevokedCerts is an array of certificates that were revoked
 	RevokedCerts []RevokedCert
+	// RevokedCredentials is an array of the revocation handles of Idemix credentials that were revoked
+	RevokedCredentials []string
 	// CRL is PEM-encoded certificate revocation list (CRL) that contains all unexpired revoked certificates
 	CRL []byte
+	// Pending is set instead if the revocation must be confirmed by a second identity
+	Pending *PendingOperation
 }
 
 // RevokedCert represents a revoked certificate
@@ -187,6 +208,12 @@ type GenCRLRequest struct {
 	ExpireBefore  time.Time `json:"expirebefore,omitempty"`
 }
 
+// GetCRIRequest is a request to get the credential revocation information (CRI)
+// of the Idemix issuer of the specified certificate authority
+type GetCRIRequest struct {
+	CAName string `json:"caname,omitempty" skip:"true"`
+}
+
 // GenCRLResponse represents a response to get CRL
 type GenCRLResponse struct {
 	// CRL is PEM-encoded certificate revocation list (CRL) that contains requested unexpired revoked certificates
@@ -204,8 +231,10 @@ type AddIdentityRequest struct {
 	// Secret is an optional password.  If not specified,
 	// a random secret is generated.  In both cases, the secret
 	// is returned in the RegistrationResponse.
-	Secret string `json:"secret,omitempty" mask:"password" help:"The enrollment secret for the identity being added"`
-	CAName string `json:"caname,omitempty" skip:"true"`
+	Secret        string `json:"secret,omitempty" mask:"password" help:"The enrollment secret for the identity being added"`
+	SecretExpiry  string `json:"secret_expiry,omitempty" skip:"true"`
+	SecretOneTime bool   `json:"secret_one_time,omitempty" skip:"true"`
+	CAName        string `json:"caname,omitempty" skip:"true"`
 }
 
 // ModifyIdentityRequest represents the request to modify an existing identity on the
@@ -217,7 +246,58 @@ type ModifyIdentityRequest struct {
 	Attributes     []Attribute `mapstructure:"attrs" json:"attrs"`
 	MaxEnrollments int         `mapstructure:"max_enrollments" json:"max_enrollments" help:"The maximum number of times the secret can be reused to enroll"`
 	Secret         string      `json:"secret,omitempty" mask:"password" help:"The enrollment secret for the identity"`
-	CAName         string      `json:"caname,omitempty" skip:"true"`
+	SecretExpiry   string      `json:"secret_expiry,omitempty" skip:"true"`
+	// Suspend prevents the identity from enrolling, reenrolling or
+	// authenticating with a token until it is resumed
+	Suspend bool `json:"suspend,omitempty" skip:"true"`
+	// Resume allows a suspended identity to enroll and authenticate again
+	Resume bool   `json:"resume,omitempty" skip:"true"`
+	CAName string `json:"caname,omitempty" skip:"true"`
+}
+
+// ResetSecretRequest represents the request to replace the enrollment secret of an
+// existing identity with a new random secret
+type ResetSecretRequest struct {
+	ID            string `skip:"true"`
+	SecretExpiry  string `json:"secret_expiry,omitempty"`
+	SecretOneTime bool   `json:"secret_one_time,omitempty"`
+	CAName        string `json:"caname,omitempty" skip:"true"`
+}
+
+// UnlockIdentityRequest represents the request to unlock an identity which was
+// locked out due to repeated failed logins
+type UnlockIdentityRequest struct {
+	ID     string `skip:"true"`
+	CAName string `json:"caname,omitempty" skip:"true"`
+}
+
+// ImportIdentitiesRequest represents the request to add a batch of identities
+// to the fabric-ca-server. The identities are given either as a list or as a
+// CSV document with a header row naming the columns id, type, affiliation,
+// attrs, max_enrollments and secret; all columns other than id are optional.
+// The attrs column is a semicolon-separated list of <name>=<value>[:ecert].
+type ImportIdentitiesRequest struct {
+	Identities []AddIdentityRequest `json:"identities,omitempty"`
+	CSV        string               `json:"csv,omitempty"`
+	CAName     string               `json:"caname,omitempty"`
+}
+
+// ImportIdentitiesResponse is the response from the import identities call
+type ImportIdentitiesResponse struct {
+	// Added is true if the identities were added; if any identity in the
+	// batch is rejected, none of them are added
+	Added   bool                   `json:"added"`
+	Results []ImportIdentityResult `json:"results"`
+	CAName  string                 `json:"caname,omitempty"`
+}
+
+// ImportIdentityResult is the result of importing one identity of a batch
+type ImportIdentityResult struct {
+	ID string `json:"id"`
+	// Secret is the enrollment secret of the identity if it was added
+	Secret string `json:"secret,omitempty"`
+	// Error is the reason that the identity was rejected
+	Error string `json:"error,omitempty"`
 }
 
 // RemoveIdentityRequest represents the request to remove an existing identity from the
@@ -235,6 +315,7 @@ type GetIDResponse struct {
 	Affiliation    string      `json:"affiliation"`
 	Attributes     []Attribute `json:"attrs" mapstructure:"attrs" `
 	MaxEnrollments int         `json:"max_enrollments" mapstructure:"max_enrollments"`
+	Suspended      bool        `json:"suspended,omitempty"`
 	CAName         string      `json:"caname,omitempty"`
 }
 
@@ -244,6 +325,24 @@ type GetAllIDsResponse struct {
 	CAName     string         `json:"caname,omitempty"`
 }
 
+// GetIdentitiesRequest represents the request to get a page of the identities
+// that the caller is authorized to see; only the identities which match all of
+// the non-empty fields are returned
+type GetIdentitiesRequest struct {
+	// Limit is the maximum number of identities returned; 0 means no limit
+	Limit int `json:"limit,omitempty"`
+	// Cursor is the cursor returned with the previous page of identities
+	Cursor string `json:"cursor,omitempty"`
+	// Attributes are the attributes that the identities have, each of the
+	// form 'name' or 'name:value'
+	Attributes []string `json:"attrs,omitempty"`
+	// State is the state of the identities
+	State *int `json:"state,omitempty"`
+	// MaxEnrollments is the maximum number of enrollments of the identities
+	MaxEnrollments *int   `json:"max_enrollments,omitempty"`
+	CAName         string `json:"caname,omitempty" skip:"true"`
+}
+
 // IdentityResponse is the response from the any add/modify/remove identity call
 type IdentityResponse struct {
 	ID             string      `json:"id" skip:"true"`
@@ -251,8 +350,11 @@ type IdentityResponse struct {
 	Affiliation    string      `json:"affiliation"`
 	Attributes     []Attribute `json:"attrs,omitempty" mapstructure:"attrs"`
 	MaxEnrollments int         `json:"max_enrollments,omitempty" mapstructure:"max_enrollments"`
+	Suspended      bool        `json:"suspended,omitempty"`
 	Secret         string      `json:"secret,omitempty"`
 	CAName         string      `json:"caname,omitempty"`
+	// Pending is set if the request must be confirmed by a second identity
+	Pending *PendingOperation `json:"pending,omitempty"`
 }
 
 // IdentityInfo contains information about an identity
@@ -262,6 +364,7 @@ type IdentityInfo struct {
 	Affiliation    string      `json:"affiliation"`
 	Attributes     []Attribute `json:"attrs" mapstructure:"attrs"`
 	MaxEnrollments int         `json:"max_enrollments" mapstructure:"max_enrollments"`
+	Suspended      bool        `json:"suspended,omitempty"`
 }
 
 // AddAffiliationRequest represents the request to add a new affiliation to the
@@ -293,6 +396,8 @@ type RemoveAffiliationRequest struct {
 type AffiliationResponse struct {
 	AffiliationInfo `mapstructure:",squash"`
 	CAName          string `json:"caname,omitempty"`
+	// Pending is set if the request must be confirmed by a second identity
+	Pending *PendingOperation `json:"pending,omitempty"`
 }
 
 // AffiliationInfo contains the affiliation name, child affiliation info, and identities
@@ -303,6 +408,117 @@ type AffiliationInfo struct {
 	Identities   []IdentityInfo    `json:"identities,omitempty"`
 }
 
+// GetAuditLogRequest represents the request to get the records of the audit log
+// of the fabric-ca-server; only the records which match all of the non-empty
+// fields are returned
+type GetAuditLogRequest struct {
+	// Since is the time after which the records were logged
+	Since time.Time `json:"since,omitempty"`
+	// Until is the time before which the records were logged
+	Until time.Time `json:"until,omitempty"`
+	// Caller is the name of the identity which made the changes
+	Caller string `json:"caller,omitempty"`
+	// Action is the kind of change, such as "identity.modify"
+	Action string `json:"action,omitempty"`
+	CAName string `json:"caname,omitempty" skip:"true"`
+}
+
+// AuditRecord is a record in the audit log of a change made by a caller
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Caller string    `json:"caller"`
+	CAName string    `json:"caname"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	// Changes maps each changed field of the target to its values before
+	// and after the change; the values of secrets are masked
+	Changes map[string]AuditChange `json:"changes,omitempty"`
+	// Source is the IP address from which the request was sent
+	Source string `json:"source"`
+}
+
+// AuditChange is the value of a field before and after a change
+type AuditChange struct {
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// PendingOperation is a request which is not performed until a second
+// identity with the authority to perform it confirms it
+type PendingOperation struct {
+	ID string `json:"id"`
+	// Operation is the kind of request, such as "removeidentity"
+	Operation string `json:"operation"`
+	// Target is the identity, affiliation or certificate of the request
+	Target string `json:"target"`
+	// Requester is the name of the identity which sent the request
+	Requester string `json:"requester"`
+	// RequestedAt is when the request was sent, as an RFC3339 timestamp
+	RequestedAt string `json:"requested_at"`
+	// Expiry is when the request can no longer be confirmed, as an RFC3339
+	// timestamp
+	Expiry string `json:"expiry"`
+	CAName string `json:"caname,omitempty"`
+}
+
+// GetPendingOperationsResponse is the response to a request for the pending
+// operations which the caller may confirm
+type GetPendingOperationsResponse struct {
+	Operations []PendingOperation `json:"operations"`
+	CAName     string             `json:"caname,omitempty"`
+}
+
+// ConfirmOperationRequest is a request to confirm a pending operation
+type ConfirmOperationRequest struct {
+	ID     string `json:"id" skip:"true"`
+	CAName string `json:"caname,omitempty" skip:"true"`
+}
+
+// ConfirmOperationResponse is the response to the confirmation of a
+// pending operation
+type ConfirmOperationResponse struct {
+	Operation PendingOperation `json:"operation"`
+	// Result is the response of the operation, which has the same form as
+	// the response to the original request
+	Result interface{} `json:"result,omitempty"`
+	CAName string      `json:"caname,omitempty"`
+}
+
+// InvalidateLDAPCacheRequest is a request to remove an LDAP user from the
+// cache of LDAP users of the fabric-ca-server
+type InvalidateLDAPCacheRequest struct {
+	// ID is the user name or the DN of the user; if it is empty, all users
+	// are removed
+	ID     string `json:"id,omitempty" skip:"true"`
+	CAName string `json:"caname,omitempty" skip:"true"`
+}
+
+// LDAPCacheResponse is the state of the cache of LDAP users
+type LDAPCacheResponse struct {
+	// Entries is the number of cached lookups, including those of users
+	// which were not found
+	Entries int `json:"entries"`
+	// Hits is the number of lookups of users which were found in the cache
+	Hits uint64 `json:"hits"`
+	// NegativeHits is the number of lookups of users which the cache knew
+	// not to exist
+	NegativeHits uint64 `json:"negative_hits"`
+	// Misses is the number of lookups which were sent to the LDAP server
+	Misses uint64 `json:"misses"`
+	// Invalidated is the number of entries which were removed by a request
+	// to invalidate the cache
+	Invalidated int    `json:"invalidated,omitempty"`
+	CAName      string `json:"caname,omitempty"`
+}
+
+// BackupResponse is a backup of the state of every CA of the
+// fabric-ca-server
+type BackupResponse struct {
+	// Archive is a gzip-compressed tar archive, whose manifest is signed by
+	// the default CA
+	Archive []byte `json:"archive"`
+}
+
 // CSRInfo is Certificate Signing Request (CSR) Information
 type CSRInfo struct {
 	CN           string           `json:"CN"`
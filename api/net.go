@@ -18,6 +18,7 @@ package api
 
 import (
 	"github.com/cloudflare/cfssl/signer"
+	"github.com/hyperledger/fabric/idemix"
 )
 
 /*
@@ -43,6 +44,20 @@ type EnrollmentRequestNet struct {
 	AttrReqs []*AttributeRequest `json:"attr_reqs,omitempty"`
 }
 
+// IdemixNonceRequestNet is a request for a nonce to be used in a
+// subsequent Idemix credential request
+type IdemixNonceRequestNet struct {
+	CAName string `json:"caname,omitempty"`
+}
+
+// IdemixEnrollmentRequestNet is a request for an Idemix credential.
+// The issuer nonce in the credential request must have been obtained
+// from the same CA by means of an IdemixNonceRequestNet.
+type IdemixEnrollmentRequestNet struct {
+	CredRequest *idemix.CredRequest `json:"request"`
+	CAName      string              `json:"caname,omitempty"`
+}
+
 // ReenrollmentRequestNet is a request to reenroll an identity.
 // This is useful to renew a certificate before it has expired.
 type ReenrollmentRequestNet struct {
@@ -53,9 +68,9 @@ type ReenrollmentRequestNet struct {
 
 // RevocationRequestNet is a revocation request which flows over the network
 // to the fabric-ca server.
-// To revoke a single certificate, both the Serial and AKI fields must be set;
-// otherwise, to revoke all certificates and the identity associated with an enrollment ID,
-// the Name field must be set to an existing enrollment ID.
+// To revoke a single certificate, either the Certificate field or both the Serial and AKI
+// fields must be set; otherwise, to revoke all certificates and the identity associated with
+// an enrollment ID, the Name field must be set to an existing enrollment ID.
 // A RevocationRequest can only be performed by a user with the "hf.Revoker" attribute.
 type RevocationRequestNet struct {
 	RevocationRequest
@@ -207,6 +207,10 @@ func (c *ClientCmd) runRemoveAffiliation(cmd *cobra.Command, args []string) erro
 	if err != nil {
 		return err
 	}
+	if resp.Pending != nil {
+		printPendingRequest(resp.Pending)
+		return nil
+	}
 
 	fmt.Printf("Successfully removed affiliation: %+v\n", resp)
 
@@ -0,0 +1,106 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib"
+)
+
+type auditArgs struct {
+	since  string
+	until  string
+	caller string
+	action string
+}
+
+func (c *ClientCmd) newAuditCommand() *cobra.Command {
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Get the audit log",
+		Long:  "Get the audit log of changes made to identities, affiliations and certificates",
+	}
+	auditCmd.AddCommand(c.newListAuditCommand())
+	return auditCmd
+}
+
+func (c *ClientCmd) newListAuditCommand() *cobra.Command {
+	auditListCmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List audit log records",
+		Long:    "List the records of the audit log, oldest first; the caller must have the 'hf.Auditor' attribute",
+		Example: "fabric-ca-client audit list --since 2018-06-01T00:00:00Z --caller admin",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return errors.Errorf("Unknown argument '%s'", args[0])
+			}
+			log.Level = log.LevelWarning
+			return c.configInit()
+		},
+		RunE: c.runListAudit,
+	}
+	flags := auditListCmd.Flags()
+	flags.StringVarP(
+		&c.audit.since, "since", "", "", "List records logged at or after this UTC timestamp (in RFC3339 format)")
+	flags.StringVarP(
+		&c.audit.until, "until", "", "", "List records logged before this UTC timestamp (in RFC3339 format)")
+	flags.StringVarP(
+		&c.audit.caller, "caller", "", "", "List records of changes made by this identity")
+	flags.StringVarP(
+		&c.audit.action, "action", "", "", "List records of this action (e.g. 'identity.modify')")
+	return auditListCmd
+}
+
+// The client side logic for listing the audit log
+func (c *ClientCmd) runListAudit(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runListAudit: %+v", c.audit)
+
+	var err error
+	req := &api.GetAuditLogRequest{
+		Caller: c.audit.caller,
+		Action: c.audit.action,
+		CAName: c.clientCfg.CAName,
+	}
+	if c.audit.since != "" {
+		req.Since, err = time.Parse(time.RFC3339, c.audit.since)
+		if err != nil {
+			return errors.Wrap(err, "Invalid 'since' value")
+		}
+	}
+	if c.audit.until != "" {
+		req.Until, err = time.Parse(time.RFC3339, c.audit.until)
+		if err != nil {
+			return errors.Wrap(err, "Invalid 'until' value")
+		}
+	}
+	if !req.Since.IsZero() && !req.Until.IsZero() && req.Since.After(req.Until) {
+		return errors.Errorf("Invalid 'since' value '%s'; it must not be later than the 'until' value '%s'",
+			c.audit.since, c.audit.until)
+	}
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	return id.GetAuditLog(req, lib.AuditRecordDecoder)
+}
@@ -0,0 +1,70 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func (c *ClientCmd) newBackupCommand() *cobra.Command {
+	backupCmd := &cobra.Command{
+		Use:     "backup",
+		Short:   "Back up the server",
+		Long:    "Write a signed archive of the state of every CA of the server to a file, from which it can be restored with 'fabric-ca-server restore'",
+		Example: "fabric-ca-client backup --file backup.tar.gz",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return errors.Errorf("Unknown argument '%s'", args[0])
+			}
+			if c.backupFile == "" {
+				return errors.New("The --file option is required")
+			}
+			return c.configInit()
+		},
+		RunE: c.runBackup,
+	}
+	backupCmd.Flags().StringVarP(
+		&c.backupFile, "file", "", "", "File to which to write the backup archive")
+	return backupCmd
+}
+
+// The client side logic for backing up the server
+func (c *ClientCmd) runBackup(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runBackup: '%s'", c.backupFile)
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	resp, err := id.Backup(c.clientCfg.CAName)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(c.backupFile, resp.Archive, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write the backup archive to '%s'", c.backupFile)
+	}
+	fmt.Printf("Successfully wrote the backup archive to %s\n", c.backupFile)
+	return nil
+}
@@ -61,6 +61,8 @@ type crlArgs struct {
 type revokeArgs struct {
 	// GenCRL specifies whether to generate a CRL
 	GenCRL bool `def:"false" json:"gencrl,omitempty" opt:"" help:"Generates a CRL that contains all revoked certificates"`
+	// Cert is the PEM-encoded certificate file to be revoked
+	Cert string `opt:"" help:"PEM-encoded X.509 or SM2 certificate file to be revoked"`
 }
 
 // ClientCmd encapsulates cobra command that provides command line interface
@@ -103,6 +105,14 @@ type ClientCmd struct {
 	dynamicIdentity identityArgs
 	// Dynamically configuring affiliations
 	dynamicAffiliation affiliationArgs
+	// audit command argument values
+	audit auditArgs
+	// ID of the LDAP user to remove from the LDAP cache of the server
+	ldapCacheID string
+	// backupFile is the file to which the backup of the server is written
+	backupFile string
+	// idTokenFile is the file containing the OIDC ID token with which to enroll
+	idTokenFile string
 	// Enable debug level logging
 	debug bool
 }
@@ -153,7 +163,11 @@ func (c *ClientCmd) init() {
 		c.newGenCsrCommand(),
 		c.newGenCRLCommand(),
 		c.newIdentityCommand(),
-		c.newAffiliationCommand())
+		c.newAffiliationCommand(),
+		c.newAuditCommand(),
+		c.newOperationCommand(),
+		c.newLDAPCacheCommand(),
+		c.newBackupCommand())
 	c.rootCmd.AddCommand(&cobra.Command{
 		Use:   "version",
 		Short: "Prints Fabric CA Client version",
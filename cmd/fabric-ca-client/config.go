@@ -165,6 +165,10 @@ csr:
 #  maxenrollments - The maximum number of times the secret can be reused to enroll.
 #                   Specially, -1 means unlimited; 0 means to use CA's max enrollment
 #                   value.
+#  secretexpiry - When the secret expires, either as an RFC3339 timestamp or
+#                 as a duration (e.g. 24h) from the time of registration.
+#                 If not set, the secret does not expire.
+#  secretonetime - If true, the secret can only be used to enroll once
 #  attributes - List of name/value pairs of attribute for identity
 #############################################################################
 id:
@@ -172,6 +176,8 @@ id:
   type:
   affiliation:
   maxenrollments: 0
+  secretexpiry:
+  secretonetime: false
   attributes:
    # - name:
    #   value:
@@ -181,10 +187,15 @@ id:
 #
 #  profile - Name of the signing profile to use in issuing the certificate
 #  label - Label to use in HSM operations
+#  type - Type of enrollment request: 'x509' for an enrollment certificate or
+#         'idemix' for an Idemix credential. An Idemix credential is written
+#         to the 'user/SignerConfig' file and the issuer public key of the CA
+#         to the 'msp/IssuerPublicKey' file of the MSP directory.
 #############################################################################
 enrollment:
   profile:
   label:
+  type: x509
 
 #############################################################################
 # Name of the CA to connect to within the fabric-ca server
@@ -33,6 +33,17 @@ type identityArgs struct {
 	add    api.AddIdentityRequest
 	modify api.ModifyIdentityRequest
 	remove api.RemoveIdentityRequest
+	reset  api.ResetSecretRequest
+	unlock api.UnlockIdentityRequest
+	batch  identityBatchArgs
+	list   identityListArgs
+}
+
+type identityListArgs struct {
+	limit          int
+	attrs          []string
+	state          int
+	maxEnrollments int
 }
 
 func (c *ClientCmd) newIdentityCommand() *cobra.Command {
@@ -45,14 +56,19 @@ func (c *ClientCmd) newIdentityCommand() *cobra.Command {
 	identityCmd.AddCommand(c.newAddIdentityCommand())
 	identityCmd.AddCommand(c.newModifyIdentityCommand())
 	identityCmd.AddCommand(c.newRemoveIdentityCommand())
+	identityCmd.AddCommand(c.newResetSecretCommand())
+	identityCmd.AddCommand(c.newUnlockIdentityCommand())
+	identityCmd.AddCommand(c.newImportIdentityCommand())
+	identityCmd.AddCommand(c.newExportIdentityCommand())
 	return identityCmd
 }
 
 func (c *ClientCmd) newListIdentityCommand() *cobra.Command {
 	identityListCmd := &cobra.Command{
-		Use:   "list",
-		Short: "List identities",
-		Long:  "List identities visible to caller",
+		Use:     "list",
+		Short:   "List identities",
+		Long:    "List identities visible to caller",
+		Example: "fabric-ca-client identity list --attr hf.Registrar.Roles --attr dept:finance --limit 50",
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			log.Level = log.LevelWarning
 			err := c.configInit()
@@ -69,6 +85,14 @@ func (c *ClientCmd) newListIdentityCommand() *cobra.Command {
 	flags := identityListCmd.Flags()
 	flags.StringVarP(
 		&c.dynamicIdentity.id, "id", "", "", "Get identity information from the fabric-ca server")
+	flags.IntVarP(
+		&c.dynamicIdentity.list.limit, "limit", "", 0, "Maximum number of identities to get from the fabric-ca server at a time (default no limit)")
+	flags.StringArrayVarP(
+		&c.dynamicIdentity.list.attrs, "attr", "", nil, "List identities with this attribute, of the form <name> or <name>:<value>; may be repeated")
+	flags.IntVarP(
+		&c.dynamicIdentity.list.state, "state", "", 0, "List identities in this state")
+	flags.IntVarP(
+		&c.dynamicIdentity.list.maxEnrollments, "maxenrollments", "", 0, "List identities with this maximum number of enrollments")
 	return identityListCmd
 }
 
@@ -85,6 +109,10 @@ func (c *ClientCmd) newAddIdentityCommand() *cobra.Command {
 	util.RegisterFlags(c.myViper, flags, &c.dynamicIdentity.add, nil)
 	flags.StringSliceVarP(
 		&c.cfgAttrs, "attrs", "", nil, "A list of comma-separated attributes of the form <name>=<value> (e.g. foo=foo1,bar=bar1)")
+	flags.StringVarP(
+		&c.dynamicIdentity.add.SecretExpiry, "secret-expiry", "", "", "When the enrollment secret expires, as an RFC3339 timestamp or a duration such as '24h' (default no expiry)")
+	flags.BoolVarP(
+		&c.dynamicIdentity.add.SecretOneTime, "secret-one-time", "", false, "The enrollment secret can only be used to enroll once")
 	flags.StringVarP(
 		&c.dynamicIdentity.json, "json", "", "", "JSON string for adding a new identity")
 	return identityAddCmd
@@ -106,6 +134,12 @@ func (c *ClientCmd) newModifyIdentityCommand() *cobra.Command {
 	util.RegisterFlags(c.myViper, flags, &c.dynamicIdentity.modify, tags)
 	flags.StringSliceVarP(
 		&c.cfgAttrs, "attrs", "", nil, "A list of comma-separated attributes of the form <name>=<value> (e.g. foo=foo1,bar=bar1)")
+	flags.StringVarP(
+		&c.dynamicIdentity.modify.SecretExpiry, "secret-expiry", "", "", "When the enrollment secret expires, as an RFC3339 timestamp or a duration such as '24h'; '0' removes the expiry")
+	flags.BoolVarP(
+		&c.dynamicIdentity.modify.Suspend, "suspend", "", false, "Suspend the identity, so that it cannot enroll, reenroll or authenticate until it is resumed")
+	flags.BoolVarP(
+		&c.dynamicIdentity.modify.Resume, "resume", "", false, "Resume a suspended identity")
 	flags.StringVarP(
 		&c.dynamicIdentity.json, "json", "", "", "JSON string for modifying an existing identity")
 	return identityModifyCmd
@@ -126,6 +160,35 @@ func (c *ClientCmd) newRemoveIdentityCommand() *cobra.Command {
 	return identityRemoveCmd
 }
 
+func (c *ClientCmd) newResetSecretCommand() *cobra.Command {
+	identityResetSecretCmd := &cobra.Command{
+		Use:     "resetsecret <id>",
+		Short:   "Reset the secret of an identity",
+		Long:    "Replace the enrollment secret of an identity with a new random secret",
+		Example: "fabric-ca-client identity resetsecret user1 --secret-expiry 24h",
+		PreRunE: c.identityPreRunE,
+		RunE:    c.runResetSecret,
+	}
+	flags := identityResetSecretCmd.Flags()
+	flags.StringVarP(
+		&c.dynamicIdentity.reset.SecretExpiry, "secret-expiry", "", "", "When the new enrollment secret expires, as an RFC3339 timestamp or a duration such as '24h' (default no expiry)")
+	flags.BoolVarP(
+		&c.dynamicIdentity.reset.SecretOneTime, "secret-one-time", "", false, "The new enrollment secret can only be used to enroll once")
+	return identityResetSecretCmd
+}
+
+func (c *ClientCmd) newUnlockIdentityCommand() *cobra.Command {
+	identityUnlockCmd := &cobra.Command{
+		Use:     "unlock <id>",
+		Short:   "Unlock identity",
+		Long:    "Unlock an identity which was locked out due to repeated failed logins",
+		Example: "fabric-ca-client identity unlock user1",
+		PreRunE: c.identityPreRunE,
+		RunE:    c.runUnlockIdentity,
+	}
+	return identityUnlockCmd
+}
+
 // The client side logic for executing list identity command
 func (c *ClientCmd) runListIdentity(cmd *cobra.Command, args []string) error {
 	log.Debug("Entered runListIdentity")
@@ -141,16 +204,35 @@ func (c *ClientCmd) runListIdentity(cmd *cobra.Command, args []string) error {
 			return err
 		}
 
-		fmt.Printf("Name: %s, Type: %s, Affiliation: %s, Max Enrollments: %d, Attributes: %+v\n", resp.ID, resp.Type, resp.Affiliation, resp.MaxEnrollments, resp.Attributes)
+		fmt.Printf("Name: %s, Type: %s, Affiliation: %s, Max Enrollments: %d, Attributes: %+v, Suspended: %t\n", resp.ID, resp.Type, resp.Affiliation, resp.MaxEnrollments, resp.Attributes, resp.Suspended)
 		return nil
 	}
 
-	err = id.GetAllIdentities(c.clientCfg.CAName, lib.IdentityDecoder)
-	if err != nil {
-		return err
+	req := &api.GetIdentitiesRequest{
+		Limit:      c.dynamicIdentity.list.limit,
+		Attributes: c.dynamicIdentity.list.attrs,
+		CAName:     c.clientCfg.CAName,
+	}
+	if req.Limit < 0 {
+		return errors.Errorf("Invalid 'limit' value %d; it must not be negative", req.Limit)
+	}
+	if cmd.Flags().Changed("state") {
+		req.State = &c.dynamicIdentity.list.state
+	}
+	if cmd.Flags().Changed("maxenrollments") {
+		req.MaxEnrollments = &c.dynamicIdentity.list.maxEnrollments
 	}
 
-	return nil
+	// Follow the cursor until the last page of identities
+	for {
+		req.Cursor, err = id.GetIdentities(req, lib.IdentityDecoder)
+		if err != nil {
+			return err
+		}
+		if req.Cursor == "" {
+			return nil
+		}
+	}
 }
 
 // The client side logic for adding an identity
@@ -211,6 +293,9 @@ func (c *ClientCmd) runModifyIdentity(cmd *cobra.Command, args []string) error {
 		req = &c.dynamicIdentity.modify
 		req.Attributes = c.clientCfg.ID.Attributes
 	}
+	if req.Suspend && req.Resume {
+		return errors.New("Can't use 'suspend' flag in conjunction with 'resume' flag")
+	}
 
 	req.ID = args[0]
 	req.CAName = c.clientCfg.CAName
@@ -219,7 +304,7 @@ func (c *ClientCmd) runModifyIdentity(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	fmt.Printf("Successfully modified identity - Name: %s, Type: %s, Affiliation: %s, Max Enrollments: %d, Secret: %s, Attributes: %+v\n", resp.ID, resp.Type, resp.Affiliation, resp.MaxEnrollments, resp.Secret, resp.Attributes)
+	fmt.Printf("Successfully modified identity - Name: %s, Type: %s, Affiliation: %s, Max Enrollments: %d, Secret: %s, Attributes: %+v, Suspended: %t\n", resp.ID, resp.Type, resp.Affiliation, resp.MaxEnrollments, resp.Secret, resp.Attributes, resp.Suspended)
 	return nil
 }
 
@@ -239,11 +324,57 @@ func (c *ClientCmd) runRemoveIdentity(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	if resp.Pending != nil {
+		printPendingRequest(resp.Pending)
+		return nil
+	}
 
 	fmt.Printf("Successfully removed identity - Name: %s, Type: %s, Affiliation: %s, Max Enrollments: %d, Attributes: %+v\n", resp.ID, resp.Type, resp.Affiliation, resp.MaxEnrollments, resp.Attributes)
 	return nil
 }
 
+// The client side logic for resetting the secret of an identity
+func (c *ClientCmd) runResetSecret(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runResetSecret: %+v", c.dynamicIdentity)
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	req := &c.dynamicIdentity.reset
+	req.ID = args[0]
+	req.CAName = c.clientCfg.CAName
+	resp, err := id.ResetSecret(req)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully reset secret of identity - Name: %s, Secret: %s\n", resp.ID, resp.Secret)
+	return nil
+}
+
+// The client side logic for unlocking an identity
+func (c *ClientCmd) runUnlockIdentity(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runUnlockIdentity: %+v", c.dynamicIdentity)
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	req := &c.dynamicIdentity.unlock
+	req.ID = args[0]
+	req.CAName = c.clientCfg.CAName
+	resp, err := id.UnlockIdentity(req)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully unlocked identity - Name: %s\n", resp.ID)
+	return nil
+}
+
 func (c *ClientCmd) identityPreRunE(cmd *cobra.Command, args []string) error {
 	err := argsCheck(args, "Identity")
 	if err != nil {
@@ -265,7 +396,7 @@ func (c *ClientCmd) identityPreRunE(cmd *cobra.Command, args []string) error {
 // flags. This is a workaround until this bug is addressed in Viper.
 // Viper Bug: https://github.com/spf13/viper/issues/276
 func checkOtherFlags(cmd *cobra.Command) bool {
-	checkFlags := []string{"id", "type", "affiliation", "secret", "maxenrollments", "attrs"}
+	checkFlags := []string{"id", "type", "affiliation", "secret", "maxenrollments", "attrs", "secret-expiry", "secret-one-time"}
 	flags := cmd.Flags()
 	for _, checkFlag := range checkFlags {
 		flag := flags.Lookup(checkFlag)
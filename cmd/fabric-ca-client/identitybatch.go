@@ -0,0 +1,244 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/attr"
+)
+
+type identityBatchArgs struct {
+	format string
+	output string
+}
+
+func (c *ClientCmd) newImportIdentityCommand() *cobra.Command {
+	identityImportCmd := &cobra.Command{
+		Use:     "import <file>",
+		Short:   "Import identities",
+		Long:    "Add the identities listed in a CSV or JSON file; if any identity is rejected, none of them are added",
+		Example: "fabric-ca-client identity import identities.csv",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("The name of the file of identities to import is required")
+			}
+			return c.configInit()
+		},
+		RunE: c.runImportIdentity,
+	}
+	flags := identityImportCmd.Flags()
+	flags.StringVarP(
+		&c.dynamicIdentity.batch.format, "format", "", "", "Format of the file, 'csv' or 'json' (default based on the file extension)")
+	return identityImportCmd
+}
+
+func (c *ClientCmd) newExportIdentityCommand() *cobra.Command {
+	identityExportCmd := &cobra.Command{
+		Use:     "export",
+		Short:   "Export identities",
+		Long:    "Export the identities visible to the caller in a format which can be imported",
+		Example: "fabric-ca-client identity export --format csv --output identities.csv",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return errors.Errorf("Unknown argument '%s'", args[0])
+			}
+			log.Level = log.LevelWarning
+			return c.configInit()
+		},
+		RunE: c.runExportIdentity,
+	}
+	flags := identityExportCmd.Flags()
+	flags.StringVarP(
+		&c.dynamicIdentity.batch.format, "format", "", "json", "Format of the exported identities, 'csv' or 'json'")
+	flags.StringVarP(
+		&c.dynamicIdentity.batch.output, "output", "o", "", "File to which the identities are written (default standard output)")
+	return identityExportCmd
+}
+
+// The client side logic for importing identities
+func (c *ClientCmd) runImportIdentity(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runImportIdentity: %s", args[0])
+
+	format, err := getBatchFormat(c.dynamicIdentity.batch.format, args[0])
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read file '%s'", args[0])
+	}
+
+	req := &api.ImportIdentitiesRequest{CAName: c.clientCfg.CAName}
+	if format == "csv" {
+		req.CSV = string(content)
+	} else {
+		err = json.Unmarshal(content, &req.Identities)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid JSON in file '%s'; it must contain a list of identities", args[0])
+		}
+	}
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+	resp, err := id.ImportIdentities(req)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range resp.Results {
+		if result.Error != "" {
+			fmt.Printf("Name: %s, Error: %s\n", result.ID, result.Error)
+		} else {
+			fmt.Printf("Name: %s, Secret: %s\n", result.ID, result.Secret)
+		}
+	}
+	if !resp.Added {
+		return errors.New("No identities were imported")
+	}
+	fmt.Printf("Successfully imported %d identities\n", len(resp.Results))
+	return nil
+}
+
+// The client side logic for exporting identities
+func (c *ClientCmd) runExportIdentity(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runExportIdentity: %+v", c.dynamicIdentity.batch)
+
+	format, err := getBatchFormat(c.dynamicIdentity.batch.format, "")
+	if err != nil {
+		return err
+	}
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	ids := []api.AddIdentityRequest{}
+	err = id.GetAllIdentities(c.clientCfg.CAName, func(decoder *json.Decoder) error {
+		var info api.IdentityInfo
+		err := decoder.Decode(&info)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, getExportedIdentity(&info))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if c.dynamicIdentity.batch.output != "" {
+		file, err := os.Create(c.dynamicIdentity.batch.output)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to create file '%s'", c.dynamicIdentity.batch.output)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if format == "csv" {
+		return writeIdentitiesCSV(out, ids)
+	}
+	content, err := json.MarshalIndent(ids, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal identities")
+	}
+	_, err = fmt.Fprintf(out, "%s\n", content)
+	return err
+}
+
+// getBatchFormat returns the format of a file of identities, which defaults to
+// the extension of the file name
+func getBatchFormat(format, fileName string) (string, error) {
+	if format == "" {
+		format = "json"
+		if strings.EqualFold(filepath.Ext(fileName), ".csv") {
+			format = "csv"
+		}
+	}
+	format = strings.ToLower(format)
+	if format != "csv" && format != "json" {
+		return "", errors.Errorf("Invalid format '%s'; it must be 'csv' or 'json'", format)
+	}
+	return format, nil
+}
+
+// getExportedIdentity converts an identity to the form in which it is
+// imported, leaving out the attributes which the server adds to every identity
+func getExportedIdentity(info *api.IdentityInfo) api.AddIdentityRequest {
+	attrs := []api.Attribute{}
+	for _, a := range info.Attributes {
+		if a.Name == attr.EnrollmentID || a.Name == attr.Type || a.Name == attr.Affiliation {
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	affiliation := info.Affiliation
+	if affiliation == "" {
+		// Request the root affiliation rather than that of the importer
+		affiliation = "."
+	}
+	return api.AddIdentityRequest{
+		ID:             info.ID,
+		Type:           info.Type,
+		Affiliation:    affiliation,
+		Attributes:     attrs,
+		MaxEnrollments: info.MaxEnrollments,
+	}
+}
+
+// writeIdentitiesCSV writes identities in the CSV format accepted by the
+// import identities endpoint
+func writeIdentitiesCSV(out io.Writer, ids []api.AddIdentityRequest) error {
+	w := csv.NewWriter(out)
+	err := w.Write([]string{"id", "type", "affiliation", "attrs", "max_enrollments"})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		attrs := make([]string, 0, len(id.Attributes))
+		for _, a := range id.Attributes {
+			s := fmt.Sprintf("%s=%s", a.Name, a.Value)
+			if a.ECert {
+				s += ":ecert"
+			}
+			attrs = append(attrs, s)
+		}
+		err = w.Write([]string{id.ID, id.Type, id.Affiliation, strings.Join(attrs, ";"), strconv.Itoa(id.MaxEnrollments)})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,116 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func (c *ClientCmd) newLDAPCacheCommand() *cobra.Command {
+	ldapCacheCmd := &cobra.Command{
+		Use:   "ldapcache",
+		Short: "Manage the LDAP user cache",
+		Long:  "Manage the cache of the LDAP users which the server has looked up",
+	}
+	ldapCacheCmd.AddCommand(c.newShowLDAPCacheCommand())
+	ldapCacheCmd.AddCommand(c.newInvalidateLDAPCacheCommand())
+	return ldapCacheCmd
+}
+
+func (c *ClientCmd) newShowLDAPCacheCommand() *cobra.Command {
+	ldapCacheShowCmd := &cobra.Command{
+		Use:     "show",
+		Short:   "Show LDAP user cache statistics",
+		Long:    "Show the number of entries of the LDAP user cache and the number of lookups which it has served",
+		Example: "fabric-ca-client ldapcache show",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return errors.Errorf("Unknown argument '%s'", args[0])
+			}
+			log.Level = log.LevelWarning
+			return c.configInit()
+		},
+		RunE: c.runShowLDAPCache,
+	}
+	return ldapCacheShowCmd
+}
+
+func (c *ClientCmd) newInvalidateLDAPCacheCommand() *cobra.Command {
+	ldapCacheInvalidateCmd := &cobra.Command{
+		Use:     "invalidate",
+		Short:   "Invalidate LDAP user cache entries",
+		Long:    "Remove an LDAP user, or all LDAP users, from the LDAP user cache, so that they are looked up again",
+		Example: "fabric-ca-client ldapcache invalidate --id jsmith",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return errors.Errorf("Unknown argument '%s'", args[0])
+			}
+			return c.configInit()
+		},
+		RunE: c.runInvalidateLDAPCache,
+	}
+	ldapCacheInvalidateCmd.Flags().StringVarP(
+		&c.ldapCacheID, "id", "", "", "User name or DN of the LDAP user to remove; all users are removed if it is not set")
+	return ldapCacheInvalidateCmd
+}
+
+// The client side logic for showing the statistics of the LDAP user cache
+func (c *ClientCmd) runShowLDAPCache(cmd *cobra.Command, args []string) error {
+	log.Debug("Entered runShowLDAPCache")
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	resp, err := id.GetLDAPCache(c.clientCfg.CAName)
+	if err != nil {
+		return err
+	}
+
+	printLDAPCache(resp)
+	return nil
+}
+
+// The client side logic for invalidating entries of the LDAP user cache
+func (c *ClientCmd) runInvalidateLDAPCache(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runInvalidateLDAPCache: '%s'", c.ldapCacheID)
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	resp, err := id.InvalidateLDAPCache(&api.InvalidateLDAPCacheRequest{ID: c.ldapCacheID, CAName: c.clientCfg.CAName})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully removed %d entries from the LDAP user cache\n", resp.Invalidated)
+	printLDAPCache(resp)
+	return nil
+}
+
+func printLDAPCache(resp *api.LDAPCacheResponse) {
+	fmt.Printf("Entries: %d, Hits: %d, Negative hits: %d, Misses: %d\n",
+		resp.Entries, resp.Hits, resp.NegativeHits, resp.Misses)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func (c *ClientCmd) newOperationCommand() *cobra.Command {
+	operationCmd := &cobra.Command{
+		Use:   "operation",
+		Short: "Manage pending operations",
+		Long:  "Manage operations which must be confirmed by a second identity before they are performed",
+	}
+	operationCmd.AddCommand(c.newListOperationCommand())
+	operationCmd.AddCommand(c.newConfirmOperationCommand())
+	return operationCmd
+}
+
+func (c *ClientCmd) newListOperationCommand() *cobra.Command {
+	operationListCmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List pending operations",
+		Long:    "List the pending operations which the caller may confirm",
+		Example: "fabric-ca-client operation list",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return errors.Errorf("Unknown argument '%s'", args[0])
+			}
+			log.Level = log.LevelWarning
+			return c.configInit()
+		},
+		RunE: c.runListOperations,
+	}
+	return operationListCmd
+}
+
+func (c *ClientCmd) newConfirmOperationCommand() *cobra.Command {
+	operationConfirmCmd := &cobra.Command{
+		Use:     "confirm <id>",
+		Short:   "Confirm a pending operation",
+		Long:    "Confirm an operation requested by another identity, which is then performed on behalf of the caller",
+		Example: "fabric-ca-client operation confirm 3f2a9c0e51d84b7a8e6c1d2f0b9a4e57",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			err := argsCheck(args, "Operation")
+			if err != nil {
+				return err
+			}
+			return c.configInit()
+		},
+		RunE: c.runConfirmOperation,
+	}
+	return operationConfirmCmd
+}
+
+// The client side logic for listing the pending operations
+func (c *ClientCmd) runListOperations(cmd *cobra.Command, args []string) error {
+	log.Debug("Entered runListOperations")
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	resp, err := id.GetPendingOperations(c.clientCfg.CAName)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range resp.Operations {
+		printPendingOperation(&op)
+	}
+	return nil
+}
+
+// The client side logic for confirming a pending operation
+func (c *ClientCmd) runConfirmOperation(cmd *cobra.Command, args []string) error {
+	log.Debugf("Entered runConfirmOperation: %s", args[0])
+
+	id, err := c.loadMyIdentity()
+	if err != nil {
+		return err
+	}
+
+	resp, err := id.ConfirmOperation(&api.ConfirmOperationRequest{ID: args[0], CAName: c.clientCfg.CAName})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully confirmed operation '%s' on '%s' requested by '%s'\n",
+		resp.Operation.Operation, resp.Operation.Target, resp.Operation.Requester)
+	return nil
+}
+
+func printPendingOperation(op *api.PendingOperation) {
+	fmt.Printf("ID: %s, Operation: %s, Target: %s, Requester: %s, Expiry: %s\n",
+		op.ID, op.Operation, op.Target, op.Requester, op.Expiry)
+}
+
+// printPendingRequest prints how to confirm a request which is pending
+// approval by a second identity
+func printPendingRequest(op *api.PendingOperation) {
+	fmt.Printf("The request must be confirmed by another identity before %s with:\n"+
+		"    fabric-ca-client operation confirm %s\n", op.Expiry, op.ID)
+}
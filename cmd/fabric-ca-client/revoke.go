@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
 	"path/filepath"
 
 	"github.com/pkg/errors"
@@ -28,7 +29,7 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var errInput = errors.New("Invalid usage; either --revoke.name and/or both --revoke.serial and --revoke.aki are required")
+var errInput = errors.New("Invalid usage; either --revoke.name, --cert, --revoke.revocationhandle, and/or both --revoke.serial and --revoke.aki are required")
 
 func (c *ClientCmd) newRevokeCommand() *cobra.Command {
 	revokeCmd := &cobra.Command{
@@ -80,31 +81,51 @@ func (c *ClientCmd) runRevoke(cmd *cobra.Command) error {
 		return err
 	}
 
-	// aki and serial # are required to revoke a certificate. The enrollment ID
-	// is required to revoke an identity. So, either aki and serial must be
-	// specified OR enrollment ID must be specified, else return an error.
-	// Note that all three can be specified, in which case server will revoke
-	// certificate associated with the specified aki, serial number.
-	if (c.clientCfg.Revoke.Name == "") && (c.clientCfg.Revoke.AKI == "" ||
-		c.clientCfg.Revoke.Serial == "") {
+	// Either a certificate file or aki and serial # are required to revoke a
+	// certificate. The revocation handle is required to revoke an Idemix
+	// credential. The enrollment ID is required to revoke an identity. So,
+	// either the certificate, aki and serial, revocation handle OR enrollment ID
+	// must be specified, else return an error. Note that all can be specified,
+	// in which case server will revoke the certificate associated with the
+	// specified aki, serial number.
+	certFile := c.revokeParams.Cert
+	if (c.clientCfg.Revoke.Name == "") && (certFile == "") && (c.clientCfg.Revoke.RevocationHandle == "") &&
+		(c.clientCfg.Revoke.AKI == "" || c.clientCfg.Revoke.Serial == "") {
 		cmd.Usage()
 		return errInput
 	}
 
+	var certPEM []byte
+	if certFile != "" {
+		certPEM, err = util.ReadFile(certFile)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("Failed to read certificate to be revoked from '%s'", certFile))
+		}
+	}
+
 	req := &api.RevocationRequest{
-		Name:   c.clientCfg.Revoke.Name,
-		Serial: c.clientCfg.Revoke.Serial,
-		AKI:    c.clientCfg.Revoke.AKI,
-		Reason: c.clientCfg.Revoke.Reason,
-		GenCRL: c.revokeParams.GenCRL,
-		CAName: c.clientCfg.CAName,
+		Name:             c.clientCfg.Revoke.Name,
+		Serial:           c.clientCfg.Revoke.Serial,
+		AKI:              c.clientCfg.Revoke.AKI,
+		Reason:           c.clientCfg.Revoke.Reason,
+		GenCRL:           c.revokeParams.GenCRL,
+		CAName:           c.clientCfg.CAName,
+		Certificate:      string(certPEM),
+		RevocationHandle: c.clientCfg.Revoke.RevocationHandle,
 	}
 	result, err := id.Revoke(req)
 
 	if err != nil {
 		return err
 	}
+	if result.Pending != nil {
+		printPendingRequest(result.Pending)
+		return nil
+	}
 	log.Infof("Sucessfully revoked certificates: %+v", result.RevokedCerts)
+	if len(result.RevokedCredentials) > 0 {
+		log.Infof("Sucessfully revoked Idemix credentials with revocation handles: %v", result.RevokedCredentials)
+	}
 
 	if req.GenCRL {
 		return storeCRL(c.clientCfg, result.CRL)
@@ -90,6 +90,39 @@ debug: false
 # Size limit of an acceptable CRL in bytes (default: 512000)
 crlsizelimit: 512000
 
+#############################################################################
+#  Rate limits of the enroll, register and tcert endpoints
+#
+#  Each endpoint has a token bucket for each enrollment ID and one for each
+#  remote address. The rate is the number of requests allowed per minute and
+#  the burst is the number of requests allowed at once, which defaults to the
+#  rate. A rate of 0 disables the limit. The limit by enrollment ID is only
+#  applied to authenticated requests. Requests over a limit are rejected
+#  with HTTP status 429 and a Retry-After header.
+#############################################################################
+ratelimits:
+  enroll:
+    identity:
+      rate: 0
+      burst: 0
+    ip:
+      rate: 0
+      burst: 0
+  register:
+    identity:
+      rate: 0
+      burst: 0
+    ip:
+      rate: 0
+      burst: 0
+  tcert:
+    identity:
+      rate: 0
+      burst: 0
+    ip:
+      rate: 0
+      burst: 0
+
 #############################################################################
 #  TLS section for the server's listening port
 #
@@ -99,6 +132,11 @@ crlsizelimit: 512000
 #
 #  Certfiles is a list of root certificate authorities that the server uses
 #  when verifying client certificates.
+#
+#  If certauth is true, requests without an authorization header are
+#  authenticated by the TLS client certificate of the caller, which must have
+#  been issued by the CA. This requires a client authentication type of
+#  VerifyClientCertIfGiven or RequireAndVerifyClientCert.
 #############################################################################
 tls:
   # Enable TLS (default: false)
@@ -109,6 +147,7 @@ tls:
   clientauth:
     type: noclientcert
     certfiles:
+    certauth: false
 
 #############################################################################
 #  The CA section contains information related to the Certificate Authority
@@ -141,6 +180,46 @@ crl:
   # is used to set the 'Next Update' date of the CRL.
   expiry: 24h
 
+#############################################################################
+#  The idemix section contains configuration options of the Idemix issuer
+#  of the CA, which issues Idemix (anonymous) credentials. The issuer key
+#  pair and the key pair of its revocation authority are generated when
+#  the CA is initialized, unless the files below already exist.
+#############################################################################
+idemix:
+  # The Idemix issuer public key file
+  issuerpublickeyfile:
+  # The Idemix issuer secret key file
+  issuersecretkeyfile:
+  # The PEM-encoded public key file of the revocation authority, which
+  # signs the credential revocation information (CRI)
+  revocationpublickeyfile:
+  # The PEM-encoded private key file of the revocation authority
+  revocationprivatekeyfile:
+  # Duration after which a nonce issued for a credential request expires
+  nonceexpiration: 15s
+
+#############################################################################
+#  The certificates section controls the purge of expired certificates
+#  from the certificates table. A purged certificate is moved to the
+#  certificates_archive table, or to the archive file if one is specified,
+#  and no longer appears in generated CRLs. Its serial number and AKI are
+#  kept in the certificates_archive table, so a purged certificate is still
+#  rejected if it is presented to the server.
+#  Expired certificates are purged by the 'fabric-ca-server certificates purge'
+#  command, and by the server every 'purgeinterval' if it is set.
+#############################################################################
+certificates:
+  # Period of time after their expiration for which certificates are kept
+  # in the certificates table
+  retention: 8760h
+  # Interval at which the server purges expired certificates
+  purgeinterval:
+  # Gzip-compressed file to which purged certificates are appended as JSON
+  # records; if not set, purged certificates are kept in the
+  # certificates_archive table
+  archivefile:
+
 #############################################################################
 #  The registry section controls how the fabric-ca-server does two things:
 #  1) authenticates enrollment requests which contain a username and password
@@ -163,6 +242,42 @@ registry:
   # (default: -1, which means there is no limit)
   maxenrollments: -1
 
+  # Maximum number of unexpired and unrevoked certificates which an identity
+  # may hold; an identity's 'hf.MaxActiveCertificates' attribute may lower it
+  # (default: -1, which means there is no limit)
+  maxactivecertificates: -1
+
+  # If true, when a reenroll request would exceed the maximum number of
+  # active certificates of an identity, the certificates which expire first
+  # are revoked with reason 'superseded'; otherwise, the request is rejected
+  revokesuperseded: false
+
+  # Locks out an identity after repeated failed enrollment logins, which
+  # protects identities such as the bootstrap admin from password guessing.
+  # A registrar may unlock an identity with the 'identity unlock' command.
+  lockout:
+    # Number of consecutive failed logins after which the identity is locked
+    # out (default: 0, which means identities are never locked out)
+    maxfailedattempts: 0
+    # Period of time for which the identity stays locked out; if 0, it stays
+    # locked out until it is unlocked by a registrar
+    duration: 30m
+
+  # Registration policies which are checked whenever a registrar registers,
+  # adds, imports or modifies an identity. Each policy is a boolean expression
+  # which must be true for the request to be allowed. The expressions may use
+  # the variables 'id', 'type' and 'affiliation' of the identity, and
+  # 'registrar', 'registrarType' and 'registrarAffiliation' of the registrar,
+  # as well as the following functions:
+  #   attr(name)           - value of the identity's attribute, or ''
+  #   registrarAttr(name)  - value of the registrar's attribute, or ''
+  #   isUnder(aff, parent) - true if 'aff' is 'parent' or a sub-affiliation of it
+  # For example, the following allows a registrar to register peers only under
+  # the 'org1' affiliation named by the registrar's 'dept' attribute:
+  # policies:
+  #   - name: peers-by-dept
+  #     expr: "type != 'peer' || isUnder(affiliation, 'org1.' + registrarAttr('dept'))"
+
   # Contains identity information which is used when LDAP is disabled
   identities:
      - name: <<<ADMIN>>>
@@ -177,6 +292,50 @@ registry:
           hf.GenCRL: true
           hf.Registrar.Attributes: "*"
           hf.AffiliationMgr: true
+          hf.Auditor: true
+          hf.Backup: true
+
+#############################################################################
+#  Tokens section
+#  Requests other than enroll are authenticated by a token in the
+#  authorization header, which is signed with the key of the caller's
+#  enrollment certificate. The token covers the method, URI and body of the
+#  request, the time at which it was created and a random nonce, and it is
+#  accepted only once.
+#############################################################################
+tokens:
+  # Maximum difference between the time at which a token was created and
+  # the server's time
+  clockskew: 5m
+  # If true, the tokens of older clients, which cover only the body of the
+  # request and so can be replayed, are also accepted. Enable this only while
+  # the clients are being upgraded.
+  allowlegacy: false
+
+#############################################################################
+#  Authorization section
+#  The policy file maps roles to the actions which they are authorized to
+#  perform: register, identities, affiliations, revoke, gencrl, audit,
+#  intermediateca and backup. If no policy file is set, the actions are
+#  authorized by the hf.Registrar.Roles, hf.AffiliationMgr, hf.Revoker,
+#  hf.GenCRL, hf.Auditor, hf.IntermediateCA and hf.Backup attributes of the
+#  caller.
+#############################################################################
+authorization:
+  policyfile:
+
+#############################################################################
+#  Approval section
+#  The operations listed here are not performed when requested; instead a
+#  pending operation is created, which a second identity with the authority
+#  to perform it must confirm within the window. The operations are:
+#    revoke            - revoking a registrar or an intermediate CA
+#    removeidentity    - removing an identity
+#    removeaffiliation - removing an affiliation with the force option
+#############################################################################
+approval:
+  operations:
+  window: 24h
 
 #############################################################################
 #  Database section
@@ -209,14 +368,77 @@ ldap:
    # Enables or disables the LDAP client (default: false)
    # If this is set to true, the "registry" section is ignored.
    enabled: false
-   # The URL of the LDAP server
+   # The URL of the LDAP server. To fail over between several servers, list
+   # their URLs separated by spaces, in order of preference; the URLs must
+   # have the same base.
    url: ldap://<adminDN>:<adminPassword>@<host>:<port>/<base>
+   # If true, connections to servers with an ldap:// URL are upgraded to TLS
+   # with StartTLS, using the TLS configuration below
+   starttls: false
    # TLS configuration for the client connection to the LDAP server
    tls:
       certfiles:
       client:
          certfile:
          keyfile:
+   # Timeouts for connecting to an LDAP server and for a request to it
+   timeout:
+      connect: 10s
+      request: 30s
+   # Maximum number of open connections bound as the admin user, which are
+   # reused for searches
+   pool:
+      size: 10
+   # How long a server which failed is skipped before it is tried again
+   failover:
+      retryinterval: 30s
+   # Cache of the users which are looked up, together with their affiliations
+   # and the values of their converters. A user which was found is cached for
+   # 'ttl', and a user which was not found for 'negativettl' (0 disables the
+   # caching of users which were not found). The 'ldapcache' commands of the
+   # client show the statistics of the cache and remove users from it.
+   cache:
+      enabled: false
+      ttl: 5m
+      negativettl: 30s
+      size: 10000
+   # Number of entries to get per page when listing the identities and
+   # affiliations of the directory; 0 disables paged results
+   pagesize: 500
+   # Where the affiliations of LDAP users come from: 'dn' for the OU
+   # hierarchy of their DNs, 'groups' for the names (the 'cn' attribute)
+   # of the groups which match the group filter, the first of which is the
+   # affiliation of a member of several groups, or 'converter' for the value
+   # of the 'converter' expression, such as:
+   #    converter: if(inGroup("Org1 Admins"), "org1.admins", "org1")
+   affiliation:
+      source: dn
+      converter:
+   # How the groups of LDAP users, which the 'groups()' and 'inGroup(name)'
+   # functions of converters return, are found:
+   #  memberof - the groups of the memberOf attribute of the user's entry
+   #  nested   - also the groups of those groups, to a depth of 'maxdepth'
+   #  inchain  - the nested groups, found by Active Directory with the
+   #             LDAP_MATCHING_RULE_IN_CHAIN rule
+   groups:
+      resolution: memberof
+      maxdepth: 10
+   # The hybrid registry serves the identities of the database, such as peers,
+   # orderers and the bootstrap admin, together with those of LDAP. New
+   # identities and affiliations are only written to the database, and the
+   # lists of identities and affiliations include those of both.
+   hybrid:
+      enabled: false
+      # How identities are looked up:
+      #  fallback  - in each registry of 'order' in turn, until one has it
+      #  namespace - in LDAP if the name starts with 'namespace' (which is
+      #              removed) or is a DN below the LDAP base; otherwise in
+      #              the database
+      lookup: fallback
+      order:
+         - db
+         - ldap
+      namespace: ldap/
    # Attribute related configuration for mapping from LDAP entries to Fabric CA attributes
    attribute:
       # 'names' is an array of strings containing the LDAP attribute names which are
@@ -231,6 +453,11 @@ ldap:
       #    converters:
       #       - name: hf.Revoker
       #         value: attr("uid") =~ "revoker*"
+      # Similarly, the following makes the members of the "CA Admins" group,
+      # whose DN or CN is given to 'inGroup', registrars of clients and peers.
+      #    converters:
+      #       - name: hf.Registrar.Roles
+      #         value: if(inGroup("CA Admins"), "client,peer", "")
       converters:
          - name:
            value:
@@ -258,6 +485,53 @@ ldap:
             - name:
               value:
 
+#############################################################################
+#  OIDC section
+#  If OIDC is enabled, an identity may enroll with a signed ID token from
+#  the configured issuer instead of its secret. The claims of the token are
+#  mapped to the enrollment ID, type, affiliation and attributes of the
+#  identity, which is created in the registry the first time it enrolls.
+#  OIDC can't be enabled together with LDAP, unless the LDAP hybrid
+#  registry is enabled.
+#############################################################################
+oidc:
+   # Enables or disables enrollment with OIDC ID tokens (default: false)
+   enabled: false
+   # The issuer of the ID tokens, which must equal their 'iss' claim
+   issuer:
+   # The audience of the ID tokens, such as the client ID, which must be
+   # in their 'aud' claim
+   audience:
+   # The file or https URL of the JSON Web Key Set with which the ID tokens
+   # are verified
+   jwks:
+   # The clock skew allowed when checking the times in the ID tokens
+   clockskew: 1m
+   claims:
+      # The claim whose value is the enrollment ID
+      id: sub
+      # The claim whose value is the type of the identity, and the type if
+      # the ID token has no such claim
+      type:
+      defaulttype: client
+      # The claim whose value is the affiliation of the identity
+      affiliation:
+      # The 'converters' and 'maps' sections are used to convert the claims
+      # of an ID token to the values of attributes, like those of the LDAP
+      # section, except that the 'claim' function returns the value of a
+      # claim. For example, the following sets the "hf.Revoker" attribute to
+      # "true" for members of the "admins" group.
+      #    converters:
+      #       - name: hf.Revoker
+      #         value: if(claim("groups") =~ "admins", "true", "false")
+      converters:
+         - name:
+           value:
+      maps:
+         groups:
+            - name:
+              value:
+
 #############################################################################
 # Affiliations section. Fabric CA server can be bootstrapped with the
 # affiliations specified in this section. Affiliations are specified as maps.
@@ -504,8 +778,8 @@ func (s *ServerCmd) createDefaultConfigFile() error {
 	var user, pass string
 	// If LDAP is enabled, authentication of enrollment requests are performed
 	// by using LDAP authentication; therefore, no bootstrap username and password
-	// are required.
-	ldapEnabled := s.myViper.GetBool("ldap.enabled")
+	// are required, unless the hybrid registry also serves identities from the DB.
+	ldapEnabled := s.myViper.GetBool("ldap.enabled") && !s.myViper.GetBool("ldap.hybrid.enabled")
 	if !ldapEnabled {
 		// When LDAP is disabled, the fabric-ca-server functions as its own
 		// identity registry; therefore, we require that the default configuration
@@ -18,11 +18,15 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/cloudflare/cfssl/log"
 	"github.com/tjfoc/fabric-ca-gm/lib"
+	"github.com/tjfoc/fabric-ca-gm/lib/dbutil"
 	"github.com/tjfoc/fabric-ca-gm/lib/metadata"
 	"github.com/tjfoc/fabric-ca-gm/util"
 	"github.com/pkg/errors"
@@ -51,6 +55,19 @@ type ServerCmd struct {
 	homeDirectory string
 	// serverCfg is the server's configuration
 	cfg *lib.ServerConfig
+	// dbVersion is the schema version of the db migrate and rollback commands
+	dbVersion int
+	// dbCopyFrom and dbCopyTo are the databases of the db copy command
+	dbCopyFrom string
+	dbCopyTo   string
+	// backupFile is the archive of the backup and restore commands
+	backupFile string
+	// restoreConfig indicates whether the restore command overwrites the
+	// configuration files
+	restoreConfig bool
+	// trustedCert is the file of certificates to which the default CA of a
+	// backup archive must chain if the server has no CA certificate
+	trustedCert string
 }
 
 // NewCommand returns new ServerCmd ready for running
@@ -127,6 +144,178 @@ func (s *ServerCmd) init() {
 	}
 	s.rootCmd.AddCommand(startCmd)
 
+	// certificatesCmd groups the commands which manage the certificates table
+	certificatesCmd := &cobra.Command{
+		Use:   "certificates",
+		Short: "Manage certificates",
+		Long:  "Manage the certificates stored in the database of the server",
+	}
+	purgeCmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Purge expired certificates",
+		Long:  "Move certificates which expired longer ago than the configured retention period out of the certificates table",
+	}
+	purgeCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, purgeCmd.UsageString())
+		}
+		err := s.getServer().PurgeExpiredCertificates()
+		if err != nil {
+			return err
+		}
+		log.Info("Expired certificates were successfully purged")
+		return nil
+	}
+	certificatesCmd.AddCommand(purgeCmd)
+	s.rootCmd.AddCommand(certificatesCmd)
+
+	// dbCmd groups the commands which manage the schema of the databases
+	dbCmd := &cobra.Command{
+		Use:   "db",
+		Short: "Manage the database schema",
+		Long:  "Manage the schema migrations of the databases of the CAs of the server",
+	}
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply pending schema migrations",
+		Long:  "Apply the pending schema migrations, up to the specified version if any, to the databases of the CAs",
+	}
+	migrateCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, migrateCmd.UsageString())
+		}
+		err := s.getServer().MigrateDB(s.dbVersion)
+		if err != nil {
+			return err
+		}
+		log.Info("Databases were successfully migrated")
+		return nil
+	}
+	migrateCmd.Flags().IntVar(&s.dbVersion, "version", 0, "Schema version to migrate to (default: latest)")
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the schema migrations",
+		Long:  "Show the applied and pending schema migrations of the databases of the CAs",
+	}
+	statusCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, statusCmd.UsageString())
+		}
+		status, err := s.getServer().GetDBMigrationStatus()
+		if err != nil {
+			return err
+		}
+		printMigrationStatus(status)
+		return nil
+	}
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Roll back schema migrations",
+		Long:  "Roll back the schema migrations newer than the specified version, or the most recent migration, in the databases of the CAs",
+	}
+	rollbackCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, rollbackCmd.UsageString())
+		}
+		version := s.dbVersion
+		if !cmd.Flags().Changed("version") {
+			version = -1
+		}
+		err := s.getServer().RollbackDB(version)
+		if err != nil {
+			return err
+		}
+		log.Info("Databases were successfully rolled back")
+		return nil
+	}
+	rollbackCmd.Flags().IntVar(&s.dbVersion, "version", 0, "Schema version to roll back to (default: the version before the most recent migration)")
+	copyCmd := &cobra.Command{
+		Use:     "copy",
+		Short:   "Copy the database to another database",
+		Long:    "Create the schema of the target database and copy all rows of the database of the default CA to it, then verify the row counts and checksums of the tables; each database is specified as <type>:<datasource>",
+		Example: "fabric-ca-server db copy --from sqlite3:fabric-ca-server.db --to \"postgres:host=localhost port=5432 user=fabric password=pw dbname=fabric_ca sslmode=disable\"",
+	}
+	copyCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, copyCmd.UsageString())
+		}
+		if s.dbCopyFrom == "" || s.dbCopyTo == "" {
+			return errors.New("The --from and --to options are required")
+		}
+		result, err := s.getServer().CopyDB(s.dbCopyFrom, s.dbCopyTo)
+		if err != nil {
+			return err
+		}
+		for _, t := range result {
+			fmt.Printf("  %-26s  %8d rows  %s\n", t.Table, t.Rows, t.Checksum)
+		}
+		log.Info("The database was successfully copied and verified")
+		return nil
+	}
+	copyCmd.Flags().StringVar(&s.dbCopyFrom, "from", "", "Source database, as <type>:<datasource>")
+	copyCmd.Flags().StringVar(&s.dbCopyTo, "to", "", "Target database, as <type>:<datasource>")
+	dbCmd.AddCommand(migrateCmd, statusCmd, rollbackCmd, copyCmd)
+	s.rootCmd.AddCommand(dbCmd)
+
+	backupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Back up the server",
+		Long:  "Write a signed archive of the configuration, certificates, keys and database of every CA of the server to a file",
+	}
+	backupCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, backupCmd.UsageString())
+		}
+		if s.backupFile == "" {
+			return errors.New("The --file option is required")
+		}
+		f, err := os.OpenFile(s.backupFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create the backup archive")
+		}
+		err = s.getServer().Backup(f)
+		if cerr := f.Close(); err == nil && cerr != nil {
+			err = errors.Wrap(cerr, "Failed to write the backup archive")
+		}
+		if err != nil {
+			os.Remove(s.backupFile)
+			return err
+		}
+		log.Infof("The server was successfully backed up to %s", s.backupFile)
+		return nil
+	}
+	backupCmd.Flags().StringVar(&s.backupFile, "file", "", "File to which to write the backup archive")
+	s.rootCmd.AddCommand(backupCmd)
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore the server from a backup",
+		Long:  "Validate the signature and versions of a backup archive and restore the certificates, keys and database of every CA of the server from it; the server must be stopped",
+	}
+	restoreCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.Errorf(extraArgsError, args, restoreCmd.UsageString())
+		}
+		if s.backupFile == "" {
+			return errors.New("The --file option is required")
+		}
+		f, err := os.Open(s.backupFile)
+		if err != nil {
+			return errors.Wrap(err, "Failed to open the backup archive")
+		}
+		defer f.Close()
+		err = s.getServer().Restore(f, s.trustedCert, s.restoreConfig)
+		if err != nil {
+			return err
+		}
+		log.Infof("The server was successfully restored from %s", s.backupFile)
+		return nil
+	}
+	restoreCmd.Flags().StringVar(&s.backupFile, "file", "", "Backup archive from which to restore the server")
+	restoreCmd.Flags().BoolVar(&s.restoreConfig, "restoreconfig", false, "Also overwrite the configuration files with those of the backup archive")
+	restoreCmd.Flags().StringVar(&s.trustedCert, "trustedcert", "", "PEM file of certificates to which the default CA of the backup archive must chain if the server has no CA certificate")
+	s.rootCmd.AddCommand(restoreCmd)
+
 	var versionCmd = &cobra.Command{
 		Use:   "version",
 		Short: "Prints Fabric CA Server version",
@@ -179,6 +368,29 @@ func (s *ServerCmd) configRequired() bool {
 	return s.name != version
 }
 
+// printMigrationStatus prints the status of the schema migrations of the
+// database of each CA
+func printMigrationStatus(status map[string][]dbutil.MigrationStatus) {
+	var names []string
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("CA '%s':\n", name)
+		for _, m := range status[name] {
+			state := "pending"
+			if m.Applied {
+				state = "applied " + m.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			if m.Unknown {
+				state += " (unknown to this server)"
+			}
+			fmt.Printf("  %4d  %-46s  %s\n", m.Version, m.Description, state)
+		}
+	}
+}
+
 // getServer returns a lib.Server for the init and start commands
 func (s *ServerCmd) getServer() *lib.Server {
 	return &lib.Server{
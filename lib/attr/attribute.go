@@ -44,6 +44,8 @@ const (
 	FIXED
 	// CUSTOM indicates that the attribute is a custom attribute
 	CUSTOM
+	// INTEGER indicates that the attribute is of type integer
+	INTEGER
 )
 
 // Attribute names
@@ -58,6 +60,10 @@ const (
 	EnrollmentID   = "hf.EnrollmentID"
 	Type           = "hf.Type"
 	Affiliation    = "hf.Affiliation"
+	MaxActiveCerts = "hf.MaxActiveCertificates"
+	Auditor        = "hf.Auditor"
+	Backup         = "hf.Backup"
+	OIDCIssuer     = "hf.OIDC.Issuer"
 )
 
 // CanRegisterRequestedAttributes validates that the registrar can register the requested attributes
@@ -118,7 +124,7 @@ var attributeMap = initAttrs()
 func initAttrs() map[string]*attributeControl {
 	var attributeMap = make(map[string]*attributeControl)
 
-	booleanAttributes := []string{Revoker, IntermediateCA, GenCRL, AffiliationMgr}
+	booleanAttributes := []string{Revoker, IntermediateCA, GenCRL, AffiliationMgr, Auditor, Backup}
 
 	for _, attr := range booleanAttributes {
 		attributeMap[attr] = &attributeControl{
@@ -138,7 +144,13 @@ func initAttrs() map[string]*attributeControl {
 		}
 	}
 
-	fixedValueAttributes := []string{EnrollmentID, Type, Affiliation}
+	attributeMap[MaxActiveCerts] = &attributeControl{
+		name:              MaxActiveCerts,
+		requiresOwnership: false,
+		attrType:          INTEGER,
+	}
+
+	fixedValueAttributes := []string{EnrollmentID, Type, Affiliation, OIDCIssuer}
 
 	for _, attr := range fixedValueAttributes {
 		attributeMap[attr] = &attributeControl{
@@ -190,11 +202,27 @@ func (ac *attributeControl) isRegistrarAuthorized(requestedAttr *api.Attribute,
 		return errors.Errorf("Cannot register fixed value attribute '%s'", ac.getName())
 	case CUSTOM:
 		return nil
+	case INTEGER:
+		return ac.validateIntegerAttribute(requestedAttr)
 	}
 
 	return nil
 }
 
+func (ac *attributeControl) validateIntegerAttribute(requestedAttr *api.Attribute) error {
+	log.Debug("Requested attribute type is integer")
+	requestedAttrValue := requestedAttr.GetValue()
+	// Deleting an attribute if empty string is requested as value for attribute, no further validation necessary
+	if requestedAttrValue == "" {
+		return nil
+	}
+	_, err := strconv.Atoi(requestedAttrValue)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Failed to get integer value of '%s'", requestedAttrValue))
+	}
+	return nil
+}
+
 func (ac *attributeControl) validateBooleanAttribute(requestedAttr *api.Attribute, callersAttrValue string) error {
 	log.Debug("Requested attribute type is boolean")
 	requestedAttrValue := requestedAttr.GetValue()
@@ -19,9 +19,9 @@ package attr
 import (
 	"testing"
 
-	"github.com/hyperledger/fabric-ca/api"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
 )
 
 type testUser struct {
@@ -0,0 +1,58 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package attr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func TestMaxActiveCertsAttribute(t *testing.T) {
+	registrar := getUser("admin", []api.Attribute{
+		api.Attribute{
+			Name:  RegistrarAttr,
+			Value: "hf.MaxActiveCertificates",
+		},
+	})
+
+	// Registrar requesting a non-integer value for 'hf.MaxActiveCertificates'
+	requestedAttrs := []api.Attribute{
+		api.Attribute{
+			Name:  MaxActiveCerts,
+			Value: "two",
+		},
+	}
+	err := CanRegisterRequestedAttributes(requestedAttrs, nil, registrar)
+	assert.Error(t, err, "Should fail, 'hf.MaxActiveCertificates' must be an integer")
+
+	// Registrar does not need to own 'hf.MaxActiveCertificates' to register it
+	requestedAttrs = []api.Attribute{
+		api.Attribute{
+			Name:  MaxActiveCerts,
+			Value: "2",
+		},
+	}
+	err = CanRegisterRequestedAttributes(requestedAttrs, nil, registrar)
+	assert.NoError(t, err, "Failed to register attribute 'hf.MaxActiveCertificates'")
+
+	// An empty value deletes the attribute
+	requestedAttrs[0].Value = ""
+	err = CanRegisterRequestedAttributes(requestedAttrs, nil, registrar)
+	assert.NoError(t, err, "Failed to delete attribute 'hf.MaxActiveCertificates'")
+}
@@ -0,0 +1,123 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/kisielk/sqlstruct"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+const (
+	insertAuditRecordSQL = `
+INSERT INTO audit (logged_at, caller, ca_name, action, target, changes, source, level)
+	VALUES (:logged_at, :caller, :ca_name, :action, :target, :changes, :source, :level);`
+
+	selectAuditRecordsSQL = `
+SELECT %s FROM audit
+WHERE (%s)
+ORDER BY logged_at;`
+)
+
+// AuditRecord represents a record in the audit table
+type AuditRecord struct {
+	LoggedAt time.Time `db:"logged_at"`
+	Caller   string    `db:"caller"`
+	CAName   string    `db:"ca_name"`
+	Action   string    `db:"action"`
+	Target   string    `db:"target"`
+	Changes  string    `db:"changes"`
+	Source   string    `db:"source"`
+	Level    int       `db:"level"`
+}
+
+// AuditDBAccessor stores and retrieves the audit log of a CA
+type AuditDBAccessor struct {
+	db *sqlx.DB
+}
+
+// NewAuditDBAccessor returns a new AuditDBAccessor
+func NewAuditDBAccessor(db *sqlx.DB) *AuditDBAccessor {
+	return &AuditDBAccessor{db: db}
+}
+
+func (d *AuditDBAccessor) checkDB() error {
+	if d.db == nil {
+		return errors.New("Database is not set")
+	}
+	return nil
+}
+
+// InsertRecord puts an AuditRecord into the database
+func (d *AuditDBAccessor) InsertRecord(rec AuditRecord) error {
+	log.Debugf("DB: Insert audit record of action '%s' on '%s' by '%s'", rec.Action, rec.Target, rec.Caller)
+
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	rec.LoggedAt = rec.LoggedAt.UTC()
+	_, err = d.db.NamedExec(insertAuditRecordSQL, &rec)
+	if err != nil {
+		return errors.Wrap(err, "Failed to insert audit record into database")
+	}
+	return nil
+}
+
+// GetRecords returns the rows of the audit log of CA 'caName' which match
+// the request, oldest first
+func (d *AuditDBAccessor) GetRecords(caName string, req *api.GetAuditLogRequest) (*sqlx.Rows, error) {
+	log.Debugf("DB: Get audit records of CA '%s' matching %+v", caName, req)
+
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	conds := []string{"ca_name = ?"}
+	args := []interface{}{caName}
+	if !req.Since.IsZero() {
+		conds = append(conds, "logged_at >= ?")
+		args = append(args, req.Since.UTC())
+	}
+	if !req.Until.IsZero() {
+		conds = append(conds, "logged_at < ?")
+		args = append(args, req.Until.UTC())
+	}
+	if req.Caller != "" {
+		conds = append(conds, "caller = ?")
+		args = append(args, req.Caller)
+	}
+	if req.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, req.Action)
+	}
+
+	query := fmt.Sprintf(selectAuditRecordsSQL, sqlstruct.Columns(AuditRecord{}), strings.Join(conds, " AND "))
+	rows, err := d.db.Queryx(d.db.Rebind(query), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get audit records from database")
+	}
+	return rows, nil
+}
@@ -0,0 +1,250 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/lib/attr"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+	"github.com/tjfoc/fabric-ca-gm/util"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The actions which are authorized by the authorization policy
+const (
+	actionRegister       = "register"
+	actionIdentities     = "identities"
+	actionAffiliations   = "affiliations"
+	actionRevoke         = "revoke"
+	actionGenCRL         = "gencrl"
+	actionAudit          = "audit"
+	actionIntermediateCA = "intermediateca"
+	actionBackup         = "backup"
+)
+
+// authzActions maps each action to the error code which is logged when a
+// caller is not authorized to perform it
+var authzActions = map[string]int{
+	actionRegister:       ErrMissingRegAttr,
+	actionIdentities:     ErrMissingRegAttr,
+	actionAffiliations:   ErrMissingRole,
+	actionRevoke:         ErrNotRevoker,
+	actionGenCRL:         ErrNoGenCRLAuth,
+	actionAudit:          ErrNoAuditAuth,
+	actionIntermediateCA: ErrActionNotAuthorized,
+	actionBackup:         ErrNoBackupAuth,
+}
+
+// caWideActions are the actions which act on the CA as a whole rather than
+// on identities or affiliations, so they can't be granted by a role with an
+// affiliation scope
+var caWideActions = []string{actionGenCRL, actionAudit, actionIntermediateCA, actionBackup}
+
+// authzPolicy decides which callers may perform which actions. A caller may
+// perform an action if it is a member of a role which grants the action.
+type authzPolicy struct {
+	Roles []*authzRole `yaml:"roles"`
+}
+
+// authzRole grants actions to its members. The members are the identities
+// whose enrollment ID is in IDs, whose type is in Types, or which have
+// attribute Attribute with value Value. If Affiliation is set, the role
+// only grants actions on identities and affiliations at or below it.
+type authzRole struct {
+	Name        string   `yaml:"name"`
+	IDs         []string `yaml:"ids"`
+	Types       []string `yaml:"types"`
+	Attribute   string   `yaml:"attribute"`
+	Value       string   `yaml:"value"`
+	Affiliation string   `yaml:"affiliation"`
+	Actions     []string `yaml:"actions"`
+}
+
+// defaultAuthzPolicy returns the policy which grants actions to the
+// identities with the corresponding built-in 'hf.*' attributes
+func defaultAuthzPolicy() *authzPolicy {
+	return &authzPolicy{Roles: []*authzRole{
+		{Name: "registrar", Attribute: attr.Roles, Value: "*", Actions: []string{actionRegister, actionIdentities}},
+		{Name: "affiliationmgr", Attribute: attr.AffiliationMgr, Value: "true", Actions: []string{actionAffiliations}},
+		{Name: "revoker", Attribute: attr.Revoker, Value: "true", Actions: []string{actionRevoke}},
+		{Name: "gencrl", Attribute: attr.GenCRL, Value: "true", Actions: []string{actionGenCRL}},
+		{Name: "auditor", Attribute: attr.Auditor, Value: "true", Actions: []string{actionAudit}},
+		{Name: "intermediateca", Attribute: attr.IntermediateCA, Value: "true", Actions: []string{actionIntermediateCA}},
+		{Name: "backup", Attribute: attr.Backup, Value: "true", Actions: []string{actionBackup}},
+	}}
+}
+
+// loadAuthzPolicy loads the authorization policy from 'file', or returns
+// the default policy if no file is configured
+func loadAuthzPolicy(file string) (*authzPolicy, error) {
+	if file == "" {
+		return defaultAuthzPolicy(), nil
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read authorization policy file '%s'", file)
+	}
+	policy := &authzPolicy{}
+	err = yaml.Unmarshal(buf, policy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse authorization policy file '%s'", file)
+	}
+	err = policy.validate()
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("Invalid authorization policy file '%s'", file))
+	}
+	log.Debugf("Loaded authorization policy with %d roles from '%s'", len(policy.Roles), file)
+	return policy, nil
+}
+
+// validate returns an error if a role of the policy is invalid
+func (p *authzPolicy) validate() error {
+	names := map[string]bool{}
+	for i, role := range p.Roles {
+		if role.Name == "" {
+			return errors.Errorf("Role %d has no name", i+1)
+		}
+		if names[role.Name] {
+			return errors.Errorf("There is more than one role named '%s'", role.Name)
+		}
+		names[role.Name] = true
+		if len(role.IDs) == 0 && len(role.Types) == 0 && role.Attribute == "" {
+			return errors.Errorf("Role '%s' has no members; it must have ids, types or an attribute", role.Name)
+		}
+		if role.Attribute != "" && role.Value == "" {
+			return errors.Errorf("Role '%s' has no value for attribute '%s'", role.Name, role.Attribute)
+		}
+		if len(role.Actions) == 0 {
+			return errors.Errorf("Role '%s' has no actions", role.Name)
+		}
+		for _, action := range role.Actions {
+			if _, ok := authzActions[action]; !ok {
+				return errors.Errorf("Role '%s' has unknown action '%s'", role.Name, action)
+			}
+			if role.Affiliation != "" && util.StrContained(action, caWideActions) {
+				return errors.Errorf("Role '%s' has an affiliation scope, so it can't grant action '%s'", role.Name, action)
+			}
+		}
+	}
+	return nil
+}
+
+// grants returns the roles of the policy which grant 'action' to 'caller'
+func (p *authzPolicy) grants(caller spi.User, action string) []*authzRole {
+	roles := []*authzRole{}
+	for _, role := range p.Roles {
+		if util.StrContained(action, role.Actions) && role.hasMember(caller) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// hasMember returns true if 'caller' is a member of the role
+func (r *authzRole) hasMember(caller spi.User) bool {
+	if util.StrContained(caller.GetName(), r.IDs) || util.StrContained(caller.GetType(), r.Types) {
+		return true
+	}
+	if r.Attribute == "" {
+		return false
+	}
+	a, err := caller.GetAttribute(r.Attribute)
+	if err != nil || a.Value == "" {
+		return false
+	}
+	return authzValueMatches(a.Value, r.Value)
+}
+
+// authzValueMatches returns true if the value of an attribute matches the
+// value in a role. A value of "*" matches any value, and boolean values
+// match if they are both true or both false.
+func authzValueMatches(value, want string) bool {
+	if want == "*" || value == want {
+		return true
+	}
+	b1, err1 := strconv.ParseBool(value)
+	b2, err2 := strconv.ParseBool(want)
+	return err1 == nil && err2 == nil && b1 == b2
+}
+
+// Authorize returns an error unless the authorization policy of the CA
+// grants 'action' to the caller
+func (ctx *serverRequestContext) Authorize(action string) error {
+	_, err := ctx.authorize(action)
+	return err
+}
+
+func (ctx *serverRequestContext) authorize(action string) ([]*authzRole, error) {
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	caller, err := ctx.GetCaller()
+	if err != nil {
+		return nil, err
+	}
+	roles := ca.authz.grants(caller, action)
+	if len(roles) == 0 {
+		return nil, newAuthErr(authzActions[action], "The identity '%s' is not authorized to perform action '%s'",
+			caller.GetName(), action)
+	}
+	return roles, nil
+}
+
+// authorizeEndpoint authorizes the caller to perform the action of the
+// endpoint, if it has one. The affiliations on which the caller may act are
+// then limited to the scopes of the roles which grant the action.
+func (ctx *serverRequestContext) authorizeEndpoint() error {
+	action := ctx.endpoint.action
+	if action == "" {
+		return nil
+	}
+	roles, err := ctx.authorize(action)
+	if err != nil {
+		return err
+	}
+	scopes := []string{}
+	for _, role := range roles {
+		if role.Affiliation == "" {
+			// The caller may act on any affiliation
+			return nil
+		}
+		scopes = append(scopes, role.Affiliation)
+	}
+	ctx.authzScopes = scopes
+	return nil
+}
+
+// inAuthzScope returns true if 'affiliation' is within the scope of the
+// roles which authorized the caller to perform the action of the endpoint
+func (ctx *serverRequestContext) inAuthzScope(affiliation string) bool {
+	if ctx.authzScopes == nil {
+		return true
+	}
+	for _, scope := range ctx.authzScopes {
+		if affiliation == scope || strings.HasPrefix(affiliation, scope+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+// newTestAuthzUser returns a user with the type and attributes
+func newTestAuthzUser(name, userType, attrs string) *DBUser {
+	return (&Accessor{}).newDBUser(&UserRecord{Name: name, Type: userType, Attributes: attrs})
+}
+
+func TestDefaultAuthzPolicy(t *testing.T) {
+	p := defaultAuthzPolicy()
+	assert.NoError(t, p.validate(), "The default policy should be valid")
+
+	registrar := newTestAuthzUser("registrar", "client",
+		`[{"name":"hf.Registrar.Roles","value":"peer,client"},{"name":"hf.Revoker","value":"1"},{"name":"hf.GenCRL","value":"false"}]`)
+	assert.Len(t, p.grants(registrar, actionRegister), 1)
+	assert.Len(t, p.grants(registrar, actionIdentities), 1)
+	assert.Len(t, p.grants(registrar, actionRevoke), 1, "A value of '1' for hf.Revoker should grant revoke")
+	assert.Empty(t, p.grants(registrar, actionGenCRL), "A value of 'false' for hf.GenCRL should not grant gencrl")
+	assert.Empty(t, p.grants(registrar, actionAffiliations), "An identity without hf.AffiliationMgr should not manage affiliations")
+
+	user := newTestAuthzUser("user", "client", `[{"name":"hf.Registrar.Roles","value":""}]`)
+	assert.Empty(t, p.grants(user, actionRegister), "An empty value for hf.Registrar.Roles should not grant register")
+}
+
+func TestLoadAuthzPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	load := func(policy string) (*authzPolicy, error) {
+		file := filepath.Join(dir, "policy.yaml")
+		err := ioutil.WriteFile(file, []byte(policy), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write policy file: %s", err)
+		}
+		return loadAuthzPolicy(file)
+	}
+
+	p, err := load(`
+roles:
+  - name: org1admins
+    attribute: dept
+    value: admins
+    affiliation: org1
+    actions: [register, identities, revoke]
+  - name: crladmins
+    ids: [alice]
+    types: [auditor]
+    actions: [gencrl, audit]
+`)
+	if assert.NoError(t, err, "Failed to load a valid policy") {
+		admin := newTestAuthzUser("bob", "client", `[{"name":"dept","value":"admins"},{"name":"hf.GenCRL","value":"true"}]`)
+		roles := p.grants(admin, actionRevoke)
+		if assert.Len(t, roles, 1) {
+			assert.Equal(t, "org1", roles[0].Affiliation)
+		}
+		assert.Empty(t, p.grants(admin, actionGenCRL), "The hf.* attributes should not grant actions with a policy file")
+		assert.Len(t, p.grants(newTestAuthzUser("alice", "client", ""), actionGenCRL), 1)
+		assert.Len(t, p.grants(newTestAuthzUser("carol", "auditor", ""), actionAudit), 1)
+	}
+
+	_, err = loadAuthzPolicy(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err, "Loading a missing policy file should fail")
+	_, err = load("roles: [")
+	assert.Error(t, err, "Loading an invalid YAML file should fail")
+	_, err = load("roles:\n  - name: r1\n    ids: [alice]\n    actions: [fly]\n")
+	assert.Error(t, err, "A role with an unknown action should be invalid")
+	_, err = load("roles:\n  - name: r1\n    actions: [revoke]\n")
+	assert.Error(t, err, "A role without members should be invalid")
+	_, err = load("roles:\n  - name: r1\n    attribute: dept\n    actions: [revoke]\n")
+	assert.Error(t, err, "A role with an attribute but no value should be invalid")
+	_, err = load("roles:\n  - name: r1\n    ids: [alice]\n    affiliation: org1\n    actions: [gencrl]\n")
+	assert.Error(t, err, "A role with an affiliation scope should not grant gencrl")
+	_, err = load("roles:\n  - name: r1\n    ids: [alice]\n    actions: [revoke]\n  - name: r1\n    ids: [bob]\n    actions: [audit]\n")
+	assert.Error(t, err, "Roles with the same name should be invalid")
+}
+
+func TestAuthzPolicyFile(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	policyFile := filepath.Join(dir, "policy.yaml")
+	err = ioutil.WriteFile(policyFile, []byte(`
+roles:
+  - name: org1registrar
+    ids: [admin]
+    affiliation: org1
+    actions: [register, identities]
+`), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write policy file: %s", err)
+	}
+
+	srv := TestGetRootServer(t)
+	srv.CA.Config.Authorization.PolicyFile = policyFile
+	err = srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	resp, err := getTestClient(rootPort).Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+
+	_, err = admin.Register(&api.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	assert.NoError(t, err, "Failed to register an identity within the scope of the role")
+	_, err = admin.Register(&api.RegistrationRequest{Name: "user2", Affiliation: "org2"})
+	assert.Error(t, err, "Registration should have failed; org2 is not within the scope of the role")
+	_, err = admin.GetIdentity("user1", "")
+	assert.NoError(t, err, "Failed to get an identity within the scope of the role")
+	_, err = admin.GetIdentity("admin", "")
+	assert.Error(t, err, "Getting admin should have failed; its affiliation is not within the scope of the role")
+	ids := []string{}
+	err = admin.GetAllIdentities("", func(decoder *json.Decoder) error {
+		var id api.IdentityInfo
+		err := decoder.Decode(&id)
+		ids = append(ids, id.ID)
+		return err
+	})
+	if assert.NoError(t, err, "Failed to get all identities") {
+		assert.Equal(t, []string{"user1"}, ids, "Only the identities within the scope of the role should be listed")
+	}
+	_, err = admin.GenCRL(&api.GenCRLRequest{})
+	assert.Error(t, err, "Generating a CRL should have failed; no role of the policy grants it")
+}
@@ -0,0 +1,739 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/lib/dbutil"
+	"github.com/tjfoc/fabric-ca-gm/lib/metadata"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+const (
+	// Version of the format of the backup archives written by this server
+	backupFormatVersion = 1
+	backupManifestFile  = "manifest.json"
+	backupSignatureFile = "manifest.sig"
+)
+
+// backupManifest describes the content of a backup archive. It is signed
+// with the key of the default CA, which is the first CA of the archive.
+type backupManifest struct {
+	FormatVersion int         `json:"formatVersion"`
+	ServerVersion string      `json:"serverVersion"`
+	CreatedAt     time.Time   `json:"createdAt"`
+	CAs           []*backupCA `json:"cas"`
+	// Digests maps the name of each file of the archive, other than the
+	// manifest and its signature, to its hex-encoded SHA-256 digest
+	Digests map[string]string `json:"digests"`
+}
+
+// backupCA names the files of the archive which contain the state of a CA
+type backupCA struct {
+	Name          string `json:"name"`
+	SchemaVersion int    `json:"schemaVersion"`
+	ConfigFile    string `json:"configFile,omitempty"`
+	CertFile      string `json:"certFile"`
+	ChainFile     string `json:"chainFile,omitempty"`
+	// The public keys of the Idemix issuer and of its revocation authority
+	IdemixPublicKeyFile     string            `json:"idemixPublicKeyFile,omitempty"`
+	IdemixRevocationKeyFile string            `json:"idemixRevocationKeyFile,omitempty"`
+	KeyFiles                []string          `json:"keyFiles,omitempty"`
+	Tables                  map[string]string `json:"tables"`
+}
+
+type propertyRecord struct {
+	Property string `db:"property"`
+	Value    string `db:"value"`
+}
+
+// backupTable is a database table which is exported to backup archives as
+// a JSON array of records, independently of the database type
+type backupTable struct {
+	name    string
+	columns string
+	// newRecords returns a pointer to an empty slice of records
+	newRecords func() interface{}
+}
+
+// backupTables are the tables exported to backup archives. The nonces table
+// is not backed up, since its Idemix nonces expire shortly after they are
+// issued, nor is the schema_migrations table, which is recreated by
+// migrating the database.
+var backupTables = []backupTable{
+	{
+		name:       "users",
+		columns:    "id, token, type, affiliation, attributes, state, max_enrollments, level, secret_expiry, secret_one_time, failed_attempts, locked_at, suspended",
+		newRecords: func() interface{} { return &[]UserRecord{} },
+	},
+	{
+		name:       "affiliations",
+		columns:    "name, prekey, level",
+		newRecords: func() interface{} { return &[]AffiliationRecord{} },
+	},
+	{
+		name:       "certificates",
+		columns:    "id, serial_number, authority_key_identifier, ca_label, status, reason, expiry, revoked_at, pem, level",
+		newRecords: func() interface{} { return &[]CertRecord{} },
+	},
+	{
+		name:       "certificates_archive",
+		columns:    "id, serial_number, authority_key_identifier, ca_label, status, reason, expiry, revoked_at, pem, purged_at, level",
+		newRecords: func() interface{} { return &[]ArchivedCertRecord{} },
+	},
+	{
+		name:       "credentials",
+		columns:    "id, revocation_handle, cred, ca_label, status, reason, revoked_at, level",
+		newRecords: func() interface{} { return &[]CredRecord{} },
+	},
+	{
+		name:       "revocation_authority_info",
+		columns:    "epoch, next_handle, level",
+		newRecords: func() interface{} { return &[]revocationAuthorityInfo{} },
+	},
+	{
+		name:       "audit",
+		columns:    "logged_at, caller, ca_name, action, target, changes, source, level",
+		newRecords: func() interface{} { return &[]AuditRecord{} },
+	},
+	{
+		name:       "pending_operations",
+		columns:    "id, ca_name, operation, target, request, requester, requested_at, expiry, level",
+		newRecords: func() interface{} { return &[]PendingOperationRecord{} },
+	},
+	{
+		name:       "properties",
+		columns:    "property, value",
+		newRecords: func() interface{} { return &[]propertyRecord{} },
+	},
+}
+
+// backupWriter accumulates the files of a backup archive
+type backupWriter struct {
+	names []string
+	files map[string][]byte
+}
+
+func (bw *backupWriter) add(name string, content []byte) {
+	bw.names = append(bw.names, name)
+	bw.files[name] = content
+}
+
+// Backup writes a signed archive of the state of every CA of the server to
+// 'w'. The server need not be running.
+func (s *Server) Backup(w io.Writer) error {
+	cas, err := s.openCADBs()
+	defer s.closeCADBs(cas)
+	if err != nil {
+		return err
+	}
+	return writeBackup(cas, w)
+}
+
+// backupCAs returns the CAs of a running server, the default CA first
+func (s *Server) backupCAs() []*CA {
+	cas := []*CA{&s.CA}
+	var names []string
+	for name, ca := range s.caMap {
+		if ca != &s.CA {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cas = append(cas, s.caMap[name])
+	}
+	return cas
+}
+
+// writeBackup writes a gzip-compressed tar archive of the state of the CAs
+// to 'w'; the manifest of the archive is signed with the key of the first CA
+func writeBackup(cas []*CA, w io.Writer) error {
+	bw := &backupWriter{files: make(map[string][]byte)}
+	manifest := &backupManifest{
+		FormatVersion: backupFormatVersion,
+		ServerVersion: metadata.GetVersion(),
+		CreatedAt:     time.Now().UTC(),
+		Digests:       make(map[string]string),
+	}
+	for i, ca := range cas {
+		bca, err := backupCAState(ca, fmt.Sprintf("cas/%d", i), bw)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("Failed to back up CA '%s'", ca.Config.CA.Name))
+		}
+		manifest.CAs = append(manifest.CAs, bca)
+	}
+	for name, content := range bw.files {
+		manifest.Digests[name] = backupDigest(content)
+	}
+	mbytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal the backup manifest")
+	}
+	sig, err := signBackupManifest(cas[0], mbytes)
+	if err != nil {
+		return err
+	}
+	bw.add(backupManifestFile, mbytes)
+	bw.add(backupSignatureFile, sig)
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, name := range bw.names {
+		content := bw.files[name]
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(content)),
+			ModTime: manifest.CreatedAt,
+		}
+		err = tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write(content)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Failed to write the backup archive")
+		}
+	}
+	err = tw.Close()
+	if err == nil {
+		err = gw.Close()
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to write the backup archive")
+	}
+	log.Infof("Backed up %d CA(s)", len(cas))
+	return nil
+}
+
+// backupCAState adds the configuration, certificates, keys and database
+// tables of a CA to the archive, in the directory 'dir'
+func backupCAState(ca *CA, dir string, bw *backupWriter) (*backupCA, error) {
+	bca := &backupCA{Name: ca.Config.CA.Name, Tables: make(map[string]string)}
+	content, err := ioutil.ReadFile(ca.Config.CA.Certfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the CA certificate")
+	}
+	bca.CertFile = path.Join(dir, "ca-cert.pem")
+	bw.add(bca.CertFile, content)
+	optional := []struct {
+		src  string
+		name string
+		dst  *string
+	}{
+		{ca.ConfigFilePath, "config.yaml", &bca.ConfigFile},
+		{ca.Config.CA.Chainfile, "ca-chain.pem", &bca.ChainFile},
+		{ca.Config.Idemix.IssuerPublicKeyfile, "IssuerPublicKey", &bca.IdemixPublicKeyFile},
+		{ca.Config.Idemix.RevocationPublicKeyfile, "IssuerRevocationPublicKey", &bca.IdemixRevocationKeyFile},
+	}
+	for _, f := range optional {
+		if f.src == "" || !util.FileExists(f.src) {
+			continue
+		}
+		content, err = ioutil.ReadFile(f.src)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read '%s'", f.src)
+		}
+		*f.dst = path.Join(dir, f.name)
+		bw.add(*f.dst, content)
+	}
+	keystore, err := ca.keystoreDir()
+	if err != nil {
+		return nil, err
+	}
+	if keystore != "" {
+		files, err := ioutil.ReadDir(keystore)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "Failed to read the keystore")
+		}
+		for _, f := range files {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			content, err = ioutil.ReadFile(filepath.Join(keystore, f.Name()))
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to read the keystore")
+			}
+			name := path.Join(dir, "keystore", f.Name())
+			bca.KeyFiles = append(bca.KeyFiles, name)
+			bw.add(name, content)
+		}
+	}
+	bca.SchemaVersion, err = dbutil.SchemaVersion(ca.db)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := exportTables(ca.db)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range backupTables {
+		name := path.Join(dir, "db", t.name+".json")
+		bca.Tables[t.name] = name
+		bw.add(name, tables[t.name])
+	}
+	return bca, nil
+}
+
+// exportTables returns the records of the backed up tables as JSON, read in
+// a single transaction so that they are consistent with each other
+func exportTables(db *sqlx.DB) (map[string][]byte, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+	if db.DriverName() == "postgres" {
+		// Read all tables from the same snapshot; it is the default
+		// isolation level of MySQL, and SQLite serializes transactions
+		_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ")
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to set the transaction isolation level")
+		}
+	}
+	tables := make(map[string][]byte)
+	for _, t := range backupTables {
+		records := t.newRecords()
+		err = tx.Select(records, fmt.Sprintf("SELECT %s FROM %s", t.columns, t.name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to export the %s table", t.name)
+		}
+		tables[t.name], err = json.Marshal(records)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to marshal the %s table", t.name)
+		}
+	}
+	return tables, nil
+}
+
+// signBackupManifest signs the digest of the manifest with the key of the CA
+func signBackupManifest(ca *CA, manifest []byte) ([]byte, error) {
+	csp, err := ca.getCSP()
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, err := util.GetSignerFromCertFile(ca.Config.CA.Certfile, csp)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get the key of the CA")
+	}
+	digest, err := csp.Hash(manifest, &bccsp.SHAOpts{})
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to compute the digest of the backup manifest")
+	}
+	sig, err := csp.Sign(key, digest, nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to sign the backup manifest")
+	}
+	return sig, nil
+}
+
+// verifyBackupManifest verifies the signature of the manifest with the
+// public key of the CA certificate 'cert'
+func verifyBackupManifest(csp bccsp.BCCSP, cert *x509.Certificate, manifest, sig []byte) error {
+	pubKey, err := csp.KeyImport(util.ParseX509Certificate2Sm2(cert), &bccsp.X509PublicKeyImportOpts{Temporary: true})
+	if err != nil {
+		return errors.WithMessage(err, "Failed to import the public key of the CA certificate")
+	}
+	digest, err := csp.Hash(manifest, &bccsp.SHAOpts{})
+	if err != nil {
+		return errors.WithMessage(err, "Failed to compute the digest of the backup manifest")
+	}
+	valid, err := csp.Verify(pubKey, sig, digest, nil)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to verify the signature")
+	}
+	if !valid {
+		return errors.New("The signature does not match the manifest")
+	}
+	return nil
+}
+
+// Restore restores the state of the CAs of the server from a backup archive
+// written by Backup, after validating its signature and versions. The server
+// must be stopped. The archive must be signed by the default CA of the
+// server if its certificate exists, or else by a CA which is or chains to a
+// certificate of 'trustedCertFile'. The configuration files are overwritten
+// only if 'restoreConfig' is true.
+func (s *Server) Restore(r io.Reader, trustedCertFile string, restoreConfig bool) error {
+	files, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+	cas, err := s.openCADBs()
+	defer s.closeCADBs(cas)
+	if err != nil {
+		return err
+	}
+	var trusted []*x509.Certificate
+	if trustedCertFile != "" {
+		// Initializing the crypto provider selects how certificates are parsed
+		_, err = cas[0].getCSP()
+		if err != nil {
+			return err
+		}
+		pemBytes, err := ioutil.ReadFile(trustedCertFile)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read the trusted certificate file '%s'", trustedCertFile)
+		}
+		trusted, err = util.GetX509CertificatesFromPEM(pemBytes)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("Invalid trusted certificate file '%s'", trustedCertFile))
+		}
+		if len(trusted) == 0 {
+			return errors.Errorf("The trusted certificate file '%s' contains no certificate", trustedCertFile)
+		}
+	}
+	manifest, err := validateBackup(files, cas[0], trusted, s.levels)
+	if err != nil {
+		return errors.WithMessage(err, "Invalid backup archive")
+	}
+	byName := make(map[string]*CA)
+	for _, ca := range cas {
+		byName[ca.Config.CA.Name] = ca
+	}
+	targets := make([]*CA, len(manifest.CAs))
+	for i, bca := range manifest.CAs {
+		targets[i] = byName[bca.Name]
+		if targets[i] == nil {
+			return errors.Errorf("CA '%s' of the backup archive is not configured on this server", bca.Name)
+		}
+	}
+	for i, bca := range manifest.CAs {
+		err = restoreCAState(targets[i], bca, files, restoreConfig)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("Failed to restore CA '%s'", bca.Name))
+		}
+		log.Infof("Restored CA '%s' from the backup of %s", bca.Name, manifest.CreatedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// readBackup returns the files of a backup archive, keyed by name
+func readBackup(r io.Reader) (map[string][]byte, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the backup archive")
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read the backup archive")
+		}
+		files[hdr.Name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read the backup archive")
+		}
+	}
+	return files, nil
+}
+
+// validateBackup verifies the signature of the manifest, the digests of the
+// files and the versions of the archive, and returns the manifest. The
+// manifest must be signed by the default CA of the archive, which must be
+// the default CA of this server if its certificate exists, or else must be
+// or chain through the archived CA chain to one of the 'trusted' certificates.
+func validateBackup(files map[string][]byte, defaultCA *CA, trusted []*x509.Certificate, levels *dbutil.Levels) (*backupManifest, error) {
+	mbytes, ok := files[backupManifestFile]
+	if !ok {
+		return nil, errors.New("The archive has no manifest")
+	}
+	sig, ok := files[backupSignatureFile]
+	if !ok {
+		return nil, errors.New("The archive has no signature")
+	}
+	manifest := &backupManifest{}
+	err := json.Unmarshal(mbytes, manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the manifest")
+	}
+	if manifest.FormatVersion != backupFormatVersion {
+		return nil, errors.Errorf("Unsupported archive format version %d", manifest.FormatVersion)
+	}
+	if len(manifest.CAs) == 0 {
+		return nil, errors.New("The archive contains no CA")
+	}
+
+	csp, err := defaultCA.getCSP()
+	if err != nil {
+		return nil, err
+	}
+	signer, err := util.GetX509CertificateFromPEM(files[manifest.CAs[0].CertFile])
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid certificate of the default CA of the archive")
+	}
+	err = verifyBackupManifest(csp, signer, mbytes, sig)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid signature")
+	}
+	if util.FileExists(defaultCA.Config.CA.Certfile) {
+		current, err := ioutil.ReadFile(defaultCA.Config.CA.Certfile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read the CA certificate")
+		}
+		if !bytes.Equal(pemBytes(current), signer.Raw) {
+			return nil, errors.Errorf("The archive was not created by the CA whose certificate is '%s'", defaultCA.Config.CA.Certfile)
+		}
+	} else if len(trusted) > 0 {
+		var chain []*x509.Certificate
+		if manifest.CAs[0].ChainFile != "" {
+			chain, err = util.GetX509CertificatesFromPEM(files[manifest.CAs[0].ChainFile])
+			if err != nil {
+				return nil, errors.WithMessage(err, "Invalid CA chain of the default CA of the archive")
+			}
+		}
+		if !chainsToTrustedCert(signer, chain, trusted) {
+			return nil, errors.New("The default CA of the archive does not chain to a trusted certificate")
+		}
+	} else {
+		return nil, errors.Errorf("The CA certificate '%s' does not exist, so a trusted certificate is required to verify the archive",
+			defaultCA.Config.CA.Certfile)
+	}
+
+	for name, content := range files {
+		if name == backupManifestFile || name == backupSignatureFile {
+			continue
+		}
+		digest, ok := manifest.Digests[name]
+		if !ok {
+			return nil, errors.Errorf("File '%s' is not in the manifest", name)
+		}
+		if digest != backupDigest(content) {
+			return nil, errors.Errorf("The digest of file '%s' does not match the manifest", name)
+		}
+	}
+	for name := range manifest.Digests {
+		if _, ok := files[name]; !ok {
+			return nil, errors.Errorf("File '%s' of the manifest is missing", name)
+		}
+	}
+
+	archiveLevels, err := metadata.GetLevels(manifest.ServerVersion)
+	if err != nil {
+		return nil, err
+	}
+	if archiveLevels != nil && (archiveLevels.Identity > levels.Identity ||
+		archiveLevels.Affiliation > levels.Affiliation || archiveLevels.Certificate > levels.Certificate) {
+		return nil, errors.Errorf("The archive was created by server version %s, which is newer than this server", manifest.ServerVersion)
+	}
+	for _, bca := range manifest.CAs {
+		if bca.SchemaVersion > dbutil.LatestSchemaVersion() {
+			return nil, errors.Errorf("The schema version %d of CA '%s' is newer than the latest version %d known to the server", bca.SchemaVersion, bca.Name, dbutil.LatestSchemaVersion())
+		}
+		for _, t := range backupTables {
+			if _, ok := files[bca.Tables[t.name]]; !ok {
+				return nil, errors.Errorf("The %s table of CA '%s' is missing", t.name, bca.Name)
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// chainsToTrustedCert returns true if 'cert' is one of the 'trusted'
+// certificates or is issued by one of them through the certificates of 'chain'
+func chainsToTrustedCert(cert *x509.Certificate, chain, trusted []*x509.Certificate) bool {
+	// Each step moves up the chain, so a valid path is no longer than the chain
+	for i := 0; i <= len(chain); i++ {
+		sm2Cert := util.ParseX509Certificate2Sm2(cert)
+		for _, t := range trusted {
+			if bytes.Equal(cert.Raw, t.Raw) || sm2Cert.CheckSignatureFrom(util.ParseX509Certificate2Sm2(t)) == nil {
+				return true
+			}
+		}
+		var issuer *x509.Certificate
+		for _, c := range chain {
+			if !bytes.Equal(c.Raw, cert.Raw) && sm2Cert.CheckSignatureFrom(util.ParseX509Certificate2Sm2(c)) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil {
+			return false
+		}
+		cert = issuer
+	}
+	return false
+}
+
+// restoreCAState writes the certificates, keys and, if requested, the
+// configuration of a CA from the archive, and replaces the records of the
+// backed up tables of its database
+func restoreCAState(ca *CA, bca *backupCA, files map[string][]byte, restoreConfig bool) error {
+	err := writeRestoredFile(ca.Config.CA.Certfile, files[bca.CertFile], 0644)
+	if err != nil {
+		return err
+	}
+	optional := map[string]string{
+		bca.ChainFile:               ca.Config.CA.Chainfile,
+		bca.IdemixPublicKeyFile:     ca.Config.Idemix.IssuerPublicKeyfile,
+		bca.IdemixRevocationKeyFile: ca.Config.Idemix.RevocationPublicKeyfile,
+	}
+	for name, dst := range optional {
+		if name == "" {
+			continue
+		}
+		err = writeRestoredFile(dst, files[name], 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if len(bca.KeyFiles) > 0 {
+		keystore, err := ca.keystoreDir()
+		if err != nil {
+			return err
+		}
+		if keystore == "" {
+			return errors.New("The CA has no software keystore to which to restore its keys")
+		}
+		for _, name := range bca.KeyFiles {
+			err = writeRestoredFile(filepath.Join(keystore, path.Base(name)), files[name], 0600)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if restoreConfig && bca.ConfigFile != "" && ca.ConfigFilePath != "" {
+		err = writeRestoredFile(ca.ConfigFilePath, files[bca.ConfigFile], 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = ca.migrateDB(0)
+	if err != nil {
+		return err
+	}
+	tx, err := ca.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	err = importTables(tx, bca, files)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "Error encountered while committing transaction")
+	}
+	return nil
+}
+
+// importTables replaces the records of the backed up tables with those of
+// the archive
+func importTables(tx *sqlx.Tx, bca *backupCA, files map[string][]byte) error {
+	for _, t := range backupTables {
+		records := t.newRecords()
+		err := json.Unmarshal(files[bca.Tables[t.name]], records)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to parse the %s table", t.name)
+		}
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s", t.name))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to clear the %s table", t.name)
+		}
+		insertSQL := fmt.Sprintf("INSERT INTO %s (%s) VALUES (:%s)", t.name, t.columns, strings.Replace(t.columns, ", ", ", :", -1))
+		slice := reflect.ValueOf(records).Elem()
+		for i := 0; i < slice.Len(); i++ {
+			_, err = tx.NamedExec(insertSQL, slice.Index(i).Interface())
+			if err != nil {
+				return errors.Wrapf(err, "Failed to restore the %s table", t.name)
+			}
+		}
+		log.Debugf("Restored %d records of the %s table", slice.Len(), t.name)
+	}
+	return nil
+}
+
+func writeRestoredFile(file string, content []byte, perm os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create the directory of '%s'", file)
+	}
+	err = ioutil.WriteFile(file, content, perm)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write '%s'", file)
+	}
+	return nil
+}
+
+// getCSP returns the CA's crypto provider, initializing it if needed
+func (ca *CA) getCSP() (bccsp.BCCSP, error) {
+	if ca.csp == nil {
+		var err error
+		ca.csp, err = util.InitBCCSP(&ca.Config.CSP, "", ca.HomeDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ca.csp, nil
+}
+
+// keystoreDir returns the directory of the CA's software keystore, or an
+// empty string if its keys are not stored in files
+func (ca *CA) keystoreDir() (string, error) {
+	_, err := ca.getCSP()
+	if err != nil {
+		return "", err
+	}
+	opts := ca.Config.CSP
+	if opts == nil || opts.SwOpts == nil || opts.SwOpts.FileKeystore == nil {
+		return "", nil
+	}
+	return opts.SwOpts.FileKeystore.KeyStorePath, nil
+}
+
+// pemBytes returns the DER bytes of the first PEM block of 'buf'
+func pemBytes(buf []byte) []byte {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil
+	}
+	return block.Bytes
+}
+
+func backupDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
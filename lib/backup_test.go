@@ -0,0 +1,176 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/certdb"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+func TestBackupRestore(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	if err != nil {
+		srv.Stop()
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+	_, err = admin.Register(&api.RegistrationRequest{Name: "backup1", Affiliation: "org2"})
+	if err != nil {
+		srv.Stop()
+		t.Fatalf("Failed to register backup1: %s", err)
+	}
+	insertBackupTestRecords(t, srv.CA.db, "record1")
+	backup, err := admin.Backup("")
+	if err != nil {
+		srv.Stop()
+		t.Fatalf("Failed to back up the server: %s", err)
+	}
+	_, err = admin.Register(&api.RegistrationRequest{Name: "backup2", Affiliation: "org2"})
+	if err != nil {
+		srv.Stop()
+		t.Fatalf("Failed to register backup2: %s", err)
+	}
+	insertBackupTestRecords(t, srv.CA.db, "record2")
+	srv.Stop()
+
+	// A modified archive is rejected
+	var archive bytes.Buffer
+	err = srv.Backup(&archive)
+	assert.NoError(t, err, "Failed to back up the stopped server")
+	buf := archive.Bytes()
+	buf[len(buf)/2] ^= 0xff
+	err = srv.Restore(bytes.NewReader(buf), "", false)
+	assert.Error(t, err, "Restoring a modified archive should fail")
+
+	// Without the CA certificate, the archive must chain to a trusted certificate
+	certFile := srv.CA.Config.CA.Certfile
+	cert, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatalf("Failed to read the CA certificate: %s", err)
+	}
+	trustedFile := filepath.Join(rootDir, "trusted-cert.pem")
+	err = ioutil.WriteFile(trustedFile, cert, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write the trusted certificate: %s", err)
+	}
+	os.Remove(certFile)
+	err = srv.Restore(bytes.NewReader(backup.Archive), "", false)
+	assert.Error(t, err, "Restoring without a trust anchor should fail")
+	err = srv.Restore(bytes.NewReader(backup.Archive), "../testdata/root.pem", false)
+	assert.Error(t, err, "Restoring an archive of a CA which is not trusted should fail")
+	assert.False(t, util.FileExists(certFile), "A rejected archive should not be restored")
+
+	err = srv.Restore(bytes.NewReader(backup.Archive), trustedFile, false)
+	if err != nil {
+		t.Fatalf("Failed to restore the server: %s", err)
+	}
+	err = srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+	_, err = admin.GetIdentity("backup1", "")
+	assert.NoError(t, err, "The identity registered before the backup should be restored")
+	_, err = admin.GetIdentity("backup2", "")
+	assert.Error(t, err, "The identity registered after the backup should not be restored")
+	for _, table := range []string{"certificates_archive", "audit", "pending_operations"} {
+		assert.Equal(t, 1, countBackupTestRecords(t, srv.CA.db, table, "record1"), "The %s record written before the backup should be restored", table)
+		assert.Equal(t, 0, countBackupTestRecords(t, srv.CA.db, table, "record2"), "The %s record written after the backup should not be restored", table)
+	}
+}
+
+// insertBackupTestRecords writes an archived certificate, an audit record and
+// a pending operation whose IDs are 'name'
+func insertBackupTestRecords(t *testing.T, db *sqlx.DB, name string) {
+	now := time.Now().UTC()
+	cert := ArchivedCertRecord{
+		CertRecord: CertRecord{
+			ID: name,
+			CertificateRecord: certdb.CertificateRecord{
+				Serial:    name,
+				AKI:       name,
+				CALabel:   "",
+				Status:    "good",
+				Expiry:    now.Add(-time.Hour),
+				RevokedAt: time.Time{}.UTC(),
+				PEM:       "pem",
+			},
+		},
+		PurgedAt: now,
+	}
+	_, err := db.NamedExec(insertArchiveSQL, cert)
+	if err != nil {
+		t.Fatalf("Failed to insert archived certificate %s: %s", name, err)
+	}
+	err = NewAuditDBAccessor(db).InsertRecord(AuditRecord{
+		LoggedAt: now,
+		Caller:   "admin",
+		Action:   "register",
+		Target:   name,
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert audit record of %s: %s", name, err)
+	}
+	err = NewPendingOperationDBAccessor(db).InsertOperation(PendingOperationRecord{
+		ID:          name,
+		Operation:   "revoke",
+		Requester:   "admin",
+		RequestedAt: now,
+		Expiry:      now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert pending operation %s: %s", name, err)
+	}
+}
+
+// countBackupTestRecords returns the number of records of 'table' which were
+// written by insertBackupTestRecords for 'name'
+func countBackupTestRecords(t *testing.T, db *sqlx.DB, table, name string) int {
+	column := map[string]string{
+		"certificates_archive": "id",
+		"audit":                "target",
+		"pending_operations":   "id",
+	}[table]
+	var count int
+	err := db.Get(&count, db.Rebind(fmt.Sprintf("SELECT count(*) FROM %s WHERE (%s = ?)", table, column)), name)
+	if err != nil {
+		t.Fatalf("Failed to count the records of the %s table: %s", table, err)
+	}
+	return count
+}
@@ -29,6 +29,7 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,6 +46,7 @@ import (
 	"github.com/tjfoc/fabric-ca-gm/lib/dbutil"
 	"github.com/tjfoc/fabric-ca-gm/lib/ldap"
 	"github.com/tjfoc/fabric-ca-gm/lib/metadata"
+	"github.com/tjfoc/fabric-ca-gm/lib/oidc"
 	"github.com/tjfoc/fabric-ca-gm/lib/spi"
 	"github.com/tjfoc/fabric-ca-gm/lib/tcert"
 	"github.com/tjfoc/fabric-ca-gm/lib/tls"
@@ -100,10 +102,26 @@ type CA struct {
 	verifyOptions *x509.VerifyOptions
 	// The attribute manager
 	attrMgr *attrmgr.Mgr
+	// The registration policies
+	policies []*registrationPolicy
+	// The policy which authorizes callers to perform actions
+	authz *authzPolicy
+	// The verifier of OIDC ID tokens, if enrollment with them is enabled
+	oidcVerifier *oidc.Verifier
+	// The nonces of the authorization tokens which have been accepted
+	nonces *nonceCache
 	// The tcert manager for this CA
 	tcertMgr *tcert.Mgr
 	// The key tree
 	keyTree *tcert.KeyTree
+	// The Idemix credential issuer of this CA
+	idemixIssuer *idemixIssuer
+	// The Idemix credential DB accessor
+	idemixCredDBAccessor *IdemixCredDBAccessor
+	// The audit log DB accessor
+	auditDBAccessor *AuditDBAccessor
+	// The pending operations DB accessor
+	pendingOpDBAccessor *PendingOperationDBAccessor
 	// The server hosting this CA
 	server *Server
 	// Indicates if database was successfully initialized
@@ -112,6 +130,9 @@ type CA struct {
 	levels *dbutil.Levels
 	// CA mutex
 	mutex sync.Mutex
+	// Serializes the enrollments of identities with a maximum number of
+	// active certificates, so that concurrent requests can't exceed it
+	activeCertsMutex sync.Mutex
 }
 
 const (
@@ -159,6 +180,11 @@ func (ca *CA) init(renew bool) (err error) {
 	if err != nil {
 		return err
 	}
+	// Parse the registration policies
+	ca.policies, err = newRegistrationPolicies(ca.Config.Registry.Policies)
+	if err != nil {
+		return err
+	}
 	// Initialize the crypto layer (BCCSP) for this CA
 	ca.csp, err = util.InitBCCSP(&ca.Config.CSP, "", ca.HomeDir)
 	if err != nil {
@@ -169,6 +195,11 @@ func (ca *CA) init(renew bool) (err error) {
 	if err != nil {
 		return err
 	}
+	// Initialize the Idemix issuer
+	err = ca.initIdemixIssuer()
+	if err != nil {
+		return err
+	}
 	// Initialize the database
 	err = ca.initDB()
 	if err != nil {
@@ -183,6 +214,21 @@ func (ca *CA) init(renew bool) (err error) {
 	if err != nil {
 		return err
 	}
+	// Initialize enrollment with OIDC ID tokens
+	ca.nonces = newNonceCache()
+	err = ca.initOIDC()
+	if err != nil {
+		return err
+	}
+	// Load the authorization policy
+	ca.authz, err = loadAuthzPolicy(ca.Config.Authorization.PolicyFile)
+	if err != nil {
+		return err
+	}
+	err = validateApprovalConfig(&ca.Config.Approval)
+	if err != nil {
+		return err
+	}
 	// Create the attribute manager
 	ca.attrMgr = attrmgr.New()
 	// Initialize TCert handling
@@ -455,6 +501,37 @@ func (ca *CA) initConfig() (err error) {
 	if cfg.CA.Chainfile == "" {
 		cfg.CA.Chainfile = "ca-chain.pem"
 	}
+	if cfg.Idemix.IssuerPublicKeyfile == "" {
+		cfg.Idemix.IssuerPublicKeyfile = defaultIdemixIssuerPublicKeyfile
+	}
+	if cfg.Idemix.IssuerSecretKeyfile == "" {
+		cfg.Idemix.IssuerSecretKeyfile = defaultIdemixIssuerSecretKeyfile
+	}
+	if cfg.Idemix.RevocationPublicKeyfile == "" {
+		cfg.Idemix.RevocationPublicKeyfile = defaultIdemixRevocationPublicKeyfile
+	}
+	if cfg.Idemix.RevocationPrivateKeyfile == "" {
+		cfg.Idemix.RevocationPrivateKeyfile = defaultIdemixRevocationPrivateKeyfile
+	}
+	if cfg.Idemix.NonceExpiration == 0 {
+		cfg.Idemix.NonceExpiration = defaultIdemixNonceExpiration
+	}
+	if cfg.Certificates.Retention == 0 {
+		cfg.Certificates.Retention = defaultCertRetention
+	} else if cfg.Certificates.Retention < 0 {
+		return errors.Errorf("Invalid certificates.retention value '%s'; it must not be negative", cfg.Certificates.Retention)
+	}
+	if cfg.Tokens.ClockSkew == 0 {
+		cfg.Tokens.ClockSkew = defaultTokenClockSkew
+	} else if cfg.Tokens.ClockSkew < 0 {
+		return errors.Errorf("Invalid tokens.clockskew value '%s'; it must not be negative", cfg.Tokens.ClockSkew)
+	}
+	if cfg.Registry.Lockout.MaxFailedAttempts < 0 {
+		return errors.Errorf("Invalid registry.lockout.maxfailedattempts value '%d'; it must not be negative", cfg.Registry.Lockout.MaxFailedAttempts)
+	}
+	if cfg.Registry.Lockout.Duration < 0 {
+		return errors.Errorf("Invalid registry.lockout.duration value '%s'; it must not be negative", cfg.Registry.Lockout.Duration)
+	}
 	if cfg.CSR.CA == nil {
 		cfg.CSR.CA = &cfcsr.CAConfig{}
 	}
@@ -609,58 +686,35 @@ func (ca *CA) initDB() error {
 		return nil
 	}
 
-	db := &ca.Config.DB
 	dbError := false
-	var err error
-
-	if db.Type == "" || db.Type == defaultDatabaseType {
-
-		db.Type = defaultDatabaseType
-
-		if db.Datasource == "" {
-			db.Datasource = "fabric-ca-server.db"
-		}
+	err := ca.openDB()
+	if err != nil {
+		return err
+	}
 
-		db.Datasource, err = util.MakeFileAbs(db.Datasource, ca.HomeDir)
-		if err != nil {
+	// Update the database to use the latest schema
+	_, err = ca.migrateDB(0)
+	if err != nil {
+		if isFatalError(err) {
 			return err
 		}
+		return errors.WithMessage(err, "Failed to update schema")
 	}
 
-	// Strip out user:pass from datasource for logging
-	ds := db.Datasource
-	ds = dbutil.MaskDBCred(ds)
-
-	log.Debugf("Initializing '%s' database at '%s'", db.Type, ds)
-
-	switch db.Type {
-	case defaultDatabaseType:
-		ca.db, err = dbutil.NewUserRegistrySQLLite3(db.Datasource)
-		if err != nil {
-			return errors.WithMessage(err, "Failed to create user registry for SQLite")
-		}
-	case "postgres":
-		ca.db, err = dbutil.NewUserRegistryPostgres(db.Datasource, &db.TLS)
-		if err != nil {
-			return errors.WithMessage(err, "Failed to create user registry for PostgreSQL")
-		}
-	case "mysql":
-		ca.db, err = dbutil.NewUserRegistryMySQL(db.Datasource, &db.TLS, ca.csp)
-		if err != nil {
-			return errors.WithMessage(err, "Failed to create user registry for MySQL")
-		}
-	default:
-		return errors.Errorf("Invalid db.type in config file: '%s'; must be 'sqlite3', 'postgres', or 'mysql'", db.Type)
-	}
+	// Set the certificate DB accessor
+	ca.certDBAccessor = NewCertDBAccessor(ca.db, ca.levels.Certificate)
 
-	// Update the database to use the latest schema
-	err = dbutil.UpdateSchema(ca.db, ca.server.levels)
+	// Set the Idemix credential DB accessor
+	ca.idemixCredDBAccessor = NewIdemixCredDBAccessor(ca.db)
+	err = ca.idemixCredDBAccessor.initRevocationAuthorityInfo()
 	if err != nil {
-		return errors.Wrap(err, "Failed to update schema")
+		return err
 	}
 
-	// Set the certificate DB accessor
-	ca.certDBAccessor = NewCertDBAccessor(ca.db, ca.levels.Certificate)
+	// Set the audit log DB accessor
+	ca.auditDBAccessor = NewAuditDBAccessor(ca.db)
+	// Set the pending operations DB accessor
+	ca.pendingOpDBAccessor = NewPendingOperationDBAccessor(ca.db)
 
 	// If DB initialization fails and we need to reinitialize DB, need to make sure to set the DB accessor for the signer
 	if ca.enrollSigner != nil {
@@ -673,8 +727,8 @@ func (ca *CA) initDB() error {
 		return err
 	}
 
-	// If not using LDAP, migrate database if needed to latest version and load the users and affiliations table
-	if !ca.Config.LDAP.Enabled {
+	// If not using only LDAP, migrate database if needed to latest version and load the users and affiliations table
+	if ca.usesDBRegistry() {
 		err = ca.checkDBLevels()
 		if err != nil {
 			return err
@@ -702,6 +756,8 @@ func (ca *CA) initDB() error {
 		}
 	}
 
+	db := &ca.Config.DB
+	ds := dbutil.MaskDBCred(db.Datasource)
 	if dbError {
 		return errors.Errorf("Failed to initialize %s database at %s ", db.Type, ds)
 	}
@@ -724,22 +780,54 @@ func (ca *CA) closeDB() error {
 	return nil
 }
 
+// Initialize the verifier of the OIDC ID tokens with which identities may
+// enroll, if enabled
+func (ca *CA) initOIDC() error {
+	oidcCfg := &ca.Config.OIDC
+	if !oidcCfg.Enabled {
+		return nil
+	}
+	if !ca.usesDBRegistry() {
+		// Identities which enroll with ID tokens are created in the database
+		return errors.New("Enrollment with OIDC ID tokens can't be enabled when LDAP is enabled without the hybrid registry")
+	}
+	var err error
+	ca.oidcVerifier, err = oidc.NewVerifier(oidcCfg)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to initialize OIDC verifier")
+	}
+	log.Infof("Enrollment with OIDC ID tokens issued by '%s' is enabled", oidcCfg.Issuer)
+	return nil
+}
+
 // Initialize the user registry interface
 func (ca *CA) initUserRegistry() error {
 	log.Debug("Initializing identity registry")
-	var err error
 	ldapCfg := &ca.Config.LDAP
 
 	if ldapCfg.Enabled {
 		// Use LDAP for the user registry
-		ca.registry, err = ldap.NewClient(ldapCfg, ca.server.csp)
+		lc, err := ldap.NewClient(ldapCfg, ca.server.csp)
 		log.Debugf("Initialized LDAP identity registry; err=%s", err)
-		if err == nil {
-			log.Info("Successfully initialized LDAP client")
-		} else {
+		if err != nil {
 			log.Warningf("Failed to initialize LDAP client; err=%s", err)
+			return err
 		}
-		return err
+		log.Info("Successfully initialized LDAP client")
+		if !ldapCfg.Hybrid.Enabled {
+			ca.registry = lc
+			return nil
+		}
+		// Serve the identities of the DB together with those of LDAP
+		dbAccessor := new(Accessor)
+		dbAccessor.SetDB(ca.db)
+		hr, err := newHybridRegistry(dbAccessor, lc, &ldapCfg.Hybrid)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to initialize hybrid identity registry")
+		}
+		ca.registry = hr
+		log.Infof("Initialized hybrid DB and LDAP identity registry with %s lookup", hr.lookup)
+		return nil
 	}
 
 	// Use the DB for the user registry
@@ -750,6 +838,37 @@ func (ca *CA) initUserRegistry() error {
 	return nil
 }
 
+// usesDBRegistry returns true if identities are kept in the database,
+// which is the case unless LDAP is the only identity registry
+func (ca *CA) usesDBRegistry() bool {
+	return !ca.Config.LDAP.Enabled || ca.Config.LDAP.Hybrid.Enabled
+}
+
+// dbRegistry returns the database accessor of the identity registry, or
+// nil if identities are not kept in the database
+func (ca *CA) dbRegistry() *Accessor {
+	switch r := ca.registry.(type) {
+	case *Accessor:
+		return r
+	case *hybridRegistry:
+		return r.db
+	}
+	return nil
+}
+
+// ldapRegistry returns the LDAP client of the identity registry, or nil if
+// LDAP is not enabled
+func (ca *CA) ldapRegistry() *ldap.Client {
+	switch r := ca.registry.(type) {
+	case *ldap.Client:
+		return r
+	case *hybridRegistry:
+		lc, _ := r.ldap.(*ldap.Client)
+		return lc
+	}
+	return nil
+}
+
 // Initialize the enrollment signer
 func (ca *CA) initEnrollmentSigner() (err error) {
 	log.Debug("Initializing enrollment signer")
@@ -921,6 +1040,12 @@ func (ca *CA) makeFileNamesAbsolute() error {
 		&ca.Config.CA.Certfile,
 		&ca.Config.CA.Keyfile,
 		&ca.Config.CA.Chainfile,
+		&ca.Config.Idemix.IssuerPublicKeyfile,
+		&ca.Config.Idemix.IssuerSecretKeyfile,
+		&ca.Config.Idemix.RevocationPublicKeyfile,
+		&ca.Config.Idemix.RevocationPrivateKeyfile,
+		&ca.Config.Certificates.ArchiveFile,
+		&ca.Config.Authorization.PolicyFile,
 	}
 	err := util.MakeFileNamesAbsolute(fields, ca.HomeDir)
 	if err != nil {
@@ -934,6 +1059,14 @@ func (ca *CA) makeFileNamesAbsolute() error {
 	if err != nil {
 		return err
 	}
+	// The JWKS of the OIDC issuer is either a file or a URL
+	jwks := ca.Config.OIDC.JWKS
+	if !strings.HasPrefix(jwks, "https://") && !strings.HasPrefix(jwks, "http://") {
+		ca.Config.OIDC.JWKS, err = util.MakeFileAbs(jwks, ca.HomeDir)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -950,53 +1083,6 @@ func (ca *CA) normalizeStringSlices() {
 	}
 }
 
-// userHasAttribute returns nil error and the value of the attribute
-// if the user has the attribute, or an appropriate error if the user
-// does not have this attribute.
-func (ca *CA) userHasAttribute(username, attrname string) (string, error) {
-	val, err := ca.getUserAttrValue(username, attrname)
-	if err != nil {
-		return "", err
-	}
-	if val == "" {
-		return "", errors.Errorf("Identity '%s' does not have attribute '%s'", username, attrname)
-	}
-	return val, nil
-}
-
-// attributeIsTrue returns nil if the attribute has
-// one of the following values: "1", "t", "T", "true", "TRUE", "True";
-// otherwise it will return an error
-func (ca *CA) attributeIsTrue(username, attrname string) error {
-	val, err := ca.userHasAttribute(username, attrname)
-	if err != nil {
-		return err
-	}
-	val2, err := strconv.ParseBool(val)
-	if err != nil {
-		return errors.Wrapf(err, "Invalid value for attribute '%s' of identity '%s'", attrname, username)
-	}
-	if val2 {
-		return nil
-	}
-	return errors.Errorf("Attribute '%s' is not set to true for identity '%s'", attrname, username)
-}
-
-// getUserAttrValue returns a user's value for an attribute
-func (ca *CA) getUserAttrValue(username, attrname string) (string, error) {
-	log.Debugf("getUserAttrValue identity=%s, attr=%s", username, attrname)
-	user, err := ca.registry.GetUser(username, []string{attrname})
-	if err != nil {
-		return "", err
-	}
-	attrval, err := user.GetAttribute(attrname)
-	if err != nil {
-		return "", errors.WithMessage(err, fmt.Sprintf("Failed to get attribute '%s' for user '%s'", attrname, user.GetName()))
-	}
-	log.Debugf("getUserAttrValue identity=%s, name=%s, value=%s", username, attrname, attrval)
-	return attrval.Value, nil
-}
-
 // getUserAffiliation returns a user's affiliation
 func (ca *CA) getUserAffiliation(username string) (string, error) {
 	log.Debugf("getUserAffilliation identity=%s", username)
@@ -1017,6 +1103,18 @@ func (ca *CA) fillCAInfo(info *serverInfoResponseNet) error {
 	}
 	info.CAName = ca.Config.CA.Name
 	info.CAChain = util.B64Encode(caChain)
+	if ca.idemixIssuer != nil {
+		ipk, err := ca.idemixIssuer.publicKeyBytes()
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal Idemix issuer public key")
+		}
+		rpk, err := ca.idemixIssuer.revocationPublicKeyBytes()
+		if err != nil {
+			return err
+		}
+		info.IssuerPublicKey = util.B64Encode(ipk)
+		info.IssuerRevocationPublicKey = util.B64Encode(rpk)
+	}
 	return nil
 }
 
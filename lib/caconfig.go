@@ -23,6 +23,7 @@ import (
 	"github.com/tjfoc/fabric-ca-gm/api"
 	"github.com/tjfoc/fabric-ca-gm/lib/dbutil"
 	"github.com/tjfoc/fabric-ca-gm/lib/ldap"
+	"github.com/tjfoc/fabric-ca-gm/lib/oidc"
 	"github.com/tjfoc/fabric-ca-gm/lib/tls"
 	"github.com/tjfoc/fabric-ca-gm/util"
 	"github.com/hyperledger/fabric/bccsp/factory"
@@ -88,21 +89,27 @@ csr:
 // "help" - the help message to display on the command line;
 // "skip" - to skip the field.
 type CAConfig struct {
-	Version      string `skip:"true"`
-	Cfg          cfgOptions
-	CA           CAInfo
-	Signing      *config.Signing
-	CSR          api.CSRInfo
-	Registry     CAConfigRegistry
-	Affiliations map[string]interface{}
-	LDAP         ldap.Config
-	DB           CAConfigDB
-	CSP          *factory.FactoryOpts `mapstructure:"bccsp"`
+	Version       string `skip:"true"`
+	Cfg           cfgOptions
+	CA            CAInfo
+	Signing       *config.Signing
+	CSR           api.CSRInfo
+	Registry      CAConfigRegistry
+	Affiliations  map[string]interface{}
+	LDAP          ldap.Config
+	OIDC          oidc.Config
+	Tokens        CAConfigTokens
+	Authorization CAConfigAuthorization
+	Approval      CAConfigApproval
+	DB            CAConfigDB
+	CSP           *factory.FactoryOpts `mapstructure:"bccsp"`
 	// Optional client config for an intermediate server which acts as a client
 	// of the root (or parent) server
 	Client       *ClientConfig
 	Intermediate IntermediateCA
 	CRL          CRLConfig
+	Idemix       IdemixConfig
+	Certificates CertificatesConfig
 }
 
 // cfgOptions is a CA configuration that allows for setting different options
@@ -147,8 +154,60 @@ func (c CAConfigDB) String() string {
 
 // CAConfigRegistry is the registry part of the server's config
 type CAConfigRegistry struct {
-	MaxEnrollments int `def:"-1" help:"Maximum number of enrollments; valid if LDAP not enabled"`
-	Identities     []CAConfigIdentity
+	MaxEnrollments        int  `def:"-1" help:"Maximum number of enrollments; valid if LDAP not enabled"`
+	MaxActiveCertificates int  `def:"-1" help:"Maximum number of unexpired and unrevoked certificates of an identity"`
+	RevokeSuperseded      bool `help:"Revoke the oldest certificates of an identity upon reenroll if it would exceed its maximum number of active certificates"`
+	Lockout               CAConfigLockout
+	Policies              []CAConfigPolicy
+	Identities            []CAConfigIdentity
+}
+
+// CAConfigLockout controls the locking out of identities after repeated
+// failed enrollment logins
+type CAConfigLockout struct {
+	// The number of consecutive failed logins after which an identity is
+	// locked out; if zero, identities are never locked out
+	MaxFailedAttempts int `help:"Number of consecutive failed logins after which an identity is locked out; if not set, identities are not locked out"`
+	// The period of time for which an identity stays locked out; if zero,
+	// it stays locked out until a registrar unlocks it
+	Duration time.Duration `def:"30m" help:"Period of time for which an identity stays locked out; if 0, until it is unlocked by a registrar"`
+}
+
+// CAConfigTokens controls the verification of the tokens in the
+// authorization header of requests
+type CAConfigTokens struct {
+	// The maximum difference between the time at which a token was created
+	// and the time of the server
+	ClockSkew time.Duration `def:"5m" help:"Maximum difference between the time at which an authorization token was created and the server's time"`
+	// Whether to accept tokens created by older clients, which do not cover
+	// the method and URI of the request, a timestamp and a nonce
+	AllowLegacy bool `help:"Accept authorization tokens of older clients, which can be replayed"`
+}
+
+// CAConfigAuthorization controls which callers are authorized to perform
+// which actions
+type CAConfigAuthorization struct {
+	// The file containing the authorization policy; if not set, actions are
+	// authorized by the built-in 'hf.*' attributes of the callers
+	PolicyFile string `help:"File containing the authorization policy; if not set, callers are authorized by their hf.* attributes"`
+}
+
+// CAConfigApproval lists the operations which must be confirmed by a second
+// identity before they are performed
+type CAConfigApproval struct {
+	// The operations which require approval: 'revoke' (of registrars and
+	// intermediate CAs), 'removeidentity' and 'removeaffiliation' (with force)
+	Operations []string `help:"Operations which must be confirmed by a second identity: revoke, removeidentity and/or removeaffiliation"`
+	// How long a pending operation may be confirmed after it was requested
+	Window time.Duration `def:"24h" help:"How long a pending operation may be confirmed after it was requested"`
+}
+
+// CAConfigPolicy is a registration policy in the server's config.
+// Expr is a boolean expression over the registrar and the identity being
+// registered or modified, which must be true for the request to be allowed.
+type CAConfigPolicy struct {
+	Name string
+	Expr string
 }
 
 // CAConfigIdentity is identity information in the server's config
@@ -184,6 +243,28 @@ type CRLConfig struct {
 	Expiry time.Duration `def:"24h" help:"Expiration for the CRL generated by the gencrl request"`
 }
 
+// IdemixConfig contains configuration options of the Idemix issuer of a CA
+type IdemixConfig struct {
+	IssuerPublicKeyfile      string        `help:"Idemix issuer public key file"`
+	IssuerSecretKeyfile      string        `help:"Idemix issuer secret key file"`
+	RevocationPublicKeyfile  string        `help:"PEM-encoded public key file of the Idemix revocation authority"`
+	RevocationPrivateKeyfile string        `help:"PEM-encoded private key file of the Idemix revocation authority"`
+	NonceExpiration          time.Duration `def:"15s" help:"Duration after which a nonce issued for an Idemix credential request expires"`
+}
+
+// CertificatesConfig contains configuration options for the purge of
+// expired certificates from the certificates table
+type CertificatesConfig struct {
+	// Certificates which expired longer ago than this period are purged
+	Retention time.Duration `def:"8760h" help:"Period of time after their expiration for which certificates are kept in the certificates table"`
+	// The interval at which the server purges expired certificates; if zero,
+	// certificates are only purged by the 'certificates purge' command
+	PurgeInterval time.Duration `help:"Interval at which the server purges expired certificates; if not set, the server does not purge certificates"`
+	// If set, purged certificates are appended to this gzip-compressed file
+	// instead of being kept in the certificates_archive table
+	ArchiveFile string `help:"Gzip-compressed file to which purged certificates are appended"`
+}
+
 func (cc CAConfigIdentity) String() string {
 	return util.StructToString(&cc)
 }
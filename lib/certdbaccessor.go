@@ -17,7 +17,9 @@ limitations under the License.
 package lib
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"math/big"
 	"strings"
 	"time"
@@ -54,6 +56,27 @@ WHERE (id = :id AND status != 'revoked');`
 	deleteCertificatebyID = `
 DELETE FROM certificates
 		WHERE (ID = ?);`
+
+	selectExpiredSQL = `
+SELECT %s FROM certificates
+WHERE (expiry < ?);`
+
+	insertArchiveSQL = `
+INSERT INTO certificates_archive (id, serial_number, authority_key_identifier, ca_label, status, reason, expiry, revoked_at, pem, purged_at, level)
+	VALUES (:id, :serial_number, :authority_key_identifier, :ca_label, :status, :reason, :expiry, :revoked_at, :pem, :purged_at, :level);`
+
+	deleteCertificateSQL = `
+DELETE FROM certificates
+WHERE (serial_number = ? AND authority_key_identifier = ?);`
+
+	selectActiveSQLbyID = `
+SELECT %s FROM certificates
+WHERE (id = ? AND status != 'revoked' AND expiry > ?)
+ORDER BY expiry;`
+
+	selectArchivedSQL = `
+SELECT count(*) FROM certificates_archive
+WHERE (serial_number = ? AND authority_key_identifier = ?);`
 )
 
 // CertRecord extends CFSSL CertificateRecord by adding an enrollment ID to the record
@@ -63,6 +86,13 @@ type CertRecord struct {
 	certdb.CertificateRecord
 }
 
+// ArchivedCertRecord is a certificate record which was purged from the
+// certificates table and moved to the certificates_archive table
+type ArchivedCertRecord struct {
+	CertRecord
+	PurgedAt time.Time `db:"purged_at"`
+}
+
 // CertDBAccessor implements certdb.Accessor interface.
 type CertDBAccessor struct {
 	level    int
@@ -160,6 +190,23 @@ func (d *CertDBAccessor) GetCertificatesByID(id string) (crs []CertRecord, err e
 	return crs, nil
 }
 
+// GetActiveCertificatesByID gets the unexpired and unrevoked certificates of
+// an identity, ordered by expiration
+func (d *CertDBAccessor) GetActiveCertificatesByID(id string) (crs []CertRecord, err error) {
+	log.Debugf("DB: Get active certificates by ID (%s)", id)
+	err = d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.db.Select(&crs, fmt.Sprintf(d.db.Rebind(selectActiveSQLbyID), sqlstruct.Columns(CertRecord{})), id, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	return crs, nil
+}
+
 // GetCertificate gets a CertificateRecord indexed by serial.
 func (d *CertDBAccessor) GetCertificate(serial, aki string) (crs []certdb.CertificateRecord, err error) {
 	log.Debugf("DB: Get certificate by serial (%s) and aki (%s)", serial, aki)
@@ -304,3 +351,82 @@ func (d *CertDBAccessor) UpdateOCSP(serial, aki, body string, expiry time.Time)
 func (d *CertDBAccessor) UpsertOCSP(serial, aki, body string, expiry time.Time) error {
 	return d.accessor.UpsertOCSP(serial, aki, body, expiry)
 }
+
+// PurgeExpiredCertificates removes the certificates which expired before
+// 'expiredBefore' from the certificates table and returns the number of
+// certificates purged. The serial number and AKI of each purged certificate
+// are kept in the certificates_archive table so that the certificate can
+// still be recognized. If 'archive' is not nil, the purged records are
+// written to it as JSON, one per line, and their PEM is not kept in the table.
+func (d *CertDBAccessor) PurgeExpiredCertificates(expiredBefore time.Time, archive io.Writer) (int, error) {
+	log.Debugf("DB: Purge certificates that expired before %s", expiredBefore)
+
+	err := d.checkDB()
+	if err != nil {
+		return 0, err
+	}
+
+	var crs []CertRecord
+	err = d.db.Select(&crs, fmt.Sprintf(d.db.Rebind(selectExpiredSQL), sqlstruct.Columns(CertRecord{})), expiredBefore.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get expired certificates")
+	}
+	if len(crs) == 0 {
+		return 0, nil
+	}
+
+	// Write the records to the archive before removing them from the database,
+	// so that a failure never loses a certificate
+	if archive != nil {
+		enc := json.NewEncoder(archive)
+		for _, cr := range crs {
+			err = enc.Encode(&cr)
+			if err != nil {
+				return 0, errors.Wrap(err, "Failed to write certificate to archive")
+			}
+		}
+	}
+
+	purgedAt := time.Now().UTC()
+	tx := d.db.MustBegin()
+	for _, cr := range crs {
+		record := &ArchivedCertRecord{CertRecord: cr, PurgedAt: purgedAt}
+		if archive != nil {
+			record.PEM = ""
+		}
+		_, err = tx.NamedExec(insertArchiveSQL, record)
+		if err == nil {
+			_, err = tx.Exec(tx.Rebind(deleteCertificateSQL), cr.Serial, cr.AKI)
+		}
+		if err != nil {
+			err2 := tx.Rollback()
+			if err2 != nil {
+				log.Errorf("Error encountered while rolling back transaction: %s", err2)
+			}
+			return 0, errors.Wrapf(err, "Failed to purge certificate with serial %s and AKI %s", cr.Serial, cr.AKI)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, errors.Wrap(err, "Error encountered while committing transaction")
+	}
+
+	return len(crs), nil
+}
+
+// IsCertificatePurged returns true if the certificate with the given serial
+// and AKI was purged from the certificates table
+func (d *CertDBAccessor) IsCertificatePurged(serial, aki string) (bool, error) {
+	err := d.checkDB()
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	err = d.db.Get(&count, d.db.Rebind(selectArchivedSQL), serial, aki)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to search archived certificates")
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Default period of time for which expired certificates are kept
+	defaultCertRetention = 365 * 24 * time.Hour
+)
+
+// PurgeExpiredCertificates removes the certificates which expired longer ago
+// than the configured retention period from the certificates table of the
+// CA's database, and returns the number of certificates purged
+func (ca *CA) PurgeExpiredCertificates() (int, error) {
+	cfg := &ca.Config.Certificates
+	expiredBefore := time.Now().UTC().Add(-cfg.Retention)
+	if cfg.ArchiveFile == "" {
+		return ca.certDBAccessor.PurgeExpiredCertificates(expiredBefore, nil)
+	}
+
+	err := os.MkdirAll(filepath.Dir(cfg.ArchiveFile), 0755)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to create directory for certificate archive file '%s'", cfg.ArchiveFile)
+	}
+	file, err := os.OpenFile(cfg.ArchiveFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to open certificate archive file '%s'", cfg.ArchiveFile)
+	}
+	defer file.Close()
+	// Each purge appends a new gzip member to the archive file; a gzip reader
+	// reads the concatenated members as a single stream
+	zw := gzip.NewWriter(file)
+	count, err := ca.certDBAccessor.PurgeExpiredCertificates(expiredBefore, zw)
+	err2 := zw.Close()
+	if err != nil {
+		return 0, err
+	}
+	if err2 != nil {
+		return count, errors.Wrapf(err2, "Failed to write certificate archive file '%s'", cfg.ArchiveFile)
+	}
+	return count, nil
+}
+
+// Purge expired certificates every 'interval' until the 'stop' channel is closed
+func (ca *CA) purgeExpiredCertificatesPeriodically(interval time.Duration, stop chan struct{}) {
+	log.Debugf("Purging expired certificates of CA '%s' every %s", ca.Config.CA.Name, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			count, err := ca.PurgeExpiredCertificates()
+			if err != nil {
+				log.Errorf("Failed to purge expired certificates of CA '%s': %s", ca.Config.CA.Name, err)
+				continue
+			}
+			log.Infof("Purged %d expired certificate(s) of CA '%s'", count, ca.Config.CA.Name)
+		}
+	}
+}
+
+// PurgeExpiredCertificates purges the expired certificates of all of the CAs
+// hosted by the server
+func (s *Server) PurgeExpiredCertificates() (err error) {
+	err = s.init(false)
+	defer func() {
+		err2 := s.closeDB()
+		if err2 != nil {
+			log.Errorf("Close DB failed: %s", err2)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	for name, ca := range s.caMap {
+		count, err := ca.PurgeExpiredCertificates()
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("Failed to purge expired certificates of CA '%s'", name))
+		}
+		log.Infof("Purged %d expired certificate(s) of CA '%s'", count, name)
+	}
+	return nil
+}
+
+// Start the tasks which periodically purge the expired certificates of the
+// CAs which have a purge interval configured
+func (s *Server) startCertPurgeTasks() {
+	s.purgeStop = make(chan struct{})
+	for _, ca := range s.caMap {
+		interval := ca.Config.Certificates.PurgeInterval
+		if interval > 0 {
+			go ca.purgeExpiredCertificatesPeriodically(interval, s.purgeStop)
+		}
+	}
+}
+
+// Stop the tasks which periodically purge expired certificates
+func (s *Server) stopCertPurgeTasks() {
+	if s.purgeStop != nil {
+		close(s.purgeStop)
+		s.purgeStop = nil
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/dbutil"
+)
+
+func TestPurgeExpiredCertificates(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	for i := 0; i < 2; i++ {
+		_, err = client.Enroll(&api.EnrollmentRequest{
+			Name:   "admin",
+			Secret: "adminpw",
+		})
+		if err != nil {
+			t.Fatalf("Enrollment failed: %s", err)
+		}
+	}
+
+	// Make one of the certificates expire two years ago
+	db, err := dbutil.NewUserRegistrySQLLite3(filepath.Join(rootDir, "fabric-ca-server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	defer db.Close()
+	var serials []string
+	err = db.Select(&serials, "SELECT serial_number FROM certificates")
+	if err != nil || len(serials) != 2 {
+		t.Fatalf("Failed to get the serial numbers of the certificates: %v", err)
+	}
+	_, err = db.Exec(db.Rebind("UPDATE certificates SET expiry = ? WHERE serial_number = ?"),
+		time.Now().UTC().Add(-2*8760*time.Hour), serials[0])
+	if err != nil {
+		t.Fatalf("Failed to update certificate expiry: %s", err)
+	}
+
+	count, err := srv.CA.PurgeExpiredCertificates()
+	assert.NoError(t, err, "Failed to purge expired certificates")
+	assert.Equal(t, 1, count, "Exactly one certificate should have been purged")
+	count, err = srv.CA.PurgeExpiredCertificates()
+	assert.NoError(t, err, "Failed to purge expired certificates")
+	assert.Equal(t, 0, count, "No certificate should have been purged")
+
+	var aki string
+	err = db.Get(&aki, "SELECT authority_key_identifier FROM certificates_archive")
+	if err != nil {
+		t.Fatalf("Purged certificate was not archived: %s", err)
+	}
+	purged, err := srv.CA.CertDBAccessor().IsCertificatePurged(serials[0], aki)
+	assert.NoError(t, err)
+	assert.True(t, purged, "Certificate %s should have been purged", serials[0])
+	purged, err = srv.CA.CertDBAccessor().IsCertificatePurged(serials[1], aki)
+	assert.NoError(t, err)
+	assert.False(t, purged, "Certificate %s should not have been purged", serials[1])
+}
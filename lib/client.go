@@ -138,6 +138,10 @@ type GetServerInfoResponse struct {
 	CAChain []byte
 	// Version of the server
 	Version string
+	// IssuerPublicKey is the serialized Idemix issuer public key of the CA
+	IssuerPublicKey []byte
+	// IssuerRevocationPublicKey is the PEM-encoded Idemix revocation public key of the CA
+	IssuerRevocationPublicKey []byte
 }
 
 // GetCAInfo returns generic CA information
@@ -173,16 +177,29 @@ func (c *Client) net2LocalServerInfo(net *serverInfoResponseNet, local *GetServe
 	if err != nil {
 		return err
 	}
+	ipk, err := util.B64Decode(net.IssuerPublicKey)
+	if err != nil {
+		return err
+	}
+	rpk, err := util.B64Decode(net.IssuerRevocationPublicKey)
+	if err != nil {
+		return err
+	}
 	local.CAName = net.CAName
 	local.CAChain = caChain
 	local.Version = net.Version
+	local.IssuerPublicKey = ipk
+	local.IssuerRevocationPublicKey = rpk
 	return nil
 }
 
 // EnrollmentResponse is the response from Client.Enroll and Identity.Reenroll
 type EnrollmentResponse struct {
-	Identity   *Identity
-	ServerInfo GetServerInfoResponse
+	Identity *Identity
+	// IdemixCredential is set instead of Identity in response to a request
+	// for an Idemix credential
+	IdemixCredential *IdemixCredential
+	ServerInfo       GetServerInfoResponse
 }
 
 // Enroll enrolls a new identity
@@ -195,6 +212,10 @@ func (c *Client) Enroll(req *api.EnrollmentRequest) (*EnrollmentResponse, error)
 		return nil, err
 	}
 
+	if isIdemixEnrollment(req) {
+		return c.handleIdemixEnroll(req)
+	}
+
 	// Generate the CSR
 	csrPEM, key, err := c.GenCSR(req.CSR, req.Name)
 	if err != nil {
@@ -218,12 +239,17 @@ func (c *Client) Enroll(req *api.EnrollmentRequest) (*EnrollmentResponse, error)
 		return nil, err
 	}
 
-	// Send the CSR to the fabric-ca server with basic auth header
+	// Send the CSR to the fabric-ca server with basic auth header, or with
+	// the ID token as a bearer token
 	post, err := c.newPost("enroll", body)
 	if err != nil {
 		return nil, err
 	}
-	post.SetBasicAuth(req.Name, req.Secret)
+	if req.IDToken != "" {
+		post.Header.Set("Authorization", "Bearer "+req.IDToken)
+	} else {
+		post.SetBasicAuth(req.Name, req.Secret)
+	}
 	var result enrollmentResponseNet
 	err = c.SendReq(post, &result)
 	if err != nil {
@@ -517,6 +543,21 @@ func (c *Client) SendReq(req *http.Request, result interface{}) (err error) {
 
 // StreamResponse reads the response as it comes back from the server
 func (c *Client) StreamResponse(req *http.Request, stream string, cb func(*json.Decoder) error) (err error) {
+	return c.streamResponse(req, func(dec *json.Decoder) error {
+		return streamer.StreamJSONArray(dec, stream, cb)
+	})
+}
+
+// StreamResponseWithValue reads the response as it comes back from the server,
+// and also passes the value of the json element 'valuePath' to 'valueCB'
+func (c *Client) StreamResponseWithValue(req *http.Request, stream string, cb func(*json.Decoder) error,
+	valuePath string, valueCB func(interface{}) error) error {
+	return c.streamResponse(req, func(dec *json.Decoder) error {
+		return streamer.StreamJSONArrayWithValue(dec, stream, cb, valuePath, valueCB)
+	})
+}
+
+func (c *Client) streamResponse(req *http.Request, stream func(*json.Decoder) error) (err error) {
 
 	reqStr := util.HTTPRequestToString(req)
 	log.Debugf("Sending request\n%s", reqStr)
@@ -533,7 +574,7 @@ func (c *Client) StreamResponse(req *http.Request, stream string, cb func(*json.
 	defer resp.Body.Close()
 
 	dec := json.NewDecoder(resp.Body)
-	err = streamer.StreamJSONArray(dec, stream, cb)
+	err = stream(dec)
 	if err != nil {
 		return err
 	}
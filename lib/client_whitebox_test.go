@@ -355,13 +355,6 @@ func getServer(port int, home, parentURL string, maxEnroll int, t *testing.T) *S
 	return srv
 }
 
-func getTestClient(port int) *Client {
-	return &Client{
-		Config:  &ClientConfig{URL: fmt.Sprintf("http://localhost:%d", port)},
-		HomeDir: testdataDir,
-	}
-}
-
 // Enroll enrolls a new identity
 // @param req The enrollment request
 func masqueradeEnroll(c *Client, id string, passInSubject bool, req *api.EnrollmentRequest) (*EnrollmentResponse, error) {
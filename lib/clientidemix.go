@@ -0,0 +1,249 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/idemix"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/milagro-crypto/amcl/version3/go/amcl/FP256BN"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+const (
+	// IdemixEnrollmentType is the enrollment type of a request for an Idemix credential
+	IdemixEnrollmentType = "idemix"
+	// Layout of an Idemix MSP directory, relative to the client's MSP directory
+	idemixConfigDirMsp              = "msp"
+	idemixConfigDirUser             = "user"
+	idemixConfigFileIssuerPublicKey = "IssuerPublicKey"
+	idemixConfigFileRevocationKey   = "RevocationPublicKey"
+	idemixConfigFileSigner          = "SignerConfig"
+)
+
+// IdemixCredential is an Idemix credential issued to a client by a CA
+type IdemixCredential struct {
+	client *Client
+	// signerConfig is stored in the 'user/SignerConfig' file of an Idemix MSP
+	// directory in the protobuf format read by the Idemix MSP of Fabric
+	signerConfig        *msp.IdemixMSPSignerConfig
+	enrollmentID        string
+	revocationHandle    string
+	cri                 []byte
+	issuerPublicKey     []byte
+	revocationPublicKey []byte
+}
+
+// GetName returns the enrollment ID of the owner of the credential
+func (cred *IdemixCredential) GetName() string {
+	return cred.enrollmentID
+}
+
+// GetSignerConfig returns the signer configuration of the credential
+func (cred *IdemixCredential) GetSignerConfig() *msp.IdemixMSPSignerConfig {
+	return cred.signerConfig
+}
+
+// GetRevocationHandle returns the value of the RevocationHandle attribute of
+// the credential, by which the credential can be revoked
+func (cred *IdemixCredential) GetRevocationHandle() string {
+	return cred.revocationHandle
+}
+
+// GetCRI returns the JSON-encoded credential revocation information which
+// the CA returned with the credential
+func (cred *IdemixCredential) GetCRI() []byte {
+	return cred.cri
+}
+
+// Store writes the credential, together with the issuer public key and the
+// revocation public key of the CA, to the Idemix MSP layout in the client's
+// MSP directory
+func (cred *IdemixCredential) Store() error {
+	if cred.client == nil {
+		return errors.New("A credential with no client may not be stored")
+	}
+	mspDir := cred.client.Config.MSPDir
+	buf, err := proto.Marshal(cred.signerConfig)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal Idemix signer configuration")
+	}
+	err = storeIdemixFile("Idemix credential", path.Join(mspDir, idemixConfigDirUser, idemixConfigFileSigner), buf, 0600)
+	if err != nil {
+		return err
+	}
+	err = storeIdemixFile("Idemix issuer public key", path.Join(mspDir, idemixConfigDirMsp, idemixConfigFileIssuerPublicKey), cred.issuerPublicKey, 0644)
+	if err != nil {
+		return err
+	}
+	return storeIdemixFile("Idemix revocation public key", path.Join(mspDir, idemixConfigDirMsp, idemixConfigFileRevocationKey), cred.revocationPublicKey, 0644)
+}
+
+func storeIdemixFile(what, file string, buf []byte, perm os.FileMode) error {
+	err := writeFile(file, buf, perm)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store %s at '%s'", what, file)
+	}
+	log.Infof("Stored %s at %s", what, file)
+	return nil
+}
+
+// Check to see if this is a request for an Idemix credential
+func isIdemixEnrollment(req *api.EnrollmentRequest) bool {
+	return strings.ToLower(req.Type) == IdemixEnrollmentType
+}
+
+// Obtain an Idemix credential from the CA. If the request contains an enrollment
+// ID, the requests to the CA are authenticated with the enrollment ID and secret;
+// otherwise, they are authenticated with a token based on the client's enrollment
+// certificate.
+func (c *Client) handleIdemixEnroll(req *api.EnrollmentRequest) (*EnrollmentResponse, error) {
+	log.Debugf("Requesting Idemix credential for CA '%s'", req.CAName)
+
+	var id *Identity
+	var err error
+	if req.Name == "" {
+		id, err = c.LoadMyIdentity()
+		if err != nil {
+			return nil, errors.WithMessage(err,
+				"An enrollment ID and secret or an existing enrollment certificate is required to get an Idemix credential")
+		}
+	}
+
+	// Get the Idemix issuer public key of the CA
+	si, err := c.GetCAInfo(&api.GetCAInfoRequest{CAName: req.CAName})
+	if err != nil {
+		return nil, err
+	}
+	if len(si.IssuerPublicKey) == 0 {
+		return nil, errors.Errorf("CA '%s' does not support Idemix credentials", si.CAName)
+	}
+	ipk := new(idemix.IssuerPublicKey)
+	err = proto.Unmarshal(si.IssuerPublicKey, ipk)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal Idemix issuer public key")
+	}
+
+	// Get a nonce from the CA
+	body, err := util.Marshal(&api.IdemixNonceRequestNet{CAName: req.CAName}, "IdemixNonceRequest")
+	if err != nil {
+		return nil, err
+	}
+	var nonceResp idemixNonceResponseNet
+	err = c.sendIdemixReq("idemix/nonce", body, req, id, &nonceResp)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := util.B64Decode(nonceResp.Nonce)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid nonce in response from server")
+	}
+
+	// Create the credential request and send it to the CA
+	rng, err := idemix.GetRand()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to initialize random number generator")
+	}
+	sk := idemix.RandModOrder(rng)
+	credS1 := idemix.RandModOrder(rng)
+	credReq := idemix.NewCredRequest(sk, credS1, FP256BN.FromBytes(nonce), ipk, rng)
+	body, err = util.Marshal(&api.IdemixEnrollmentRequestNet{CredRequest: credReq, CAName: req.CAName}, "IdemixEnrollmentRequest")
+	if err != nil {
+		return nil, err
+	}
+	var result idemixEnrollmentResponseNet
+	err = c.sendIdemixReq("idemix/credential", body, req, id, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	// Complete and verify the credential
+	credBytes, err := util.B64Decode(result.Credential)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid response format from server")
+	}
+	cred := new(idemix.Credential)
+	err = proto.Unmarshal(credBytes, cred)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal Idemix credential")
+	}
+	cred.Complete(credS1)
+	err = cred.Ver(sk, ipk)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Idemix credential returned by the server is invalid")
+	}
+	credBytes, err = proto.Marshal(cred)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal Idemix credential")
+	}
+	cri, err := util.B64Decode(result.CRI)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid CRI in response from server")
+	}
+
+	signerConfig := &msp.IdemixMSPSignerConfig{
+		Cred:                         credBytes,
+		Sk:                           idemix.BigToBytes(sk),
+		OrganizationalUnitIdentifier: fmt.Sprint(result.Attrs[idemixAttrOU]),
+	}
+	if role, ok := result.Attrs[idemixAttrRole].(float64); ok {
+		signerConfig.IsAdmin = int(role) == idemixRoleAdmin
+	}
+
+	resp := &EnrollmentResponse{
+		IdemixCredential: &IdemixCredential{
+			client:              c,
+			signerConfig:        signerConfig,
+			enrollmentID:        fmt.Sprint(result.Attrs[idemixAttrEnrollmentID]),
+			revocationHandle:    fmt.Sprint(result.Attrs[idemixAttrRevocationHandle]),
+			cri:                 cri,
+			issuerPublicKey:     si.IssuerPublicKey,
+			revocationPublicKey: si.IssuerRevocationPublicKey,
+		},
+	}
+	err = c.net2LocalServerInfo(&result.ServerInfo, &resp.ServerInfo)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Send a request to an Idemix endpoint, authenticated with the enrollment
+// ID and secret of the request or with a token of identity 'id'
+func (c *Client) sendIdemixReq(endpoint string, body []byte, req *api.EnrollmentRequest, id *Identity, result interface{}) error {
+	post, err := c.newPost(endpoint, body)
+	if err != nil {
+		return err
+	}
+	if id != nil {
+		err = id.addTokenAuthHdr(post, body)
+		if err != nil {
+			return err
+		}
+	} else {
+		post.SetBasicAuth(req.Name, req.Secret)
+	}
+	return c.SendReq(post, result)
+}
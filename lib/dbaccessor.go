@@ -18,7 +18,9 @@ package lib
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/tjfoc/fabric-ca-gm/lib/attr"
 
@@ -39,10 +41,13 @@ func init() {
 	sqlstruct.TagName = "db"
 }
 
+// errSecretExpired is the cause of a login failure due to an expired secret
+var errSecretExpired = errors.New("Secret has expired")
+
 const (
 	insertUser = `
-INSERT INTO users (id, token, type, affiliation, attributes, state, max_enrollments, level)
-	VALUES (:id, :token, :type, :affiliation, :attributes, :state, :max_enrollments, :level);`
+INSERT INTO users (id, token, type, affiliation, attributes, state, max_enrollments, level, secret_expiry, secret_one_time, suspended)
+	VALUES (:id, :token, :type, :affiliation, :attributes, :state, :max_enrollments, :level, :secret_expiry, :secret_one_time, :suspended);`
 
 	deleteUser = `
 DELETE FROM users
@@ -50,7 +55,7 @@ DELETE FROM users
 
 	updateUser = `
 UPDATE users
-	SET token = :token, type = :type, affiliation = :affiliation, attributes = :attributes, state = :state, max_enrollments = :max_enrollments, level = :level
+	SET token = :token, type = :type, affiliation = :affiliation, attributes = :attributes, state = :state, max_enrollments = :max_enrollments, level = :level, secret_expiry = :secret_expiry, secret_one_time = :secret_one_time, suspended = :suspended
 	WHERE (id = :id);`
 
 	getUser = `
@@ -76,14 +81,19 @@ SELECT * FROM affiliations
 
 // UserRecord defines the properties of a user
 type UserRecord struct {
-	Name           string `db:"id"`
-	Pass           []byte `db:"token"`
-	Type           string `db:"type"`
-	Affiliation    string `db:"affiliation"`
-	Attributes     string `db:"attributes"`
-	State          int    `db:"state"`
-	MaxEnrollments int    `db:"max_enrollments"`
-	Level          int    `db:"level"`
+	Name           string    `db:"id"`
+	Pass           []byte    `db:"token"`
+	Type           string    `db:"type"`
+	Affiliation    string    `db:"affiliation"`
+	Attributes     string    `db:"attributes"`
+	State          int       `db:"state"`
+	MaxEnrollments int       `db:"max_enrollments"`
+	Level          int       `db:"level"`
+	SecretExpiry   time.Time `db:"secret_expiry"`
+	SecretOneTime  bool      `db:"secret_one_time"`
+	FailedAttempts int       `db:"failed_attempts"`
+	LockedAt       time.Time `db:"locked_at"`
+	Suspended      bool      `db:"suspended"`
 }
 
 // AffiliationRecord defines the properties of an affiliation
@@ -130,29 +140,13 @@ func (d *Accessor) InsertUser(user *spi.UserInfo) error {
 		return err
 	}
 
-	attrBytes, err := json.Marshal(user.Attributes)
+	userRec, err := newUserRecord(user)
 	if err != nil {
 		return err
 	}
 
-	// Hash the password before storing it
-	pwd := []byte(user.Pass)
-	pwd, err = bcrypt.GenerateFromPassword(pwd, bcrypt.DefaultCost)
-	if err != nil {
-		return errors.Wrap(err, "Failed to hash password")
-	}
-
 	// Store the user record in the DB
-	res, err := d.db.NamedExec(insertUser, &UserRecord{
-		Name:           user.Name,
-		Pass:           pwd,
-		Type:           user.Type,
-		Affiliation:    user.Affiliation,
-		Attributes:     string(attrBytes),
-		State:          user.State,
-		MaxEnrollments: user.MaxEnrollments,
-		Level:          user.Level,
-	})
+	res, err := d.db.NamedExec(insertUser, userRec)
 
 	if err != nil {
 		return errors.Wrapf(err, "Error adding identity '%s' to the database", user.Name)
@@ -177,6 +171,65 @@ func (d *Accessor) InsertUser(user *spi.UserInfo) error {
 
 }
 
+// InsertUsers inserts a batch of users into the database in a single
+// transaction; either all or none of the users are inserted
+func (d *Accessor) InsertUsers(users []*spi.UserInfo) error {
+	log.Debugf("DB: Add %d identities", len(users))
+
+	_, err := d.doTransaction(d.insertUsersTx, users)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Successfully added %d identities to the database", len(users))
+	return nil
+}
+
+func (d *Accessor) insertUsersTx(tx *sqlx.Tx, args ...interface{}) (interface{}, error) {
+	users := args[0].([]*spi.UserInfo)
+
+	for _, user := range users {
+		userRec, err := newUserRecord(user)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.NamedExec(insertUser, userRec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error adding identity '%s' to the database", user.Name)
+		}
+	}
+
+	return nil, nil
+}
+
+// newUserRecord creates the DB record of a new user, hashing its password
+func newUserRecord(user *spi.UserInfo) (*UserRecord, error) {
+	attrBytes, err := json.Marshal(user.Attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash the password before storing it
+	pwd, err := bcrypt.GenerateFromPassword([]byte(user.Pass), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to hash password")
+	}
+
+	return &UserRecord{
+		Name:           user.Name,
+		Pass:           pwd,
+		Type:           user.Type,
+		Affiliation:    user.Affiliation,
+		Attributes:     string(attrBytes),
+		State:          user.State,
+		MaxEnrollments: user.MaxEnrollments,
+		Level:          user.Level,
+		SecretExpiry:   user.SecretExpiry.UTC(),
+		SecretOneTime:  user.SecretOneTime,
+		Suspended:      user.Suspended,
+	}, nil
+}
+
 // DeleteUser deletes user from database
 func (d *Accessor) DeleteUser(id string) (spi.User, error) {
 	log.Debugf("DB: Delete identity %s", id)
@@ -256,6 +309,9 @@ func (d *Accessor) UpdateUser(user *spi.UserInfo, updatePass bool) error {
 		State:          user.State,
 		MaxEnrollments: user.MaxEnrollments,
 		Level:          user.Level,
+		SecretExpiry:   user.SecretExpiry.UTC(),
+		SecretOneTime:  user.SecretOneTime,
+		Suspended:      user.Suspended,
 	})
 
 	if err != nil {
@@ -590,7 +646,7 @@ func (d *Accessor) GetUserLessThanLevel(level int) ([]spi.User, error) {
 }
 
 // GetAllAffiliations gets the requested affiliation and any sub affiliations from the database
-func (d *Accessor) GetAllAffiliations(name string) (*sqlx.Rows, error) {
+func (d *Accessor) GetAllAffiliations(name string) (spi.Rows, error) {
 	log.Debugf("DB: Get affiliation %s", name)
 	err := d.checkDB()
 	if err != nil {
@@ -613,9 +669,10 @@ func (d *Accessor) GetAllAffiliations(name string) (*sqlx.Rows, error) {
 	return rows, nil
 }
 
-// GetFilteredUsers returns all identities that fall under the affiliation and types
-func (d *Accessor) GetFilteredUsers(affiliation, types string) (*sqlx.Rows, error) {
-	log.Debugf("DB: Get all identities per affiliation '%s' and types '%s'", affiliation, types)
+// GetFilteredUsers returns all identities that fall under the affiliation and types,
+// and which match the filter, if it is not nil, ordered by name
+func (d *Accessor) GetFilteredUsers(affiliation, types string, filter *spi.UserFilter) (spi.Rows, error) {
+	log.Debugf("DB: Get all identities per affiliation '%s', types '%s' and filter %+v", affiliation, types, filter)
 	err := d.checkDB()
 	if err != nil {
 		return nil, err
@@ -626,32 +683,71 @@ func (d *Accessor) GetFilteredUsers(affiliation, types string) (*sqlx.Rows, erro
 		typesArray[i] = strings.TrimSpace(typesArray[i])
 	}
 
-	if affiliation == "" {
-		query := "SELECT * FROM users WHERE (type IN (?))"
-		query, args, err := sqlx.In(query, typesArray)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to construct query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
+	conds := []string{"(type IN (?))"}
+	args := []interface{}{typesArray}
+	if affiliation != "" {
+		conds = append(conds, "((affiliation = ?) OR (affiliation LIKE ?))")
+		args = append(args, affiliation, affiliation+".%")
+	}
+	limit := ""
+	if filter != nil {
+		for _, a := range filter.Attributes {
+			pattern, err := getAttributeLikePattern(a)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, "(attributes LIKE ? ESCAPE '!')")
+			args = append(args, pattern)
 		}
-		rows, err := d.db.Queryx(d.db.Rebind(query), args...)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
+		if filter.State != nil {
+			conds = append(conds, "(state = ?)")
+			args = append(args, *filter.State)
+		}
+		if filter.MaxEnrollments != nil {
+			conds = append(conds, "(max_enrollments = ?)")
+			args = append(args, *filter.MaxEnrollments)
+		}
+		if filter.After != "" {
+			conds = append(conds, "(id > ?)")
+			args = append(args, filter.After)
+		}
+		if filter.Limit > 0 {
+			limit = fmt.Sprintf(" LIMIT %d", filter.Limit)
 		}
-		return rows, nil
 	}
 
-	subAffiliation := affiliation + ".%"
-	query := "SELECT * FROM users WHERE ((affiliation = ?) OR (affiliation LIKE ?)) AND (type IN (?))"
-	inQuery, args, err := sqlx.In(query, affiliation, subAffiliation, typesArray)
+	query := "SELECT * FROM users WHERE " + strings.Join(conds, " AND ") + " ORDER BY id" + limit
+	inQuery, inArgs, err := sqlx.In(query, args...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to construct query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 	}
-	rows, err := d.db.Queryx(d.db.Rebind(inQuery), args...)
+	rows, err := d.db.Queryx(d.db.Rebind(inQuery), inArgs...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to execute query '%s' for affiliation '%s' and types '%s'", query, affiliation, types)
 	}
 
 	return rows, nil
+}
 
+// getAttributeLikePattern returns the pattern with which a SQL LIKE clause,
+// using '!' as the escape character, matches the JSON encoding of the
+// attributes of an identity that has the attribute. An attribute with an
+// empty value matches any value.
+func getAttributeLikePattern(a api.Attribute) (string, error) {
+	name, err := json.Marshal(a.Name)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to marshal attribute name '%s'", a.Name)
+	}
+	pattern := fmt.Sprintf(`{"name":%s,`, name)
+	if a.Value != "" {
+		value, err := json.Marshal(a.Value)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to marshal value of attribute '%s'", a.Name)
+		}
+		pattern += fmt.Sprintf(`"value":%s`, value)
+	}
+	escaper := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return "%" + escaper.Replace(pattern) + "%", nil
 }
 
 // ModifyAffiliation renames the affiliation and updates all identities to use the new affiliation depending on
@@ -891,6 +987,11 @@ func (d *Accessor) newDBUser(userRec *UserRecord) *DBUser {
 	user.Affiliation = userRec.Affiliation
 	user.Type = userRec.Type
 	user.Level = userRec.Level
+	user.SecretExpiry = userRec.SecretExpiry
+	user.SecretOneTime = userRec.SecretOneTime
+	user.failedAttempts = userRec.FailedAttempts
+	user.lockedAt = userRec.LockedAt
+	user.Suspended = userRec.Suspended
 
 	var attrs []api.Attribute
 	json.Unmarshal([]byte(userRec.Attributes), &attrs)
@@ -912,9 +1013,11 @@ func (d *Accessor) newDBUser(userRec *UserRecord) *DBUser {
 // DBUser is the databases representation of a user
 type DBUser struct {
 	spi.UserInfo
-	pass  []byte
-	attrs map[string]api.Attribute
-	db    *sqlx.DB
+	pass           []byte
+	attrs          map[string]api.Attribute
+	failedAttempts int
+	lockedAt       time.Time
+	db             *sqlx.DB
 }
 
 // GetName returns the enrollment ID of the user
@@ -978,6 +1081,19 @@ func (u *DBUser) Login(pass string, caMaxEnrollments int) error {
 		return errors.Errorf("User %s is revoked; access denied", u.Name)
 	}
 
+	if u.Suspended {
+		return errors.Errorf("User %s is suspended; access denied", u.Name)
+	}
+
+	// A one-time secret is expired as soon as it has been used, so this also
+	// rejects a one-time secret which was already used to enroll
+	if !u.SecretExpiry.IsZero() && !time.Now().Before(u.SecretExpiry) {
+		if u.SecretOneTime {
+			return errors.Wrapf(errSecretExpired, "The one-time secret of identity %s was already used", u.Name)
+		}
+		return errors.Wrapf(errSecretExpired, "The secret of identity %s expired at %s", u.Name, u.SecretExpiry.UTC().Format(time.RFC3339))
+	}
+
 	// If max enrollment value of user is greater than allowed by CA, using CA max enrollment value for user
 	if caMaxEnrollments != -1 && (u.MaxEnrollments > caMaxEnrollments || u.MaxEnrollments == -1) {
 		log.Debugf("Max enrollment value (%d) of identity is greater than allowed by CA, using CA max enrollment value of %d", u.MaxEnrollments, caMaxEnrollments)
@@ -997,23 +1113,33 @@ func (u *DBUser) Login(pass string, caMaxEnrollments int) error {
 
 }
 
-// LoginComplete completes the login process by incrementing the state of the user
+// LoginComplete completes the login process by incrementing the state of the user.
+// A one-time secret is expired by the same statement, which only matches while the
+// secret still has the expiry checked by Login, so concurrent logins with a one-time
+// secret can't both complete.
 func (u *DBUser) LoginComplete() error {
-	var stateUpdateSQL string
-	var args []interface{}
 	var err error
 
 	state := u.State + 1
-	args = append(args, u.Name)
-	if u.MaxEnrollments == -1 {
-		// unlimited so no state check
-		stateUpdateSQL = "UPDATE users SET state = state + 1 WHERE (id = ?)"
-	} else {
+	set := "state = state + 1"
+	where := "id = ?"
+	var setArgs, whereArgs []interface{}
+	whereArgs = append(whereArgs, u.Name)
+	if u.MaxEnrollments != -1 {
 		// state must be less than max enrollments
-		stateUpdateSQL = "UPDATE users SET state = state + 1 WHERE (id = ? AND state < ?)"
-		args = append(args, u.MaxEnrollments)
-	}
-	res, err := u.db.Exec(u.db.Rebind(stateUpdateSQL), args...)
+		where += " AND state < ?"
+		whereArgs = append(whereArgs, u.MaxEnrollments)
+	}
+	expiry := time.Now().UTC()
+	if u.SecretOneTime {
+		// The secret is being used, expire it so that it can't be used again
+		set += ", secret_expiry = ?"
+		setArgs = append(setArgs, expiry)
+		where += " AND secret_expiry = ?"
+		whereArgs = append(whereArgs, u.SecretExpiry.UTC())
+	}
+	stateUpdateSQL := fmt.Sprintf("UPDATE users SET %s WHERE (%s)", set, where)
+	res, err := u.db.Exec(u.db.Rebind(stateUpdateSQL), append(setArgs, whereArgs...)...)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to update state of identity %s to %d", u.Name, state)
 	}
@@ -1024,6 +1150,9 @@ func (u *DBUser) LoginComplete() error {
 	}
 
 	if numRowsAffected == 0 {
+		if u.SecretOneTime {
+			return errors.Wrapf(errSecretExpired, "The one-time secret of identity %s was already used", u.Name)
+		}
 		return errors.Errorf("No rows were affected when updating the state of identity %s", u.Name)
 	}
 
@@ -1032,10 +1161,71 @@ func (u *DBUser) LoginComplete() error {
 	}
 
 	log.Debugf("Successfully incremented state for identity %s to %d", u.Name, state)
+
+	if u.SecretOneTime {
+		u.SecretExpiry = expiry
+		log.Debugf("Expired the one-time secret of identity %s", u.Name)
+	}
 	return nil
 
 }
 
+// IsLockedOut returns true if the user is locked out due to failed logins.
+// If the lockout duration is zero, the user stays locked out until unlocked.
+func (u *DBUser) IsLockedOut(duration time.Duration) bool {
+	if u.lockedAt.IsZero() {
+		return false
+	}
+	return duration == 0 || time.Now().Before(u.lockedAt.Add(duration))
+}
+
+// LoginFailed records a failed login of the user and locks the user out if
+// this was the maxAttempts consecutive failed login. Returns true if the user
+// was locked out by this call.
+func (u *DBUser) LoginFailed(maxAttempts int) (bool, error) {
+	if !u.lockedAt.IsZero() {
+		// A previous lockout has expired, so start counting again
+		err := u.ResetFailedLogins()
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err := u.db.Exec(u.db.Rebind("UPDATE users SET failed_attempts = failed_attempts + 1 WHERE (id = ?)"), u.Name)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to update failed login attempts of identity %s", u.Name)
+	}
+	err = u.db.Get(&u.failedAttempts, u.db.Rebind("SELECT failed_attempts FROM users WHERE (id = ?)"), u.Name)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to get failed login attempts of identity %s", u.Name)
+	}
+	log.Debugf("Identity %s has %d consecutive failed login attempts", u.Name, u.failedAttempts)
+	if u.failedAttempts < maxAttempts {
+		return false, nil
+	}
+	lockedAt := time.Now().UTC()
+	_, err = u.db.Exec(u.db.Rebind("UPDATE users SET locked_at = ? WHERE (id = ?)"), lockedAt, u.Name)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to lock out identity %s", u.Name)
+	}
+	u.lockedAt = lockedAt
+	return true, nil
+}
+
+// ResetFailedLogins clears the failed login attempts of the user, which also
+// unlocks the user if it was locked out
+func (u *DBUser) ResetFailedLogins() error {
+	if u.failedAttempts == 0 && u.lockedAt.IsZero() {
+		return nil
+	}
+	_, err := u.db.Exec(u.db.Rebind("UPDATE users SET failed_attempts = 0, locked_at = ? WHERE (id = ?)"), time.Time{}, u.Name)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to reset failed login attempts of identity %s", u.Name)
+	}
+	u.failedAttempts = 0
+	u.lockedAt = time.Time{}
+	return nil
+}
+
 // GetAffiliationPath returns the complete path for the user's affiliation.
 func (u *DBUser) GetAffiliationPath() []string {
 	affiliationPath := strings.Split(u.Affiliation, ".")
@@ -0,0 +1,361 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/lib/dbutil"
+	"github.com/tjfoc/fabric-ca-gm/lib/metadata"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+// openDB opens the CA's database without changing its schema
+func (ca *CA) openDB() error {
+	db := &ca.Config.DB
+	var err error
+
+	if db.Type == "" || db.Type == defaultDatabaseType {
+
+		db.Type = defaultDatabaseType
+
+		if db.Datasource == "" {
+			db.Datasource = "fabric-ca-server.db"
+		}
+
+		db.Datasource, err = util.MakeFileAbs(db.Datasource, ca.HomeDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Strip out user:pass from datasource for logging
+	ds := db.Datasource
+	ds = dbutil.MaskDBCred(ds)
+
+	log.Debugf("Initializing '%s' database at '%s'", db.Type, ds)
+
+	switch db.Type {
+	case defaultDatabaseType:
+		ca.db, err = dbutil.OpenSQLLite3(db.Datasource)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to create user registry for SQLite")
+		}
+	case "postgres":
+		ca.db, err = dbutil.OpenPostgres(db.Datasource, &db.TLS)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to create user registry for PostgreSQL")
+		}
+	case "mysql":
+		if ca.csp == nil {
+			ca.csp, err = util.InitBCCSP(&ca.Config.CSP, "", ca.HomeDir)
+			if err != nil {
+				return err
+			}
+		}
+		ca.db, err = dbutil.OpenMySQL(db.Datasource, &db.TLS, ca.csp)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to create user registry for MySQL")
+		}
+	default:
+		return errors.Errorf("Invalid db.type in config file: '%s'; must be 'sqlite3', 'postgres', or 'mysql'", db.Type)
+	}
+	return nil
+}
+
+// migrateDB applies the pending schema migrations up to the target version,
+// or all of them if the target is 0, to the CA's database, and returns the
+// number of migrations applied
+func (ca *CA) migrateDB(target int) (int, error) {
+	version, err := dbutil.SchemaVersion(ca.db)
+	if err != nil {
+		return 0, err
+	}
+	latest := dbutil.LatestSchemaVersion()
+	if version > latest {
+		return 0, newFatalError(ErrDBLevel, "The schema version %d of the database is newer than the latest version %d known to the server.  Upgrade your server.", version, latest)
+	}
+	count := 0
+	if version == 0 {
+		// Databases created before versioned migrations may have outdated
+		// tables, which must be brought up to date before the migrations
+		// that follow the baseline are applied
+		err = dbutil.MigrateBaseline(ca.db, ca.server.levels)
+		if err != nil {
+			return 0, err
+		}
+		count = 1
+	}
+	n, err := dbutil.Migrate(ca.db, target)
+	return count + n, err
+}
+
+// MigrateDB applies the pending schema migrations up to the specified
+// version, or all of them if the version is 0, to the databases of the CAs
+// of the server
+func (s *Server) MigrateDB(version int) error {
+	cas, err := s.openCADBs()
+	defer s.closeCADBs(cas)
+	if err != nil {
+		return err
+	}
+	for _, ca := range cas {
+		name := ca.Config.CA.Name
+		count, err := ca.migrateDB(version)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("Failed to migrate the database of CA '%s'", name))
+		}
+		current, err := dbutil.SchemaVersion(ca.db)
+		if err != nil {
+			return err
+		}
+		log.Infof("Applied %d migration(s) to the database of CA '%s', whose schema version is %d", count, name, current)
+	}
+	return nil
+}
+
+// RollbackDB rolls back the schema migrations newer than the specified
+// version, or only the most recent migration if the version is negative, in
+// the databases of the CAs of the server
+func (s *Server) RollbackDB(version int) error {
+	cas, err := s.openCADBs()
+	defer s.closeCADBs(cas)
+	if err != nil {
+		return err
+	}
+	for _, ca := range cas {
+		name := ca.Config.CA.Name
+		target := version
+		if target < 0 {
+			current, err := dbutil.SchemaVersion(ca.db)
+			if err != nil {
+				return err
+			}
+			if current == 0 {
+				continue
+			}
+			target = current - 1
+		}
+		count, err := dbutil.Rollback(ca.db, target)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("Failed to roll back the database of CA '%s'", name))
+		}
+		current, err := dbutil.SchemaVersion(ca.db)
+		if err != nil {
+			return err
+		}
+		log.Infof("Rolled back %d migration(s) in the database of CA '%s', whose schema version is %d", count, name, current)
+	}
+	return nil
+}
+
+// GetDBMigrationStatus returns the status of the schema migrations of the
+// database of each CA of the server, keyed by CA name
+func (s *Server) GetDBMigrationStatus() (map[string][]dbutil.MigrationStatus, error) {
+	cas, err := s.openCADBs()
+	defer s.closeCADBs(cas)
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[string][]dbutil.MigrationStatus)
+	for _, ca := range cas {
+		name := ca.Config.CA.Name
+		status[name], err = dbutil.GetMigrationStatus(ca.db)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to get the migration status of the database of CA '%s'", name))
+		}
+	}
+	return status, nil
+}
+
+// CopyDB copies the database of the default CA from the database specified
+// by 'from' to the database specified by 'to', each in the form
+// <type>:<datasource>. The schema of the target database is created, and the
+// row counts and checksums of the tables are verified after they are copied.
+// The TLS settings of the configured database are used to connect to
+// PostgreSQL and MySQL.
+func (s *Server) CopyDB(from, to string) ([]dbutil.TableCopy, error) {
+	srcType, srcDS, err := parseDBSpec(from)
+	if err != nil {
+		return nil, err
+	}
+	dstType, dstDS, err := parseDBSpec(to)
+	if err != nil {
+		return nil, err
+	}
+	s.levels, err = metadata.GetLevels(metadata.GetVersion())
+	if err != nil {
+		return nil, err
+	}
+	err = s.initHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	s.CA.server = s
+	s.CA.HomeDir = s.HomeDir
+	err = s.CA.initConfig()
+	if err != nil {
+		return nil, err
+	}
+	err = s.CA.makeFileNamesAbsolute()
+	if err != nil {
+		return nil, err
+	}
+	if srcType == defaultDatabaseType {
+		srcDS, err = util.MakeFileAbs(srcDS, s.HomeDir)
+		if err != nil {
+			return nil, err
+		}
+		if !util.FileExists(srcDS) {
+			return nil, errors.Errorf("The source database '%s' does not exist", srcDS)
+		}
+	}
+	if dstType == defaultDatabaseType {
+		dstDS, err = util.MakeFileAbs(dstDS, s.HomeDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if srcType == dstType && srcDS == dstDS {
+		return nil, errors.New("The source and target databases are the same")
+	}
+
+	src := s.newDBCopyCA(srcType, srcDS)
+	dst := s.newDBCopyCA(dstType, dstDS)
+	defer s.closeCADBs([]*CA{src, dst})
+	err = src.openDB()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to open the source database")
+	}
+	version, err := dbutil.SchemaVersion(src.db)
+	if err != nil {
+		return nil, err
+	}
+	if version != dbutil.LatestSchemaVersion() {
+		return nil, errors.Errorf("The schema version %d of the source database is not the latest version %d; migrate it first with 'fabric-ca-server db migrate'", version, dbutil.LatestSchemaVersion())
+	}
+	err = dst.openDB()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to open the target database")
+	}
+	_, err = dst.migrateDB(0)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create the schema of the target database")
+	}
+	log.Infof("Copying the '%s' database at '%s' to the '%s' database at '%s'",
+		srcType, dbutil.MaskDBCred(srcDS), dstType, dbutil.MaskDBCred(dstDS))
+	return dbutil.CopyDB(src.db, dst.db)
+}
+
+// newDBCopyCA returns a CA with the configuration of the default CA, except
+// for the type and datasource of its database
+func (s *Server) newDBCopyCA(dbType, datasource string) *CA {
+	cfg := *s.CA.Config
+	cfg.DB.Type = dbType
+	cfg.DB.Datasource = datasource
+	return &CA{
+		HomeDir: s.HomeDir,
+		Config:  &cfg,
+		server:  s,
+	}
+}
+
+// parseDBSpec returns the type and datasource of a database specified in the
+// form <type>:<datasource>
+func parseDBSpec(spec string) (string, string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", errors.Errorf("Invalid database '%s'; expecting <type>:<datasource>", spec)
+	}
+	switch parts[0] {
+	case defaultDatabaseType, "postgres", "mysql":
+	default:
+		return "", "", errors.Errorf("Invalid database type '%s'; must be 'sqlite3', 'postgres', or 'mysql'", parts[0])
+	}
+	return parts[0], parts[1], nil
+}
+
+// openCADBs opens the databases of the default CA and of the additional CAs
+// of the server without initializing the CAs, so that their schema can be
+// managed while the server is stopped
+func (s *Server) openCADBs() ([]*CA, error) {
+	var err error
+	s.levels, err = metadata.GetLevels(metadata.GetVersion())
+	if err != nil {
+		return nil, err
+	}
+	err = s.initHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	cfg := s.Config
+	if cfg.CAcount != 0 && len(cfg.CAfiles) > 0 {
+		return nil, errors.New("The --cacount and --cafiles options are mutually exclusive")
+	}
+	cfg.CAfiles, err = util.NormalizeFileList(cfg.CAfiles, s.HomeDir)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CAcount >= 1 {
+		err = s.createDefaultCAConfigs(cfg.CAcount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.CA.server = s
+	s.CA.HomeDir = s.HomeDir
+	cas := []*CA{&s.CA}
+	for _, caFile := range util.NormalizeStringSlice(cfg.CAfiles) {
+		caCfg, err := s.loadCAConfig(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, &CA{
+			HomeDir:        filepath.Dir(caFile),
+			ConfigFilePath: caFile,
+			Config:         caCfg,
+			server:         s,
+		})
+	}
+	for i, ca := range cas {
+		err = ca.initConfig()
+		if err == nil {
+			err = ca.makeFileNamesAbsolute()
+		}
+		if err == nil {
+			err = ca.openDB()
+		}
+		if err != nil {
+			return cas[:i], err
+		}
+	}
+	return cas, nil
+}
+
+// closeCADBs closes the databases opened by openCADBs
+func (s *Server) closeCADBs(cas []*CA) {
+	for _, ca := range cas {
+		err := ca.closeDB()
+		if err != nil {
+			log.Errorf("Close DB failed: %s", err)
+		}
+	}
+}
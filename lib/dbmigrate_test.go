@@ -0,0 +1,207 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/dbutil"
+)
+
+func TestMigrateDB(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := os.MkdirAll(rootDir, 0755)
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	latest := dbutil.LatestSchemaVersion()
+
+	err = srv.MigrateDB(0)
+	assert.NoError(t, err, "Failed to migrate a new database")
+	status, err := srv.GetDBMigrationStatus()
+	assert.NoError(t, err, "Failed to get the migration status")
+	for _, s := range status[srv.CA.Config.CA.Name] {
+		assert.True(t, s.Applied, "Migration %d should have been applied", s.Version)
+	}
+
+	err = srv.RollbackDB(-1)
+	assert.NoError(t, err, "Failed to roll back the most recent migration")
+	status, err = srv.GetDBMigrationStatus()
+	assert.NoError(t, err, "Failed to get the migration status")
+	migrations := status[srv.CA.Config.CA.Name]
+	if assert.Len(t, migrations, latest) {
+		assert.False(t, migrations[latest-1].Applied, "The most recent migration should have been rolled back")
+	}
+	err = srv.RollbackDB(0)
+	assert.Error(t, err, "The baseline migration should not be rolled back")
+
+	// The server applies pending migrations when it starts
+	err = srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	srv.Stop()
+	db, err := dbutil.OpenSQLLite3(filepath.Join(rootDir, "fabric-ca-server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	version, err := dbutil.SchemaVersion(db)
+	assert.NoError(t, err, "Failed to get the schema version")
+	assert.Equal(t, latest, version, "The server should have migrated the database")
+
+	// A server must not start against a schema migrated by a newer server
+	_, err = db.Exec(db.Rebind("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)"),
+		latest+1, "future", time.Now().UTC())
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to insert migration: %s", err)
+	}
+	err = srv.Start()
+	if assert.Error(t, err, "Server should not start against a newer schema") {
+		assert.Contains(t, err.Error(), "newer than the latest version")
+	}
+	err = srv.MigrateDB(0)
+	assert.Error(t, err, "Migrating a newer schema should fail")
+}
+
+// The baseline migration of a database created before versioned migrations
+// is only recorded once its outdated tables are updated
+func TestMigrateLegacyDB(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := os.MkdirAll(rootDir, 0755)
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	db, err := dbutil.OpenSQLLite3(filepath.Join(rootDir, "fabric-ca-server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err)
+	}
+	// A view can't be altered, so updating the schema fails
+	_, err = db.Exec("CREATE VIEW users AS SELECT 'admin' AS id")
+	if err != nil {
+		t.Fatalf("Failed to create view: %s", err)
+	}
+	err = srv.MigrateDB(0)
+	assert.Error(t, err, "Migrating a database whose schema can't be updated should fail")
+	version, err := dbutil.SchemaVersion(db)
+	assert.NoError(t, err, "Failed to get the schema version")
+	assert.Equal(t, 0, version, "The baseline migration should not be recorded if the schema update failed")
+
+	_, err = db.Exec("DROP VIEW users")
+	if err != nil {
+		t.Fatalf("Failed to drop view: %s", err)
+	}
+	_, err = db.Exec("CREATE TABLE users (id VARCHAR(64), token bytea, type VARCHAR(64), affiliation VARCHAR(64), attributes VARCHAR(256), state INTEGER, max_enrollments INTEGER)")
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to create table: %s", err)
+	}
+	err = srv.MigrateDB(0)
+	assert.NoError(t, err, "Failed to migrate the database once its schema can be updated")
+	status, err := srv.GetDBMigrationStatus()
+	if assert.NoError(t, err, "Failed to get the migration status") {
+		for _, s := range status[srv.CA.Config.CA.Name] {
+			assert.True(t, s.Applied, "Migration %d should have been applied", s.Version)
+		}
+	}
+}
+
+func TestCopyDB(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	if err != nil {
+		srv.Stop()
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	_, err = resp.Identity.Register(&api.RegistrationRequest{Name: "copy1", Affiliation: "org2"})
+	srv.Stop()
+	if err != nil {
+		t.Fatalf("Failed to register copy1: %s", err)
+	}
+
+	// Relative datasources are relative to the home directory of the server
+	target := "sqlite3:copy.db"
+	result, err := srv.CopyDB("sqlite3:fabric-ca-server.db", target)
+	if err != nil {
+		t.Fatalf("Failed to copy the database: %s", err)
+	}
+	rows := make(map[string]int)
+	for _, tc := range result {
+		rows[tc.Table] = tc.Rows
+	}
+	assert.Equal(t, 2, rows["users"], "Both identities should have been copied")
+	assert.Equal(t, 1, rows["certificates"], "The certificate of the bootstrap user should have been copied")
+
+	db, err := dbutil.OpenSQLLite3(filepath.Join(rootDir, "copy.db"))
+	if err != nil {
+		t.Fatalf("Failed to open the copied database: %s", err)
+	}
+	var count int
+	err = db.Get(&count, "SELECT COUNT(*) FROM users WHERE id = 'copy1'")
+	db.Close()
+	assert.NoError(t, err, "Failed to query the copied database")
+	assert.Equal(t, 1, count, "The copied database should contain copy1")
+
+	_, err = srv.CopyDB("sqlite3:fabric-ca-server.db", target)
+	assert.Error(t, err, "Copying to a database which is not empty should fail")
+	_, err = srv.CopyDB("sqlite3:fabric-ca-server.db", "sqlite3:fabric-ca-server.db")
+	assert.Error(t, err, "Copying a database to itself should fail")
+	_, err = srv.CopyDB("oracle:db", target)
+	assert.Error(t, err, "Copying from an unsupported database type should fail")
+
+	// A copy which fails leaves the target database empty, so it can be run
+	// again. The copy is made to fail when the revocation_authority_info
+	// table is copied, after the users table.
+	db, err = dbutil.OpenSQLLite3(filepath.Join(rootDir, "copy.db"))
+	if err != nil {
+		t.Fatalf("Failed to open the copied database: %s", err)
+	}
+	for _, table := range []string{"users", "affiliations", "certificates", "certificates_archive", "credentials",
+		"revocation_authority_info", "nonces", "audit", "pending_operations"} {
+		db.MustExec(fmt.Sprintf("DELETE FROM %s", table))
+	}
+	db.MustExec("CREATE TRIGGER failcopy BEFORE INSERT ON revocation_authority_info BEGIN SELECT RAISE(ABORT, 'copy failed'); END")
+	_, err = srv.CopyDB("sqlite3:fabric-ca-server.db", target)
+	assert.Error(t, err, "Copy should have failed")
+	err = db.Get(&count, "SELECT COUNT(*) FROM users")
+	assert.NoError(t, err, "Failed to query the copied database")
+	assert.Equal(t, 0, count, "A failed copy should not have copied the users table")
+	db.MustExec("DROP TRIGGER failcopy")
+	db.Close()
+	_, err = srv.CopyDB("sqlite3:fabric-ca-server.db", target)
+	assert.NoError(t, err, "Copying again after a failed copy should succeed")
+}
@@ -0,0 +1,447 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dbutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// TableCopy is the result of copying a table from one database to another
+type TableCopy struct {
+	Table string
+	Rows  int
+	// Checksum is the hex-encoded SHA-256 digest of the rows of the table,
+	// which is the same in both databases
+	Checksum string
+}
+
+// copyTable describes the columns of a table whose type differs between
+// the database types, and which must therefore be converted when copied
+type copyTable struct {
+	name string
+	// binary are the bytea columns of PostgreSQL, which are blob columns in
+	// SQLite and varbinary columns in MySQL
+	binary []string
+	bool   []string
+	time   []string
+}
+
+// copyTables are the tables copied by CopyDB. The schema_migrations table
+// is not copied, since the migrations are applied to the target database.
+var copyTables = []copyTable{
+	{
+		name:   "users",
+		binary: []string{"token"},
+		bool:   []string{"secret_one_time", "suspended"},
+		time:   []string{"secret_expiry", "locked_at"},
+	},
+	{name: "affiliations"},
+	{
+		name:   "certificates",
+		binary: []string{"serial_number", "authority_key_identifier", "ca_label", "status", "pem"},
+		time:   []string{"expiry", "revoked_at"},
+	},
+	{
+		name:   "certificates_archive",
+		binary: []string{"serial_number", "authority_key_identifier", "ca_label", "status", "pem"},
+		time:   []string{"expiry", "revoked_at", "purged_at"},
+	},
+	{name: "credentials", time: []string{"revoked_at"}},
+	{name: "revocation_authority_info"},
+	{name: "nonces", time: []string{"expiry"}},
+	{name: "audit", time: []string{"logged_at"}},
+	{name: "pending_operations", time: []string{"requested_at", "expiry"}},
+	// The properties hold the levels of the tables, which the target
+	// database takes from the source database
+	{name: "properties"},
+}
+
+// Formats in which the database drivers return the timestamps which they
+// don't parse
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05Z",
+	"2006-01-02",
+}
+
+// CopyDB copies the rows of all tables of the source database to the target
+// database, whose schema must be at the same version as the source and whose
+// tables must be empty except for the properties table. All tables are read
+// in a single transaction of the source database, so that they are copied
+// from one snapshot even if the source database is in use, and written in a
+// single transaction of the target database, which is committed only after
+// the row counts and checksums of every table in both databases have been
+// compared. If the copy fails, the tables of the target database are
+// therefore left empty and the copy can simply be run again.
+func CopyDB(src, dst *sqlx.DB) ([]TableCopy, error) {
+	srcVersion, err := SchemaVersion(src)
+	if err != nil {
+		return nil, err
+	}
+	dstVersion, err := SchemaVersion(dst)
+	if err != nil {
+		return nil, err
+	}
+	if srcVersion != dstVersion {
+		return nil, errors.Errorf("The schema version %d of the source database differs from the schema version %d of the target database", srcVersion, dstVersion)
+	}
+	srcTx, err := beginSnapshot(src)
+	if err != nil {
+		return nil, err
+	}
+	// The source database is only read, so its transaction is never committed
+	defer srcTx.Rollback()
+	dstTx, err := dst.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to begin transaction")
+	}
+	result, err := copyAllTables(srcTx, dstTx)
+	if err != nil {
+		err2 := dstTx.Rollback()
+		if err2 != nil {
+			log.Errorf("Error encountered while rolling back transaction: %s", err2)
+		}
+		return nil, err
+	}
+	err = dstTx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error encountered while committing transaction")
+	}
+	return result, nil
+}
+
+// beginSnapshot begins a transaction in which all tables of the database are
+// read from the same snapshot. SQLite holds its read lock until the end of
+// the transaction and REPEATABLE READ is the default isolation level of
+// MySQL, but PostgreSQL defaults to READ COMMITTED.
+func beginSnapshot(db *sqlx.DB) (*sqlx.Tx, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to begin transaction")
+	}
+	if db.DriverName() == "postgres" {
+		_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY")
+		if err != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(err, "Failed to set the isolation level of the transaction")
+		}
+	}
+	return tx, nil
+}
+
+// copyAllTables copies and verifies all tables within the transactions of
+// the source and target databases
+func copyAllTables(src, dst *sqlx.Tx) ([]TableCopy, error) {
+	for _, t := range copyTables {
+		if t.name == "properties" {
+			continue
+		}
+		count, err := countRows(dst, t.name)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, errors.Errorf("The %s table of the target database is not empty", t.name)
+		}
+	}
+	var result []TableCopy
+	for _, t := range copyTables {
+		columns, err := t.columns(src, dst)
+		if err != nil {
+			return nil, err
+		}
+		err = t.copy(src, dst, columns)
+		if err != nil {
+			return nil, err
+		}
+		tc, err := t.verify(src, dst, columns)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Copied %d rows of the %s table", tc.Rows, t.name)
+		result = append(result, *tc)
+	}
+	return result, nil
+}
+
+// copy streams the rows of the table from the source to the target database
+func (t *copyTable) copy(src sqlx.Queryer, tx *sqlx.Tx, columns []string) error {
+	rows, err := src.Queryx(fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), t.name))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read the %s table", t.name)
+	}
+	defer rows.Close()
+	if t.name == "properties" {
+		// Replace the properties which the migrations inserted
+		_, err := tx.Exec("DELETE FROM properties")
+		if err != nil {
+			return errors.Wrap(err, "Failed to clear the properties table")
+		}
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	stmt, err := tx.Preparex(tx.Rebind(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.name, strings.Join(columns, ", "), placeholders)))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to prepare the insertion into the %s table", t.name)
+	}
+	defer stmt.Close()
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read the %s table", t.name)
+		}
+		for i, col := range columns {
+			values[i], err = t.convert(col, values[i])
+			if err != nil {
+				return err
+			}
+		}
+		_, err = stmt.Exec(values...)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to insert into the %s table", t.name)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrapf(err, "Failed to read the %s table", t.name)
+	}
+	return nil
+}
+
+// columns returns the columns of the table which exist in both databases,
+// since MySQL gives some tables an auto-increment ID
+func (t *copyTable) columns(src, dst sqlx.Queryer) ([]string, error) {
+	srcColumns, err := tableColumns(src, t.name)
+	if err != nil {
+		return nil, err
+	}
+	dstColumns, err := tableColumns(dst, t.name)
+	if err != nil {
+		return nil, err
+	}
+	inDst := make(map[string]bool)
+	for _, col := range dstColumns {
+		inDst[col] = true
+	}
+	var columns []string
+	for _, col := range srcColumns {
+		if inDst[col] {
+			columns = append(columns, col)
+		}
+	}
+	return columns, nil
+}
+
+// convert converts a value read by any database driver into a value which
+// any database driver writes to a column of the type of 'column'
+func (t *copyTable) convert(column string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch {
+	case contains(t.binary, column):
+		// The SQLite driver writes an empty byte slice as NULL
+		switch v := value.(type) {
+		case string:
+			if v != "" {
+				return []byte(v), nil
+			}
+		case []byte:
+			if len(v) == 0 {
+				return "", nil
+			}
+		}
+	case contains(t.bool, column):
+		b, err := toBool(value)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("Invalid value of column %s of the %s table", column, t.name))
+		}
+		return b, nil
+	case contains(t.time, column):
+		tm, err := toTime(value)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("Invalid value of column %s of the %s table", column, t.name))
+		}
+		return tm, nil
+	default:
+		switch v := value.(type) {
+		case []byte:
+			return string(v), nil
+		}
+	}
+	return value, nil
+}
+
+// verify compares the row counts and checksums of the table in both
+// databases
+func (t *copyTable) verify(src, dst sqlx.Queryer, columns []string) (*TableCopy, error) {
+	srcCount, srcSum, err := t.checksum(src, columns)
+	if err != nil {
+		return nil, err
+	}
+	dstCount, dstSum, err := t.checksum(dst, columns)
+	if err != nil {
+		return nil, err
+	}
+	if srcCount != dstCount {
+		return nil, errors.Errorf("The %s table has %d rows in the source database but %d rows in the target database", t.name, srcCount, dstCount)
+	}
+	if srcSum != dstSum {
+		return nil, errors.Errorf("The checksum of the %s table differs between the source and the target database", t.name)
+	}
+	return &TableCopy{Table: t.name, Rows: srcCount, Checksum: srcSum}, nil
+}
+
+// checksum returns the number of rows of the table and a digest of their
+// values which doesn't depend on the database type or on the order of the
+// rows. Timestamps are compared to the second, which is the precision of
+// MySQL.
+func (t *copyTable) checksum(db sqlx.Queryer, columns []string) (int, string, error) {
+	rows, err := db.Queryx(fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), t.name))
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "Failed to read the %s table", t.name)
+	}
+	defer rows.Close()
+	var digests [][]byte
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return 0, "", errors.Wrapf(err, "Failed to read the %s table", t.name)
+		}
+		h := sha256.New()
+		for i, col := range columns {
+			value, err := t.convert(col, values[i])
+			if err != nil {
+				return 0, "", err
+			}
+			fmt.Fprintf(h, "%s\x00", canonicalValue(value))
+		}
+		digests = append(digests, h.Sum(nil))
+	}
+	if err = rows.Err(); err != nil {
+		return 0, "", errors.Wrapf(err, "Failed to read the %s table", t.name)
+	}
+	sort.Slice(digests, func(i, j int) bool { return bytes.Compare(digests[i], digests[j]) < 0 })
+	h := sha256.New()
+	for _, d := range digests {
+		h.Write(d)
+	}
+	return len(digests), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func canonicalValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return hex.EncodeToString(v)
+	case string:
+		return hex.EncodeToString([]byte(v))
+	case time.Time:
+		return v.UTC().Truncate(time.Second).Format(time.RFC3339)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case []byte:
+		return strconv.ParseBool(string(v))
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return false, errors.Errorf("Unexpected boolean value %v of type %T", value, value)
+}
+
+func toTime(value interface{}) (time.Time, error) {
+	var s string
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return time.Time{}, errors.Errorf("Unexpected timestamp value %v of type %T", value, value)
+	}
+	if strings.HasPrefix(s, "0000-00-00") {
+		// The zero timestamp of MySQL
+		return time.Time{}, nil
+	}
+	for _, layout := range timeLayouts {
+		tm, err := time.Parse(layout, s)
+		if err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("Unexpected timestamp value '%s'", s)
+}
+
+func tableColumns(db sqlx.Queryer, table string) ([]string, error) {
+	rows, err := db.Queryx(fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", table))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get the columns of the %s table", table)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get the columns of the %s table", table)
+	}
+	return columns, nil
+}
+
+func countRows(db sqlx.Queryer, table string) (int, error) {
+	var count int
+	err := sqlx.Get(db, &count, fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to count the rows of the %s table", table)
+	}
+	return count, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dbutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToBool(t *testing.T) {
+	for _, value := range []interface{}{true, int64(1), []byte("1"), "true"} {
+		b, err := toBool(value)
+		assert.NoError(t, err, "Failed to convert %v to a boolean", value)
+		assert.True(t, b, "%v should have converted to true", value)
+	}
+	for _, value := range []interface{}{false, int64(0), []byte("0"), "false"} {
+		b, err := toBool(value)
+		assert.NoError(t, err, "Failed to convert %v to a boolean", value)
+		assert.False(t, b, "%v should have converted to false", value)
+	}
+	_, err := toBool("maybe")
+	assert.Error(t, err, "Converting an invalid string to a boolean should have failed")
+	_, err = toBool(1.5)
+	assert.Error(t, err, "Converting a float to a boolean should have failed")
+}
+
+func TestToTime(t *testing.T) {
+	expected := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, value := range []interface{}{
+		expected,
+		"2018-03-04 05:06:07+00:00",
+		"2018-03-04T05:06:07+00:00",
+		"2018-03-04 05:06:07",
+		[]byte("2018-03-04T05:06:07Z"),
+	} {
+		tm, err := toTime(value)
+		if assert.NoError(t, err, "Failed to convert %v to a timestamp", value) {
+			assert.True(t, expected.Equal(tm), "%v converted to %s instead of %s", value, tm, expected)
+		}
+	}
+
+	// Fractions of seconds are kept
+	tm, err := toTime("2018-03-04 05:06:07.123456")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 123456000, tm.Nanosecond())
+	}
+
+	tm, err = toTime("2018-03-04")
+	if assert.NoError(t, err) {
+		assert.True(t, time.Date(2018, 3, 4, 0, 0, 0, 0, time.UTC).Equal(tm))
+	}
+
+	// The zero timestamp of MySQL is the zero time
+	tm, err = toTime([]byte("0000-00-00 00:00:00"))
+	if assert.NoError(t, err) {
+		assert.True(t, tm.IsZero(), "The zero timestamp of MySQL should have converted to the zero time")
+	}
+
+	_, err = toTime("yesterday")
+	assert.Error(t, err, "Converting an invalid string to a timestamp should have failed")
+	_, err = toTime(int64(1520139967))
+	assert.Error(t, err, "Converting an integer to a timestamp should have failed")
+}
+
+func TestConvert(t *testing.T) {
+	table := &copyTable{
+		name:   "test",
+		binary: []string{"bin"},
+		bool:   []string{"flag"},
+		time:   []string{"at"},
+	}
+
+	value, err := table.convert("bin", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, value, "NULL should be kept")
+
+	// Binary columns are written as byte slices, except for empty values,
+	// which the SQLite driver would write as NULL
+	value, err = table.convert("bin", "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc"), value)
+	value, err = table.convert("bin", []byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc"), value)
+	value, err = table.convert("bin", []byte{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+	value, err = table.convert("bin", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+
+	value, err = table.convert("flag", int64(1))
+	assert.NoError(t, err)
+	assert.Equal(t, true, value)
+	_, err = table.convert("flag", "maybe")
+	assert.Error(t, err, "Converting an invalid boolean column should have failed")
+
+	value, err = table.convert("at", []byte("2018-03-04 05:06:07"))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC), value)
+	_, err = table.convert("at", "yesterday")
+	assert.Error(t, err, "Converting an invalid timestamp column should have failed")
+
+	// Text read as a byte slice is written as a string
+	value, err = table.convert("other", []byte("text"))
+	assert.NoError(t, err)
+	assert.Equal(t, "text", value)
+	value, err = table.convert("other", int64(3))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+}
+
+func TestCanonicalValue(t *testing.T) {
+	assert.Equal(t, "NULL", canonicalValue(nil))
+
+	// Text and binary values are the same whether they are read as strings or
+	// byte slices
+	assert.Equal(t, canonicalValue("abc"), canonicalValue([]byte("abc")))
+	assert.NotEqual(t, canonicalValue("abc"), canonicalValue("abd"))
+	assert.NotEqual(t, "NULL", canonicalValue("NULL"), "The string 'NULL' should differ from NULL")
+
+	assert.Equal(t, "1", canonicalValue(true))
+	assert.Equal(t, "0", canonicalValue(false))
+	assert.Equal(t, "42", canonicalValue(int64(42)))
+
+	// Timestamps are compared to the second and regardless of their location
+	tm := time.Date(2018, 3, 4, 5, 6, 7, 500000000, time.UTC)
+	assert.Equal(t, canonicalValue(tm), canonicalValue(tm.Truncate(time.Second)))
+	assert.Equal(t, canonicalValue(tm), canonicalValue(tm.In(time.FixedZone("UTC+2", 2*60*60))))
+	assert.NotEqual(t, canonicalValue(tm), canonicalValue(tm.Add(time.Second)))
+}
@@ -42,14 +42,23 @@ type Levels struct {
 	Certificate int
 }
 
-// NewUserRegistrySQLLite3 returns a pointer to a sqlite database
+// NewUserRegistrySQLLite3 returns a pointer to a sqlite database, migrated
+// to the latest schema version
 func NewUserRegistrySQLLite3(datasource string) (*sqlx.DB, error) {
-	log.Debugf("Using sqlite database, connect to database in home (%s) directory", datasource)
-
-	err := createSQLiteDBTables(datasource)
+	db, err := OpenSQLLite3(datasource)
+	if err != nil {
+		return nil, err
+	}
+	err = migrateNewDB(db)
 	if err != nil {
 		return nil, errors.WithMessage(err, "Failed to create SQLite3 database")
 	}
+	return db, nil
+}
+
+// OpenSQLLite3 opens a sqlite database without migrating its schema
+func OpenSQLLite3(datasource string) (*sqlx.DB, error) {
+	log.Debugf("Using sqlite database, connect to database in home (%s) directory", datasource)
 
 	db, err := sqlx.Open("sqlite3", datasource+"?_busy_timeout=5000")
 	if err != nil {
@@ -72,51 +81,9 @@ func NewUserRegistrySQLLite3(datasource string) (*sqlx.DB, error) {
 	return db, nil
 }
 
-func createSQLiteDBTables(datasource string) error {
-	log.Debugf("Creating SQLite database (%s) if it does not exist...", datasource)
-	db, err := sqlx.Open("sqlite3", datasource)
-	if err != nil {
-		return errors.Wrap(err, "Failed to open SQLite database")
-	}
-	defer db.Close()
-
-	err = doTransaction(db, createAllSQLiteTables)
-	if err != nil {
-		return err
-	}
-
-	log.Debug("Creating properties table if it does not exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))"); err != nil {
-		return errors.Wrap(err, "Error creating properties table")
-	}
-	_, err = db.Exec(db.Rebind("INSERT INTO properties (property, value) VALUES ('identity.level', '0'), ('affiliation.level', '0'), ('certificate.level', '0')"))
-	if err != nil {
-		if !strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			return errors.Wrap(err, "Failed to initialize properties table")
-		}
-	}
-	return nil
-}
-
-func createAllSQLiteTables(tx *sqlx.Tx, args ...interface{}) error {
-	err := createSQLiteIdentityTable(tx)
-	if err != nil {
-		return err
-	}
-	err = createSQLiteAffiliationTable(tx)
-	if err != nil {
-		return err
-	}
-	err = createSQLiteCertificateTable(tx)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 func createSQLiteIdentityTable(tx *sqlx.Tx) error {
 	log.Debug("Creating users table if it does not exist")
-	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255), token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0)"); err != nil {
+	if _, err := tx.Exec(sqliteUsersTable); err != nil {
 		return errors.Wrap(err, "Error creating users table")
 	}
 	return nil
@@ -124,7 +91,7 @@ func createSQLiteIdentityTable(tx *sqlx.Tx) error {
 
 func createSQLiteAffiliationTable(tx *sqlx.Tx) error {
 	log.Debug("Creating affiliations table if it does not exist")
-	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS affiliations (name VARCHAR(1024) NOT NULL UNIQUE, prekey VARCHAR(1024), level INTEGER DEFAULT 0)"); err != nil {
+	if _, err := tx.Exec(sqliteAffiliationsTable); err != nil {
 		return errors.Wrap(err, "Error creating affiliations table")
 	}
 	return nil
@@ -132,14 +99,29 @@ func createSQLiteAffiliationTable(tx *sqlx.Tx) error {
 
 func createSQLiteCertificateTable(tx *sqlx.Tx) error {
 	log.Debug("Creating certificates table if it does not exist")
-	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number blob NOT NULL, authority_key_identifier blob NOT NULL, ca_label blob, status blob NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem blob NOT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier))"); err != nil {
+	if _, err := tx.Exec(sqliteCertificatesTable); err != nil {
 		return errors.Wrap(err, "Error creating certificates table")
 	}
 	return nil
 }
 
-// NewUserRegistryPostgres opens a connection to a postgres database
+// NewUserRegistryPostgres opens a connection to a postgres database, migrated
+// to the latest schema version
 func NewUserRegistryPostgres(datasource string, clientTLSConfig *tls.ClientTLSConfig) (*sqlx.DB, error) {
+	db, err := OpenPostgres(datasource, clientTLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = migrateNewDB(db)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create Postgres tables")
+	}
+	return db, nil
+}
+
+// OpenPostgres opens a connection to a postgres database, creating the
+// database if needed, without migrating its schema
+func OpenPostgres(datasource string, clientTLSConfig *tls.ClientTLSConfig) (*sqlx.DB, error) {
 	log.Debugf("Using postgres database, connecting to database...")
 
 	dbName := getDBName(datasource)
@@ -195,11 +177,6 @@ func NewUserRegistryPostgres(datasource string, clientTLSConfig *tls.ClientTLSCo
 		return nil, errors.Wrapf(err, "Failed to open database '%s' in Postgres server", dbName)
 	}
 
-	err = createPostgresTables(dbName, db)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create Postgres tables")
-	}
-
 	return db, nil
 }
 
@@ -217,35 +194,23 @@ func createPostgresDatabase(dbName string, db *sqlx.DB) error {
 	return nil
 }
 
-// createPostgresDB creates postgres database
-func createPostgresTables(dbName string, db *sqlx.DB) error {
-	log.Debug("Creating users table if it does not exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255), token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0)"); err != nil {
-		return errors.Wrap(err, "Error creating users table")
-	}
-	log.Debug("Creating affiliations table if it does not exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS affiliations (name VARCHAR(1024) NOT NULL UNIQUE, prekey VARCHAR(1024), level INTEGER DEFAULT 0)"); err != nil {
-		return errors.Wrap(err, "Error creating affiliations table")
-	}
-	log.Debug("Creating certificates table if it does not exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number bytea NOT NULL, authority_key_identifier bytea NOT NULL, ca_label bytea, status bytea NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem bytea NOT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier))"); err != nil {
-		return errors.Wrap(err, "Error creating certificates table")
-	}
-	log.Debug("Creating properties table if it does not exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))"); err != nil {
-		return errors.Wrap(err, "Error creating properties table")
+// NewUserRegistryMySQL opens a connection to a MySQL database, migrated to
+// the latest schema version
+func NewUserRegistryMySQL(datasource string, clientTLSConfig *tls.ClientTLSConfig, csp bccsp.BCCSP) (*sqlx.DB, error) {
+	db, err := OpenMySQL(datasource, clientTLSConfig, csp)
+	if err != nil {
+		return nil, err
 	}
-	_, err := db.Exec(db.Rebind("INSERT INTO properties (property, value) VALUES ('identity.level', '0'), ('affiliation.level', '0'), ('certificate.level', '0')"))
+	err = migrateNewDB(db)
 	if err != nil {
-		if !strings.Contains(err.Error(), "duplicate key") {
-			return err
-		}
+		return nil, errors.WithMessage(err, "Failed to create MySQL tables")
 	}
-	return nil
+	return db, nil
 }
 
-// NewUserRegistryMySQL opens a connection to a postgres database
-func NewUserRegistryMySQL(datasource string, clientTLSConfig *tls.ClientTLSConfig, csp bccsp.BCCSP) (*sqlx.DB, error) {
+// OpenMySQL opens a connection to a MySQL database, creating the database if
+// needed, without migrating its schema
+func OpenMySQL(datasource string, clientTLSConfig *tls.ClientTLSConfig, csp bccsp.BCCSP) (*sqlx.DB, error) {
 	log.Debugf("Using MySQL database, connecting to database...")
 
 	dbName := getDBName(datasource)
@@ -285,11 +250,6 @@ func NewUserRegistryMySQL(datasource string, clientTLSConfig *tls.ClientTLSConfi
 		return nil, errors.Wrapf(err, "Failed to open database (%s) in MySQL server", dbName)
 	}
 
-	err = createMySQLTables(dbName, db)
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create MySQL tables")
-	}
-
 	return db, nil
 }
 
@@ -304,34 +264,13 @@ func createMySQLDatabase(dbName string, db *sqlx.DB) error {
 	return nil
 }
 
-func createMySQLTables(dbName string, db *sqlx.DB) error {
-	log.Debug("Creating users table if it doesn't exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255) NOT NULL, token blob, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER, max_enrollments INTEGER, level INTEGER DEFAULT 0, PRIMARY KEY (id)) DEFAULT CHARSET=utf8 COLLATE utf8_bin"); err != nil {
-		return errors.Wrap(err, "Error creating users table")
-	}
-	log.Debug("Creating affiliations table if it doesn't exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS affiliations (id INT NOT NULL AUTO_INCREMENT, name VARCHAR(1024) NOT NULL, prekey VARCHAR(1024), level INTEGER DEFAULT 0, PRIMARY KEY (id))"); err != nil {
-		return errors.Wrap(err, "Error creating affiliations table")
-	}
-	log.Debug("Creating index on 'name' in the affiliations table")
-	if _, err := db.Exec("CREATE INDEX name_index on affiliations (name)"); err != nil {
-		if !strings.Contains(err.Error(), "Error 1061") { // Error 1061: Duplicate key name, index already exists
-			return errors.Wrap(err, "Error creating index on affiliations table")
-		}
-	}
-	log.Debug("Creating certificates table if it doesn't exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number varbinary(128) NOT NULL, authority_key_identifier varbinary(128) NOT NULL, ca_label varbinary(128), status varbinary(128) NOT NULL, reason int, expiry timestamp DEFAULT 0, revoked_at timestamp DEFAULT 0, pem varbinary(4096) NOT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier)) DEFAULT CHARSET=utf8 COLLATE utf8_bin"); err != nil {
-		return errors.Wrap(err, "Error creating certificates table")
-	}
-	log.Debug("Creating properties table if it does not exist")
-	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))"); err != nil {
-		return errors.Wrap(err, "Error creating properties table")
-	}
-	_, err := db.Exec(db.Rebind("INSERT INTO properties (property, value) VALUES ('identity.level', '0'), ('affiliation.level', '0'), ('certificate.level', '0')"))
+// migrateNewDB applies all pending migrations to a newly opened database,
+// closing it if the migrations fail
+func migrateNewDB(db *sqlx.DB) error {
+	_, err := Migrate(db, 0)
 	if err != nil {
-		if !strings.Contains(err.Error(), "1062") { // MySQL error code for duplicate entry
-			return err
-		}
+		db.Close()
+		return err
 	}
 	return nil
 }
@@ -492,6 +431,37 @@ func updateSQLiteSchema(db *sqlx.DB, serverLevels *Levels) error {
 		}
 	}
 
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN secret_expiry timestamp DEFAULT '0001-01-01 00:00:00+00:00'")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN secret_one_time BOOLEAN DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN failed_attempts INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN locked_at timestamp DEFAULT '0001-01-01 00:00:00+00:00'")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN suspended BOOLEAN DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") { // Already using the latest schema
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -600,6 +570,36 @@ func updateMySQLSchema(db *sqlx.DB) error {
 			return err
 		}
 	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN secret_expiry timestamp DEFAULT 0 AFTER level")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN secret_one_time BOOLEAN DEFAULT 0 AFTER secret_expiry")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN failed_attempts INTEGER DEFAULT 0 AFTER secret_one_time")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN locked_at timestamp DEFAULT 0 AFTER failed_attempts")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN suspended BOOLEAN DEFAULT 0 AFTER locked_at")
+	if err != nil {
+		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
+			return err
+		}
+	}
 	_, err = db.Exec("ALTER TABLE certificates ADD COLUMN level INTEGER DEFAULT 0 AFTER pem")
 	if err != nil {
 		if !strings.Contains(err.Error(), "1060") { // Already using the latest schema
@@ -660,6 +660,36 @@ func updatePostgresSchema(db *sqlx.DB) error {
 			return err
 		}
 	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN secret_expiry timestamp DEFAULT '0001-01-01 00:00:00'")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN secret_one_time BOOLEAN DEFAULT FALSE")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN failed_attempts INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN locked_at timestamp DEFAULT '0001-01-01 00:00:00'")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN suspended BOOLEAN DEFAULT FALSE")
+	if err != nil {
+		if !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
 	_, err = db.Exec("ALTER TABLE certificates ADD COLUMN level INTEGER DEFAULT 0")
 	if err != nil {
 		if !strings.Contains(err.Error(), "already exists") {
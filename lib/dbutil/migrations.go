@@ -0,0 +1,380 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dbutil
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Migration is a versioned change to the database schema. The up and down
+// scripts are keyed by the name of the database driver ("sqlite3",
+// "postgres" or "mysql"); a migration without down scripts can't be
+// rolled back.
+type Migration struct {
+	Version     int
+	Description string
+	Up          map[string][]string
+	Down        map[string][]string
+	// IgnoreExisting is set for the baseline migration, whose objects may
+	// already exist in databases created before versioned migrations
+	IgnoreExisting bool
+}
+
+// MigrationStatus is the state of a migration in a database
+type MigrationStatus struct {
+	Version     int
+	Description string
+	// Applied is set if the migration has been applied, in which case
+	// AppliedAt is the time at which it was applied
+	Applied   bool
+	AppliedAt time.Time
+	// Unknown is set if the migration has been applied by a newer server
+	Unknown bool
+}
+
+// migrationRecord is a row of the schema_migrations table
+type migrationRecord struct {
+	Version     int       `db:"version"`
+	Description string    `db:"description"`
+	AppliedAt   time.Time `db:"applied_at"`
+}
+
+const (
+	sqliteUsersTable        = "CREATE TABLE IF NOT EXISTS users (id VARCHAR(255), token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0, secret_expiry timestamp DEFAULT '0001-01-01 00:00:00+00:00', secret_one_time BOOLEAN DEFAULT 0, failed_attempts INTEGER DEFAULT 0, locked_at timestamp DEFAULT '0001-01-01 00:00:00+00:00', suspended BOOLEAN DEFAULT 0)"
+	sqliteAffiliationsTable = "CREATE TABLE IF NOT EXISTS affiliations (name VARCHAR(1024) NOT NULL UNIQUE, prekey VARCHAR(1024), level INTEGER DEFAULT 0)"
+	sqliteCertificatesTable = "CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number blob NOT NULL, authority_key_identifier blob NOT NULL, ca_label blob, status blob NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem blob NOT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier))"
+)
+
+var migrationsTable = map[string]string{
+	"sqlite3":  "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL, description VARCHAR(255), applied_at timestamp, PRIMARY KEY(version))",
+	"postgres": "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL, description VARCHAR(255), applied_at timestamp, PRIMARY KEY(version))",
+	"mysql":    "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL, description VARCHAR(255), applied_at timestamp(6) NULL DEFAULT NULL, PRIMARY KEY(version)) DEFAULT CHARSET=utf8 COLLATE utf8_bin",
+}
+
+// migrations are the schema migrations in the order in which they are
+// applied. New schema changes are added as new migrations at the end of the
+// list; released migrations must never be changed.
+var migrations = []Migration{
+	{
+		Version:        1,
+		Description:    "Create the initial tables",
+		IgnoreExisting: true,
+		Up: map[string][]string{
+			"sqlite3": {
+				sqliteUsersTable,
+				sqliteAffiliationsTable,
+				sqliteCertificatesTable,
+				"CREATE TABLE IF NOT EXISTS certificates_archive (id VARCHAR(255), serial_number blob NOT NULL, authority_key_identifier blob NOT NULL, ca_label blob, status blob NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem blob, purged_at timestamp, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier))",
+				"CREATE TABLE IF NOT EXISTS credentials (id VARCHAR(255), revocation_handle VARCHAR(255) NOT NULL, cred TEXT NOT NULL, ca_label VARCHAR(1024), status VARCHAR(255) NOT NULL, reason INTEGER, revoked_at timestamp, level INTEGER DEFAULT 0, PRIMARY KEY(revocation_handle))",
+				"CREATE TABLE IF NOT EXISTS revocation_authority_info (epoch INTEGER, next_handle INTEGER, level INTEGER DEFAULT 0)",
+				"CREATE TABLE IF NOT EXISTS nonces (val VARCHAR(255) NOT NULL, expiry timestamp, level INTEGER DEFAULT 0, PRIMARY KEY(val))",
+				"CREATE TABLE IF NOT EXISTS audit (logged_at timestamp NOT NULL, caller VARCHAR(255), ca_name VARCHAR(255), action VARCHAR(64) NOT NULL, target VARCHAR(1024), changes TEXT, source VARCHAR(255), level INTEGER DEFAULT 0)",
+				"CREATE TABLE IF NOT EXISTS pending_operations (id VARCHAR(64) NOT NULL, ca_name VARCHAR(255), operation VARCHAR(64) NOT NULL, target VARCHAR(1024), request TEXT, requester VARCHAR(255) NOT NULL, requested_at timestamp, expiry timestamp, level INTEGER DEFAULT 0, PRIMARY KEY(id))",
+				"CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))",
+				"INSERT OR IGNORE INTO properties (property, value) VALUES ('identity.level', '0'), ('affiliation.level', '0'), ('certificate.level', '0')",
+			},
+			"postgres": {
+				"CREATE TABLE IF NOT EXISTS users (id VARCHAR(255), token bytea, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER,  max_enrollments INTEGER, level INTEGER DEFAULT 0, secret_expiry timestamp DEFAULT '0001-01-01 00:00:00', secret_one_time BOOLEAN DEFAULT FALSE, failed_attempts INTEGER DEFAULT 0, locked_at timestamp DEFAULT '0001-01-01 00:00:00', suspended BOOLEAN DEFAULT FALSE)",
+				"CREATE TABLE IF NOT EXISTS affiliations (name VARCHAR(1024) NOT NULL UNIQUE, prekey VARCHAR(1024), level INTEGER DEFAULT 0)",
+				"CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number bytea NOT NULL, authority_key_identifier bytea NOT NULL, ca_label bytea, status bytea NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem bytea NOT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier))",
+				"CREATE TABLE IF NOT EXISTS certificates_archive (id VARCHAR(255), serial_number bytea NOT NULL, authority_key_identifier bytea NOT NULL, ca_label bytea, status bytea NOT NULL, reason int, expiry timestamp, revoked_at timestamp, pem bytea, purged_at timestamp, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier))",
+				"CREATE TABLE IF NOT EXISTS credentials (id VARCHAR(255), revocation_handle VARCHAR(255) NOT NULL, cred TEXT NOT NULL, ca_label VARCHAR(1024), status VARCHAR(255) NOT NULL, reason int, revoked_at timestamp, level INTEGER DEFAULT 0, PRIMARY KEY(revocation_handle))",
+				"CREATE TABLE IF NOT EXISTS revocation_authority_info (epoch INTEGER, next_handle INTEGER, level INTEGER DEFAULT 0)",
+				"CREATE TABLE IF NOT EXISTS nonces (val VARCHAR(255) NOT NULL, expiry timestamp, level INTEGER DEFAULT 0, PRIMARY KEY(val))",
+				"CREATE TABLE IF NOT EXISTS audit (logged_at timestamp NOT NULL, caller VARCHAR(255), ca_name VARCHAR(255), action VARCHAR(64) NOT NULL, target VARCHAR(1024), changes TEXT, source VARCHAR(255), level INTEGER DEFAULT 0)",
+				"CREATE TABLE IF NOT EXISTS pending_operations (id VARCHAR(64) NOT NULL, ca_name VARCHAR(255), operation VARCHAR(64) NOT NULL, target VARCHAR(1024), request TEXT, requester VARCHAR(255) NOT NULL, requested_at timestamp, expiry timestamp, level INTEGER DEFAULT 0, PRIMARY KEY(id))",
+				"CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))",
+				"INSERT INTO properties (property, value) VALUES ('identity.level', '0'), ('affiliation.level', '0'), ('certificate.level', '0') ON CONFLICT (property) DO NOTHING",
+			},
+			"mysql": {
+				"CREATE TABLE IF NOT EXISTS users (id VARCHAR(255) NOT NULL, token blob, type VARCHAR(256), affiliation VARCHAR(1024), attributes TEXT, state INTEGER, max_enrollments INTEGER, level INTEGER DEFAULT 0, secret_expiry timestamp DEFAULT 0, secret_one_time BOOLEAN DEFAULT 0, failed_attempts INTEGER DEFAULT 0, locked_at timestamp DEFAULT 0, suspended BOOLEAN DEFAULT 0, PRIMARY KEY (id)) DEFAULT CHARSET=utf8 COLLATE utf8_bin",
+				"CREATE TABLE IF NOT EXISTS affiliations (id INT NOT NULL AUTO_INCREMENT, name VARCHAR(1024) NOT NULL, prekey VARCHAR(1024), level INTEGER DEFAULT 0, PRIMARY KEY (id))",
+				"CREATE INDEX name_index on affiliations (name)",
+				"CREATE TABLE IF NOT EXISTS certificates (id VARCHAR(255), serial_number varbinary(128) NOT NULL, authority_key_identifier varbinary(128) NOT NULL, ca_label varbinary(128), status varbinary(128) NOT NULL, reason int, expiry timestamp DEFAULT 0, revoked_at timestamp DEFAULT 0, pem varbinary(4096) NOT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier)) DEFAULT CHARSET=utf8 COLLATE utf8_bin",
+				"CREATE TABLE IF NOT EXISTS certificates_archive (id VARCHAR(255), serial_number varbinary(128) NOT NULL, authority_key_identifier varbinary(128) NOT NULL, ca_label varbinary(128), status varbinary(128) NOT NULL, reason int, expiry timestamp DEFAULT 0, revoked_at timestamp DEFAULT 0, pem varbinary(4096), purged_at timestamp DEFAULT 0, level INTEGER DEFAULT 0, PRIMARY KEY(serial_number, authority_key_identifier)) DEFAULT CHARSET=utf8 COLLATE utf8_bin",
+				"CREATE TABLE IF NOT EXISTS credentials (id VARCHAR(255), revocation_handle varbinary(128) NOT NULL, cred varbinary(4096) NOT NULL, ca_label varbinary(128), status varbinary(128) NOT NULL, reason int, revoked_at timestamp DEFAULT 0, level INTEGER DEFAULT 0, PRIMARY KEY(revocation_handle)) DEFAULT CHARSET=utf8 COLLATE utf8_bin",
+				"CREATE TABLE IF NOT EXISTS revocation_authority_info (epoch INTEGER, next_handle INTEGER, level INTEGER DEFAULT 0) DEFAULT CHARSET=utf8 COLLATE utf8_bin",
+				"CREATE TABLE IF NOT EXISTS nonces (val varbinary(255) NOT NULL, expiry timestamp DEFAULT 0, level INTEGER DEFAULT 0, PRIMARY KEY(val)) DEFAULT CHARSET=utf8 COLLATE utf8_bin",
+				"CREATE TABLE IF NOT EXISTS audit (logged_at timestamp(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), caller VARCHAR(255), ca_name VARCHAR(255), action VARCHAR(64) NOT NULL, target VARCHAR(1024), changes TEXT, source VARCHAR(255), level INTEGER DEFAULT 0) DEFAULT CHARSET=utf8 COLLATE utf8_bin",
+				"CREATE TABLE IF NOT EXISTS pending_operations (id VARCHAR(64) NOT NULL, ca_name VARCHAR(255), operation VARCHAR(64) NOT NULL, target VARCHAR(1024), request TEXT, requester VARCHAR(255) NOT NULL, requested_at timestamp(6) NULL DEFAULT NULL, expiry timestamp(6) NULL DEFAULT NULL, level INTEGER DEFAULT 0, PRIMARY KEY(id)) DEFAULT CHARSET=utf8 COLLATE utf8_bin",
+				"CREATE TABLE IF NOT EXISTS properties (property VARCHAR(255), value VARCHAR(256), PRIMARY KEY(property))",
+				"INSERT IGNORE INTO properties (property, value) VALUES ('identity.level', '0'), ('affiliation.level', '0'), ('certificate.level', '0')",
+			},
+		},
+	},
+	{
+		Version:     2,
+		Description: "Index certificates by enrollment ID",
+		Up: map[string][]string{
+			"sqlite3":  {"CREATE INDEX certificates_id_index ON certificates (id)"},
+			"postgres": {"CREATE INDEX certificates_id_index ON certificates (id)"},
+			"mysql":    {"CREATE INDEX certificates_id_index ON certificates (id)"},
+		},
+		Down: map[string][]string{
+			"sqlite3":  {"DROP INDEX certificates_id_index"},
+			"postgres": {"DROP INDEX certificates_id_index"},
+			"mysql":    {"DROP INDEX certificates_id_index ON certificates"},
+		},
+	},
+}
+
+// LatestSchemaVersion returns the version of the last migration known to
+// this server
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the last migration applied to the
+// database, or 0 if no migration has been applied
+func SchemaVersion(db *sqlx.DB) (int, error) {
+	err := createMigrationsTable(db)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get the schema version of the database")
+	}
+	return version, nil
+}
+
+// Migrate applies the pending migrations up to and including the target
+// version; a target of 0 applies all pending migrations. It returns the
+// number of migrations that were applied.
+func Migrate(db *sqlx.DB, target int) (int, error) {
+	latest := LatestSchemaVersion()
+	if target == 0 {
+		target = latest
+	}
+	if target < 0 || target > latest {
+		return 0, errors.Errorf("Invalid schema version %d; must be between 1 and %d", target, latest)
+	}
+	current, err := checkedSchemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if target < current {
+		return 0, errors.Errorf("The database schema version %d is newer than the requested version %d; roll back the database instead", current, target)
+	}
+	count := 0
+	for _, m := range migrations {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+		log.Infof("Applying database migration %d: %s", m.Version, m.Description)
+		err = applyMigration(db, m, true)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// MigrateBaseline applies the baseline migration to a database to which no
+// migration has been applied. Databases created before versioned migrations
+// may have outdated tables, so the tables of the baseline are created, the
+// existing tables are brought up to date by UpdateSchema, and only then is
+// the baseline recorded; if any step fails, it is retried the next time.
+func MigrateBaseline(db *sqlx.DB, levels *Levels) error {
+	current, err := checkedSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > 0 {
+		return nil
+	}
+	m := migrations[0]
+	log.Infof("Applying database migration %d: %s", m.Version, m.Description)
+	err = doTransaction(db, func(tx *sqlx.Tx, args ...interface{}) error {
+		return runMigration(tx, m, true)
+	})
+	if err != nil {
+		return err
+	}
+	err = UpdateSchema(db, levels)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update schema")
+	}
+	return doTransaction(db, func(tx *sqlx.Tx, args ...interface{}) error {
+		return recordMigration(tx, m, true)
+	})
+}
+
+// Rollback rolls back the applied migrations that are newer than the target
+// version, newest first. It returns the number of migrations that were
+// rolled back.
+func Rollback(db *sqlx.DB, target int) (int, error) {
+	if target < 0 {
+		return 0, errors.Errorf("Invalid schema version %d", target)
+	}
+	current, err := checkedSchemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	// Make sure that every migration can be rolled back before changing
+	// anything
+	var pending []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+		if m.Down == nil {
+			return 0, errors.Errorf("Database migration %d (%s) cannot be rolled back", m.Version, m.Description)
+		}
+		pending = append(pending, m)
+	}
+	for i, m := range pending {
+		log.Infof("Rolling back database migration %d: %s", m.Version, m.Description)
+		err = applyMigration(db, m, false)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(pending), nil
+}
+
+// GetMigrationStatus returns the status of each migration known to this
+// server, followed by the migrations applied to the database by a newer
+// server
+func GetMigrationStatus(db *sqlx.DB) ([]MigrationStatus, error) {
+	err := createMigrationsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	var records []migrationRecord
+	err = db.Select(&records, "SELECT version, description, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get the applied database migrations")
+	}
+	applied := make(map[int]migrationRecord)
+	for _, r := range records {
+		applied[r.Version] = r
+	}
+	var status []MigrationStatus
+	for _, m := range migrations {
+		s := MigrationStatus{Version: m.Version, Description: m.Description}
+		if r, ok := applied[m.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = r.AppliedAt
+		}
+		status = append(status, s)
+	}
+	for _, r := range records {
+		if r.Version > LatestSchemaVersion() {
+			status = append(status, MigrationStatus{
+				Version:     r.Version,
+				Description: r.Description,
+				Applied:     true,
+				AppliedAt:   r.AppliedAt,
+				Unknown:     true,
+			})
+		}
+	}
+	return status, nil
+}
+
+// checkedSchemaVersion returns the schema version of the database, or an
+// error if the database was migrated by a newer server
+func checkedSchemaVersion(db *sqlx.DB) (int, error) {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if current > LatestSchemaVersion() {
+		return 0, errors.Errorf("The database schema version %d is newer than the latest version %d known to the server. Upgrade your server.", current, LatestSchemaVersion())
+	}
+	return current, nil
+}
+
+func createMigrationsTable(db *sqlx.DB) error {
+	stmt, ok := migrationsTable[db.DriverName()]
+	if !ok {
+		return errors.Errorf("Unsupported database type: %s", db.DriverName())
+	}
+	_, err := db.Exec(stmt)
+	if err != nil {
+		return errors.Wrap(err, "Error creating schema_migrations table")
+	}
+	return nil
+}
+
+// applyMigration runs the up or down scripts of a migration and records it
+// in the schema_migrations table in a single transaction. MySQL commits DDL
+// statements implicitly, so a failed MySQL migration may be partly applied.
+func applyMigration(db *sqlx.DB, m Migration, up bool) error {
+	return doTransaction(db, func(tx *sqlx.Tx, args ...interface{}) error {
+		err := runMigration(tx, m, up)
+		if err != nil {
+			return err
+		}
+		return recordMigration(tx, m, up)
+	})
+}
+
+// runMigration runs the up or down scripts of a migration
+func runMigration(tx *sqlx.Tx, m Migration, up bool) error {
+	scripts := m.Down
+	if up {
+		scripts = m.Up
+	}
+	stmts, ok := scripts[tx.DriverName()]
+	if !ok {
+		return errors.Errorf("Database migration %d has no scripts for database type %s", m.Version, tx.DriverName())
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			if m.IgnoreExisting && isExistsError(err) {
+				log.Debugf("Ignoring error of database migration %d: %s", m.Version, err)
+				continue
+			}
+			return errors.Wrapf(err, "Database migration %d failed", m.Version)
+		}
+	}
+	return nil
+}
+
+// recordMigration adds an applied migration to, or removes a rolled back
+// migration from, the schema_migrations table
+func recordMigration(tx *sqlx.Tx, m Migration, up bool) error {
+	var err error
+	if up {
+		_, err = tx.Exec(tx.Rebind("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)"), m.Version, m.Description, time.Now().UTC())
+	} else {
+		_, err = tx.Exec(tx.Rebind("DELETE FROM schema_migrations WHERE (version = ?)"), m.Version)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to record database migration %d", m.Version)
+	}
+	return nil
+}
+
+// isExistsError returns true if the error indicates that the object being
+// created already exists
+func isExistsError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "Error 1061") || // MySQL: Duplicate key name
+		strings.Contains(msg, "already exists")
+}
@@ -0,0 +1,349 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/lib/ldap"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+)
+
+// The ways in which the hybrid registry looks up identities
+const (
+	hybridLookupFallback  = "fallback"
+	hybridLookupNamespace = "namespace"
+)
+
+// The names of the registries in the fallback order of the hybrid registry
+const (
+	hybridRegistryDB   = "db"
+	hybridRegistryLDAP = "ldap"
+)
+
+// hybridRegistry is a user registry which serves the identities of the
+// database together with those of LDAP. Identities are looked up either by
+// namespace, where the names of LDAP identities have a prefix or are DNs
+// below the LDAP base, or in each registry in turn. Identities and
+// affiliations are only written to the database, and the lists of
+// identities and affiliations of both registries are merged.
+type hybridRegistry struct {
+	db        *Accessor
+	ldap      ldapRegistry
+	lookup    string
+	order     []spi.UserRegistry
+	namespace string
+}
+
+// ldapRegistry is the LDAP registry of a hybrid registry
+type ldapRegistry interface {
+	spi.UserRegistry
+	// IsUserDN returns true if 'name' is the DN of an LDAP identity
+	IsUserDN(name string) bool
+}
+
+// newHybridRegistry returns a hybrid registry of the database and LDAP
+func newHybridRegistry(db *Accessor, lc ldapRegistry, cfg *ldap.HybridConfig) (*hybridRegistry, error) {
+	r := &hybridRegistry{
+		db:        db,
+		ldap:      lc,
+		lookup:    cfg.Lookup,
+		namespace: cfg.Namespace,
+	}
+	if r.lookup == "" {
+		r.lookup = hybridLookupFallback
+	}
+	switch r.lookup {
+	case hybridLookupFallback:
+		order := cfg.Order
+		if len(order) == 0 {
+			order = []string{hybridRegistryDB, hybridRegistryLDAP}
+		}
+		for _, name := range order {
+			var reg spi.UserRegistry
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case hybridRegistryDB:
+				reg = db
+			case hybridRegistryLDAP:
+				reg = lc
+			default:
+				return nil, errors.Errorf("Invalid registry '%s' in the hybrid registry order; it must be '%s' or '%s'",
+					name, hybridRegistryDB, hybridRegistryLDAP)
+			}
+			for _, r2 := range r.order {
+				if r2 == reg {
+					return nil, errors.Errorf("Registry '%s' is in the hybrid registry order more than once", name)
+				}
+			}
+			r.order = append(r.order, reg)
+		}
+	case hybridLookupNamespace:
+		if r.namespace == "" {
+			return nil, errors.New("The hybrid registry requires a namespace for LDAP identities with the namespace lookup")
+		}
+	default:
+		return nil, errors.Errorf("Invalid hybrid registry lookup '%s'; it must be '%s' or '%s'",
+			r.lookup, hybridLookupFallback, hybridLookupNamespace)
+	}
+	return r, nil
+}
+
+// ldapName returns the LDAP user name of 'id' and true if it is in the
+// namespace of LDAP identities
+func (r *hybridRegistry) ldapName(id string) (string, bool) {
+	if strings.HasPrefix(id, r.namespace) {
+		return strings.TrimPrefix(id, r.namespace), true
+	}
+	// Identities which authenticate with a certificate are named by its
+	// enrollment ID, which is the DN of an LDAP identity
+	return id, r.ldap.IsUserDN(id)
+}
+
+// GetUser gets the identity from the registry of its namespace or from the
+// first registry which has it
+func (r *hybridRegistry) GetUser(id string, attrs []string) (spi.User, error) {
+	if r.lookup == hybridLookupNamespace {
+		if name, ok := r.ldapName(id); ok {
+			return r.ldap.GetUser(name, attrs)
+		}
+		return r.db.GetUser(id, attrs)
+	}
+	var firstErr error
+	for _, reg := range r.order {
+		user, err := reg.GetUser(id, attrs)
+		if err == nil {
+			return user, nil
+		}
+		// Only fall back if the identity is not in a registry, so that an
+		// identity can't be shadowed while the registry is unavailable
+		if !isUserNotFound(err) {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// isUserNotFound returns true if the error of GetUser is that the registry
+// doesn't have the identity
+func isUserNotFound(err error) bool {
+	if ldap.IsUserNotFound(err) {
+		return true
+	}
+	he := getHTTPErr(err)
+	return he != nil && he.scode == 404
+}
+
+// InsertUser inserts the identity into the database. With the fallback
+// lookup, an identity which is in LDAP is rejected, since the database
+// identity would either shadow it or be shadowed by it.
+func (r *hybridRegistry) InsertUser(user *spi.UserInfo) error {
+	if r.lookup == hybridLookupNamespace {
+		if _, ok := r.ldapName(user.Name); ok {
+			return errors.Errorf("Identity '%s' is in the namespace of LDAP identities", user.Name)
+		}
+	} else {
+		_, err := r.ldap.GetUser(user.Name, nil)
+		if err == nil {
+			return errors.Errorf("Identity '%s' is already in LDAP", user.Name)
+		}
+		if !isUserNotFound(err) {
+			return errors.WithMessage(err, fmt.Sprintf("Failed to check whether identity '%s' is in LDAP", user.Name))
+		}
+	}
+	return r.db.InsertUser(user)
+}
+
+// UpdateUser updates the identity in the database
+func (r *hybridRegistry) UpdateUser(user *spi.UserInfo, updatePass bool) error {
+	return r.db.UpdateUser(user, updatePass)
+}
+
+// DeleteUser deletes the identity from the database
+func (r *hybridRegistry) DeleteUser(id string) (spi.User, error) {
+	return r.db.DeleteUser(id)
+}
+
+// GetAffiliation gets the affiliation from the database or else from LDAP
+func (r *hybridRegistry) GetAffiliation(name string) (spi.Affiliation, error) {
+	aff, err := r.db.GetAffiliation(name)
+	if err == nil {
+		return aff, nil
+	}
+	aff, ldapErr := r.ldap.GetAffiliation(name)
+	if ldapErr != nil {
+		log.Debugf("Affiliation '%s' is not in LDAP: %s", name, ldapErr)
+		return nil, err
+	}
+	return aff, nil
+}
+
+// GetAllAffiliations gets the requested affiliation and any sub affiliations
+// from both registries
+func (r *hybridRegistry) GetAllAffiliations(name string) (spi.Rows, error) {
+	affs := map[string]AffiliationRecord{}
+	for _, reg := range []spi.UserRegistry{r.db, r.ldap} {
+		rows, err := reg.GetAllAffiliations(name)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var aff AffiliationRecord
+			err = rows.StructScan(&aff)
+			if err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "Failed to read affiliation")
+			}
+			if _, ok := affs[aff.Name]; !ok {
+				affs[aff.Name] = aff
+			}
+		}
+		rows.Close()
+	}
+	names := []string{}
+	for name := range affs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []map[string]interface{}{}
+	for _, name := range names {
+		result = append(result, recordRow(affs[name]))
+	}
+	return spi.NewRows(result), nil
+}
+
+// InsertAffiliation inserts the affiliation into the database
+func (r *hybridRegistry) InsertAffiliation(name string, prekey string, level int) error {
+	return r.db.InsertAffiliation(name, prekey, level)
+}
+
+// GetProperties returns the properties from the database
+func (r *hybridRegistry) GetProperties(names []string) (map[string]string, error) {
+	return r.db.GetProperties(names)
+}
+
+// GetUserLessThanLevel returns the identities of the database that are less
+// than the level
+func (r *hybridRegistry) GetUserLessThanLevel(level int) ([]spi.User, error) {
+	return r.db.GetUserLessThanLevel(level)
+}
+
+// GetFilteredUsers returns the identities of both registries that fall under
+// the affiliation and types, and which match the filter, if it is not nil,
+// ordered by name. If both registries have an identity with the same name,
+// the one which is looked up first is returned.
+func (r *hybridRegistry) GetFilteredUsers(affiliation, types string, filter *spi.UserFilter) (spi.Rows, error) {
+	regs := r.order
+	if r.lookup == hybridLookupNamespace {
+		regs = []spi.UserRegistry{r.db, r.ldap}
+	}
+	users := map[string]UserRecord{}
+	for _, reg := range regs {
+		rows, err := reg.GetFilteredUsers(affiliation, types, filter)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var user UserRecord
+			err = rows.StructScan(&user)
+			if err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "Failed to read identity")
+			}
+			if _, ok := users[user.Name]; !ok {
+				users[user.Name] = user
+			}
+		}
+		rows.Close()
+	}
+	names := []string{}
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Each registry applied the limit, so the merged list may be longer
+	if filter != nil && filter.Limit > 0 && len(names) > filter.Limit {
+		names = names[:filter.Limit]
+	}
+	result := []map[string]interface{}{}
+	for _, name := range names {
+		result = append(result, recordRow(users[name]))
+	}
+	return spi.NewRows(result), nil
+}
+
+// DeleteAffiliation deletes the affiliation from the database
+func (r *hybridRegistry) DeleteAffiliation(name string, force, identityRemoval, isRegistrar bool) (*spi.DbTxResult, error) {
+	return r.db.DeleteAffiliation(name, force, identityRemoval, isRegistrar)
+}
+
+// ModifyAffiliation renames the affiliation in the database
+func (r *hybridRegistry) ModifyAffiliation(oldAffiliation, newAffiliation string, force, isRegistrar bool) (*spi.DbTxResult, error) {
+	return r.db.ModifyAffiliation(oldAffiliation, newAffiliation, force, isRegistrar)
+}
+
+// GetAffiliationTree returns the requested affiliation and the affiliations
+// below it in either registry
+func (r *hybridRegistry) GetAffiliationTree(name string) (*spi.DbTxResult, error) {
+	result := &spi.DbTxResult{Affiliations: []spi.Affiliation{}, Identities: []spi.User{}}
+	found := map[string]bool{}
+	var firstErr error
+	for _, reg := range []spi.UserRegistry{r.db, r.ldap} {
+		tree, err := reg.GetAffiliationTree(name)
+		if err != nil {
+			if name == "" {
+				return nil, err
+			}
+			// The affiliation need only be in one of the registries
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, aff := range tree.Affiliations {
+			if !found[aff.GetName()] {
+				found[aff.GetName()] = true
+				result.Affiliations = append(result.Affiliations, aff)
+			}
+		}
+		result.Identities = append(result.Identities, tree.Identities...)
+	}
+	if len(found) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+// recordRow returns the columns of a database record, which are named by
+// the 'db' tags of its fields
+func recordRow(rec interface{}) map[string]interface{} {
+	row := map[string]interface{}{}
+	v := reflect.ValueOf(rec)
+	for i := 0; i < v.NumField(); i++ {
+		if col := v.Type().Field(i).Tag.Get("db"); col != "" {
+			row[col] = v.Field(i).Interface()
+		}
+	}
+	return row
+}
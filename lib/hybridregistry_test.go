@@ -0,0 +1,290 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/lib/dbutil"
+	"github.com/tjfoc/fabric-ca-gm/lib/ldap"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+)
+
+const testHybridAliceDN = "uid=alice,ou=eng,ou=users,dc=example,dc=org"
+
+// testLDAPRegistry is a stand-in for the LDAP registry of a hybrid registry
+// with the users 'alice' and 'admin' and the affiliations 'users' and
+// 'users.eng'
+type testLDAPRegistry struct {
+	spi.UserRegistry
+	users map[string]spi.User
+	// err is returned by GetUser, if set, as if the directory were unavailable
+	err error
+}
+
+func newTestLDAPRegistry() *testLDAPRegistry {
+	alice := newTestAuthzUser(testHybridAliceDN, "ldap", "")
+	return &testLDAPRegistry{users: map[string]spi.User{
+		"alice":           alice,
+		testHybridAliceDN: alice,
+		"admin":           newTestAuthzUser("admin", "ldap", ""),
+	}}
+}
+
+func (r *testLDAPRegistry) IsUserDN(name string) bool {
+	return strings.HasSuffix(name, ",dc=example,dc=org")
+}
+
+func (r *testLDAPRegistry) GetUser(id string, attrs []string) (spi.User, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if user, ok := r.users[id]; ok {
+		return user, nil
+	}
+	return nil, newHTTPErr(404, ErrDBGet, "User '%s' not found", id)
+}
+
+func (r *testLDAPRegistry) GetAffiliation(name string) (spi.Affiliation, error) {
+	if name != "users" && name != "users.eng" {
+		return nil, newHTTPErr(404, ErrDBGet, "Affiliation '%s' not found", name)
+	}
+	return spi.NewAffiliation(name, "", 0), nil
+}
+
+func (r *testLDAPRegistry) GetAllAffiliations(name string) (spi.Rows, error) {
+	return spi.NewRows([]map[string]interface{}{
+		{"name": "users", "prekey": ""},
+		{"name": "users.eng", "prekey": "users"},
+	}), nil
+}
+
+func (r *testLDAPRegistry) GetFilteredUsers(affiliation, types string, filter *spi.UserFilter) (spi.Rows, error) {
+	return spi.NewRows([]map[string]interface{}{
+		{"id": "admin", "type": "client", "affiliation": "users"},
+		{"id": testHybridAliceDN, "type": "client", "affiliation": "users.eng"},
+	}), nil
+}
+
+func (r *testLDAPRegistry) GetAffiliationTree(name string) (*spi.DbTxResult, error) {
+	if name != "" && name != "users" {
+		return nil, newHTTPErr(404, ErrDBGet, "Affiliation '%s' not found", name)
+	}
+	return &spi.DbTxResult{
+		Affiliations: []spi.Affiliation{spi.NewAffiliation("users", "", 0), spi.NewAffiliation("users.eng", "users", 0)},
+		Identities:   []spi.User{r.users["alice"]},
+	}, nil
+}
+
+func newTestHybridDB(t *testing.T) (*Accessor, func()) {
+	dir, err := ioutil.TempDir("", "hybrid")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	db, err := dbutil.NewUserRegistrySQLLite3(filepath.Join(dir, "fabric-ca-server.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create database: %s", err)
+	}
+	accessor := NewDBAccessor(db)
+	for _, id := range []string{"admin", "peer1"} {
+		err = accessor.InsertUser(&spi.UserInfo{Name: id, Pass: "pass", Type: "peer", Affiliation: "org1", MaxEnrollments: -1})
+		if err != nil {
+			t.Fatalf("Failed to insert identity '%s': %s", id, err)
+		}
+	}
+	err = accessor.InsertAffiliation("org1", "", 0)
+	if err != nil {
+		t.Fatalf("Failed to insert affiliation: %s", err)
+	}
+	return accessor, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewHybridRegistry(t *testing.T) {
+	lr := newTestLDAPRegistry()
+	invalid := []ldap.HybridConfig{
+		{Lookup: "bogus"},
+		{Order: []string{"db", "file"}},
+		{Order: []string{"db", "ldap", "DB"}},
+		{Lookup: "namespace"},
+	}
+	for _, cfg := range invalid {
+		_, err := newHybridRegistry(&Accessor{}, lr, &cfg)
+		assert.Error(t, err, "The hybrid registry configuration %+v should be invalid", cfg)
+	}
+	r, err := newHybridRegistry(&Accessor{}, lr, &ldap.HybridConfig{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, hybridLookupFallback, r.lookup)
+		assert.Equal(t, []spi.UserRegistry{r.db, lr}, r.order, "The DB should be searched first by default")
+	}
+}
+
+func TestHybridRegistryLookup(t *testing.T) {
+	db, cleanup := newTestHybridDB(t)
+	defer cleanup()
+	lr := newTestLDAPRegistry()
+
+	r, err := newHybridRegistry(db, lr, &ldap.HybridConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create hybrid registry: %s", err)
+	}
+	user, err := r.GetUser("admin", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "peer", user.GetType(), "The DB identity should shadow the LDAP one")
+	}
+	user, err = r.GetUser("alice", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testHybridAliceDN, user.GetName(), "An identity which is not in the DB should be found in LDAP")
+	}
+	_, err = r.GetUser("nobody", nil)
+	assert.True(t, isUserNotFound(err), "Getting an unknown identity should fail with a not found error")
+
+	r, err = newHybridRegistry(db, lr, &ldap.HybridConfig{Order: []string{"ldap", "db"}})
+	if assert.NoError(t, err) {
+		user, err = r.GetUser("admin", nil)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "ldap", user.GetType(), "The LDAP identity should be found first")
+		}
+	}
+
+	r, err = newHybridRegistry(db, lr, &ldap.HybridConfig{Lookup: "namespace", Namespace: "ldap/"})
+	if err != nil {
+		t.Fatalf("Failed to create hybrid registry: %s", err)
+	}
+	_, err = r.GetUser("ldap/alice", nil)
+	assert.NoError(t, err, "An identity with the namespace prefix should be looked up in LDAP")
+	_, err = r.GetUser(testHybridAliceDN, nil)
+	assert.NoError(t, err, "An identity named by a DN should be looked up in LDAP")
+	_, err = r.GetUser("alice", nil)
+	assert.Error(t, err, "An identity without the namespace prefix should only be looked up in the DB")
+	user, err = r.GetUser("admin", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "peer", user.GetType())
+	}
+
+	err = r.InsertUser(&spi.UserInfo{Name: "ldap/bob", Type: "client", MaxEnrollments: -1})
+	assert.Error(t, err, "An identity in the LDAP namespace can't be inserted")
+	err = r.InsertUser(&spi.UserInfo{Name: "orderer1", Pass: "pass", Type: "orderer", Affiliation: "org1", MaxEnrollments: -1})
+	if assert.NoError(t, err) {
+		_, err = db.GetUser("orderer1", nil)
+		assert.NoError(t, err, "The identity should have been inserted into the DB")
+	}
+}
+
+func TestHybridRegistryInsertUser(t *testing.T) {
+	db, cleanup := newTestHybridDB(t)
+	defer cleanup()
+	lr := newTestLDAPRegistry()
+
+	for _, order := range [][]string{{"db", "ldap"}, {"ldap", "db"}} {
+		r, err := newHybridRegistry(db, lr, &ldap.HybridConfig{Order: order})
+		if err != nil {
+			t.Fatalf("Failed to create hybrid registry: %s", err)
+		}
+		err = r.InsertUser(&spi.UserInfo{Name: "alice", Pass: "pass", Type: "client", Affiliation: "org1", MaxEnrollments: -1})
+		assert.Error(t, err, "An identity which is in LDAP can't be inserted with the order %v", order)
+	}
+	_, err := db.GetUser("alice", nil)
+	assert.Error(t, err, "The LDAP identity should not have been inserted into the DB")
+
+	r, err := newHybridRegistry(db, lr, &ldap.HybridConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create hybrid registry: %s", err)
+	}
+	err = r.InsertUser(&spi.UserInfo{Name: "orderer1", Pass: "pass", Type: "orderer", Affiliation: "org1", MaxEnrollments: -1})
+	if assert.NoError(t, err, "An identity which is not in LDAP should be inserted") {
+		_, err = db.GetUser("orderer1", nil)
+		assert.NoError(t, err, "The identity should have been inserted into the DB")
+	}
+
+	// The identity can't be inserted if it is unknown whether LDAP has it
+	lr.err = errors.New("LDAP server is unavailable")
+	err = r.InsertUser(&spi.UserInfo{Name: "orderer2", Pass: "pass", Type: "orderer", Affiliation: "org1", MaxEnrollments: -1})
+	assert.Error(t, err, "Inserting an identity should fail while LDAP is unavailable")
+}
+
+func TestHybridRegistryLists(t *testing.T) {
+	db, cleanup := newTestHybridDB(t)
+	defer cleanup()
+
+	r, err := newHybridRegistry(db, newTestLDAPRegistry(), &ldap.HybridConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create hybrid registry: %s", err)
+	}
+
+	rows, err := r.GetFilteredUsers("", "peer,client", &spi.UserFilter{Limit: 3})
+	if assert.NoError(t, err) {
+		ids := []string{}
+		for rows.Next() {
+			var id UserRecord
+			assert.NoError(t, rows.StructScan(&id))
+			ids = append(ids, id.Name+":"+id.Type)
+		}
+		assert.Equal(t, []string{"admin:peer", "peer1:peer", testHybridAliceDN + ":client"}, ids)
+	}
+
+	rows, err = r.GetAllAffiliations("")
+	if assert.NoError(t, err) {
+		affs := []string{}
+		for rows.Next() {
+			var aff AffiliationRecord
+			assert.NoError(t, rows.StructScan(&aff))
+			affs = append(affs, aff.Name)
+		}
+		assert.Equal(t, []string{"org1", "users", "users.eng"}, affs)
+	}
+
+	_, err = r.GetAffiliation("users.eng")
+	assert.NoError(t, err, "An affiliation which is only in LDAP should be found")
+	_, err = r.GetAffiliation("org2")
+	assert.Error(t, err)
+
+	tree, err := r.GetAffiliationTree("users")
+	if assert.NoError(t, err, "The tree of an affiliation which is only in LDAP should be found") {
+		assert.Len(t, tree.Affiliations, 2)
+		assert.Len(t, tree.Identities, 1)
+	}
+	tree, err = r.GetAffiliationTree("")
+	if assert.NoError(t, err) {
+		assert.Len(t, tree.Affiliations, 3)
+	}
+	_, err = r.GetAffiliationTree("org2")
+	assert.Error(t, err, "Getting the tree of an unknown affiliation should fail")
+}
+
+func TestCALDAPRegistry(t *testing.T) {
+	lc, err := ldap.NewClient(&ldap.Config{URL: "ldap://admin:pw@localhost/dc=example,dc=org"}, nil)
+	if err != nil {
+		t.Fatalf("ldap.NewClient failure: %s", err)
+	}
+	hr, err := newHybridRegistry(&Accessor{}, lc, &ldap.HybridConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create hybrid registry: %s", err)
+	}
+	assert.True(t, lc == (&CA{registry: lc}).ldapRegistry())
+	assert.True(t, lc == (&CA{registry: hr}).ldapRegistry(), "The LDAP client of a hybrid registry should be returned")
+	assert.Nil(t, (&CA{registry: &Accessor{}}).ldapRegistry(), "There is no LDAP client without LDAP")
+}
@@ -0,0 +1,379 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/kisielk/sqlstruct"
+)
+
+const (
+	insertCredentialSQL = `
+INSERT INTO credentials (id, revocation_handle, cred, ca_label, status, reason, revoked_at, level)
+	VALUES (:id, :revocation_handle, :cred, :ca_label, :status, :reason, :revoked_at, :level);`
+
+	selectCredentialsByIDSQL = `
+SELECT %s FROM credentials
+WHERE (id = ?);`
+
+	selectCredentialByRevocationHandleSQL = `
+SELECT %s FROM credentials
+WHERE (revocation_handle = ? AND ca_label = ?);`
+
+	selectRevokedCredentialsSQL = `
+SELECT %s FROM credentials
+WHERE (status = 'revoked' AND ca_label = ?);`
+
+	updateRevokeCredentialsSQL = `
+UPDATE credentials
+SET status='revoked', revoked_at=CURRENT_TIMESTAMP, reason=:reason
+WHERE (id = :id AND ca_label = :ca_label AND status != 'revoked');`
+
+	updateRevokeCredentialSQL = `
+UPDATE credentials
+SET status='revoked', revoked_at=CURRENT_TIMESTAMP, reason=:reason
+WHERE (revocation_handle = :revocation_handle AND ca_label = :ca_label AND status != 'revoked');`
+
+	insertNonceSQL = `
+INSERT INTO nonces (val, expiry, level)
+	VALUES (?, ?, ?);`
+
+	deleteExpiredNoncesSQL = `
+DELETE FROM nonces
+WHERE (expiry < ?);`
+)
+
+// CredRecord represents an Idemix credential stored in the credentials table
+type CredRecord struct {
+	ID               string    `db:"id"`
+	RevocationHandle string    `db:"revocation_handle"`
+	Cred             string    `db:"cred"`
+	CALabel          string    `db:"ca_label"`
+	Status           string    `db:"status"`
+	Reason           int       `db:"reason"`
+	RevokedAt        time.Time `db:"revoked_at"`
+	Level            int       `db:"level"`
+}
+
+// revocationAuthorityInfo is the single row of the revocation_authority_info table
+type revocationAuthorityInfo struct {
+	Epoch      int `db:"epoch"`
+	NextHandle int `db:"next_handle"`
+	Level      int `db:"level"`
+}
+
+// IdemixCredDBAccessor stores and retrieves Idemix credentials, nonces and
+// revocation authority information of a CA
+type IdemixCredDBAccessor struct {
+	db *sqlx.DB
+}
+
+// NewIdemixCredDBAccessor returns a new IdemixCredDBAccessor
+func NewIdemixCredDBAccessor(db *sqlx.DB) *IdemixCredDBAccessor {
+	return &IdemixCredDBAccessor{db: db}
+}
+
+func (d *IdemixCredDBAccessor) checkDB() error {
+	if d.db == nil {
+		return errors.New("Database is not set")
+	}
+	return nil
+}
+
+// InsertCredential puts a CredRecord into the database
+func (d *IdemixCredDBAccessor) InsertCredential(cr CredRecord) error {
+	log.Debugf("DB: Insert Idemix credential with revocation handle %s", cr.RevocationHandle)
+
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	cr.RevokedAt = cr.RevokedAt.UTC()
+	res, err := d.db.NamedExec(insertCredentialSQL, &cr)
+	if err != nil {
+		return errors.Wrap(err, "Failed to insert credential into database")
+	}
+
+	numRowsAffected, err := res.RowsAffected()
+	if numRowsAffected != 1 {
+		return errors.Errorf("Expected to affect 1 entry in credentials table but affected %d",
+			numRowsAffected)
+	}
+
+	return err
+}
+
+// GetCredentialsByID returns all of the Idemix credentials issued to an identity
+func (d *IdemixCredDBAccessor) GetCredentialsByID(id string) (crs []CredRecord, err error) {
+	log.Debugf("DB: Get Idemix credentials by ID (%s)", id)
+
+	err = d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.db.Select(&crs, fmt.Sprintf(d.db.Rebind(selectCredentialsByIDSQL), sqlstruct.Columns(CredRecord{})), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return crs, nil
+}
+
+// GetCredential returns the Idemix credential issued by the CA 'caLabel' with
+// the revocation handle 'rh'
+func (d *IdemixCredDBAccessor) GetCredential(rh, caLabel string) (*CredRecord, error) {
+	log.Debugf("DB: Get Idemix credential by revocation handle (%s)", rh)
+
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	cr := new(CredRecord)
+	err = d.db.Get(cr, fmt.Sprintf(d.db.Rebind(selectCredentialByRevocationHandleSQL), sqlstruct.Columns(CredRecord{})), rh, caLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// GetRevokedCredentials returns all Idemix credentials revoked by the CA 'caLabel'
+func (d *IdemixCredDBAccessor) GetRevokedCredentials(caLabel string) (crs []CredRecord, err error) {
+	log.Debugf("DB: Get revoked Idemix credentials of CA '%s'", caLabel)
+
+	err = d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.db.Select(&crs, fmt.Sprintf(d.db.Rebind(selectRevokedCredentialsSQL), sqlstruct.Columns(CredRecord{})), caLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	return crs, nil
+}
+
+// RevokeCredential revokes the Idemix credential issued by the CA 'caLabel' with
+// the revocation handle 'rh' and advances the epoch of the revocation authority
+func (d *IdemixCredDBAccessor) RevokeCredential(rh, caLabel string, reasonCode int) error {
+	log.Debugf("DB: Revoke Idemix credential by revocation handle (%s)", rh)
+
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	tx := d.db.MustBegin()
+	record := &CredRecord{RevocationHandle: rh, CALabel: caLabel, Reason: reasonCode}
+	res, err := tx.NamedExec(updateRevokeCredentialSQL, record)
+	if err == nil {
+		var numRowsAffected int64
+		numRowsAffected, err = res.RowsAffected()
+		if err == nil && numRowsAffected != 1 {
+			err = errors.Errorf("Expected to affect 1 entry in credentials table but affected %d", numRowsAffected)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE revocation_authority_info SET epoch = epoch + 1")
+	}
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			log.Errorf("Error encountered while rolling back transaction: %s", err2)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "Error encountered while committing transaction")
+	}
+
+	return nil
+}
+
+// RevokeCredentialsByID revokes all Idemix credentials issued by the CA 'caLabel'
+// to an identity and advances the epoch of the revocation authority if any
+// credential was revoked
+func (d *IdemixCredDBAccessor) RevokeCredentialsByID(id, caLabel string, reasonCode int) (crs []CredRecord, err error) {
+	log.Debugf("DB: Revoke Idemix credentials by ID (%s)", id)
+
+	err = d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := d.db.MustBegin()
+	err = tx.Select(&crs, tx.Rebind("SELECT * FROM credentials WHERE (id = ? AND ca_label = ? AND status != 'revoked')"), id, caLabel)
+	if err == nil && len(crs) > 0 {
+		record := &CredRecord{ID: id, CALabel: caLabel, Reason: reasonCode}
+		_, err = tx.NamedExec(updateRevokeCredentialsSQL, record)
+		if err == nil {
+			_, err = tx.Exec("UPDATE revocation_authority_info SET epoch = epoch + 1")
+		}
+	}
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			log.Errorf("Error encountered while rolling back transaction: %s", err2)
+		}
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error encountered while committing transaction")
+	}
+
+	return crs, nil
+}
+
+// initRevocationAuthorityInfo creates the row of the revocation_authority_info
+// table if it does not exist yet
+func (d *IdemixCredDBAccessor) initRevocationAuthorityInfo() error {
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	var count int
+	err = d.db.Get(&count, "SELECT count(*) FROM revocation_authority_info")
+	if err != nil {
+		return errors.Wrap(err, "Failed to get revocation authority information")
+	}
+	if count > 0 {
+		return nil
+	}
+
+	log.Debug("DB: Initializing revocation authority information")
+	_, err = d.db.Exec(d.db.Rebind("INSERT INTO revocation_authority_info (epoch, next_handle, level) VALUES (?, ?, ?)"), 0, 1, 0)
+	if err != nil {
+		return errors.Wrap(err, "Failed to initialize revocation authority information")
+	}
+	return nil
+}
+
+// getRevocationAuthorityInfo returns the current epoch and next revocation handle
+func (d *IdemixCredDBAccessor) getRevocationAuthorityInfo() (*revocationAuthorityInfo, error) {
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	info := new(revocationAuthorityInfo)
+	err = d.db.Get(info, "SELECT epoch, next_handle, level FROM revocation_authority_info")
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("Revocation authority information was not found in the database")
+		}
+		return nil, errors.Wrap(err, "Failed to get revocation authority information")
+	}
+	return info, nil
+}
+
+// NextRevocationHandle allocates a revocation handle that has not been used
+// for any other credential, even by other servers in a cluster
+func (d *IdemixCredDBAccessor) NextRevocationHandle() (int, error) {
+	const maxAttempts = 10
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		info, err := d.getRevocationAuthorityInfo()
+		if err != nil {
+			return 0, err
+		}
+		res, err := d.db.Exec(d.db.Rebind("UPDATE revocation_authority_info SET next_handle = ? WHERE (next_handle = ?)"),
+			info.NextHandle+1, info.NextHandle)
+		if err != nil {
+			return 0, errors.Wrap(err, "Failed to update revocation authority information")
+		}
+		numRowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return 0, errors.Wrap(err, "db.RowsAffected failed")
+		}
+		if numRowsAffected == 1 {
+			return info.NextHandle, nil
+		}
+		// Another server allocated this handle concurrently, so try again
+		log.Debugf("Revocation handle %d was allocated concurrently, retrying", info.NextHandle)
+	}
+	return 0, errors.Errorf("Failed to allocate a revocation handle after %d attempts", maxAttempts)
+}
+
+// InsertNonce stores a nonce which expires at 'expiry' and removes any
+// nonces which have already expired
+func (d *IdemixCredDBAccessor) InsertNonce(nonce string, expiry time.Time) error {
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(d.db.Rebind(deleteExpiredNoncesSQL), time.Now().UTC())
+	if err != nil {
+		log.Warningf("Failed to remove expired nonces: %s", err)
+	}
+
+	_, err = d.db.Exec(d.db.Rebind(insertNonceSQL), nonce, expiry.UTC(), 0)
+	if err != nil {
+		return errors.Wrap(err, "Failed to store nonce")
+	}
+	return nil
+}
+
+// ConsumeNonce removes a nonce from the database. An error is returned if the
+// nonce is unknown, has expired, or was already consumed.
+func (d *IdemixCredDBAccessor) ConsumeNonce(nonce string) error {
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	var expiry time.Time
+	err = d.db.Get(&expiry, d.db.Rebind("SELECT expiry FROM nonces WHERE (val = ?)"), nonce)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errors.New("Nonce not found")
+		}
+		return errors.Wrap(err, "Failed to get nonce")
+	}
+
+	res, err := d.db.Exec(d.db.Rebind("DELETE FROM nonces WHERE (val = ?)"), nonce)
+	if err != nil {
+		return errors.Wrap(err, "Failed to remove nonce")
+	}
+	numRowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "db.RowsAffected failed")
+	}
+	if numRowsAffected != 1 {
+		return errors.New("Nonce was already used")
+	}
+
+	if time.Now().UTC().After(expiry.UTC()) {
+		return errors.Errorf("Nonce expired at %s", expiry.UTC())
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/idemix"
+	"github.com/milagro-crypto/amcl/version3/go/amcl"
+	"github.com/milagro-crypto/amcl/version3/go/amcl/FP256BN"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+const (
+	// Names of the attributes of an Idemix credential, in the order in which
+	// they appear in the issuer public key
+	idemixAttrOU               = "OU"
+	idemixAttrRole             = "Role"
+	idemixAttrEnrollmentID     = "EnrollmentID"
+	idemixAttrRevocationHandle = "RevocationHandle"
+
+	// Values of the Role attribute, which match the MSP role values
+	idemixRoleMember = 0
+	idemixRoleAdmin  = 1
+
+	// The identity attribute which causes the Role attribute of a credential to be admin
+	idemixAdminAttr = "isAdmin"
+
+	defaultIdemixIssuerPublicKeyfile      = "IssuerPublicKey"
+	defaultIdemixIssuerSecretKeyfile      = "msp/keystore/IssuerSecretKey"
+	defaultIdemixRevocationPublicKeyfile  = "IssuerRevocationPublicKey"
+	defaultIdemixRevocationPrivateKeyfile = "msp/keystore/IssuerRevocationPrivateKey"
+	defaultIdemixNonceExpiration          = 15 * time.Second
+)
+
+var idemixAttributeNames = []string{idemixAttrOU, idemixAttrRole, idemixAttrEnrollmentID, idemixAttrRevocationHandle}
+
+// IdemixCRI is the credential revocation information (CRI) of the Idemix
+// issuer of a CA. It lists the revocation handles of all revoked credentials
+// and is signed by the revocation authority of the CA.
+type IdemixCRI struct {
+	// Epoch is incremented each time a credential is revoked
+	Epoch int `json:"epoch"`
+	// RevokedHandles are the revocation handles of the revoked credentials
+	RevokedHandles []string `json:"revokedHandles"`
+	// Signature is the ASN.1 encoded ECDSA signature over the SHA-256 digest of
+	// the JSON encoding of this CRI without the signature
+	Signature []byte `json:"signature,omitempty"`
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func (cri *IdemixCRI) digest() ([]byte, error) {
+	unsigned := *cri
+	unsigned.Signature = nil
+	buf, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal CRI")
+	}
+	digest := sha256.Sum256(buf)
+	return digest[:], nil
+}
+
+// Verify verifies the signature of the CRI with the public key of the
+// revocation authority
+func (cri *IdemixCRI) Verify(pub *ecdsa.PublicKey) error {
+	digest, err := cri.digest()
+	if err != nil {
+		return err
+	}
+	sig := new(ecdsaSignature)
+	_, err = asn1.Unmarshal(cri.Signature, sig)
+	if err != nil {
+		return errors.Wrap(err, "Failed to unmarshal CRI signature")
+	}
+	if !ecdsa.Verify(pub, digest, sig.R, sig.S) {
+		return errors.New("Invalid CRI signature")
+	}
+	return nil
+}
+
+// IsRevoked returns true if the credential with revocation handle 'rh' is revoked
+func (cri *IdemixCRI) IsRevoked(rh string) bool {
+	for _, handle := range cri.RevokedHandles {
+		if handle == rh {
+			return true
+		}
+	}
+	return false
+}
+
+// idemixIssuer issues Idemix credentials on behalf of a CA
+type idemixIssuer struct {
+	ca            *CA
+	issuerKey     *idemix.IssuerKey
+	revocationKey *ecdsa.PrivateKey
+	// The random number generator is not safe for concurrent use
+	rng   *amcl.RAND
+	mutex sync.Mutex
+}
+
+// Initialize the Idemix issuer of the CA, generating its key pair and the
+// key pair of its revocation authority if they do not exist yet
+func (ca *CA) initIdemixIssuer() error {
+	log.Debug("Initialize Idemix issuer")
+
+	rng, err := idemix.GetRand()
+	if err != nil {
+		return errors.Wrap(err, "Failed to initialize random number generator for Idemix issuer")
+	}
+	issuer := &idemixIssuer{ca: ca, rng: rng}
+	cfg := &ca.Config.Idemix
+
+	if util.FileExists(cfg.IssuerPublicKeyfile) && util.FileExists(cfg.IssuerSecretKeyfile) {
+		issuer.issuerKey, err = loadIdemixIssuerKey(cfg.IssuerPublicKeyfile, cfg.IssuerSecretKeyfile)
+		if err != nil {
+			return err
+		}
+		log.Infof("Loaded Idemix issuer public key from %s", cfg.IssuerPublicKeyfile)
+	} else {
+		issuer.issuerKey, err = idemix.NewIssuerKey(idemixAttributeNames, rng)
+		if err != nil {
+			return errors.Wrap(err, "Failed to generate Idemix issuer key")
+		}
+		err = storeIdemixIssuerKey(issuer.issuerKey, cfg.IssuerPublicKeyfile, cfg.IssuerSecretKeyfile)
+		if err != nil {
+			return err
+		}
+		log.Infof("The Idemix issuer public key was stored at %s", cfg.IssuerPublicKeyfile)
+	}
+
+	if util.FileExists(cfg.RevocationPrivateKeyfile) {
+		issuer.revocationKey, err = loadIdemixRevocationKey(cfg.RevocationPrivateKeyfile)
+		if err != nil {
+			return err
+		}
+	} else {
+		issuer.revocationKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			return errors.Wrap(err, "Failed to generate Idemix revocation authority key")
+		}
+		err = storeIdemixRevocationKey(issuer.revocationKey, cfg.RevocationPublicKeyfile, cfg.RevocationPrivateKeyfile)
+		if err != nil {
+			return err
+		}
+		log.Infof("The Idemix revocation public key was stored at %s", cfg.RevocationPublicKeyfile)
+	}
+
+	ca.idemixIssuer = issuer
+	return nil
+}
+
+func loadIdemixIssuerKey(pubKeyFile, secretKeyFile string) (*idemix.IssuerKey, error) {
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read Idemix issuer public key from '%s'", pubKeyFile)
+	}
+	secretKeyBytes, err := ioutil.ReadFile(secretKeyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read Idemix issuer secret key from '%s'", secretKeyFile)
+	}
+	ipk := new(idemix.IssuerPublicKey)
+	err = proto.Unmarshal(pubKeyBytes, ipk)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to unmarshal Idemix issuer public key from '%s'", pubKeyFile)
+	}
+	err = ipk.Check()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid Idemix issuer public key")
+	}
+	if strings.Join(ipk.AttributeNames, ",") != strings.Join(idemixAttributeNames, ",") {
+		return nil, errors.Errorf("Idemix issuer public key in '%s' has attributes %v but %v are required",
+			pubKeyFile, ipk.AttributeNames, idemixAttributeNames)
+	}
+	return &idemix.IssuerKey{ISk: secretKeyBytes, IPk: ipk}, nil
+}
+
+func storeIdemixIssuerKey(key *idemix.IssuerKey, pubKeyFile, secretKeyFile string) error {
+	pubKeyBytes, err := proto.Marshal(key.IPk)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal Idemix issuer public key")
+	}
+	err = writeFile(secretKeyFile, key.ISk, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store Idemix issuer secret key at '%s'", secretKeyFile)
+	}
+	err = writeFile(pubKeyFile, pubKeyBytes, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store Idemix issuer public key at '%s'", pubKeyFile)
+	}
+	return nil
+}
+
+func loadIdemixRevocationKey(privKeyFile string) (*ecdsa.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(privKeyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read Idemix revocation private key from '%s'", privKeyFile)
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.Errorf("Failed to decode PEM-encoded Idemix revocation private key in '%s'", privKeyFile)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse Idemix revocation private key in '%s'", privKeyFile)
+	}
+	return key, nil
+}
+
+func storeIdemixRevocationKey(key *ecdsa.PrivateKey, pubKeyFile, privKeyFile string) error {
+	privKeyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal Idemix revocation private key")
+	}
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal Idemix revocation public key")
+	}
+	err = writeFile(privKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privKeyBytes}), 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store Idemix revocation private key at '%s'", privKeyFile)
+	}
+	err = writeFile(pubKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyBytes}), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store Idemix revocation public key at '%s'", pubKeyFile)
+	}
+	return nil
+}
+
+// publicKeyBytes returns the serialized Idemix issuer public key
+func (i *idemixIssuer) publicKeyBytes() ([]byte, error) {
+	return proto.Marshal(i.issuerKey.IPk)
+}
+
+// revocationPublicKeyBytes returns the PEM-encoded public key of the revocation authority
+func (i *idemixIssuer) revocationPublicKeyBytes() ([]byte, error) {
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(&i.revocationKey.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal Idemix revocation public key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyBytes}), nil
+}
+
+// newNonce generates a nonce to be used in a credential request and stores it
+// in the database so that it can be used once before it expires
+func (i *idemixIssuer) newNonce() ([]byte, error) {
+	i.mutex.Lock()
+	nonce := idemix.BigToBytes(idemix.RandModOrder(i.rng))
+	i.mutex.Unlock()
+	expiry := time.Now().Add(i.ca.Config.Idemix.NonceExpiration)
+	err := i.ca.idemixCredDBAccessor.InsertNonce(hex.EncodeToString(nonce), expiry)
+	if err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// issueCredential verifies the credential request of 'caller' and issues
+// a credential containing the caller's OU, role, enrollment ID and a newly
+// allocated revocation handle
+func (i *idemixIssuer) issueCredential(caller spi.User, req *idemix.CredRequest) (*idemix.Credential, map[string]interface{}, error) {
+	err := i.ca.idemixCredDBAccessor.ConsumeNonce(hex.EncodeToString(req.GetIssuerNonce()))
+	if err != nil {
+		return nil, nil, newHTTPErr(400, ErrBadNonce, "Invalid nonce in credential request: %s", err)
+	}
+	err = req.Check(i.issuerKey.IPk)
+	if err != nil {
+		return nil, nil, newHTTPErr(400, ErrBadCredRequest, "Invalid credential request: %s", err)
+	}
+
+	id := caller.GetName()
+	ou := strings.Join(caller.GetAffiliationPath(), ".")
+	role := idemixRoleMember
+	attr, err := caller.GetAttribute(idemixAdminAttr)
+	if err == nil && attr.Value == "true" {
+		role = idemixRoleAdmin
+	}
+	rh, err := i.ca.idemixCredDBAccessor.NextRevocationHandle()
+	if err != nil {
+		return nil, nil, newHTTPErr(500, ErrIdemixIssueFailure, "Failed to get revocation handle: %s", err)
+	}
+
+	attrs := []*FP256BN.BIG{
+		idemix.HashModOrder([]byte(ou)),
+		FP256BN.NewBIGint(role),
+		idemix.HashModOrder([]byte(id)),
+		FP256BN.NewBIGint(rh),
+	}
+	i.mutex.Lock()
+	cred, err := idemix.NewCredential(i.issuerKey, req, attrs, i.rng)
+	i.mutex.Unlock()
+	if err != nil {
+		return nil, nil, newHTTPErr(500, ErrIdemixIssueFailure, "Failed to issue credential to '%s': %s", id, err)
+	}
+
+	credBytes, err := proto.Marshal(cred)
+	if err != nil {
+		return nil, nil, newHTTPErr(500, ErrIdemixIssueFailure, "Failed to marshal credential: %s", err)
+	}
+	err = i.ca.idemixCredDBAccessor.InsertCredential(CredRecord{
+		ID:               id,
+		RevocationHandle: strconv.Itoa(rh),
+		Cred:             util.B64Encode(credBytes),
+		CALabel:          i.ca.Config.CA.Name,
+		Status:           "good",
+	})
+	if err != nil {
+		return nil, nil, newHTTPErr(500, ErrIdemixIssueFailure, "Failed to store credential: %s", err)
+	}
+	log.Debugf("Issued Idemix credential with revocation handle %d to '%s'", rh, id)
+
+	attrValues := map[string]interface{}{
+		idemixAttrOU:               ou,
+		idemixAttrRole:             role,
+		idemixAttrEnrollmentID:     id,
+		idemixAttrRevocationHandle: strconv.Itoa(rh),
+	}
+	return cred, attrValues, nil
+}
+
+// getCRI returns the current credential revocation information, signed by
+// the revocation authority
+func (i *idemixIssuer) getCRI() (*IdemixCRI, error) {
+	info, err := i.ca.idemixCredDBAccessor.getRevocationAuthorityInfo()
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := i.ca.idemixCredDBAccessor.GetRevokedCredentials(i.ca.Config.CA.Name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get revoked credentials")
+	}
+	cri := &IdemixCRI{Epoch: info.Epoch, RevokedHandles: []string{}}
+	for _, rec := range revoked {
+		cri.RevokedHandles = append(cri.RevokedHandles, rec.RevocationHandle)
+	}
+	digest, err := cri.digest()
+	if err != nil {
+		return nil, err
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, i.revocationKey, digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to sign CRI")
+	}
+	cri.Signature, err = asn1.Marshal(ecdsaSignature{R: r, S: s})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal CRI signature")
+	}
+	return cri, nil
+}
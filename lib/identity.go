@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -172,12 +173,17 @@ func (i *Identity) Revoke(req *api.RevocationRequest) (*api.RevocationResponse,
 	if err != nil {
 		return nil, err
 	}
-	log.Debugf("Successfully revoked certificates: %+v", req)
+	if result.Pending != nil {
+		log.Debugf("Revocation is pending approval as operation '%s'", result.Pending.ID)
+	} else {
+		log.Debugf("Successfully revoked certificates: %+v", req)
+	}
 	crl, err := util.B64Decode(result.CRL)
 	if err != nil {
 		return nil, err
 	}
-	return &api.RevocationResponse{RevokedCerts: result.RevokedCerts, CRL: crl}, nil
+	return &api.RevocationResponse{RevokedCerts: result.RevokedCerts, RevokedCredentials: result.RevokedCredentials,
+		CRL: crl, Pending: result.Pending}, nil
 }
 
 // RevokeSelf revokes the current identity and all certificates
@@ -226,7 +232,7 @@ func (i *Identity) GetIdentity(id, caname string) (*api.GetIDResponse, error) {
 // GetAllIdentities returns all identities that the caller is authorized to see
 func (i *Identity) GetAllIdentities(caname string, cb func(*json.Decoder) error) error {
 	log.Debugf("Entering identity.GetAllIdentities")
-	err := i.GetStreamResponse("identities", caname, "result.identities", cb)
+	err := i.GetStreamResponse("identities", caname, "result.identities", cb, nil)
 	if err != nil {
 		return err
 	}
@@ -234,6 +240,79 @@ func (i *Identity) GetAllIdentities(caname string, cb func(*json.Decoder) error)
 	return nil
 }
 
+// GetIdentities streams a page of the identities that the caller is
+// authorized to see and which match the request to the 'cb' callback
+// function, one identity at a time. It returns the cursor of the next page,
+// which is empty if this is the last page.
+func (i *Identity) GetIdentities(req *api.GetIdentitiesRequest, cb func(*json.Decoder) error) (string, error) {
+	log.Debugf("Entering identity.GetIdentities %+v", req)
+	httpReq, err := i.client.newGet("identities")
+	if err != nil {
+		return "", err
+	}
+	if req.CAName != "" {
+		addQueryParm(httpReq, "ca", req.CAName)
+	}
+	if req.Limit > 0 {
+		addQueryParm(httpReq, "limit", strconv.Itoa(req.Limit))
+	}
+	if req.Cursor != "" {
+		addQueryParm(httpReq, "cursor", req.Cursor)
+	}
+	for _, a := range req.Attributes {
+		addQueryParm(httpReq, "attr", a)
+	}
+	if req.State != nil {
+		addQueryParm(httpReq, "state", strconv.Itoa(*req.State))
+	}
+	if req.MaxEnrollments != nil {
+		addQueryParm(httpReq, "maxenrollments", strconv.Itoa(*req.MaxEnrollments))
+	}
+	err = i.addTokenAuthHdr(httpReq, nil)
+	if err != nil {
+		return "", err
+	}
+	cursor := ""
+	err = i.client.StreamResponseWithValue(httpReq, "result.identities", cb, "result.cursor", func(val interface{}) error {
+		var ok bool
+		cursor, ok = val.(string)
+		if !ok {
+			return errors.Errorf("Invalid cursor '%v' in response", val)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Successfully retrieved identities; next cursor: '%s'", cursor)
+	return cursor, nil
+}
+
+// GetAuditLog streams the records of the audit log which match the request
+// to the 'cb' callback function, one record at a time
+func (i *Identity) GetAuditLog(req *api.GetAuditLogRequest, cb func(*json.Decoder) error) error {
+	log.Debugf("Entering identity.GetAuditLog %+v", req)
+	queryParam := map[string]string{}
+	if !req.Since.IsZero() {
+		queryParam["since"] = req.Since.UTC().Format(time.RFC3339)
+	}
+	if !req.Until.IsZero() {
+		queryParam["until"] = req.Until.UTC().Format(time.RFC3339)
+	}
+	if req.Caller != "" {
+		queryParam["caller"] = req.Caller
+	}
+	if req.Action != "" {
+		queryParam["action"] = req.Action
+	}
+	err := i.GetStreamResponse("audit", req.CAName, "result.records", cb, queryParam)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Successfully retrieved audit log")
+	return nil
+}
+
 // AddIdentity adds a new identity to the server
 func (i *Identity) AddIdentity(req *api.AddIdentityRequest) (*api.IdentityResponse, error) {
 	log.Debugf("Entering identity.AddIdentity with request: %+v", req)
@@ -280,6 +359,76 @@ func (i *Identity) ModifyIdentity(req *api.ModifyIdentityRequest) (*api.Identity
 	return result, nil
 }
 
+// ResetSecret replaces the enrollment secret of an existing identity with a new
+// random secret, which is returned in the response
+func (i *Identity) ResetSecret(req *api.ResetSecretRequest) (*api.IdentityResponse, error) {
+	log.Debugf("Entering identity.ResetSecret with request: %+v", req)
+	if req.ID == "" {
+		return nil, errors.New("Name of the identity whose secret is to be reset is required")
+	}
+
+	reqBody, err := util.Marshal(req, "resetSecret")
+	if err != nil {
+		return nil, err
+	}
+
+	// Send a post to the "identities/<id>/secret" endpoint with req as body
+	result := &api.IdentityResponse{}
+	err = i.Post(fmt.Sprintf("identities/%s/secret", req.ID), reqBody, result, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Successfully reset secret of identity '%s'", result.ID)
+	return result, nil
+}
+
+// UnlockIdentity unlocks an identity which was locked out due to repeated
+// failed logins
+func (i *Identity) UnlockIdentity(req *api.UnlockIdentityRequest) (*api.IdentityResponse, error) {
+	log.Debugf("Entering identity.UnlockIdentity with request: %+v", req)
+	if req.ID == "" {
+		return nil, errors.New("Name of the identity to be unlocked is required")
+	}
+
+	reqBody, err := util.Marshal(req, "unlockIdentity")
+	if err != nil {
+		return nil, err
+	}
+
+	// Send a post to the "identities/<id>/unlock" endpoint with req as body
+	result := &api.IdentityResponse{}
+	err = i.Post(fmt.Sprintf("identities/%s/unlock", req.ID), reqBody, result, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Successfully unlocked identity '%s'", result.ID)
+	return result, nil
+}
+
+// ImportIdentities adds a batch of identities to the server. If any identity of
+// the batch is rejected, none of them are added; the response gives the result
+// for each identity.
+func (i *Identity) ImportIdentities(req *api.ImportIdentitiesRequest) (*api.ImportIdentitiesResponse, error) {
+	log.Debugf("Entering identity.ImportIdentities with %d identities", len(req.Identities))
+
+	reqBody, err := util.Marshal(req, "importIdentities")
+	if err != nil {
+		return nil, err
+	}
+
+	// Send a post to the "batch/identities" endpoint with req as body
+	result := &api.ImportIdentitiesResponse{}
+	err = i.Post("batch/identities", reqBody, result, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Import of identities completed, added: %t", result.Added)
+	return result, nil
+}
+
 // RemoveIdentity removes a new identity from the server
 func (i *Identity) RemoveIdentity(req *api.RemoveIdentityRequest) (*api.IdentityResponse, error) {
 	log.Debugf("Entering identity.RemoveIdentity with request: %+v", req)
@@ -302,6 +451,88 @@ func (i *Identity) RemoveIdentity(req *api.RemoveIdentityRequest) (*api.Identity
 	return result, nil
 }
 
+// GetPendingOperations returns the operations which are waiting to be
+// confirmed and which the caller may confirm
+func (i *Identity) GetPendingOperations(caname string) (*api.GetPendingOperationsResponse, error) {
+	log.Debug("Entering identity.GetPendingOperations")
+	result := &api.GetPendingOperationsResponse{}
+	err := i.Get("operations", caname, result)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Successfully retrieved %d pending operations", len(result.Operations))
+	return result, nil
+}
+
+// GetLDAPCache returns the statistics of the cache of LDAP users of the server
+func (i *Identity) GetLDAPCache(caname string) (*api.LDAPCacheResponse, error) {
+	log.Debug("Entering identity.GetLDAPCache")
+	result := &api.LDAPCacheResponse{}
+	err := i.Get("ldap/cache", caname, result)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Successfully retrieved LDAP cache statistics: %+v", result)
+	return result, nil
+}
+
+// InvalidateLDAPCache removes an LDAP user, or all LDAP users if the ID of
+// the request is empty, from the cache of LDAP users of the server
+func (i *Identity) InvalidateLDAPCache(req *api.InvalidateLDAPCacheRequest) (*api.LDAPCacheResponse, error) {
+	log.Debugf("Entering identity.InvalidateLDAPCache with request: %+v", req)
+	result := &api.LDAPCacheResponse{}
+	queryParam := map[string]string{"ca": req.CAName}
+	if req.ID != "" {
+		queryParam["id"] = req.ID
+	}
+	err := i.Delete("ldap/cache", result, queryParam)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Successfully removed %d entries from LDAP cache", result.Invalidated)
+	return result, nil
+}
+
+// Backup returns a signed archive of the state of every CA of the server
+func (i *Identity) Backup(caname string) (*api.BackupResponse, error) {
+	log.Debug("Entering identity.Backup")
+	var result backupResponseNet
+	err := i.Get("backup", caname, &result)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := util.B64Decode(result.Archive)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Successfully retrieved a backup of %d bytes", len(archive))
+	return &api.BackupResponse{Archive: archive}, nil
+}
+
+// ConfirmOperation confirms an operation which was requested by another
+// identity, which is then performed on behalf of the caller
+func (i *Identity) ConfirmOperation(req *api.ConfirmOperationRequest) (*api.ConfirmOperationResponse, error) {
+	log.Debugf("Entering identity.ConfirmOperation with request: %+v", req)
+	if req.ID == "" {
+		return nil, errors.New("ID of the operation to be confirmed is required")
+	}
+
+	reqBody, err := util.Marshal(req, "confirmOperation")
+	if err != nil {
+		return nil, err
+	}
+
+	// Send a post to the "operations/<id>/confirm" endpoint with req as body
+	result := &api.ConfirmOperationResponse{}
+	err = i.Post(fmt.Sprintf("operations/%s/confirm", req.ID), reqBody, result, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Successfully confirmed operation '%s'", req.ID)
+	return result, nil
+}
+
 // GetAffiliation returns information about the requested affiliation
 func (i *Identity) GetAffiliation(affiliation, caname string) (*api.AffiliationResponse, error) {
 	log.Debugf("Entering identity.GetAffiliation %+v", affiliation)
@@ -428,7 +659,7 @@ func (i *Identity) Get(endpoint, caname string, result interface{}) error {
 }
 
 // GetStreamResponse sends a request to an endpoint and streams the response
-func (i *Identity) GetStreamResponse(endpoint, caname, stream string, cb func(*json.Decoder) error) error {
+func (i *Identity) GetStreamResponse(endpoint, caname, stream string, cb func(*json.Decoder) error, queryParam map[string]string) error {
 	req, err := i.client.newGet(endpoint)
 	if err != nil {
 		return err
@@ -436,6 +667,9 @@ func (i *Identity) GetStreamResponse(endpoint, caname, stream string, cb func(*j
 	if caname != "" {
 		addQueryParm(req, "ca", caname)
 	}
+	for key, value := range queryParam {
+		addQueryParm(req, key, value)
+	}
 	err = i.addTokenAuthHdr(req, nil)
 	if err != nil {
 		return err
@@ -504,7 +738,7 @@ func (i *Identity) addTokenAuthHdr(req *http.Request, body []byte) error {
 	log.Debug("Adding token-based authorization header")
 	cert := i.ecert.cert
 	key := i.ecert.key
-	token, err := util.CreateToken(i.CSP, cert, key, body)
+	token, err := util.CreateRequestToken(i.CSP, cert, key, req.Method, req.URL.RequestURI(), body)
 	if err != nil {
 		return errors.WithMessage(err, "Failed to add token authorization header")
 	}
@@ -0,0 +1,151 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ldap
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// The defaults of the cache settings which are not configured
+const (
+	defaultCacheTTL  = 5 * time.Minute
+	defaultCacheSize = 10000
+)
+
+// CacheStats is the number of entries of the cache of LDAP users and the
+// number of lookups which it has served
+type CacheStats struct {
+	// Entries is the number of cached lookups, including those of users
+	// which were not found
+	Entries int
+	// Hits is the number of lookups of users which were found in the cache
+	Hits uint64
+	// NegativeHits is the number of lookups which the cache answered with
+	// a user which is known not to exist
+	NegativeHits uint64
+	// Misses is the number of lookups which were sent to the LDAP server
+	Misses uint64
+}
+
+// userCache caches the users which are looked up by name, together with the
+// values of their converters, and the names of users which were not found
+type userCache struct {
+	mutex       sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	entries     map[string]cacheEntry
+	stats       CacheStats
+}
+
+// cacheEntry is a cached lookup of a user
+type cacheEntry struct {
+	user   *user // nil if the user was not found
+	expiry time.Time
+}
+
+func newUserCache(cfg *CacheConfig) *userCache {
+	c := &userCache{
+		ttl:         durationVal(cfg.TTL, defaultCacheTTL),
+		negativeTTL: cfg.NegativeTTL,
+		size:        cfg.Size,
+		entries:     map[string]cacheEntry{},
+	}
+	if c.size <= 0 {
+		c.size = defaultCacheSize
+	}
+	return c
+}
+
+// get returns the cached lookup of the user 'name' and true, or false if
+// the lookup is not cached. The user is nil if it was not found.
+func (c *userCache) get(name string, now time.Time) (*user, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[name]
+	if !ok || !now.Before(e.expiry) {
+		delete(c.entries, name)
+		c.stats.Misses++
+		return nil, false
+	}
+	if e.user == nil {
+		c.stats.NegativeHits++
+	} else {
+		c.stats.Hits++
+	}
+	return e.user, true
+}
+
+// add caches the lookup of the user 'name', which was not found if 'u' is
+// nil. If the cache is full, expired entries are removed, and then the
+// entries which expire first.
+func (c *userCache) add(name string, u *user, now time.Time) {
+	ttl := c.ttl
+	if u == nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[name]; !ok && len(c.entries) >= c.size {
+		for n, e := range c.entries {
+			if !now.Before(e.expiry) {
+				delete(c.entries, n)
+			}
+		}
+		for len(c.entries) >= c.size {
+			first := ""
+			for n, e := range c.entries {
+				if first == "" || e.expiry.Before(c.entries[first].expiry) {
+					first = n
+				}
+			}
+			delete(c.entries, first)
+		}
+	}
+	c.entries[name] = cacheEntry{user: u, expiry: now.Add(ttl)}
+}
+
+// invalidate removes the lookups of the user 'name', which is either the
+// name by which it was looked up or its DN, or all lookups if 'name' is
+// empty, and returns the number of entries which were removed
+func (c *userCache) invalidate(name string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := 0
+	for n, e := range c.entries {
+		if name == "" || n == name ||
+			(e.user != nil && (e.user.name == name || strings.EqualFold(e.user.entry.DN, name))) {
+			delete(c.entries, n)
+			count++
+		}
+	}
+	return count
+}
+
+// getStats returns the statistics of the cache
+func (c *userCache) getStats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
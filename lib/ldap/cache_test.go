@@ -0,0 +1,110 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestLDAPCache(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.stop()
+
+	c, err := NewClient(&Config{
+		URL:       srv.url(),
+		Cache:     CacheConfig{Enabled: true, NegativeTTL: time.Minute},
+		Attribute: AttrConfig{Converters: []NameVal{{Name: "mailto", Value: `"mailto:" + attr("mail")`}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("ldap.NewClient failure: %s", err)
+	}
+	user, err := c.GetUser("jsmith", nil)
+	if err != nil {
+		t.Fatalf("Failed to get user: %s", err)
+	}
+	srv.stop()
+
+	// The cached user and its converters are returned without the server
+	user2, err := c.GetUser("jsmith", nil)
+	if assert.NoError(t, err, "The cached user should be returned while the server is down") {
+		assert.True(t, user == user2)
+		attr, err := user2.GetAttribute("mailto")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "mailto:jsmith", attr.Value)
+		}
+	}
+	stats, enabled := c.CacheStats()
+	assert.True(t, enabled)
+	assert.Equal(t, CacheStats{Entries: 1, Hits: 1, Misses: 1}, stats)
+
+	assert.Equal(t, 1, c.InvalidateCache(testUserDN), "A user should be invalidated by its DN")
+	_, err = c.GetUser("jsmith", nil)
+	assert.Error(t, err, "An invalidated user should be looked up again")
+}
+
+func TestLDAPCacheNegative(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.stop()
+
+	c, err := NewClient(&Config{URL: srv.url(), Cache: CacheConfig{Enabled: true, NegativeTTL: time.Minute}}, nil)
+	if err != nil {
+		t.Fatalf("ldap.NewClient failure: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = c.GetUser("nobody", nil)
+		assert.True(t, IsUserNotFound(err), "Getting an unknown user should fail with a not found error")
+	}
+	stats, _ := c.CacheStats()
+	assert.Equal(t, CacheStats{Entries: 1, NegativeHits: 1, Misses: 1}, stats)
+	assert.Equal(t, 1, c.InvalidateCache(""))
+
+	c, err = NewClient(&Config{URL: srv.url()}, nil)
+	if err != nil {
+		t.Fatalf("ldap.NewClient failure: %s", err)
+	}
+	_, enabled := c.CacheStats()
+	assert.False(t, enabled, "The cache should be disabled by default")
+}
+
+func TestUserCache(t *testing.T) {
+	c := newUserCache(&CacheConfig{TTL: time.Minute, Size: 2})
+	now := time.Now()
+	users := map[string]*user{}
+	for _, name := range []string{"u1", "u2", "u3"} {
+		users[name] = &user{name: name, entry: ldap.NewEntry("uid="+name+","+testBase, nil)}
+	}
+	c.add("u1", users["u1"], now)
+	c.add("u2", users["u2"], now.Add(time.Second))
+	c.add("nobody", nil, now)
+	c.add("u3", users["u3"], now.Add(2*time.Second))
+
+	_, ok := c.get("nobody", now)
+	assert.False(t, ok, "A user which was not found should not be cached without a negative TTL")
+	_, ok = c.get("u1", now)
+	assert.False(t, ok, "The entry which expires first should be evicted from a full cache")
+	u, ok := c.get("u3", now.Add(time.Minute))
+	if assert.True(t, ok) {
+		assert.Equal(t, users["u3"], u)
+	}
+	_, ok = c.get("u2", now.Add(time.Minute+time.Second))
+	assert.False(t, ok, "An expired entry should not be returned")
+	assert.Equal(t, CacheStats{Entries: 1, Hits: 1, Misses: 3}, c.getStats())
+}
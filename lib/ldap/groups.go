@@ -0,0 +1,150 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ldap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// The ways in which the groups of a user are found
+const (
+	groupResolutionMemberOf = "memberof"
+	groupResolutionNested   = "nested"
+	groupResolutionInChain  = "inchain"
+)
+
+// memberOfAttr is the attribute of an entry with the DNs of its groups
+const memberOfAttr = "memberOf"
+
+// inChainFilter matches the groups of which the entry with a DN is a member,
+// either directly or through other groups, using the LDAP_MATCHING_RULE_IN_CHAIN
+// rule of Active Directory
+const inChainFilter = "(member:1.2.840.113556.1.4.1941:=%s)"
+
+// getGroups returns the DNs of the groups of the user, in order
+func (u *user) getGroups() ([]string, error) {
+	if u.groups != nil {
+		return u.groups, nil
+	}
+	var groups []string
+	var err error
+	if u.client.groupResolution == groupResolutionInChain {
+		groups, err = u.client.getInChainGroups(u.entry.DN)
+	} else {
+		groups, err = u.client.getMemberOf(u.entry)
+		if err == nil && u.client.groupResolution == groupResolutionNested {
+			groups, err = u.client.getNestedGroups(groups)
+		}
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("Failed to get the groups of LDAP user '%s'", u.name))
+	}
+	sort.Strings(groups)
+	log.Debugf("Groups of LDAP user '%s' are %v", u.name, groups)
+	u.groups = groups
+	return groups, nil
+}
+
+// getMemberOf returns the DNs in the memberOf attribute of an entry, which is
+// read from the directory if the entry was found without it
+func (lc *Client) getMemberOf(entry *ldap.Entry) ([]string, error) {
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, memberOfAttr) {
+			return attr.Values, nil
+		}
+	}
+	sreq := lc.newSearchRequest("(objectClass=*)", []string{memberOfAttr})
+	sreq.BaseDN = entry.DN
+	sreq.Scope = ldap.ScopeBaseObject
+	sresp, err := lc.search(sreq)
+	if ldap.IsErrorWithCode(errors.Cause(err), ldap.LDAPResultNoSuchObject) {
+		log.Debugf("LDAP entry '%s' does not exist", entry.DN)
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(sresp.Entries) == 0 {
+		return []string{}, nil
+	}
+	return sresp.Entries[0].GetAttributeValues(memberOfAttr), nil
+}
+
+// getNestedGroups returns the groups of 'direct' together with the groups of
+// which they are members, following the memberOf attributes of groups to at
+// most the maximum depth
+func (lc *Client) getNestedGroups(direct []string) ([]string, error) {
+	seen := map[string]bool{}
+	groups := []string{}
+	level := direct
+	for depth := 1; len(level) > 0; depth++ {
+		next := []string{}
+		for _, dn := range level {
+			key := strings.ToLower(dn)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			groups = append(groups, dn)
+			if depth == lc.groupMaxDepth {
+				log.Debugf("Not following the groups of LDAP group '%s' beyond depth %d", dn, depth)
+				continue
+			}
+			parents, err := lc.getMemberOf(&ldap.Entry{DN: dn})
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, parents...)
+		}
+		level = next
+	}
+	return groups, nil
+}
+
+// getInChainGroups returns the DNs of the groups of which the entry with the
+// DN is a member, either directly or through other groups, by asking Active
+// Directory to follow the chain of memberships
+func (lc *Client) getInChainGroups(dn string) ([]string, error) {
+	// Request no attributes; only the DNs of the groups are needed
+	filter := fmt.Sprintf(inChainFilter, ldap.EscapeFilter(dn))
+	sresp, err := lc.searchWithPaging(lc.newSearchRequest(filter, []string{"1.1"}), lc.pageSize)
+	if err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, entry := range sresp.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+// groupCN returns the value of the leading CN of the DN of a group, or "" if
+// its first component is not a CN
+func groupCN(dn string) string {
+	rdn := strings.SplitN(dn, ",", 2)[0]
+	parts := strings.SplitN(rdn, "=", 2)
+	if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), "cn") {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
@@ -0,0 +1,117 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ldap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getTestGroups returns the value of the 'groups' converter of the user
+func getTestGroups(t *testing.T, c *Client, username string) string {
+	user, err := c.GetUser(username, nil)
+	if err != nil {
+		t.Fatalf("Failed to get user '%s': %s", username, err)
+	}
+	attr, err := user.GetAttribute("groups")
+	if err != nil {
+		t.Fatalf("Failed to get the groups of user '%s': %s", username, err)
+	}
+	return attr.Value
+}
+
+func TestLDAPGroups(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.stop()
+
+	_, err := NewClient(&Config{URL: srv.url(), Groups: GroupsConfig{Resolution: "recursive"}}, nil)
+	assert.Error(t, err, "An unknown group resolution should be invalid")
+
+	converters := []NameVal{
+		{Name: "groups", Value: `groups(";")`},
+		{Name: "hf.Registrar.Roles", Value: `if(inGroup("Staff"), "client,peer", "")`},
+	}
+	cases := []struct {
+		groups GroupsConfig
+		jsmith string
+		alice  string
+	}{
+		{GroupsConfig{}, testAdminsDN, testStaffDN},
+		{GroupsConfig{Resolution: "nested"}, testAdminsDN + ";" + testAllDN + ";" + testStaffDN, testAllDN + ";" + testStaffDN},
+		{GroupsConfig{Resolution: "nested", MaxDepth: 2}, testAdminsDN + ";" + testStaffDN, testAllDN + ";" + testStaffDN},
+		{GroupsConfig{Resolution: "inchain"}, testAdminsDN + ";" + testAllDN + ";" + testStaffDN, testAllDN + ";" + testStaffDN},
+	}
+	for _, tc := range cases {
+		c, err := NewClient(&Config{URL: srv.url(), Groups: tc.groups, Attribute: AttrConfig{Converters: converters}}, nil)
+		if err != nil {
+			t.Fatalf("ldap.NewClient failure: %s", err)
+		}
+		assert.Equal(t, tc.jsmith, getTestGroups(t, c, "jsmith"), "Wrong groups of jsmith with %+v", tc.groups)
+		assert.Equal(t, tc.alice, getTestGroups(t, c, "alice"), "Wrong groups of alice with %+v", tc.groups)
+		assert.Empty(t, getTestGroups(t, c, "bob"), "bob is not a member of a group")
+	}
+
+	c, err := NewClient(&Config{URL: srv.url(), Groups: GroupsConfig{Resolution: "nested"}, Attribute: AttrConfig{Converters: converters}}, nil)
+	if err != nil {
+		t.Fatalf("ldap.NewClient failure: %s", err)
+	}
+	for username, roles := range map[string]string{"jsmith": "client,peer", "alice": "client,peer", "bob": ""} {
+		user, err := c.GetUser(username, nil)
+		if assert.NoError(t, err) {
+			attr, err := user.GetAttribute("hf.Registrar.Roles")
+			if assert.NoError(t, err) {
+				assert.Equal(t, roles, attr.Value, "Wrong registrar roles of %s", username)
+			}
+		}
+	}
+}
+
+func TestLDAPAffiliationConverter(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.stop()
+
+	_, err := NewClient(&Config{URL: srv.url(), Affiliation: AffiliationConfig{Source: "converter"}}, nil)
+	assert.Error(t, err, "The converter affiliation source should require a converter")
+	_, err = NewClient(&Config{URL: srv.url(), Affiliation: AffiliationConfig{Source: "converter", Converter: "groups("}}, nil)
+	assert.Error(t, err, "An invalid affiliation converter should fail")
+
+	c, err := NewClient(&Config{
+		URL:         srv.url(),
+		Groups:      GroupsConfig{Resolution: "nested"},
+		Affiliation: AffiliationConfig{Source: "converter", Converter: `if(inGroup("admins"), "org1.admins", if(inGroup("staff"), "org1", "org2"))`},
+	}, nil)
+	if err != nil {
+		t.Fatalf("ldap.NewClient failure: %s", err)
+	}
+	user, err := c.GetUser("jsmith", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"org1", "admins"}, user.GetAffiliationPath())
+	}
+	assert.Equal(t, []string{"uid=alice:org1", "uid=bob:org2", "uid=jsmith:org1.admins"},
+		listTestUsers(t, c, "", "client", nil))
+	assert.Equal(t, []string{"org1:", "org1.admins:org1", "org2:"}, listTestAffiliations(t, c, ""))
+
+	c, err = NewClient(&Config{URL: srv.url(), Affiliation: AffiliationConfig{Source: "converter", Converter: `"org1." + attr("uid")`}}, nil)
+	if err != nil {
+		t.Fatalf("ldap.NewClient failure: %s", err)
+	}
+	user, err = c.GetUser("alice", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"org1", "alice"}, user.GetAffiliationPath())
+	}
+}
@@ -0,0 +1,373 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ldap
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+	"github.com/tjfoc/fabric-ca-gm/util"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// filterAttrRegex matches the term of a filter which compares an attribute
+// with the user name, such as "(uid=%s)"
+var filterAttrRegex = regexp.MustCompile(`\(([^()=~<>&|!]+)=%s\)`)
+
+// The filter which matches the OUs of the directory, from which the
+// affiliations come if their source is "dn"
+const ouFilter = "(objectClass=organizationalUnit)"
+
+// GetAffiliation returns an affiliation group
+func (lc *Client) GetAffiliation(name string) (spi.Affiliation, error) {
+	affs, err := lc.listAffiliations()
+	if err != nil {
+		return nil, err
+	}
+	if !util.StrContained(name, affs) {
+		return nil, errors.Errorf("Affiliation '%s' does not exist in LDAP directory", name)
+	}
+	return spi.NewAffiliation(name, parentAffiliation(name), 0), nil
+}
+
+// GetAllAffiliations gets the requested affiliation and any sub affiliations
+// from the LDAP directory
+func (lc *Client) GetAllAffiliations(name string) (spi.Rows, error) {
+	log.Debugf("Getting LDAP affiliations at or below '%s'", name)
+	affs, err := lc.listAffiliations()
+	if err != nil {
+		return nil, err
+	}
+	rows := []map[string]interface{}{}
+	for _, aff := range affs {
+		if isAffiliationWithin(aff, name) {
+			rows = append(rows, map[string]interface{}{
+				"name":   aff,
+				"prekey": parentAffiliation(aff),
+				"level":  0,
+			})
+		}
+	}
+	return spi.NewRows(rows), nil
+}
+
+// GetFilteredUsers returns all LDAP users that fall under the affiliation
+// and types, and which match the filter, if it is not nil, ordered by name.
+// All LDAP users are of type "client" and have a state and maximum number
+// of enrollments of 0.
+func (lc *Client) GetFilteredUsers(affiliation, types string, filter *spi.UserFilter) (spi.Rows, error) {
+	log.Debugf("Getting LDAP users per affiliation '%s', types '%s' and filter %+v", affiliation, types, filter)
+	rows := []map[string]interface{}{}
+	typesArray := strings.Split(types, ",")
+	for i := range typesArray {
+		typesArray[i] = strings.TrimSpace(typesArray[i])
+	}
+	if !util.StrContained("client", typesArray) {
+		return spi.NewRows(rows), nil
+	}
+	if filter == nil {
+		filter = &spi.UserFilter{}
+	}
+	if (filter.State != nil && *filter.State != 0) ||
+		(filter.MaxEnrollments != nil && *filter.MaxEnrollments != 0) {
+		return spi.NewRows(rows), nil
+	}
+	users, err := lc.listUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if filter.Limit > 0 && len(rows) >= filter.Limit {
+			break
+		}
+		if filter.After != "" && u.GetName() <= filter.After {
+			continue
+		}
+		aff := strings.Join(u.GetAffiliationPath(), ".")
+		if !isAffiliationWithin(aff, affiliation) {
+			continue
+		}
+		attrs, err := u.GetAttributes(nil)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("Failed to get the attributes of LDAP user '%s'", u.GetName()))
+		}
+		if !hasAttributes(attrs, filter.Attributes) {
+			continue
+		}
+		buf, err := json.Marshal(attrs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to marshal the attributes of LDAP user '%s'", u.GetName())
+		}
+		rows = append(rows, map[string]interface{}{
+			"id":          u.GetName(),
+			"type":        u.GetType(),
+			"affiliation": aff,
+			"attributes":  string(buf),
+		})
+	}
+	return spi.NewRows(rows), nil
+}
+
+// GetAffiliationTree returns the requested affiliation, all affiliations
+// below it, and the LDAP users which have them
+func (lc *Client) GetAffiliationTree(name string) (*spi.DbTxResult, error) {
+	log.Debugf("Getting LDAP affiliation tree for '%s'", name)
+	affs, err := lc.listAffiliations()
+	if err != nil {
+		return nil, err
+	}
+	if name != "" && !util.StrContained(name, affs) {
+		return nil, errors.Errorf("Affiliation '%s' does not exist in LDAP directory", name)
+	}
+	result := &spi.DbTxResult{Affiliations: []spi.Affiliation{}, Identities: []spi.User{}}
+	for _, aff := range affs {
+		if isAffiliationWithin(aff, name) {
+			result.Affiliations = append(result.Affiliations, spi.NewAffiliation(aff, parentAffiliation(aff), 0))
+		}
+	}
+	users, err := lc.listUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if isAffiliationWithin(strings.Join(u.GetAffiliationPath(), "."), name) {
+			result.Identities = append(result.Identities, u)
+		}
+	}
+	return result, nil
+}
+
+// listUsers returns the users which match the user filter, ordered by DN
+func (lc *Client) listUsers() ([]*user, error) {
+	sresp, err := lc.searchWithPaging(lc.newSearchRequest(fmt.Sprintf(lc.UserFilter, "*"), lc.userAttrNames()), lc.pageSize)
+	if err != nil {
+		return nil, err
+	}
+	var members map[string]string
+	if lc.affiliationSource == affiliationSourceGroups {
+		members, _, err = lc.listGroups()
+		if err != nil {
+			return nil, err
+		}
+	}
+	users := []*user{}
+	for _, entry := range sresp.Entries {
+		u := &user{name: lc.getUserName(entry), entry: entry, client: lc}
+		if members != nil {
+			aff, ok := members[u.name]
+			if !ok {
+				aff = members[entry.DN]
+			}
+			u.affiliation = splitAffiliation(aff)
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].GetName() < users[j].GetName() })
+	log.Debugf("Found %d LDAP users", len(users))
+	return users, nil
+}
+
+// userAttrNames returns the names of the attributes to request for users
+// which are not searched for by user name, which include the attribute
+// with the user name
+func (lc *Client) userAttrNames() []string {
+	nameAttr := filterAttribute(lc.UserFilter)
+	if len(lc.attrNames) == 0 || nameAttr == "" {
+		return lc.attrNames
+	}
+	return append([]string{nameAttr}, lc.attrNames...)
+}
+
+// getUserName returns the user name of an entry, which is the value of the
+// attribute which the user filter compares with it, or else its DN
+func (lc *Client) getUserName(entry *ldap.Entry) string {
+	nameAttr := filterAttribute(lc.UserFilter)
+	if nameAttr != "" && entry.GetAttributeValue(nameAttr) != "" {
+		return entry.GetAttributeValue(nameAttr)
+	}
+	return entry.DN
+}
+
+// listAffiliations returns the names of the affiliations of the directory,
+// including the parents of each, in order
+func (lc *Client) listAffiliations() ([]string, error) {
+	names := []string{}
+	switch lc.affiliationSource {
+	case affiliationSourceGroups:
+		_, groups, err := lc.listGroups()
+		if err != nil {
+			return nil, err
+		}
+		names = groups
+	case affiliationSourceConverter:
+		// The affiliations are those of the users
+		users, err := lc.listUsers()
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			names = append(names, strings.Join(u.GetAffiliationPath(), "."))
+		}
+	default:
+		// Request no attributes; the affiliation comes from the DN
+		sresp, err := lc.searchWithPaging(lc.newSearchRequest(ouFilter, []string{"1.1"}), lc.pageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range sresp.Entries {
+			names = append(names, strings.Join(getDNAffiliationPath(entry.DN), "."))
+		}
+	}
+	set := map[string]bool{}
+	for _, name := range names {
+		for ; name != ""; name = parentAffiliation(name) {
+			set[name] = true
+		}
+	}
+	affs := []string{}
+	for name := range set {
+		affs = append(affs, name)
+	}
+	sort.Strings(affs)
+	return affs, nil
+}
+
+// listGroups returns the names of the groups which match the group filter,
+// in order, and a map from each member of a group to the first of its groups
+func (lc *Client) listGroups() (map[string]string, []string, error) {
+	memberAttr := filterAttribute(lc.GroupFilter)
+	if memberAttr == "" {
+		return nil, nil, errors.Errorf("The LDAP group filter '%s' must compare an attribute with '%%s' to list the members of groups", lc.GroupFilter)
+	}
+	sresp, err := lc.searchWithPaging(lc.newSearchRequest(fmt.Sprintf(lc.GroupFilter, "*"), []string{"cn", memberAttr}), lc.pageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(sresp.Entries, func(i, j int) bool {
+		return sresp.Entries[i].GetAttributeValue("cn") < sresp.Entries[j].GetAttributeValue("cn")
+	})
+	members := map[string]string{}
+	groups := []string{}
+	for _, entry := range sresp.Entries {
+		name := entry.GetAttributeValue("cn")
+		if name == "" {
+			continue
+		}
+		groups = append(groups, name)
+		for _, member := range entry.GetAttributeValues(memberAttr) {
+			if _, ok := members[member]; !ok {
+				members[member] = name
+			}
+		}
+	}
+	return members, groups, nil
+}
+
+// getGroupAffiliation returns the name of the first group of the user
+// 'username', or "" if it is not a member of a group
+func (lc *Client) getGroupAffiliation(username string) (string, error) {
+	filter := fmt.Sprintf(lc.GroupFilter, ldap.EscapeFilter(username))
+	sresp, err := lc.search(lc.newSearchRequest(filter, []string{"cn"}))
+	if err != nil {
+		return "", err
+	}
+	groups := []string{}
+	for _, entry := range sresp.Entries {
+		if name := entry.GetAttributeValue("cn"); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	if len(groups) == 0 {
+		return "", nil
+	}
+	sort.Strings(groups)
+	if len(groups) > 1 {
+		log.Debugf("LDAP user '%s' is a member of groups %v; its affiliation is '%s'", username, groups, groups[0])
+	}
+	return groups[0], nil
+}
+
+// newSearchRequest returns a request to search the subtree of the base
+// for entries which match 'filter'
+func (lc *Client) newSearchRequest(filter string, attrNames []string) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(
+		lc.Base, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		attrNames,
+		nil,
+	)
+}
+
+// filterAttribute returns the name of the attribute which 'filter' compares
+// with the user name, or "" if there is none
+func filterAttribute(filter string) string {
+	m := filterAttrRegex.FindStringSubmatch(filter)
+	if m == nil {
+		return ""
+	}
+	return strings.TrimSpace(m[1])
+}
+
+// hasAttributes returns true if 'attrs' has all of the attributes in
+// 'want'; an attribute with an empty value matches any value
+func hasAttributes(attrs, want []api.Attribute) bool {
+	for _, w := range want {
+		found := false
+		for _, a := range attrs {
+			if a.Name == w.Name && (w.Value == "" || a.Value == w.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// isAffiliationWithin returns true if 'aff' is 'name' or below it; every
+// affiliation is within ""
+func isAffiliationWithin(aff, name string) bool {
+	return name == "" || aff == name || strings.HasPrefix(aff, name+".")
+}
+
+// parentAffiliation returns the name of the parent of an affiliation, or ""
+// if it is a root affiliation
+func parentAffiliation(name string) string {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return ""
+	}
+	return name[:i]
+}
+
+// splitAffiliation returns the path of an affiliation name
+func splitAffiliation(name string) []string {
+	if name == "" {
+		return []string{}
+	}
+	return strings.Split(name, ".")
+}
@@ -0,0 +1,157 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ldap
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+)
+
+type testUserRow struct {
+	Name        string `db:"id"`
+	Affiliation string `db:"affiliation"`
+	Attributes  string `db:"attributes"`
+}
+
+type testAffiliationRow struct {
+	Name   string `db:"name"`
+	Prekey string `db:"prekey"`
+}
+
+// listTestUsers returns the rows of GetFilteredUsers as "<id>:<affiliation>"
+func listTestUsers(t *testing.T, c *Client, affiliation, types string, filter *spi.UserFilter) []string {
+	rows, err := c.GetFilteredUsers(affiliation, types, filter)
+	if err != nil {
+		t.Fatalf("GetFilteredUsers failed: %s", err)
+	}
+	defer rows.Close()
+	users := []string{}
+	for rows.Next() {
+		var row testUserRow
+		err = rows.StructScan(&row)
+		if err != nil {
+			t.Fatalf("StructScan failed: %s", err)
+		}
+		users = append(users, strings.SplitN(row.Name, ",", 2)[0]+":"+row.Affiliation)
+	}
+	return users
+}
+
+// listTestAffiliations returns the rows of GetAllAffiliations as "<name>:<prekey>"
+func listTestAffiliations(t *testing.T, c *Client, name string) []string {
+	rows, err := c.GetAllAffiliations(name)
+	if err != nil {
+		t.Fatalf("GetAllAffiliations failed: %s", err)
+	}
+	defer rows.Close()
+	affs := []string{}
+	for rows.Next() {
+		var row testAffiliationRow
+		err = rows.StructScan(&row)
+		if err != nil {
+			t.Fatalf("StructScan failed: %s", err)
+		}
+		affs = append(affs, row.Name+":"+row.Prekey)
+	}
+	return affs
+}
+
+func TestLDAPListFromDN(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.stop()
+
+	c, err := NewClient(&Config{URL: srv.url(), PageSize: 2, Attribute: AttrConfig{Names: []string{"mail"}}}, nil)
+	if err != nil {
+		t.Fatalf("ldap.NewClient failure: %s", err)
+	}
+	assert.Equal(t, []string{"uid=alice:users.eng", "uid=bob:users.eng", "uid=jsmith:users"},
+		listTestUsers(t, c, "", "client", nil))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&srv.pages), "The three users should have been read in two pages")
+
+	assert.Equal(t, []string{"uid=alice:users.eng", "uid=bob:users.eng"}, listTestUsers(t, c, "users.eng", "peer, client", nil))
+	assert.Empty(t, listTestUsers(t, c, "", "peer", nil), "All LDAP users are clients")
+	assert.Equal(t, []string{"uid=bob:users.eng"}, listTestUsers(t, c, "", "client",
+		&spi.UserFilter{Attributes: []api.Attribute{{Name: "mail", Value: "bob"}}}))
+	state := 1
+	assert.Empty(t, listTestUsers(t, c, "", "client", &spi.UserFilter{State: &state}))
+	assert.Equal(t, []string{"uid=bob:users.eng"}, listTestUsers(t, c, "", "client",
+		&spi.UserFilter{After: "uid=alice,ou=eng,ou=users,dc=example,dc=org", Limit: 1}))
+
+	assert.Equal(t, []string{"groups:", "users:", "users.eng:users"}, listTestAffiliations(t, c, ""))
+	assert.Equal(t, []string{"users.eng:users"}, listTestAffiliations(t, c, "users.eng"))
+
+	aff, err := c.GetAffiliation("users.eng")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "users", aff.GetPrekey())
+	}
+	_, err = c.GetAffiliation("org1")
+	assert.Error(t, err, "Getting an affiliation which is not in the directory should fail")
+
+	tree, err := c.GetAffiliationTree("users")
+	if assert.NoError(t, err) {
+		assert.Len(t, tree.Affiliations, 2)
+		assert.Len(t, tree.Identities, 3)
+	}
+	_, err = c.GetAffiliationTree("org1")
+	assert.Error(t, err, "Getting the tree of an affiliation which is not in the directory should fail")
+}
+
+func TestLDAPListFromGroups(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.stop()
+
+	_, err := NewClient(&Config{URL: srv.url(), Affiliation: AffiliationConfig{Source: "ou"}}, nil)
+	assert.Error(t, err, "An unknown affiliation source should be invalid")
+
+	c, err := NewClient(&Config{URL: srv.url(), Affiliation: AffiliationConfig{Source: "groups"}}, nil)
+	if err != nil {
+		t.Fatalf("ldap.NewClient failure: %s", err)
+	}
+	assert.Equal(t, []string{"uid=alice:org1.dept1", "uid=bob:org2", "uid=jsmith:org1.dept1"},
+		listTestUsers(t, c, "", "client", nil))
+	assert.Equal(t, []string{"org1:", "org1.dept1:org1", "org2:"}, listTestAffiliations(t, c, ""))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&srv.pages), "Paging should be disabled")
+
+	user, err := c.GetUser("jsmith", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"org1", "dept1"}, user.GetAffiliationPath(),
+			"The affiliation should be the first of the user's groups")
+	}
+
+	// A user which is looked up by DN has the same affiliation
+	user, err = c.GetUser(testUserDN, nil)
+	if assert.NoError(t, err, "Failed to get a user by DN") {
+		assert.Equal(t, testUserDN, user.GetName())
+		assert.Equal(t, []string{"org1", "dept1"}, user.GetAffiliationPath())
+	}
+	_, err = c.GetUser("uid=nobody,ou=users,"+testBase, nil)
+	assert.True(t, IsUserNotFound(err), "Getting an unknown DN should fail with a not found error")
+	_, err = c.GetUser("nobody", nil)
+	assert.True(t, IsUserNotFound(err), "Getting an unknown user should fail with a not found error")
+
+	c.GroupFilter = "(&(objectClass=posixGroup)(memberUid=%s))"
+	_, err = c.GetAllAffiliations("")
+	assert.NoError(t, err)
+	c.GroupFilter = "(objectClass=posixGroup)"
+	_, err = c.GetAllAffiliations("")
+	assert.Error(t, err, "A group filter without a member attribute can't list members")
+}
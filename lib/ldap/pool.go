@@ -0,0 +1,284 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ldap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	ctls "github.com/tjfoc/fabric-ca-gm/lib/tls"
+	"github.com/tjfoc/fabric-ca-gm/util"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// server is one of the LDAP servers of a client
+type server struct {
+	url           string // The URL of the server, with the credentials masked
+	host          string
+	address       string
+	useSSL        bool
+	adminDN       string
+	adminPassword string
+	mutex         sync.Mutex
+	failedAt      time.Time // When the server last failed, or zero if it is healthy
+}
+
+// newServer parses the URL of an LDAP server, and returns the server and
+// the base of the URL
+func newServer(str string) (*server, string, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return nil, "", err
+	}
+	var defaultPort string
+	switch u.Scheme {
+	case "ldap":
+		defaultPort = "389"
+	case "ldaps":
+		defaultPort = "636"
+	default:
+		return nil, "", errors.Errorf("Invalid LDAP scheme: %s", u.Scheme)
+	}
+	var host, port string
+	if strings.Index(u.Host, ":") < 0 {
+		host = u.Host
+		port = defaultPort
+	} else {
+		host, port, err = net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "Invalid LDAP host:port (%s)", u.Host)
+		}
+	}
+	portVal, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "Invalid LDAP port (%s)", port)
+	}
+	s := &server{
+		url:     util.GetMaskedURL(str),
+		host:    host,
+		address: fmt.Sprintf("%s:%d", host, portVal),
+		useSSL:  u.Scheme == "ldaps",
+	}
+	if u.User != nil {
+		s.adminDN = u.User.Username()
+		s.adminPassword, _ = u.User.Password()
+	}
+	base := strings.TrimPrefix(u.Path, "/")
+	return s, base, nil
+}
+
+// isHealthy returns true unless the server failed within 'retryInterval'
+func (s *server) isHealthy(retryInterval time.Duration, now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.failedAt.IsZero() || now.Sub(s.failedAt) >= retryInterval
+}
+
+// setHealthy records whether the last attempt to connect to the server
+// succeeded
+func (s *server) setHealthy(healthy bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if healthy {
+		if !s.failedAt.IsZero() {
+			log.Infof("LDAP server %s is available again", s.url)
+		}
+		s.failedAt = time.Time{}
+	} else {
+		s.failedAt = time.Now()
+	}
+}
+
+// connPool is a bounded pool of connections which are bound as the admin
+// user. A connection holds one of the slots of the pool from the time it
+// is opened until it is closed, and is idle while it is in the pool.
+type connPool struct {
+	slots chan struct{}
+	idle  chan *ldap.Conn
+}
+
+func newConnPool(size int) *connPool {
+	return &connPool{
+		slots: make(chan struct{}, size),
+		idle:  make(chan *ldap.Conn, size),
+	}
+}
+
+// getConn returns an idle connection bound as the admin user, or opens a
+// new one if there is none and the pool is not full. It waits for up to the
+// request timeout for a connection to become available. 'reused' is true if
+// the connection was idle.
+func (lc *Client) getConn() (conn *ldap.Conn, reused bool, err error) {
+	select {
+	case conn = <-lc.pool.idle:
+		return conn, true, nil
+	default:
+	}
+	timer := time.NewTimer(lc.requestTimeout)
+	defer timer.Stop()
+	select {
+	case conn = <-lc.pool.idle:
+		return conn, true, nil
+	case lc.pool.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, false, errors.Errorf("Timed out after %s waiting for a connection to the LDAP server", lc.requestTimeout)
+	}
+	conn, err = lc.newConnection()
+	if err != nil {
+		<-lc.pool.slots
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+// putConn returns a connection obtained from getConn to the pool
+func (lc *Client) putConn(conn *ldap.Conn) {
+	lc.pool.idle <- conn
+}
+
+// closeConn closes a connection obtained from getConn
+func (lc *Client) closeConn(conn *ldap.Conn) {
+	conn.Close()
+	<-lc.pool.slots
+}
+
+// search sends a search request over a connection of the pool. If the
+// search fails over an idle connection, which the server may have closed,
+// it is tried again over a new connection.
+func (lc *Client) search(sreq *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return lc.searchWithPaging(sreq, 0)
+}
+
+// searchWithPaging is search which gets the results in pages of 'pageSize'
+// entries, if it is not 0, so that the size limit of the server doesn't
+// apply to searches which match many entries
+func (lc *Client) searchWithPaging(sreq *ldap.SearchRequest, pageSize uint32) (*ldap.SearchResult, error) {
+	for {
+		conn, reused, err := lc.getConn()
+		if err != nil {
+			return nil, err
+		}
+		var sresp *ldap.SearchResult
+		if pageSize == 0 {
+			sresp, err = conn.Search(sreq)
+		} else {
+			// The paging control of the request holds the cookie of the
+			// server, so a search over a new connection needs a new one
+			req := *sreq
+			req.Controls = nil
+			sresp, err = conn.SearchWithPaging(&req, pageSize)
+		}
+		if err == nil {
+			lc.putConn(conn)
+			return sresp, nil
+		}
+		lc.closeConn(conn)
+		if !reused {
+			return nil, errors.Wrapf(err, "LDAP search failure; search request: %+v", sreq)
+		}
+		log.Debugf("LDAP search failed over an idle connection but will try again over a new connection; error was: %s", err)
+	}
+}
+
+// newConnection connects to the first healthy LDAP server and binds as
+// its admin user. A server which fails is skipped until the retry interval
+// has passed. If all of the servers have failed recently, each of them is
+// tried anyway.
+func (lc *Client) newConnection() (*ldap.Conn, error) {
+	now := time.Now()
+	servers := []*server{}
+	for _, s := range lc.servers {
+		if s.isHealthy(lc.retryInterval, now) {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		servers = lc.servers
+	}
+	errs := []string{}
+	for _, s := range servers {
+		conn, err := lc.connect(s)
+		if err == nil {
+			s.setHealthy(true)
+			return conn, nil
+		}
+		log.Warningf("Failed to connect to LDAP server %s: %s", s.url, err)
+		s.setHealthy(false)
+		errs = append(errs, err.Error())
+	}
+	return nil, errors.Errorf("Failed to connect to any LDAP server: %s", strings.Join(errs, "; "))
+}
+
+// connect connects to an LDAP server and binds as its admin user
+func (lc *Client) connect(s *server) (*ldap.Conn, error) {
+	var tlsConfig *tls.Config
+	if s.useSSL || lc.StartTLS {
+		var err error
+		tlsConfig, err = ctls.GetClientTLSConfig(lc.TLS, lc.CSP)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to get client TLS config")
+		}
+		tlsConfig.ServerName = s.host
+	}
+	nc, err := net.DialTimeout("tcp", s.address, lc.connectTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to LDAP server at %s", s.address)
+	}
+	if s.useSSL {
+		log.Debugf("Connecting to LDAP server at %s over TLS", s.address)
+		tc := tls.Client(nc, tlsConfig)
+		tc.SetDeadline(time.Now().Add(lc.connectTimeout))
+		err = tc.Handshake()
+		if err != nil {
+			nc.Close()
+			return nil, errors.Wrapf(err, "Failed to connect to LDAP server over TLS at %s", s.address)
+		}
+		tc.SetDeadline(time.Time{})
+		nc = tc
+	} else {
+		log.Debugf("Connecting to LDAP server at %s over TCP", s.address)
+	}
+	conn := ldap.NewConn(nc, s.useSSL)
+	conn.Start()
+	conn.SetTimeout(lc.requestTimeout)
+	if !s.useSSL && lc.StartTLS {
+		log.Debugf("Starting TLS on the connection to LDAP server at %s", s.address)
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "Failed to start TLS on the connection to LDAP server at %s", s.address)
+		}
+	}
+	// Bind with a read only user
+	if s.adminDN != "" && s.adminPassword != "" {
+		log.Debugf("Binding to the LDAP server as admin user %s", s.adminDN)
+		err = conn.Bind(s.adminDN, s.adminPassword)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "LDAP bind failure as %s", s.adminDN)
+		}
+	}
+	return conn, nil
+}
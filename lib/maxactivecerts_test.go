@@ -0,0 +1,120 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func TestMaxActiveCertificates(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	srv.CA.Config.Registry.MaxActiveCertificates = 2
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	var resp *EnrollmentResponse
+	for i := 0; i < 2; i++ {
+		resp, err = client.Enroll(&api.EnrollmentRequest{
+			Name:   "admin",
+			Secret: "adminpw",
+		})
+		if err != nil {
+			t.Fatalf("Enrollment %d failed: %s", i, err)
+		}
+	}
+	admin := resp.Identity
+
+	// The identity already has the maximum number of active certificates
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	assert.Error(t, err, "Enrollment should have failed; admin already has 2 active certificates")
+	_, err = admin.Reenroll(&api.ReenrollmentRequest{})
+	assert.Error(t, err, "Reenrollment should have failed; admin already has 2 active certificates")
+
+	// Reenroll revokes the oldest certificate if superseded certificates are revoked
+	srv.CA.Config.Registry.RevokeSuperseded = true
+	resp, err = admin.Reenroll(&api.ReenrollmentRequest{})
+	if err != nil {
+		t.Fatalf("Reenrollment should have revoked the oldest certificate of admin: %s", err)
+	}
+	certs, err := srv.CA.CertDBAccessor().GetActiveCertificatesByID("admin")
+	assert.NoError(t, err, "Failed to get active certificates of admin")
+	if assert.Equal(t, 2, len(certs), "admin should have 2 active certificates") {
+		newCert := string(resp.Identity.GetECert().Cert())
+		assert.True(t, certs[0].PEM == newCert || certs[1].PEM == newCert, "The new certificate should not have been revoked")
+	}
+
+	// An identity's 'hf.MaxActiveCertificates' attribute lowers the maximum of the CA
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:        "maxactive1",
+		Secret:      "maxactive1pw",
+		Affiliation: "org2",
+		Attributes:  []api.Attribute{{Name: "hf.MaxActiveCertificates", Value: "1"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register maxactive1: %s", err)
+	}
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "maxactive1",
+		Secret: "maxactive1pw",
+	})
+	assert.NoError(t, err, "Enrollment of maxactive1 failed")
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "maxactive1",
+		Secret: "maxactive1pw",
+	})
+	assert.Error(t, err, "Enrollment should have failed; maxactive1 already has 1 active certificate")
+
+	// Concurrent enrollments can't exceed the maximum
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:        "maxactive2",
+		Secret:      "maxactive2pw",
+		Affiliation: "org2",
+		Attributes:  []api.Attribute{{Name: "hf.MaxActiveCertificates", Value: "1"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register maxactive2: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			getTestClient(rootPort).Enroll(&api.EnrollmentRequest{
+				Name:   "maxactive2",
+				Secret: "maxactive2pw",
+			})
+		}()
+	}
+	wg.Wait()
+	certs, err = srv.CA.CertDBAccessor().GetActiveCertificatesByID("maxactive2")
+	assert.NoError(t, err, "Failed to get active certificates of maxactive2")
+	assert.Equal(t, 1, len(certs), "maxactive2 should have 1 active certificate")
+}
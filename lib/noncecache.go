@@ -0,0 +1,62 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Default maximum difference between the time at which an authorization
+	// token was created and the time of the server
+	defaultTokenClockSkew = 5 * time.Minute
+	// The interval at which expired nonces are removed from a nonce cache
+	noncePurgeInterval = time.Minute
+)
+
+// nonceCache remembers the nonces of authorization tokens until the tokens
+// expire, so that each token is accepted only once
+type nonceCache struct {
+	mutex     sync.Mutex
+	nonces    map[string]time.Time
+	nextPurge time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{nonces: map[string]time.Time{}}
+}
+
+// add adds a nonce which expires at 'expiry', and returns false if the
+// nonce was already in the cache and has not expired
+func (c *nonceCache) add(nonce string, expiry, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.After(c.nextPurge) {
+		for n, exp := range c.nonces {
+			if !now.Before(exp) {
+				delete(c.nonces, n)
+			}
+		}
+		c.nextPurge = now.Add(noncePurgeInterval)
+	}
+	if exp, ok := c.nonces[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	c.nonces[nonce] = expiry
+	return true
+}
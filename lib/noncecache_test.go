@@ -0,0 +1,121 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/csr"
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+func TestNonceCache(t *testing.T) {
+	c := newNonceCache()
+	now := time.Now()
+
+	assert.True(t, c.add("nonce1", now.Add(time.Minute), now), "Failed to add nonce1")
+	assert.True(t, c.add("nonce2", now.Add(time.Hour), now), "Failed to add nonce2")
+	assert.False(t, c.add("nonce1", now.Add(time.Minute), now.Add(time.Second)), "nonce1 should have been a replay")
+
+	// Expired nonces are removed from the cache at the purge interval
+	later := now.Add(time.Minute + noncePurgeInterval + time.Second)
+	assert.True(t, c.add("nonce3", later.Add(time.Minute), later), "Failed to add nonce3")
+	assert.Len(t, c.nonces, 2, "nonce1 should have been purged")
+	assert.False(t, c.add("nonce2", later.Add(time.Hour), later), "nonce2 should have been a replay")
+	assert.True(t, c.add("nonce1", later.Add(time.Minute), later), "nonce1 should have been added again after it expired")
+}
+
+func TestTokenReplay(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+	_, err = admin.GetIdentity("admin", "")
+	assert.NoError(t, err, "Failed to get identity with a request token")
+
+	url := fmt.Sprintf("http://localhost:%d/api/v1/identities/admin", rootPort)
+	newReq := func(method, token string) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(nil))
+		if err != nil {
+			t.Fatalf("Failed to create request: %s", err)
+		}
+		req.Header.Set("authorization", token)
+		return req
+	}
+	ecert := admin.GetECert()
+	token, err := util.CreateRequestToken(admin.CSP, ecert.Cert(), ecert.Key(), "GET", "/api/v1/identities/admin", nil)
+	if err != nil {
+		t.Fatalf("Failed to create token: %s", err)
+	}
+
+	// A token can't be used for another request, nor used twice
+	err = client.SendReq(newReq("DELETE", token), nil)
+	assert.Error(t, err, "Request should have failed; the token is for a GET request")
+	err = client.SendReq(newReq("GET", token), nil)
+	assert.NoError(t, err, "Failed to get identity with a request token")
+	err = client.SendReq(newReq("GET", token), nil)
+	assert.Error(t, err, "Request should have failed; the token was replayed")
+
+	// A token signed with a certificate that was not issued by the CA is
+	// rejected without its nonce being recorded
+	x509Cert, err := ecert.GetX509Cert()
+	if err != nil {
+		t.Fatalf("Failed to parse enrollment certificate: %s", err)
+	}
+	key, signer, err := util.GetSignerFromCert(x509Cert, admin.CSP)
+	if err != nil {
+		t.Fatalf("Failed to get signer: %s", err)
+	}
+	selfSigned, err := createGmSm2Cert(key, &csr.CertificateRequest{CN: "admin"}, signer)
+	if err != nil {
+		t.Fatalf("Failed to create self-signed certificate: %s", err)
+	}
+	token, err = util.CreateRequestToken(admin.CSP, selfSigned, key, "GET", "/api/v1/identities/admin", nil)
+	if err != nil {
+		t.Fatalf("Failed to create token: %s", err)
+	}
+	nonces := len(srv.CA.nonces.nonces)
+	err = client.SendReq(newReq("GET", token), nil)
+	assert.Error(t, err, "Request should have failed; the certificate was not issued by the CA")
+	assert.Len(t, srv.CA.nonces.nonces, nonces, "The nonce of a token with an untrusted certificate should not have been recorded")
+
+	// Legacy tokens are not accepted unless configured
+	token, err = util.CreateToken(admin.CSP, ecert.Cert(), ecert.Key(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create legacy token: %s", err)
+	}
+	err = client.SendReq(newReq("GET", token), nil)
+	assert.Error(t, err, "Request should have failed; legacy tokens are not accepted")
+}
@@ -0,0 +1,154 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oidc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+)
+
+// claimExpr is an expression which converts the claims of an ID token into
+// the value of an attribute
+type claimExpr struct {
+	verifier   *Verifier
+	attr, expr string
+}
+
+func newClaimExpr(verifier *Verifier, attr, expr string) (*claimExpr, error) {
+	ce := &claimExpr{verifier: verifier, attr: attr, expr: expr}
+	_, err := govaluate.NewEvaluableExpressionWithFunctions(ce.expr, ce.functions(nil))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid expression for attribute '%s'", ce.attr)
+	}
+	return ce, nil
+}
+
+func (ce *claimExpr) evaluate(claims map[string]interface{}) (interface{}, error) {
+	eval, err := govaluate.NewEvaluableExpressionWithFunctions(ce.expr, ce.functions(claims))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid expression for attribute '%s'", ce.attr)
+	}
+	result, err := eval.Evaluate(nil)
+	if err != nil {
+		log.Debugf("Error evaluating expression for attribute '%s'; error: %+v", ce.attr, err)
+		return nil, err
+	}
+	log.Debugf("Evaluated expression for attribute '%s'; result: %+v", ce.attr, result)
+	return result, nil
+}
+
+func (ce *claimExpr) functions(claims map[string]interface{}) map[string]govaluate.ExpressionFunction {
+	return map[string]govaluate.ExpressionFunction{
+		"claim": func(args ...interface{}) (interface{}, error) {
+			return claimFunction(claims, args...)
+		},
+		"map": ce.mapFunction,
+		"if":  ifFunction,
+	}
+}
+
+// Get the value of a claim of the ID token; the usage is
+// claim(<claimName> [, <separator>]). If the claim is an array, return the
+// values in a single string separated by the <separator> string, which is a
+// comma by default. For example, if claim "groups" is ["admins", "users"],
+// claim("groups") returns "admins,users" and claim("groups", ":") returns
+// "admins:users".
+func claimFunction(claims map[string]interface{}, args ...interface{}) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("Expecting 1 or 2 arguments for 'claim' but found %d", len(args))
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return nil, errors.Errorf("First argument to 'claim' must be a string; '%v' is not a string", args[0])
+	}
+	sep := ","
+	if len(args) == 2 {
+		sep, ok = args[1].(string)
+		if !ok {
+			return nil, errors.Errorf("Second argument to 'claim' must be a string; '%v' is not a string", args[1])
+		}
+	}
+	return claimString(claims[name], sep), nil
+}
+
+// Map function performs string substitutions on the comma separated values
+// of the 1st argument for each entry in the map named by the 2nd argument,
+// like the map function of the LDAP converters.
+func (ce *claimExpr) mapFunction(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.Errorf("Expecting two arguments but found %d", len(args))
+	}
+	str, ok := args[0].(string)
+	if !ok {
+		return nil, errors.Errorf("First argument to 'map' must be a string; '%v' is not a string", args[0])
+	}
+	mapName, ok := args[1].(string)
+	if !ok {
+		return nil, errors.Errorf("Second argument to 'map' must be a string; '%v' is not a string", args[1])
+	}
+	mapName = strings.ToLower(mapName)
+	m := ce.verifier.maps[mapName]
+	if m == nil {
+		return nil, errors.Errorf("Unknown map name: '%s'", mapName)
+	}
+	vals := strings.Split(str, ",")
+	for i, val := range vals {
+		if mapped, ok := m[val]; ok {
+			vals[i] = mapped
+		}
+	}
+	return strings.Join(vals, ","), nil
+}
+
+// The "if" function returns the 2nd argument if the 1st argument is true,
+// or else the 3rd argument
+func ifFunction(args ...interface{}) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errors.Errorf("Expecting 3 arguments for 'if' but found %d", len(args))
+	}
+	cond, ok := args[0].(bool)
+	if !ok {
+		return nil, errors.New("First argument of 'if' must be a boolean")
+	}
+	if cond {
+		return args[1], nil
+	}
+	return args[2], nil
+}
+
+// claimString returns the value of a claim as a string, joining the values
+// of an array with 'sep'
+func claimString(val interface{}, sep string) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		vals := make([]string, len(v))
+		for i, ele := range v {
+			vals[i] = claimString(ele, sep)
+		}
+		return strings.Join(vals, sep)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
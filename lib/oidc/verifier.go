@@ -0,0 +1,482 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oidc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+// The minimum time between fetches of the JWKS from its URL when a token
+// is signed with an unknown key
+const jwksRefreshInterval = time.Minute
+
+// Config is the configuration for enrolling with OIDC ID tokens
+type Config struct {
+	Enabled   bool          `def:"false" help:"Enable enrollment with OIDC ID tokens"`
+	Issuer    string        `help:"The issuer of the OIDC ID tokens, which must equal their 'iss' claim"`
+	Audience  string        `help:"The audience of the OIDC ID tokens, such as the client ID, which must be in their 'aud' claim"`
+	JWKS      string        `help:"The file or https URL of the JSON Web Key Set with which the OIDC ID tokens are verified"`
+	ClockSkew time.Duration `def:"1m" help:"The clock skew allowed when checking the times in OIDC ID tokens"`
+	Claims    ClaimsConfig
+}
+
+// ClaimsConfig maps the claims of an ID token to an identity
+type ClaimsConfig struct {
+	ID          string    `def:"sub" help:"The claim whose value is the enrollment ID"`
+	Type        string    `help:"The claim whose value is the type of the identity"`
+	DefaultType string    `def:"client" help:"The type of the identity if the ID token has no type claim"`
+	Affiliation string    `help:"The claim whose value is the affiliation of the identity"`
+	Converters  []NameVal // Used to convert the claims into fabric-ca-server attributes
+	Maps        map[string][]NameVal
+}
+
+// NameVal is a name and value pair
+type NameVal struct {
+	Name  string
+	Value string
+}
+
+// Implements Stringer interface for oidc.Config
+func (c Config) String() string {
+	return util.StructToString(&c)
+}
+
+// Identity is the identity to which an ID token maps
+type Identity struct {
+	Name        string
+	Type        string
+	Affiliation string
+	Attributes  []api.Attribute
+}
+
+// Verifier verifies ID tokens and maps their claims to identities
+type Verifier struct {
+	cfg      *Config
+	exprs    []*claimExpr
+	maps     map[string]map[string]string
+	mutex    sync.Mutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+// NewVerifier creates a verifier, loading the JWKS of the configuration
+func NewVerifier(cfg *Config) (*Verifier, error) {
+	log.Debugf("Creating new OIDC verifier for %+v", cfg)
+	if cfg == nil {
+		return nil, errors.New("OIDC configuration is nil")
+	}
+	if cfg.Issuer == "" {
+		return nil, errors.New("OIDC configuration requires an 'issuer'")
+	}
+	if cfg.Audience == "" {
+		return nil, errors.New("OIDC configuration requires an 'audience'")
+	}
+	if cfg.JWKS == "" {
+		return nil, errors.New("OIDC configuration requires a 'jwks'")
+	}
+	v := &Verifier{cfg: cfg, maps: map[string]map[string]string{}}
+	for _, ele := range cfg.Claims.Converters {
+		ce, err := newClaimExpr(v, ele.Name, ele.Value)
+		if err != nil {
+			return nil, err
+		}
+		v.exprs = append(v.exprs, ce)
+	}
+	for mapName, value := range cfg.Claims.Maps {
+		mapName = strings.ToLower(mapName)
+		v.maps[mapName] = map[string]string{}
+		for _, ele := range value {
+			v.maps[mapName][ele.Name] = ele.Value
+		}
+	}
+	err := v.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Verify verifies the signature, issuer, audience and validity period of an
+// ID token and returns its claims
+func (v *Verifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("The ID token is not a JWS in compact serialization")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &hdr)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid ID token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid ID token signature encoding")
+	}
+	key, err := v.getKey(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid ID token payload")
+	}
+	err = v.checkClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims checks the registered claims of an ID token
+func (v *Verifier) checkClaims(claims map[string]interface{}) error {
+	if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+		return errors.Errorf("The issuer of the ID token is '%v' rather than '%s'", claims["iss"], v.cfg.Issuer)
+	}
+	if !hasAudience(claims["aud"], v.cfg.Audience) {
+		return errors.Errorf("The audience of the ID token does not include '%s'", v.cfg.Audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("The ID token has no expiry")
+	}
+	if !now.Before(time.Unix(int64(exp), 0).Add(v.cfg.ClockSkew)) {
+		return errors.New("The ID token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.cfg.ClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("The ID token is not valid yet")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(v.cfg.ClockSkew).Before(time.Unix(int64(iat), 0)) {
+		return errors.New("The ID token was issued in the future")
+	}
+	return nil
+}
+
+// hasAudience returns true if the 'aud' claim, which is either a string or
+// an array of strings, includes 'audience'
+func hasAudience(aud interface{}, audience string) bool {
+	switch val := aud.(type) {
+	case string:
+		return val == audience
+	case []interface{}:
+		for _, a := range val {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetIdentity maps the claims of a verified ID token to an identity
+func (v *Verifier) GetIdentity(claims map[string]interface{}) (*Identity, error) {
+	cc := v.cfg.Claims
+	id := &Identity{}
+	id.Name = claimString(claims[cfgVal(cc.ID, "sub")], ",")
+	if id.Name == "" {
+		return nil, errors.Errorf("The ID token has no '%s' claim for the enrollment ID", cfgVal(cc.ID, "sub"))
+	}
+	if cc.Type != "" {
+		id.Type = claimString(claims[cc.Type], ",")
+	}
+	if id.Type == "" {
+		id.Type = cfgVal(cc.DefaultType, "client")
+	}
+	if cc.Affiliation != "" {
+		id.Affiliation = claimString(claims[cc.Affiliation], ",")
+	}
+	for _, ce := range v.exprs {
+		value, err := ce.evaluate(claims)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to evaluate OIDC expression")
+		}
+		id.Attributes = append(id.Attributes, api.Attribute{Name: ce.attr, Value: claimString(value, ",")})
+	}
+	return id, nil
+}
+
+// getKey returns the key with key ID 'kid', or the only key if 'kid' is
+// empty, fetching the JWKS again if it is a URL and the key is unknown
+func (v *Verifier) getKey(kid string) (crypto.PublicKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	key := v.findKey(kid)
+	if key == nil && isURL(v.cfg.JWKS) && time.Since(v.loadedAt) >= jwksRefreshInterval {
+		// The issuer may have rotated its keys
+		err := v.loadKeysLocked()
+		if err != nil {
+			return nil, err
+		}
+		key = v.findKey(kid)
+	}
+	if key == nil {
+		return nil, errors.Errorf("No key with ID '%s' was found in the JWKS", kid)
+	}
+	return key, nil
+}
+
+func (v *Verifier) findKey(kid string) crypto.PublicKey {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key
+		}
+	}
+	return v.keys[kid]
+}
+
+func (v *Verifier) loadKeys() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.loadKeysLocked()
+}
+
+// loadKeysLocked reads the JWKS from its file or URL
+func (v *Verifier) loadKeysLocked() error {
+	var buf []byte
+	var err error
+	if isURL(v.cfg.JWKS) {
+		buf, err = fetchJWKS(v.cfg.JWKS)
+	} else {
+		buf, err = ioutil.ReadFile(v.cfg.JWKS)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read JWKS from '%s'", v.cfg.JWKS)
+	}
+	keys, err := ParseJWKS(buf)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to parse JWKS from "+v.cfg.JWKS)
+	}
+	log.Debugf("Loaded %d keys from JWKS '%s'", len(keys), v.cfg.JWKS)
+	v.keys = keys
+	v.loadedAt = time.Now()
+	return nil
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Unexpected status '%s'", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS parses the RSA and EC signing keys of a JSON Web Key Set,
+// indexed by key ID; keys of other types are ignored
+func ParseJWKS(buf []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := json.Unmarshal(buf, &jwks)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid JWKS")
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsaKey()
+		case "EC":
+			key, err = k.ecKey()
+		default:
+			log.Debugf("Ignoring JWK '%s' of type '%s'", k.Kid, k.Kty)
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithMessage(err, "Invalid JWK '"+k.Kid+"'")
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("The JWKS has no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("RSA exponent is too large")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (k *jwk) ecKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.Errorf("Unsupported EC curve '%s'", k.Crv)
+	}
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("EC point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// verifySignature verifies a JWS signature with algorithm 'alg'
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return errors.Errorf("Unsupported ID token signature algorithm '%s'", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errors.Errorf("Unsupported ID token signature algorithm '%s'", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch alg[:2] {
+	case "RS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.Errorf("The key of the ID token is not an RSA key for algorithm '%s'", alg)
+		}
+		if rsa.VerifyPKCS1v15(rsaKey, hash, digest, sig) != nil {
+			return errors.New("Invalid ID token signature")
+		}
+	case "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.Errorf("The key of the ID token is not an RSA key for algorithm '%s'", alg)
+		}
+		if rsa.VerifyPSS(rsaKey, hash, digest, sig, nil) != nil {
+			return errors.New("Invalid ID token signature")
+		}
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.Errorf("The key of the ID token is not an EC key for algorithm '%s'", alg)
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("Invalid ID token signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("Invalid ID token signature")
+		}
+	default:
+		return errors.Errorf("Unsupported ID token signature algorithm '%s'", alg)
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.Wrap(err, "Invalid base64url encoding")
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	err = dec.Decode(v)
+	if err != nil {
+		return errors.Wrap(err, "Invalid JSON")
+	}
+	return nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) == 0 {
+		return nil, errors.Errorf("Invalid base64url encoded integer '%s'", s)
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// Get the value of a config setting, or its default if not set
+func cfgVal(val, def string) string {
+	if val == "" {
+		return def
+	}
+	return val
+}
@@ -0,0 +1,277 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testAudience = "fabric-ca"
+)
+
+type testKeys struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %s", err)
+	}
+	return &testKeys{rsaKey: rsaKey, ecKey: ecKey}
+}
+
+func b64(buf []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// jwks returns the JWKS of the public keys
+func (k *testKeys) jwks() []byte {
+	pub := k.ecKey.PublicKey
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(k.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(k.rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(pub.X.Bytes()), "y": b64(pub.Y.Bytes())},
+			{"kty": "oct", "kid": "hmac1", "k": "c2VjcmV0"},
+		},
+	}
+	buf, _ := json.Marshal(jwks)
+	return buf
+}
+
+// sign returns a compact JWS of the claims signed with algorithm 'alg'
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(hdr) + "." + b64(payload)
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsaKey, crypto.SHA256, digest)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ecKey, digest)
+		if err == nil {
+			sig = make([]byte, 64)
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(sig[32-len(rb):32], rb)
+			copy(sig[64-len(sb):], sb)
+		}
+	default:
+		t.Fatalf("Unsupported test algorithm '%s'", alg)
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign token: %s", err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func testClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":    testIssuer,
+		"aud":    []string{"other", testAudience},
+		"sub":    "alice",
+		"exp":    now.Add(time.Hour).Unix(),
+		"iat":    now.Unix(),
+		"role":   "peer",
+		"org":    "org1.department1",
+		"groups": []string{"admins", "users"},
+	}
+}
+
+func newTestVerifier(t *testing.T, keys *testKeys) *Verifier {
+	dir, err := ioutil.TempDir("", "oidctest")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	err = ioutil.WriteFile(jwksFile, keys.jwks(), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write JWKS: %s", err)
+	}
+	cfg := &Config{
+		Enabled:   true,
+		Issuer:    testIssuer,
+		Audience:  testAudience,
+		JWKS:      jwksFile,
+		ClockSkew: time.Minute,
+		Claims: ClaimsConfig{
+			ID:          "sub",
+			Type:        "role",
+			DefaultType: "client",
+			Affiliation: "org",
+			Converters: []NameVal{
+				{Name: "groups", Value: `claim("groups", ":")`},
+				{Name: "hf.Revoker", Value: `if(map(claim("groups"), "admins") == "true,users", "true", "false")`},
+			},
+			Maps: map[string][]NameVal{
+				"Admins": []NameVal{{Name: "admins", Value: "true"}},
+			},
+		},
+	}
+	v, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %s", err)
+	}
+	return v
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := map[string]string{"RS256": "rsa1", "ES256": "ec1"}[alg]
+		claims, err := v.Verify(keys.sign(t, alg, kid, testClaims()))
+		if assert.NoError(t, err, "Failed to verify %s token", alg) {
+			assert.Equal(t, "alice", claims["sub"])
+		}
+	}
+
+	// The signature is checked against the key named in the header
+	_, err := v.Verify(keys.sign(t, "RS256", "ec1", testClaims()))
+	assert.Error(t, err, "Should have failed, RSA signature with an EC key")
+	_, err = v.Verify(keys.sign(t, "RS256", "unknown", testClaims()))
+	assert.Error(t, err, "Should have failed, unknown key ID")
+	_, err = v.Verify(keys.sign(t, "RS256", "hmac1", testClaims()))
+	assert.Error(t, err, "Should have failed, symmetric keys are not loaded")
+	token := keys.sign(t, "ES256", "ec1", testClaims())
+	tampered := keys.sign(t, "ES256", "ec1", map[string]interface{}{"sub": "mallory"})
+	_, err = v.Verify(token[:len(token)-10] + tampered[len(tampered)-10:])
+	assert.Error(t, err, "Should have failed, invalid signature")
+	_, err = v.Verify("not.a-token")
+	assert.Error(t, err, "Should have failed, malformed token")
+
+	claims := testClaims()
+	claims["iss"] = "https://other.example.com"
+	_, err = v.Verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Error(t, err, "Should have failed, wrong issuer")
+
+	claims = testClaims()
+	claims["aud"] = "other"
+	_, err = v.Verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Error(t, err, "Should have failed, wrong audience")
+
+	claims = testClaims()
+	claims["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+	_, err = v.Verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Error(t, err, "Should have failed, expired token")
+
+	// The clock skew is allowed
+	claims = testClaims()
+	claims["exp"] = time.Now().Add(-30 * time.Second).Unix()
+	_, err = v.Verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.NoError(t, err, "Token within the clock skew should have been valid")
+
+	claims = testClaims()
+	claims["nbf"] = time.Now().Add(time.Hour).Unix()
+	_, err = v.Verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Error(t, err, "Should have failed, token not valid yet")
+}
+
+func TestGetIdentity(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	claims, err := v.Verify(keys.sign(t, "RS256", "rsa1", testClaims()))
+	if err != nil {
+		t.Fatalf("Failed to verify token: %s", err)
+	}
+	id, err := v.GetIdentity(claims)
+	if assert.NoError(t, err, "Failed to map claims to an identity") {
+		assert.Equal(t, "alice", id.Name)
+		assert.Equal(t, "peer", id.Type)
+		assert.Equal(t, "org1.department1", id.Affiliation)
+		assert.Equal(t, []api.Attribute{
+			{Name: "groups", Value: "admins:users"},
+			{Name: "hf.Revoker", Value: "true"},
+		}, id.Attributes)
+	}
+
+	// The default type is used without a type claim
+	delete(claims, "role")
+	id, err = v.GetIdentity(claims)
+	if assert.NoError(t, err, "Failed to map claims to an identity") {
+		assert.Equal(t, "client", id.Type)
+	}
+
+	delete(claims, "sub")
+	_, err = v.GetIdentity(claims)
+	assert.Error(t, err, "Should have failed, no enrollment ID claim")
+}
+
+func TestJWKSURL(t *testing.T) {
+	oldKeys := newTestKeys(t)
+	newKeys := newTestKeys(t)
+	jwks := oldKeys.jwks()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+
+	v, err := NewVerifier(&Config{Issuer: testIssuer, Audience: testAudience, JWKS: srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %s", err)
+	}
+	_, err = v.Verify(oldKeys.sign(t, "ES256", "ec1", testClaims()))
+	assert.NoError(t, err, "Failed to verify token with key from JWKS URL")
+
+	// After the issuer rotates its keys, the JWKS is fetched again when a
+	// token is signed with an unknown key
+	jwks = []byte(`{"keys":[{"kty":"EC","kid":"ec2","crv":"P-256","x":"` +
+		b64(newKeys.ecKey.X.Bytes()) + `","y":"` + b64(newKeys.ecKey.Y.Bytes()) + `"}]}`)
+	v.loadedAt = time.Now().Add(-jwksRefreshInterval)
+	_, err = v.Verify(newKeys.sign(t, "ES256", "ec2", testClaims()))
+	assert.NoError(t, err, "Failed to verify token with rotated key")
+
+	_, err = NewVerifier(&Config{Issuer: testIssuer, Audience: testAudience, JWKS: srv.URL + "/missing", Claims: ClaimsConfig{
+		Converters: []NameVal{{Name: "a", Value: "claim("}},
+	}})
+	assert.Error(t, err, "Should have failed, invalid expression")
+	_, err = NewVerifier(&Config{Issuer: testIssuer, JWKS: srv.URL})
+	assert.Error(t, err, "Should have failed, no audience")
+}
@@ -0,0 +1,179 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/kisielk/sqlstruct"
+	"github.com/pkg/errors"
+)
+
+const (
+	insertPendingOperationSQL = `
+INSERT INTO pending_operations (id, ca_name, operation, target, request, requester, requested_at, expiry, level)
+	VALUES (:id, :ca_name, :operation, :target, :request, :requester, :requested_at, :expiry, :level);`
+
+	selectPendingOperationSQL = `
+SELECT %s FROM pending_operations
+WHERE (id = ? AND ca_name = ?);`
+
+	selectPendingOperationsSQL = `
+SELECT %s FROM pending_operations
+WHERE (ca_name = ? AND expiry > ?)
+ORDER BY requested_at;`
+
+	deletePendingOperationSQL = `
+DELETE FROM pending_operations
+WHERE (id = ?);`
+
+	deleteExpiredPendingOperationsSQL = `
+DELETE FROM pending_operations
+WHERE (expiry <= ?);`
+)
+
+// PendingOperationRecord represents a record in the pending_operations table
+type PendingOperationRecord struct {
+	ID        string `db:"id"`
+	CAName    string `db:"ca_name"`
+	Operation string `db:"operation"`
+	Target    string `db:"target"`
+	// Request is the JSON encoding of the request which is performed when
+	// the operation is confirmed
+	Request     string    `db:"request"`
+	Requester   string    `db:"requester"`
+	RequestedAt time.Time `db:"requested_at"`
+	Expiry      time.Time `db:"expiry"`
+	Level       int       `db:"level"`
+}
+
+// PendingOperationDBAccessor stores and retrieves the operations of a CA
+// which are waiting to be confirmed
+type PendingOperationDBAccessor struct {
+	db *sqlx.DB
+}
+
+// NewPendingOperationDBAccessor returns a new PendingOperationDBAccessor
+func NewPendingOperationDBAccessor(db *sqlx.DB) *PendingOperationDBAccessor {
+	return &PendingOperationDBAccessor{db: db}
+}
+
+func (d *PendingOperationDBAccessor) checkDB() error {
+	if d.db == nil {
+		return errors.New("Database is not set")
+	}
+	return nil
+}
+
+// InsertOperation puts a PendingOperationRecord into the database
+func (d *PendingOperationDBAccessor) InsertOperation(rec PendingOperationRecord) error {
+	log.Debugf("DB: Insert pending operation '%s' of '%s' on '%s' requested by '%s'", rec.ID, rec.Operation, rec.Target, rec.Requester)
+
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	rec.RequestedAt = rec.RequestedAt.UTC()
+	rec.Expiry = rec.Expiry.UTC()
+	_, err = d.db.NamedExec(insertPendingOperationSQL, &rec)
+	if err != nil {
+		return errors.Wrap(err, "Failed to insert pending operation into database")
+	}
+	return nil
+}
+
+// GetOperation returns the pending operation of CA 'caName' with ID 'id',
+// or nil if there is none
+func (d *PendingOperationDBAccessor) GetOperation(id, caName string) (*PendingOperationRecord, error) {
+	log.Debugf("DB: Get pending operation '%s' of CA '%s'", id, caName)
+
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []PendingOperationRecord
+	query := fmt.Sprintf(selectPendingOperationSQL, sqlstruct.Columns(PendingOperationRecord{}))
+	err = d.db.Select(&recs, d.db.Rebind(query), id, caName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get pending operation '%s' from database", id)
+	}
+	if len(recs) == 0 {
+		return nil, nil
+	}
+	return &recs[0], nil
+}
+
+// GetOperations returns the pending operations of CA 'caName' which have
+// not expired, oldest first
+func (d *PendingOperationDBAccessor) GetOperations(caName string, now time.Time) ([]PendingOperationRecord, error) {
+	log.Debugf("DB: Get pending operations of CA '%s'", caName)
+
+	err := d.checkDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []PendingOperationRecord
+	query := fmt.Sprintf(selectPendingOperationsSQL, sqlstruct.Columns(PendingOperationRecord{}))
+	err = d.db.Select(&recs, d.db.Rebind(query), caName, now.UTC())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get pending operations from database")
+	}
+	return recs, nil
+}
+
+// DeleteOperation removes a pending operation, and returns false if it
+// had already been removed
+func (d *PendingOperationDBAccessor) DeleteOperation(id string) (bool, error) {
+	log.Debugf("DB: Delete pending operation '%s'", id)
+
+	err := d.checkDB()
+	if err != nil {
+		return false, err
+	}
+
+	res, err := d.db.Exec(d.db.Rebind(deletePendingOperationSQL), id)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to delete pending operation '%s' from database", id)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to delete pending operation '%s' from database", id)
+	}
+	return n > 0, nil
+}
+
+// DeleteExpiredOperations removes the pending operations which have expired
+func (d *PendingOperationDBAccessor) DeleteExpiredOperations(now time.Time) error {
+	log.Debug("DB: Delete expired pending operations")
+
+	err := d.checkDB()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(d.db.Rebind(deleteExpiredPendingOperationsSQL), now.UTC())
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete expired pending operations from database")
+	}
+	return nil
+}
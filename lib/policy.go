@@ -0,0 +1,162 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+)
+
+// registrationPolicy is an expression which must evaluate to true for a
+// registrar to register or modify an identity
+type registrationPolicy struct {
+	name, expr string
+}
+
+// policyIdentity is the identity being registered or modified, as seen by
+// a registration policy
+type policyIdentity struct {
+	ID          string
+	Type        string
+	Affiliation string
+	Attributes  []api.Attribute
+}
+
+// newRegistrationPolicies parses the registration policies in the config
+func newRegistrationPolicies(cfgs []CAConfigPolicy) ([]*registrationPolicy, error) {
+	policies := []*registrationPolicy{}
+	for i, cfg := range cfgs {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("%d", i+1)
+		}
+		if cfg.Expr == "" {
+			return nil, errors.Errorf("Registration policy '%s' has no expression", name)
+		}
+		p := &registrationPolicy{name: name, expr: cfg.Expr}
+		// The functions are bound to a request when the policy is evaluated,
+		// so here they are only needed to validate the expression
+		_, err := govaluate.NewEvaluableExpressionWithFunctions(p.expr, p.functions(nil, nil))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid expression for registration policy '%s'", name)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// allows returns true if the policy allows 'registrar' to register or
+// modify identity 'id'
+func (p *registrationPolicy) allows(registrar spi.User, id *policyIdentity) (bool, error) {
+	eval, err := govaluate.NewEvaluableExpressionWithFunctions(p.expr, p.functions(registrar, id))
+	if err != nil {
+		return false, errors.Wrapf(err, "Invalid expression for registration policy '%s'", p.name)
+	}
+	parms := map[string]interface{}{
+		"id":                   id.ID,
+		"type":                 id.Type,
+		"affiliation":          id.Affiliation,
+		"registrar":            registrar.GetName(),
+		"registrarType":        registrar.GetType(),
+		"registrarAffiliation": GetUserAffiliation(registrar),
+	}
+	result, err := eval.Evaluate(parms)
+	if err != nil {
+		log.Debugf("Error evaluating registration policy '%s'; parms: %+v; error: %+v", p.name, parms, err)
+		return false, errors.Wrapf(err, "Failed to evaluate registration policy '%s'", p.name)
+	}
+	log.Debugf("Evaluated registration policy '%s'; parms: %+v; result: %+v", p.name, parms, result)
+	allowed, ok := result.(bool)
+	if !ok {
+		return false, errors.Errorf("Registration policy '%s' evaluated to '%v' rather than a boolean", p.name, result)
+	}
+	return allowed, nil
+}
+
+func (p *registrationPolicy) functions(registrar spi.User, id *policyIdentity) map[string]govaluate.ExpressionFunction {
+	return map[string]govaluate.ExpressionFunction{
+		"attr": func(args ...interface{}) (interface{}, error) {
+			name, err := getPolicyStringArg("attr", args)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range id.Attributes {
+				if a.Name == name {
+					return a.Value, nil
+				}
+			}
+			return "", nil
+		},
+		"registrarAttr": func(args ...interface{}) (interface{}, error) {
+			name, err := getPolicyStringArg("registrarAttr", args)
+			if err != nil {
+				return nil, err
+			}
+			a, err := registrar.GetAttribute(name)
+			if err != nil {
+				// The registrar does not have the attribute
+				return "", nil
+			}
+			return a.Value, nil
+		},
+		"isUnder": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, errors.Errorf("Expecting 2 arguments for 'isUnder' but found %d", len(args))
+			}
+			aff, ok1 := args[0].(string)
+			parent, ok2 := args[1].(string)
+			if !ok1 || !ok2 {
+				return nil, errors.New("The arguments of 'isUnder' must be strings")
+			}
+			return aff == parent || strings.HasPrefix(aff, parent+"."), nil
+		},
+	}
+}
+
+// getPolicyStringArg returns the single string argument of a policy function
+func getPolicyStringArg(fname string, args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", errors.Errorf("Expecting 1 argument for '%s' but found %d", fname, len(args))
+	}
+	arg, ok := args[0].(string)
+	if !ok {
+		return "", errors.Errorf("The argument of '%s' must be a string", fname)
+	}
+	return arg, nil
+}
+
+// checkRegistrationPolicies returns an error unless every registration
+// policy of the CA allows 'registrar' to register or modify identity 'id'
+func (ca *CA) checkRegistrationPolicies(registrar spi.User, id *policyIdentity) error {
+	for _, p := range ca.policies {
+		allowed, err := p.allows(registrar, id)
+		if err != nil {
+			return newAuthErr(ErrRegistrationPolicy, "Registration policy check of '%s' failed: %s", id.ID, err)
+		}
+		if !allowed {
+			return newAuthErr(ErrRegistrationPolicy, "Registration policy '%s' does not allow '%s' to register or modify identity '%s'",
+				p.name, registrar.GetName(), id.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/attr"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+func TestRegistrationPolicies(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+
+	_, err := newRegistrationPolicies([]CAConfigPolicy{{Name: "bad", Expr: "type =="}})
+	assert.Error(t, err, "An invalid policy expression should have failed to parse")
+	_, err = newRegistrationPolicies([]CAConfigPolicy{{Name: "empty"}})
+	assert.Error(t, err, "A policy without an expression should have failed")
+
+	srv := TestGetRootServer(t)
+	registry := &srv.CA.Config.Registry
+	registry.Policies = []CAConfigPolicy{
+		{
+			Name: "peers-by-dept",
+			Expr: "type != 'peer' || isUnder(affiliation, 'org2.' + registrarAttr('dept'))",
+		},
+		{
+			Name: "no-admin-attr",
+			Expr: "attr('admin') != 'true'",
+		},
+	}
+	registry.Identities = append(registry.Identities, CAConfigIdentity{
+		Name:           "admin2",
+		Pass:           "admin2pw",
+		Type:           "user",
+		Affiliation:    "org2",
+		MaxEnrollments: -1,
+		Attrs: map[string]string{
+			attr.Roles:         "user,peer",
+			attr.RegistrarAttr: "admin",
+			"dept":             "dept1",
+		},
+	})
+	err = srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin2",
+		Secret: "admin2pw",
+	})
+	util.FatalError(t, err, "Failed to enroll admin2")
+	registrar := resp.Identity
+
+	_, err = registrar.Register(&api.RegistrationRequest{
+		Name:        "peer1",
+		Type:        "peer",
+		Affiliation: "org2",
+	})
+	assert.Error(t, err, "Should have failed to register a peer outside of the registrar's department")
+
+	_, err = registrar.Register(&api.RegistrationRequest{
+		Name:        "peer1",
+		Type:        "peer",
+		Affiliation: "org2.dept1",
+	})
+	assert.NoError(t, err, "Failed to register a peer in the registrar's department")
+
+	_, err = registrar.Register(&api.RegistrationRequest{
+		Name:        "user1",
+		Type:        "user",
+		Affiliation: "org2",
+	})
+	assert.NoError(t, err, "Failed to register a user, which the policy does not restrict")
+
+	_, err = registrar.Register(&api.RegistrationRequest{
+		Name:       "user2",
+		Type:       "user",
+		Attributes: []api.Attribute{{Name: "admin", Value: "true"}},
+	})
+	assert.Error(t, err, "Should have failed to register an identity with attribute 'admin=true'")
+
+	// The policies are also checked against a modified identity
+	_, err = registrar.ModifyIdentity(&api.ModifyIdentityRequest{
+		ID:          "peer1",
+		Affiliation: "org2",
+	})
+	assert.Error(t, err, "Should have failed to move a peer out of the registrar's department")
+
+	_, err = registrar.ModifyIdentity(&api.ModifyIdentityRequest{
+		ID:   "user1",
+		Type: "peer",
+	})
+	assert.Error(t, err, "Should have failed to change the type of an identity outside of the registrar's department to peer")
+}
@@ -0,0 +1,209 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// The interval at which full buckets are removed from a rate limiter
+	rateLimitPurgeInterval = time.Minute
+	// The maximum number of buckets of a rate limiter; when it is reached,
+	// the full buckets are removed, and if none is full, the bucket which
+	// was used least recently is removed to make room for a new one
+	rateLimitMaxBuckets = 10000
+)
+
+// rateLimiter is a set of token buckets with the same rate and burst,
+// one for each key
+type rateLimiter struct {
+	mutex      sync.Mutex
+	interval   time.Duration // time to add a token to a bucket
+	burst      float64
+	buckets    map[string]*tokenBucket
+	maxBuckets int
+	nextPurge  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rate limiter for the configuration, or nil
+// if the limit is disabled
+func newRateLimiter(cfg RateLimit) *rateLimiter {
+	if cfg.Rate == 0 {
+		return nil
+	}
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = cfg.Rate
+	}
+	return &rateLimiter{
+		interval:   time.Minute / time.Duration(cfg.Rate),
+		burst:      float64(burst),
+		buckets:    map[string]*tokenBucket{},
+		maxBuckets: rateLimitMaxBuckets,
+	}
+}
+
+// allow takes a token from the bucket of 'key' and returns 0, or returns
+// how long to wait for a token if the bucket is empty
+func (l *rateLimiter) allow(key string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.After(l.nextPurge) {
+		l.purge(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.maxBuckets {
+			l.purge(now)
+		}
+		if len(l.buckets) >= l.maxBuckets {
+			l.evict()
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if b.fill(now, l.interval, l.burst) < 1 {
+		return time.Duration((1 - b.tokens) * float64(l.interval))
+	}
+	b.tokens--
+	return 0
+}
+
+// purge removes the full buckets, which are the same as new ones
+func (l *rateLimiter) purge(now time.Time) {
+	for k, b := range l.buckets {
+		if b.fill(now, l.interval, l.burst) >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	l.nextPurge = now.Add(rateLimitPurgeInterval)
+}
+
+// evict removes the bucket which was used least recently
+func (l *rateLimiter) evict() {
+	var oldest string
+	var last time.Time
+	for k, b := range l.buckets {
+		if oldest == "" || b.last.Before(last) {
+			oldest, last = k, b.last
+		}
+	}
+	delete(l.buckets, oldest)
+}
+
+// fill adds the tokens accrued since the bucket was last filled and
+// returns the number of tokens in the bucket
+func (b *tokenBucket) fill(now time.Time, interval time.Duration, burst float64) float64 {
+	if now.After(b.last) {
+		b.tokens = math.Min(burst, b.tokens+float64(now.Sub(b.last))/float64(interval))
+		b.last = now
+	}
+	return b.tokens
+}
+
+// endpointRateLimiter limits the rate of requests to an endpoint for each
+// enrollment ID and for each remote address
+type endpointRateLimiter struct {
+	byID *rateLimiter
+	byIP *rateLimiter
+}
+
+// newEndpointRateLimiter returns a rate limiter for the configuration, or
+// nil if both of its limits are disabled
+func newEndpointRateLimiter(cfg EndpointRateLimits) *endpointRateLimiter {
+	l := &endpointRateLimiter{
+		byID: newRateLimiter(cfg.Identity),
+		byIP: newRateLimiter(cfg.IP),
+	}
+	if l.byID == nil && l.byIP == nil {
+		return nil
+	}
+	return l
+}
+
+// check returns an error with HTTP status 429 and sets the Retry-After
+// header of the response if the request exceeds the limit of its remote
+// address. It is checked before the request is handled.
+func (l *endpointRateLimiter) check(w http.ResponseWriter, r *http.Request) error {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return tooManyRequests(w, l.byIP.allow(host, time.Now()))
+}
+
+// checkIdentity returns an error with HTTP status 429 and sets the
+// Retry-After header of the response if a request of the identity 'id'
+// exceeds its limit. It is checked once the identity is authenticated, so
+// that requests which only claim to be made by an identity can't use up
+// its tokens.
+func (l *endpointRateLimiter) checkIdentity(w http.ResponseWriter, id string) error {
+	return tooManyRequests(w, l.byID.allow(id, time.Now()))
+}
+
+// tooManyRequests returns the error of a request which must wait for 'wait'
+// before it is retried, or nil if it need not wait
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) error {
+	if wait == 0 {
+		return nil
+	}
+	secs := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	return newHTTPErr(429, ErrTooManyRequests, "Too many requests; retry after %d seconds", secs)
+}
+
+// checkIdentityRateLimit returns an error if a request of the authenticated
+// caller 'id' exceeds its rate limit of requests to the endpoint
+func (ctx *serverRequestContext) checkIdentityRateLimit(id string) error {
+	if ctx.endpoint == nil || ctx.endpoint.limiter == nil {
+		return nil
+	}
+	return ctx.endpoint.limiter.checkIdentity(ctx.resp, id)
+}
+
+// validateRateLimits returns an error if a rate limit is invalid
+func validateRateLimits(cfg *ServerRateLimits) error {
+	endpoints := map[string]EndpointRateLimits{
+		"enroll":   cfg.Enroll,
+		"register": cfg.Register,
+		"tcert":    cfg.TCert,
+	}
+	for name, ep := range endpoints {
+		for kind, rl := range map[string]RateLimit{"identity": ep.Identity, "ip": ep.IP} {
+			if rl.Rate < 0 || rl.Burst < 0 {
+				return errors.Errorf("Invalid rate limit for %s by %s: rate and burst must not be negative", name, kind)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, newRateLimiter(RateLimit{}), "A rate of 0 should disable the limit")
+
+	l := newRateLimiter(RateLimit{Rate: 60, Burst: 2})
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), l.allow("user1", now))
+	assert.Equal(t, time.Duration(0), l.allow("user1", now))
+	assert.Equal(t, time.Second, l.allow("user1", now), "The burst of user1 should be used up")
+	assert.Equal(t, time.Duration(0), l.allow("user2", now), "Each key should have its own bucket")
+
+	// One token is added per second
+	assert.Equal(t, 500*time.Millisecond, l.allow("user1", now.Add(500*time.Millisecond)))
+	assert.Equal(t, time.Duration(0), l.allow("user1", now.Add(time.Second)))
+	assert.Equal(t, time.Second, l.allow("user1", now.Add(time.Second)))
+
+	// Full buckets are purged
+	later := now.Add(2 * rateLimitPurgeInterval)
+	assert.Equal(t, time.Duration(0), l.allow("user3", later))
+	assert.Len(t, l.buckets, 1, "The full buckets of user1 and user2 should have been purged")
+
+	// The burst defaults to the rate
+	l = newRateLimiter(RateLimit{Rate: 3})
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, time.Duration(0), l.allow("user1", now))
+	}
+	assert.Equal(t, 20*time.Second, l.allow("user1", now))
+
+	// The number of buckets is capped; full buckets are removed first, and
+	// then the least recently used one
+	l = newRateLimiter(RateLimit{Rate: 60, Burst: 1})
+	l.maxBuckets = 2
+	l.allow("user1", now)
+	l.allow("user2", now.Add(time.Millisecond))
+	l.allow("user3", now.Add(2*time.Millisecond))
+	assert.Len(t, l.buckets, 2)
+	assert.NotContains(t, l.buckets, "user1", "The least recently used bucket should have been evicted")
+	l.allow("user4", now.Add(2*time.Second))
+	assert.Len(t, l.buckets, 1, "The full buckets should have been purged")
+}
+
+func TestEndpointRateLimiter(t *testing.T) {
+	assert.Nil(t, newEndpointRateLimiter(EndpointRateLimits{}), "No limits should disable the limiter")
+
+	l := newEndpointRateLimiter(EndpointRateLimits{
+		Identity: RateLimit{Rate: 1},
+		IP:       RateLimit{Rate: 2},
+	})
+	w := httptest.NewRecorder()
+	assert.NoError(t, l.checkIdentity(w, "user1"))
+	err := l.checkIdentity(w, "user1")
+	if assert.Error(t, err, "The second request of user1 should have been limited") {
+		he := getHTTPErr(err)
+		assert.Equal(t, 429, he.scode)
+		assert.Equal(t, ErrTooManyRequests, he.rcode)
+		assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	}
+	assert.NoError(t, l.checkIdentity(httptest.NewRecorder(), "user2"), "Each identity should have its own limit")
+
+	// Requests are limited by the remote address
+	req := httptest.NewRequest("POST", "/api/v1/enroll", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.NoError(t, l.check(httptest.NewRecorder(), req))
+	assert.NoError(t, l.check(httptest.NewRecorder(), req))
+	assert.Error(t, l.check(httptest.NewRecorder(), req), "The address should have used up its burst")
+	req.RemoteAddr = "10.0.0.2:1234"
+	assert.NoError(t, l.check(httptest.NewRecorder(), req))
+}
+
+// Requests which fail to authenticate as an identity don't use up its tokens
+func TestIdentityRateLimit(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	srv.Config.RateLimits.Enroll.Identity = RateLimit{Rate: 1}
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	for i := 0; i < 3; i++ {
+		_, err = client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "wrongpw"})
+		if assert.Error(t, err, "Enrollment with a wrong secret should fail") {
+			assert.NotContains(t, err.Error(), "Too many requests")
+		}
+	}
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	assert.NoError(t, err, "Failed logins should not have used up the tokens of admin")
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	if assert.Error(t, err, "The second enrollment of admin should have been limited") {
+		assert.Contains(t, err.Error(), "Too many requests")
+	}
+}
+
+func TestValidateRateLimits(t *testing.T) {
+	cfg := &ServerRateLimits{}
+	assert.NoError(t, validateRateLimits(cfg))
+	cfg.TCert.IP.Burst = -1
+	assert.Error(t, validateRateLimits(cfg), "A negative burst should be invalid")
+}
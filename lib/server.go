@@ -81,6 +81,8 @@ type Server struct {
 	mutex sync.Mutex
 	// The server's current levels
 	levels *dbutil.Levels
+	// channel which is closed to stop the tasks purging expired certificates
+	purgeStop chan struct{}
 }
 
 // Init initializes a fabric-ca server
@@ -142,9 +144,13 @@ func (s *Server) Start() (err error) {
 
 	log.Debugf("%d CA instance(s) running on server", len(s.caMap))
 
+	// Start purging expired certificates periodically
+	s.startCertPurgeTasks()
+
 	// Start listening and serving
 	err = s.listenAndServe()
 	if err != nil {
+		s.stopCertPurgeTasks()
 		err2 := s.closeDB()
 		if err2 != nil {
 			log.Errorf("Close DB failed: %s", err2)
@@ -159,6 +165,7 @@ func (s *Server) Start() (err error) {
 // requests in transit to fail, and so is only used for testing.
 // A graceful shutdown will be supported with golang 1.8.
 func (s *Server) Stop() error {
+	s.stopCertPurgeTasks()
 	err := s.closeListener()
 	if err != nil {
 		return err
@@ -213,6 +220,8 @@ func (s *Server) RegisterBootstrapUser(user, pass, affiliation string) error {
 			attr.GenCRL:         "true",
 			attr.RegistrarAttr:  "*",
 			attr.AffiliationMgr: "true",
+			attr.Auditor:        "true",
+			attr.Backup:         "true",
 		},
 	}
 
@@ -225,6 +234,33 @@ func (s *Server) RegisterBootstrapUser(user, pass, affiliation string) error {
 
 // initConfig initializes the configuration for the server
 func (s *Server) initConfig() (err error) {
+	err = s.initHomeDir()
+	if err != nil {
+		return err
+	}
+	cfg := s.Config
+	// Set log level if debug is true
+	if cfg.Debug {
+		log.Level = log.LevelDebug
+	}
+	err = validateRateLimits(&cfg.RateLimits)
+	if err != nil {
+		return err
+	}
+	s.CA.server = s
+	s.CA.HomeDir = s.HomeDir
+	err = s.initMultiCAConfig()
+	if err != nil {
+		return err
+	}
+	revoke.SetCRLFetcher(s.fetchCRL)
+	// Make file names absolute
+	s.makeFileNamesAbsolute()
+	return nil
+}
+
+// Initialize the home directory of the server and create its config if not set
+func (s *Server) initHomeDir() (err error) {
 	// Home directory is current working directory by default
 	if s.HomeDir == "" {
 		s.HomeDir, err = os.Getwd()
@@ -242,20 +278,6 @@ func (s *Server) initConfig() (err error) {
 	if s.Config == nil {
 		s.Config = new(ServerConfig)
 	}
-	cfg := s.Config
-	// Set log level if debug is true
-	if cfg.Debug {
-		log.Level = log.LevelDebug
-	}
-	s.CA.server = s
-	s.CA.HomeDir = s.HomeDir
-	err = s.initMultiCAConfig()
-	if err != nil {
-		return err
-	}
-	revoke.SetCRLFetcher(s.fetchCRL)
-	// Make file names absolute
-	s.makeFileNamesAbsolute()
 	return nil
 }
 
@@ -304,14 +326,33 @@ func (s *Server) initDefaultCA(renew bool) error {
 	return nil
 }
 
-// loadCAConfig loads up a CA's configuration from the specified
-// CA configuration file
+// loadCA loads up a CA from the specified CA configuration file
 func (s *Server) loadCA(caFile string, renew bool) error {
 	log.Infof("Loading CA from %s", caFile)
-	var err error
+	cfg, err := s.loadCAConfig(caFile)
+	if err != nil {
+		return err
+	}
+
+	ca, err := newCA(caFile, cfg, s, renew)
+	if err != nil {
+		return err
+	}
+	err = s.addCA(ca)
+	if err != nil {
+		err2 := ca.closeDB()
+		if err2 != nil {
+			log.Errorf("Close DB failed: %s", err2)
+		}
+	}
+	return err
+}
 
+// loadCAConfig loads up a CA's configuration from the specified
+// CA configuration file
+func (s *Server) loadCAConfig(caFile string) (*CAConfig, error) {
 	if !util.FileExists(caFile) {
-		return errors.Errorf("%s file does not exist", caFile)
+		return nil, errors.Errorf("%s file does not exist", caFile)
 	}
 
 	// Creating new Viper instance, to prevent any server level environment variables or
@@ -319,16 +360,16 @@ func (s *Server) loadCA(caFile string, renew bool) error {
 	// CA config file
 	cfg := &CAConfig{}
 	caViper := viper.New()
-	err = UnmarshalConfig(cfg, caViper, caFile, false)
+	err := UnmarshalConfig(cfg, caViper, caFile, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Need to error if no CA name provided in config file, we cannot revert to using
 	// the name of default CA cause CA names must be unique
 	caName := cfg.CA.Name
 	if caName == "" {
-		return errors.Errorf("No CA name provided in CA configuration file. CA name is required in %s", caFile)
+		return nil, errors.Errorf("No CA name provided in CA configuration file. CA name is required in %s", caFile)
 	}
 
 	// Replace missing values in CA configuration values with values from the
@@ -349,18 +390,7 @@ func (s *Server) loadCA(caFile string, renew bool) error {
 
 	log.Debugf("CA configuration after checking for missing values: %+v", cfg)
 
-	ca, err := newCA(caFile, cfg, s, renew)
-	if err != nil {
-		return err
-	}
-	err = s.addCA(ca)
-	if err != nil {
-		err2 := ca.closeDB()
-		if err2 != nil {
-			log.Errorf("Close DB failed: %s", err2)
-		}
-	}
-	return err
+	return cfg, nil
 }
 
 // DN is the distinguished name inside a certificate
@@ -470,8 +500,19 @@ func (s *Server) registerHandlers() {
 	s.registerHandler("gencrl", newGenCRLEndpoint(s))
 	s.registerHandler("identities", newIdentitiesStreamingEndpoint(s))
 	s.registerHandler("identities/{id}", newIdentitiesEndpoint(s))
+	s.registerHandler("identities/{id}/secret", newIdentitySecretEndpoint(s))
+	s.registerHandler("identities/{id}/unlock", newIdentityUnlockEndpoint(s))
+	s.registerHandler("batch/identities", newIdentitiesImportEndpoint(s))
 	s.registerHandler("affiliations", newAffiliationsStreamingEndpoint(s))
 	s.registerHandler("affiliations/{affiliation}", newAffiliationsEndpoint(s))
+	s.registerHandler("audit", newAuditEndpoint(s))
+	s.registerHandler("operations", newOperationsEndpoint(s))
+	s.registerHandler("operations/{id}/confirm", newConfirmOperationEndpoint(s))
+	s.registerHandler("ldap/cache", newLDAPCacheEndpoint(s))
+	s.registerHandler("backup", newBackupEndpoint(s))
+	s.registerHandler("idemix/nonce", newIdemixNonceEndpoint(s))
+	s.registerHandler("idemix/credential", newIdemixCredentialEndpoint(s))
+	s.registerHandler("idemix/cri", newIdemixCRIEndpoint(s))
 }
 
 // Register a handler
@@ -503,6 +544,16 @@ func (s *Server) listenAndServe() (err error) {
 		log.Debug("TLS is enabled")
 		addrStr = fmt.Sprintf("https://%s", addr)
 
+		// Callers can only be authenticated by client certificates which
+		// were verified during the TLS handshake
+		if c.TLS.ClientAuth.CertAuth {
+			authType := clientAuthTypes[strings.ToLower(c.TLS.ClientAuth.Type)]
+			if authType != tls.VerifyClientCertIfGiven && authType != tls.RequireAndVerifyClientCert {
+				return errors.Errorf("Authentication with TLS client certificates requires a client auth type of "+
+					"'VerifyClientCertIfGiven' or 'RequireAndVerifyClientCert' but found '%s'", c.TLS.ClientAuth.Type)
+			}
+		}
+
 		// If key file is specified and it does not exist or its corresponding certificate file does not exist
 		// then need to return error and not start the server. The TLS key file is specified when the user
 		// wants the server to use custom tls key and cert and don't want server to auto generate its own. So,
@@ -23,7 +23,6 @@ import (
 
 	"github.com/cloudflare/cfssl/log"
 	"github.com/tjfoc/fabric-ca-gm/api"
-	"github.com/tjfoc/fabric-ca-gm/lib/attr"
 	"github.com/tjfoc/fabric-ca-gm/lib/spi"
 	"github.com/pkg/errors"
 )
@@ -34,6 +33,7 @@ func newAffiliationsEndpoint(s *Server) *serverEndpoint {
 		Handler:   affiliationsHandler,
 		Server:    s,
 		successRC: 200,
+		action:    actionAffiliations,
 	}
 }
 
@@ -43,6 +43,7 @@ func newAffiliationsStreamingEndpoint(s *Server) *serverEndpoint {
 		Handler:   affiliationsStreamingHandler,
 		Server:    s,
 		successRC: 200,
+		action:    actionAffiliations,
 	}
 }
 
@@ -62,10 +63,6 @@ func affiliationsHandler(ctx *serverRequestContext) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = ctx.HasRole(attr.AffiliationMgr)
-	if err != nil {
-		return nil, err
-	}
 	// Process Request
 	resp, err := processAffiliationRequest(ctx, caname, caller)
 	if err != nil {
@@ -92,10 +89,6 @@ func affiliationsStreamingHandler(ctx *serverRequestContext) (interface{}, error
 	if err != nil {
 		return nil, err
 	}
-	err = ctx.HasRole(attr.AffiliationMgr)
-	if err != nil {
-		return nil, err
-	}
 	// Process Request
 	resp, err := processStreamingAffiliationRequest(ctx, caname, caller)
 	if err != nil {
@@ -182,6 +175,9 @@ func getAffiliations(ctx *serverRequestContext, caller spi.User, caname string)
 		if err != nil {
 			return nil, newHTTPErr(500, ErrGettingAffiliation, "Failed to get read row: %s", err)
 		}
+		if !ctx.inAuthzScope(aff.Name) {
+			continue
+		}
 
 		an.insertByName(aff.Name)
 	}
@@ -255,11 +251,24 @@ func processAffiliationDeleteRequest(ctx *serverRequestContext, caname string) (
 		}
 	}
 
+	if force && ctx.needsApproval(opRemoveAffiliation) {
+		pending, err := ctx.deferOperation(opRemoveAffiliation, removeAffiliation, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &api.AffiliationResponse{
+			AffiliationInfo: api.AffiliationInfo{Name: removeAffiliation},
+			CAName:          caname,
+			Pending:         pending,
+		}, nil
+	}
+
 	identityRemoval := ctx.ca.Config.Cfg.Identities.AllowRemove
 	result, err := ctx.ca.registry.DeleteAffiliation(removeAffiliation, force, identityRemoval, isRegistrar)
 	if err != nil {
 		return nil, err
 	}
+	ctx.audit(auditRemoveAffiliation, removeAffiliation, auditAffiliation(removeAffiliation, result), nil)
 
 	resp, err := getResponse(result, caname)
 	if err != nil {
@@ -340,6 +349,8 @@ func processAffiliationPostRequest(ctx *serverRequestContext, caname string) (*a
 
 	}
 
+	ctx.audit(auditAddAffiliation, addAffiliation, nil, auditAffiliation(addAffiliation, nil))
+
 	resp := &api.AffiliationResponse{CAName: caname}
 	resp.Name = addAffiliation
 
@@ -395,6 +406,7 @@ func processAffiliationPutRequest(ctx *serverRequestContext, caname string) (*ap
 	if err != nil {
 		return nil, errors.WithMessage(err, fmt.Sprintf("Failed to modify affiliation from '%s' to '%s'", modifyAffiliation, newAffiliation))
 	}
+	ctx.audit(auditModifyAffiliation, modifyAffiliation, auditAffiliation(modifyAffiliation, nil), auditAffiliation(newAffiliation, result))
 
 	resp, err := getResponse(result, caname)
 	if err != nil {
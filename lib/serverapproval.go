@@ -0,0 +1,314 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	gmux "github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/attr"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+// The operations which may require approval by a second identity
+const (
+	opRevoke            = "revoke"
+	opRemoveIdentity    = "removeidentity"
+	opRemoveAffiliation = "removeaffiliation"
+)
+
+// approvalOperation is an operation which may require approval. When it is
+// confirmed, the confirmer must be authorized to perform 'action', and the
+// stored request is performed by 'execute' on behalf of the confirmer.
+type approvalOperation struct {
+	action  string
+	execute func(ctx *serverRequestContext, rec *PendingOperationRecord, req *pendingRequest) (interface{}, error)
+}
+
+var approvalOperations = map[string]*approvalOperation{
+	opRevoke:            {action: actionRevoke, execute: executePendingRevoke},
+	opRemoveIdentity:    {action: actionIdentities, execute: executePendingRemoveIdentity},
+	opRemoveAffiliation: {action: actionAffiliations, execute: executePendingRemoveAffiliation},
+}
+
+// pendingRequest is the part of a request which is needed to perform it
+// once it is confirmed
+type pendingRequest struct {
+	Vars  map[string]string `json:"vars,omitempty"`
+	Query string            `json:"query,omitempty"`
+	Body  []byte            `json:"body,omitempty"`
+}
+
+// validateApprovalConfig returns an error if an operation which requires
+// approval is unknown
+func validateApprovalConfig(cfg *CAConfigApproval) error {
+	for _, op := range cfg.Operations {
+		if _, ok := approvalOperations[op]; !ok {
+			return errors.Errorf("Unknown operation '%s' in approval.operations; it must be one of revoke, removeidentity or removeaffiliation", op)
+		}
+	}
+	if len(cfg.Operations) > 0 && cfg.Window <= 0 {
+		return errors.New("Invalid approval.window; it must be greater than 0")
+	}
+	return nil
+}
+
+// isPrivilegedIdentity returns true if 'user' is a registrar or an
+// intermediate CA, whose revocation requires approval
+func isPrivilegedIdentity(user spi.User) bool {
+	roles, err := user.GetAttribute(attr.Roles)
+	if err == nil && roles.Value != "" {
+		return true
+	}
+	ica, err := user.GetAttribute(attr.IntermediateCA)
+	if err != nil {
+		return false
+	}
+	isICA, _ := strconv.ParseBool(ica.Value)
+	return isICA
+}
+
+// needsApproval returns true if 'op' must be confirmed by a second identity
+// before it is performed
+func (ctx *serverRequestContext) needsApproval(op string) bool {
+	return !ctx.approved && util.StrContained(op, ctx.ca.Config.Approval.Operations)
+}
+
+// deferOperation stores the request as a pending operation on 'target'
+// which must be confirmed within the approval window, and sets the status
+// of the response to 202 (Accepted). 'body' is the request body to store,
+// if the operation needs one.
+func (ctx *serverRequestContext) deferOperation(op, target string, body []byte) (*api.PendingOperation, error) {
+	ca := ctx.ca
+	caller, err := ctx.GetCaller()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(&pendingRequest{Vars: gmux.Vars(ctx.req), Query: ctx.req.URL.RawQuery, Body: body})
+	if err != nil {
+		return nil, newHTTPErr(500, ErrApproval, "Failed to marshal the request of operation '%s': %s", op, err)
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrApproval, "Failed to generate the ID of a pending operation: %s", err)
+	}
+	now := time.Now()
+	rec := PendingOperationRecord{
+		ID:          hex.EncodeToString(id),
+		CAName:      ca.Config.CA.Name,
+		Operation:   op,
+		Target:      target,
+		Request:     string(buf),
+		Requester:   caller.GetName(),
+		RequestedAt: now,
+		Expiry:      now.Add(ca.Config.Approval.Window),
+	}
+	err = ca.pendingOpDBAccessor.DeleteExpiredOperations(now)
+	if err != nil {
+		log.Warningf("Failed to delete expired pending operations: %s", err)
+	}
+	err = ca.pendingOpDBAccessor.InsertOperation(rec)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrApproval, "Failed to store pending operation '%s' on '%s': %s", op, target, err)
+	}
+	log.Infof("Operation '%s' on '%s' by '%s' is pending approval as '%s'", op, target, rec.Requester, rec.ID)
+	ctx.audit(auditRequestOperation, target, nil, map[string]interface{}{"operation": op, "id": rec.ID})
+	ctx.resp.WriteHeader(http.StatusAccepted)
+	return getPendingOperation(&rec), nil
+}
+
+func getPendingOperation(rec *PendingOperationRecord) *api.PendingOperation {
+	return &api.PendingOperation{
+		ID:          rec.ID,
+		Operation:   rec.Operation,
+		Target:      rec.Target,
+		Requester:   rec.Requester,
+		RequestedAt: rec.RequestedAt.UTC().Format(time.RFC3339),
+		Expiry:      rec.Expiry.UTC().Format(time.RFC3339),
+		CAName:      rec.CAName,
+	}
+}
+
+func newOperationsEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"GET"},
+		Handler: operationsHandler,
+		Server:  s,
+	}
+}
+
+func newConfirmOperationEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"POST"},
+		Handler: confirmOperationHandler,
+		Server:  s,
+	}
+}
+
+// operationsHandler returns the pending operations which the caller may
+// confirm
+func operationsHandler(ctx *serverRequestContext) (interface{}, error) {
+	// Authenticate
+	callerID, err := ctx.TokenAuthentication()
+	log.Debugf("Received request for pending operations from %s", callerID)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	caller, err := ctx.GetCaller()
+	if err != nil {
+		return nil, err
+	}
+	recs, err := ca.pendingOpDBAccessor.GetOperations(ca.Config.CA.Name, time.Now())
+	if err != nil {
+		return nil, newHTTPErr(500, ErrApproval, "Failed to get pending operations: %s", err)
+	}
+	resp := &api.GetPendingOperationsResponse{Operations: []api.PendingOperation{}, CAName: ca.Config.CA.Name}
+	for i := range recs {
+		rec := &recs[i]
+		op := approvalOperations[rec.Operation]
+		if op == nil || rec.Requester == callerID || len(ca.authz.grants(caller, op.action)) == 0 {
+			continue
+		}
+		resp.Operations = append(resp.Operations, *getPendingOperation(rec))
+	}
+	return resp, nil
+}
+
+// confirmOperationHandler performs a pending operation on behalf of the
+// caller, who must not be the identity which requested it and must have
+// the authority to perform it
+func confirmOperationHandler(ctx *serverRequestContext) (interface{}, error) {
+	// Authenticate
+	callerID, err := ctx.TokenAuthentication()
+	log.Debugf("Received request to confirm a pending operation from %s", callerID)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	id, err := ctx.GetVar("id")
+	if err != nil {
+		return nil, err
+	}
+	rec, err := ca.pendingOpDBAccessor.GetOperation(id, ca.Config.CA.Name)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrApproval, "Failed to get pending operation '%s': %s", id, err)
+	}
+	if rec == nil || !time.Now().Before(rec.Expiry) {
+		return nil, newHTTPErr(404, ErrPendingOpNotFound, "Pending operation '%s' was not found or has expired", id)
+	}
+	if rec.Requester == callerID {
+		return nil, newAuthErr(ErrApproval, "Pending operation '%s' was requested by '%s', so it must be confirmed by another identity",
+			id, callerID)
+	}
+	op := approvalOperations[rec.Operation]
+	if op == nil {
+		return nil, newHTTPErr(500, ErrApproval, "Pending operation '%s' has unknown operation '%s'", id, rec.Operation)
+	}
+	var req pendingRequest
+	err = json.Unmarshal([]byte(rec.Request), &req)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrApproval, "Failed to unmarshal the request of pending operation '%s': %s", id, err)
+	}
+	actx, err := ctx.approvedContext(op, &req)
+	if err != nil {
+		return nil, err
+	}
+	// Remove the operation before performing it so that it can't be
+	// performed twice by concurrent confirmations
+	removed, err := ca.pendingOpDBAccessor.DeleteOperation(id)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrApproval, "Failed to remove pending operation '%s': %s", id, err)
+	}
+	if !removed {
+		return nil, newHTTPErr(404, ErrPendingOpNotFound, "Pending operation '%s' was not found or has expired", id)
+	}
+	result, err := op.execute(actx, rec, &req)
+	if err != nil {
+		// Restore the operation so that it can be confirmed again until it
+		// expires, and record the failure
+		err2 := ca.pendingOpDBAccessor.InsertOperation(*rec)
+		if err2 != nil {
+			log.Errorf("Failed to restore pending operation '%s' after it failed: %s", id, err2)
+		}
+		log.Infof("Operation '%s' on '%s' requested by '%s' and confirmed by '%s' failed: %s",
+			rec.Operation, rec.Target, rec.Requester, callerID, err)
+		ctx.audit(auditFailedOperation, rec.Target, nil, map[string]interface{}{
+			"operation": rec.Operation, "id": id, "requester": rec.Requester, "error": err.Error()})
+		return nil, err
+	}
+	log.Infof("Operation '%s' on '%s' requested by '%s' was confirmed by '%s'", rec.Operation, rec.Target, rec.Requester, callerID)
+	ctx.audit(auditConfirmOperation, rec.Target, nil, map[string]interface{}{
+		"operation": rec.Operation, "id": id, "requester": rec.Requester})
+	return &api.ConfirmOperationResponse{Operation: *getPendingOperation(rec), Result: result, CAName: rec.CAName}, nil
+}
+
+// approvedContext returns a copy of the context in which the stored request
+// of a pending operation is performed on behalf of the caller, after
+// authorizing the caller to perform the operation
+func (ctx *serverRequestContext) approvedContext(op *approvalOperation, req *pendingRequest) (*serverRequestContext, error) {
+	actx := *ctx
+	ep := *ctx.endpoint
+	ep.action = op.action
+	actx.endpoint = &ep
+	actx.authzScopes = nil
+	err := actx.authorizeEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	r := ctx.req.WithContext(ctx.req.Context())
+	u := *r.URL
+	u.RawQuery = req.Query
+	r.URL = &u
+	actx.req = r
+	actx.vars = req.Vars
+	actx.approved = true
+	return &actx, nil
+}
+
+func executePendingRevoke(ctx *serverRequestContext, rec *PendingOperationRecord, req *pendingRequest) (interface{}, error) {
+	var revReq api.RevocationRequestNet
+	err := json.Unmarshal(req.Body, &revReq)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrApproval, "Failed to unmarshal the revocation request of pending operation '%s': %s", rec.ID, err)
+	}
+	return processRevokeRequest(ctx, &revReq)
+}
+
+func executePendingRemoveIdentity(ctx *serverRequestContext, rec *PendingOperationRecord, req *pendingRequest) (interface{}, error) {
+	return processDeleteRequest(ctx, rec.CAName)
+}
+
+func executePendingRemoveAffiliation(ctx *serverRequestContext, rec *PendingOperationRecord, req *pendingRequest) (interface{}, error) {
+	return processAffiliationDeleteRequest(ctx, rec.CAName)
+}
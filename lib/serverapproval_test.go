@@ -0,0 +1,154 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func TestValidateApprovalConfig(t *testing.T) {
+	assert.NoError(t, validateApprovalConfig(&CAConfigApproval{}))
+	assert.NoError(t, validateApprovalConfig(&CAConfigApproval{Operations: []string{opRevoke, opRemoveAffiliation}, Window: time.Hour}))
+	assert.Error(t, validateApprovalConfig(&CAConfigApproval{Operations: []string{"enroll"}, Window: time.Hour}),
+		"An unknown operation should be invalid")
+	assert.Error(t, validateApprovalConfig(&CAConfigApproval{Operations: []string{opRevoke}}),
+		"A window of 0 should be invalid")
+}
+
+func TestTwoPersonApproval(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+
+	srv := TestGetRootServer(t)
+	srv.CA.Config.Cfg.Identities.AllowRemove = true
+	srv.CA.Config.Approval = CAConfigApproval{Operations: []string{opRevoke, opRemoveIdentity}, Window: time.Hour}
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+	regResp, err := admin.Register(&api.RegistrationRequest{
+		Name:        "admin2",
+		Type:        "client",
+		Affiliation: "org1",
+		Attributes:  []api.Attribute{{Name: "hf.Registrar.Roles", Value: "client,user,peer"}, {Name: "hf.Revoker", Value: "true"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to register admin2: %s", err)
+	}
+	resp, err = client.Enroll(&api.EnrollmentRequest{Name: "admin2", Secret: regResp.Secret})
+	if err != nil {
+		t.Fatalf("Failed to enroll admin2: %s", err)
+	}
+	admin2 := resp.Identity
+	_, err = admin.Register(&api.RegistrationRequest{Name: "user1", Type: "client", Affiliation: "org1"})
+	if err != nil {
+		t.Fatalf("Failed to register user1: %s", err)
+	}
+
+	// Removing an identity creates a pending operation
+	removeResp, err := admin.RemoveIdentity(&api.RemoveIdentityRequest{ID: "user1"})
+	if err != nil {
+		t.Fatalf("Failed to request removal of user1: %s", err)
+	}
+	pending := removeResp.Pending
+	if !assert.NotNil(t, pending, "Removing an identity should require approval") {
+		t.FailNow()
+	}
+	assert.Equal(t, opRemoveIdentity, pending.Operation)
+	assert.Equal(t, "admin", pending.Requester)
+	_, err = admin.GetIdentity("user1", "")
+	assert.NoError(t, err, "user1 should not be removed until the removal is confirmed")
+
+	ops, err := admin.GetPendingOperations("")
+	if assert.NoError(t, err, "Failed to get pending operations") {
+		assert.Empty(t, ops.Operations, "The requester should not be able to confirm its own request")
+	}
+	ops, err = admin2.GetPendingOperations("")
+	if assert.NoError(t, err, "Failed to get pending operations") && assert.Len(t, ops.Operations, 1) {
+		assert.Equal(t, pending.ID, ops.Operations[0].ID)
+	}
+
+	_, err = admin.ConfirmOperation(&api.ConfirmOperationRequest{ID: pending.ID})
+	assert.Error(t, err, "The requester should not be able to confirm its own request")
+	confirmResp, err := admin2.ConfirmOperation(&api.ConfirmOperationRequest{ID: pending.ID})
+	if assert.NoError(t, err, "Failed to confirm removal of user1") {
+		assert.Equal(t, "user1", confirmResp.Operation.Target)
+	}
+	_, err = admin.GetIdentity("user1", "")
+	assert.Error(t, err, "user1 should have been removed when the removal was confirmed")
+	_, err = admin2.ConfirmOperation(&api.ConfirmOperationRequest{ID: pending.ID})
+	assert.Error(t, err, "A confirmed operation should not be confirmed again")
+
+	// Only the revocation of registrars and intermediate CAs requires approval
+	_, err = admin.Register(&api.RegistrationRequest{Name: "user2", Type: "client", Affiliation: "org1"})
+	if err != nil {
+		t.Fatalf("Failed to register user2: %s", err)
+	}
+	revResp, err := admin.Revoke(&api.RevocationRequest{Name: "user2"})
+	if assert.NoError(t, err, "Failed to revoke user2") {
+		assert.Nil(t, revResp.Pending, "Revoking an identity which is not a registrar should not require approval")
+	}
+	revResp, err = admin.Revoke(&api.RevocationRequest{Name: "admin2"})
+	if assert.NoError(t, err, "Failed to request revocation of admin2") {
+		assert.NotNil(t, revResp.Pending, "Revoking a registrar should require approval")
+	}
+	_, err = admin2.GetIdentity("admin2", "")
+	assert.NoError(t, err, "admin2 should not be revoked until the revocation is confirmed")
+
+	// An operation which fails when it is confirmed stays pending, and the
+	// failure is audited
+	_, err = admin.Register(&api.RegistrationRequest{Name: "user3", Type: "client", Affiliation: "org1"})
+	if err != nil {
+		t.Fatalf("Failed to register user3: %s", err)
+	}
+	removeResp, err = admin.RemoveIdentity(&api.RemoveIdentityRequest{ID: "user3"})
+	if err != nil || removeResp.Pending == nil {
+		t.Fatalf("Failed to request removal of user3: %v", err)
+	}
+	_, err = srv.CA.registry.DeleteUser("user3")
+	if err != nil {
+		t.Fatalf("Failed to delete user3: %s", err)
+	}
+	_, err = admin2.ConfirmOperation(&api.ConfirmOperationRequest{ID: removeResp.Pending.ID})
+	assert.Error(t, err, "Removing an identity which does not exist should fail")
+	rec, err := srv.CA.pendingOpDBAccessor.GetOperation(removeResp.Pending.ID, srv.CA.Config.CA.Name)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, rec, "The failed operation should still be pending")
+	}
+	rows, err := srv.CA.auditDBAccessor.GetRecords(srv.CA.Config.CA.Name, &api.GetAuditLogRequest{Action: auditFailedOperation})
+	if assert.NoError(t, err, "Failed to get the audit log") {
+		failures := 0
+		for rows.Next() {
+			failures++
+		}
+		rows.Close()
+		assert.Equal(t, 1, failures, "The failed operation should have been audited")
+	}
+}
@@ -0,0 +1,338 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+// The actions which are recorded in the audit log
+const (
+	auditRegister          = "register"
+	auditAddIdentity       = "identity.add"
+	auditModifyIdentity    = "identity.modify"
+	auditRemoveIdentity    = "identity.remove"
+	auditResetSecret       = "identity.resetsecret"
+	auditUnlockIdentity    = "identity.unlock"
+	auditImportIdentity    = "identity.import"
+	auditAddAffiliation    = "affiliation.add"
+	auditModifyAffiliation = "affiliation.modify"
+	auditRemoveAffiliation = "affiliation.remove"
+	auditRevoke            = "revoke"
+	auditGenCRL            = "gencrl"
+	auditRequestOperation  = "operation.request"
+	auditConfirmOperation  = "operation.confirm"
+	auditFailedOperation   = "operation.fail"
+)
+
+// The value recorded in the audit log in place of a secret
+const maskedSecret = "****"
+
+func newAuditEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods:   []string{"GET"},
+		Handler:   auditHandler,
+		Server:    s,
+		successRC: 200,
+		action:    actionAudit,
+	}
+}
+
+// auditHandler streams the records of the audit log of a CA to a caller
+// which is authorized to get it
+func auditHandler(ctx *serverRequestContext) (interface{}, error) {
+	// Authenticate
+	callerID, err := ctx.TokenAuthentication()
+	log.Debugf("Received audit log request from %s", callerID)
+	if err != nil {
+		return nil, err
+	}
+	caname, err := ctx.getCAName()
+	if err != nil {
+		return nil, err
+	}
+	req, err := getAuditLogRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Process Request
+	return nil, getAuditRecords(ctx, req, caname)
+}
+
+// getAuditLogRequest gets the filters of an audit log request from its
+// query parameters
+func getAuditLogRequest(ctx *serverRequestContext) (*api.GetAuditLogRequest, error) {
+	var err error
+	query := ctx.req.URL.Query()
+	req := &api.GetAuditLogRequest{
+		Caller: query.Get("caller"),
+		Action: query.Get("action"),
+	}
+	if since := query.Get("since"); since != "" {
+		req.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, newHTTPErr(400, ErrGettingAuditLog, "Invalid 'since' query parameter '%s'; it must be an RFC3339 timestamp", since)
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		req.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, newHTTPErr(400, ErrGettingAuditLog, "Invalid 'until' query parameter '%s'; it must be an RFC3339 timestamp", until)
+		}
+	}
+	return req, nil
+}
+
+func getAuditRecords(ctx *serverRequestContext, req *api.GetAuditLogRequest, caname string) error {
+	log.Debugf("Requesting audit records matching %+v", req)
+
+	w := ctx.resp
+	flusher, _ := w.(http.Flusher)
+
+	rows, err := ctx.ca.auditDBAccessor.GetRecords(ctx.ca.Config.CA.Name, req)
+	if err != nil {
+		return newHTTPErr(500, ErrGettingAuditLog, "Failed to get audit records: %s", err)
+	}
+	defer rows.Close()
+
+	// Get the number of records to return back to client in a chunk based on the environment variable
+	// If environment variable not set, default to 100 records
+	numRecords := 100
+	if numberOfRecords := os.Getenv("FABRIC_CA_SERVER_MAX_AUDIT_RECORDS_PER_CHUNK"); numberOfRecords != "" {
+		numRecords, err = strconv.Atoi(numberOfRecords)
+		if err != nil {
+			return newHTTPErr(500, ErrGettingAuditLog, "Incorrect format specified for environment variable 'FABRIC_CA_SERVER_MAX_AUDIT_RECORDS_PER_CHUNK', an integer value is required: %s", err)
+		}
+	}
+
+	w.Write([]byte(`{"records":[`))
+
+	rowNumber := 0
+	for rows.Next() {
+		rowNumber++
+		var rec AuditRecord
+		err := rows.StructScan(&rec)
+		if err != nil {
+			return newHTTPErr(500, ErrGettingAuditLog, "Failed to read audit record: %s", err)
+		}
+
+		if rowNumber > 1 {
+			w.Write([]byte(","))
+		}
+
+		info := api.AuditRecord{
+			Time:   rec.LoggedAt,
+			Caller: rec.Caller,
+			CAName: rec.CAName,
+			Action: rec.Action,
+			Target: rec.Target,
+			Source: rec.Source,
+		}
+		if rec.Changes != "" {
+			json.Unmarshal([]byte(rec.Changes), &info.Changes)
+		}
+
+		resp, err := util.Marshal(info, "audit record")
+		if err != nil {
+			return newHTTPErr(500, ErrGettingAuditLog, "Failed to marshal audit record: %s", err)
+		}
+		w.Write(resp)
+
+		// If hit the number of records requested then flush
+		if rowNumber%numRecords == 0 {
+			flusher.Flush() // Trigger "chunked" encoding and send a chunk...
+		}
+	}
+
+	// Close the JSON object
+	w.Write([]byte(fmt.Sprintf("], \"caname\":\"%s\"}", caname)))
+	flusher.Flush()
+
+	return nil
+}
+
+// audit adds a record of a change made by the caller to the audit log of
+// the CA. 'before' and 'after' are the fields of the target before and after
+// the change, of which only those whose values differ are recorded. A
+// failure to add the record is logged, as the change itself was made.
+func (ctx *serverRequestContext) audit(action, target string, before, after map[string]interface{}) {
+	ca := ctx.ca
+	if ca == nil || ca.auditDBAccessor == nil {
+		return
+	}
+	changes, err := json.Marshal(getAuditChanges(before, after))
+	if err != nil {
+		log.Errorf("Failed to marshal changes of action '%s' on '%s' for the audit log: %s", action, target, err)
+		return
+	}
+	rec := AuditRecord{
+		LoggedAt: time.Now().UTC(),
+		Caller:   ctx.enrollmentID,
+		CAName:   ca.Config.CA.Name,
+		Action:   action,
+		Target:   target,
+		Changes:  string(changes),
+		Source:   ctx.getSourceAddr(),
+	}
+	err = ca.auditDBAccessor.InsertRecord(rec)
+	if err != nil {
+		log.Errorf("Failed to add action '%s' on '%s' by '%s' to the audit log: %s", action, target, rec.Caller, err)
+	}
+}
+
+// getSourceAddr returns the IP address from which the request was sent
+func (ctx *serverRequestContext) getSourceAddr() string {
+	host, _, err := net.SplitHostPort(ctx.req.RemoteAddr)
+	if err != nil {
+		return ctx.req.RemoteAddr
+	}
+	return host
+}
+
+// getAuditChanges returns the fields whose values differ between 'before'
+// and 'after'
+func getAuditChanges(before, after map[string]interface{}) map[string]api.AuditChange {
+	changes := map[string]api.AuditChange{}
+	for name, val := range before {
+		if aval, ok := after[name]; !ok || !reflect.DeepEqual(val, aval) {
+			changes[name] = api.AuditChange{Before: val, After: after[name]}
+		}
+	}
+	for name, val := range after {
+		if _, ok := before[name]; !ok {
+			changes[name] = api.AuditChange{After: val}
+		}
+	}
+	return changes
+}
+
+// auditIdentity returns the fields of an identity which are recorded in the
+// audit log; if 'secretSet' is true, the masked secret is included
+func auditIdentity(user spi.User, secretSet bool) map[string]interface{} {
+	if user == nil {
+		return nil
+	}
+	fields := map[string]interface{}{
+		"id":              user.GetName(),
+		"type":            user.GetType(),
+		"affiliation":     GetUserAffiliation(user),
+		"max_enrollments": user.GetMaxEnrollments(),
+	}
+	attrs, err := user.GetAttributes(nil)
+	if err == nil {
+		fields["attrs"] = attrs
+	}
+	if isSuspended(user) {
+		fields["suspended"] = true
+	}
+	if secretSet {
+		fields["secret"] = maskedSecret
+	}
+	return fields
+}
+
+// auditRegisteredIdentity returns the audit log fields of an identity which
+// was just registered
+func auditRegisteredIdentity(ca *CA, id string) map[string]interface{} {
+	user, err := ca.registry.GetUser(id, nil)
+	if err != nil {
+		return map[string]interface{}{"id": id, "secret": maskedSecret}
+	}
+	return auditIdentity(user, true)
+}
+
+// auditAffiliation returns the audit log fields of an affiliation, including
+// the affiliations and identities affected by a change to it
+func auditAffiliation(name string, result *spi.DbTxResult) map[string]interface{} {
+	fields := map[string]interface{}{"name": name}
+	if result == nil {
+		return fields
+	}
+	if len(result.Affiliations) > 0 {
+		affs := []string{}
+		for _, aff := range result.Affiliations {
+			affs = append(affs, aff.GetName())
+		}
+		fields["affiliations"] = affs
+	}
+	if len(result.Identities) > 0 {
+		ids := []string{}
+		for _, id := range result.Identities {
+			ids = append(ids, id.GetName())
+		}
+		fields["identities"] = ids
+	}
+	return fields
+}
+
+// getRevokeTarget returns the identity, certificate or Idemix credential named
+// by a revoke request
+func getRevokeTarget(req *api.RevocationRequestNet) string {
+	if req.Serial != "" && req.AKI != "" {
+		return fmt.Sprintf("serial=%s,aki=%s", req.Serial, req.AKI)
+	}
+	if req.RevocationHandle != "" && req.Serial == "" {
+		return fmt.Sprintf("rh=%s", req.RevocationHandle)
+	}
+	return req.Name
+}
+
+// auditRevocation returns the audit log fields of revoked certificates and
+// Idemix credentials
+func auditRevocation(reason string, certs []api.RevokedCert, creds []string) map[string]interface{} {
+	serials := []string{}
+	for _, cert := range certs {
+		serials = append(serials, cert.Serial)
+	}
+	fields := map[string]interface{}{
+		"revoked": serials,
+		"reason":  reason,
+	}
+	if len(creds) > 0 {
+		fields["revoked_credentials"] = creds
+	}
+	return fields
+}
+
+// auditGenCRLRequest returns the audit log fields of a gencrl request
+func auditGenCRLRequest(req *api.GenCRLRequest) map[string]interface{} {
+	fields := map[string]interface{}{}
+	times := map[string]time.Time{
+		"revokedafter":  req.RevokedAfter,
+		"revokedbefore": req.RevokedBefore,
+		"expireafter":   req.ExpireAfter,
+		"expirebefore":  req.ExpireBefore,
+	}
+	for name, t := range times {
+		if !t.IsZero() {
+			fields[name] = t.UTC().Format(time.RFC3339)
+		}
+	}
+	return fields
+}
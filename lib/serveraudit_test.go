@@ -0,0 +1,101 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func TestAuditLog(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+
+	start := time.Now().Add(-time.Minute)
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:        "audit1",
+		Secret:      "audit1pw",
+		Affiliation: "org2",
+	})
+	if err != nil {
+		t.Fatalf("Failed to register audit1: %s", err)
+	}
+	_, err = admin.ModifyIdentity(&api.ModifyIdentityRequest{
+		ID:     "audit1",
+		Type:   "peer",
+		Secret: "newpw",
+	})
+	if err != nil {
+		t.Fatalf("Failed to modify audit1: %s", err)
+	}
+
+	var records []api.AuditRecord
+	collect := func(decoder *json.Decoder) error {
+		var rec api.AuditRecord
+		err := decoder.Decode(&rec)
+		if err != nil {
+			return err
+		}
+		records = append(records, rec)
+		return nil
+	}
+	err = admin.GetAuditLog(&api.GetAuditLogRequest{Since: start, Caller: "admin"}, collect)
+	if err != nil {
+		t.Fatalf("Failed to get audit log: %s", err)
+	}
+	if assert.Equal(t, 2, len(records), "Incorrect number of audit records") {
+		assert.Equal(t, "register", records[0].Action)
+		assert.Equal(t, "audit1", records[0].Target)
+		assert.Equal(t, "identity.modify", records[1].Action)
+		assert.Equal(t, "peer", records[1].Changes["type"].After)
+		assert.Equal(t, "****", records[1].Changes["secret"].After, "The secret should be masked")
+	}
+
+	records = nil
+	err = admin.GetAuditLog(&api.GetAuditLogRequest{Action: "identity.remove"}, collect)
+	assert.NoError(t, err, "Failed to get audit log")
+	assert.Equal(t, 0, len(records), "There should be no records of removed identities")
+
+	// Only an identity with the 'hf.Auditor' attribute may get the audit log
+	enrResp, err := client.Enroll(&api.EnrollmentRequest{Name: "audit1", Secret: "newpw"})
+	if err != nil {
+		t.Fatalf("Failed to enroll audit1: %s", err)
+	}
+	err = enrResp.Identity.GetAuditLog(&api.GetAuditLogRequest{}, collect)
+	assert.Error(t, err, "Getting the audit log without the 'hf.Auditor' attribute should have failed")
+}
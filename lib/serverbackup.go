@@ -0,0 +1,67 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+// The response to the GET /backup request
+type backupResponseNet struct {
+	// Base64 encoding of the backup archive
+	Archive string
+}
+
+func newBackupEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods:   []string{"GET"},
+		Handler:   backupHandler,
+		Server:    s,
+		successRC: 200,
+		action:    actionBackup,
+	}
+}
+
+// backupHandler returns a signed archive of the state of every CA of the
+// server
+func backupHandler(ctx *serverRequestContext) (interface{}, error) {
+	// Authenticate
+	callerID, err := ctx.TokenAuthentication()
+	log.Debugf("Received backup request from %s", callerID)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	// The archive contains the state of all CAs, so only the identities of
+	// the default CA may request it
+	if ca != &ctx.endpoint.Server.CA {
+		return nil, newAuthErr(ErrNoBackupAuth, "The identity '%s' of CA '%s' may not back up the server; send the request to the default CA", callerID, ca.Config.CA.Name)
+	}
+	var buf bytes.Buffer
+	err = writeBackup(ctx.endpoint.Server.backupCAs(), &buf)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrBackup, "Failed to back up the server: %s", err)
+	}
+	log.Infof("Backed up the server at the request of '%s'", callerID)
+	return &backupResponseNet{Archive: util.B64Encode(buf.Bytes())}, nil
+}
@@ -55,4 +55,28 @@ type ServerConfig struct {
 	CAcount int `def:"0" help:"Number of non-default CA instances"`
 	// Size limit of an acceptable CRL in bytes
 	CRLSizeLimit int `def:"512000" help:"Size limit of an acceptable CRL in bytes"`
+	// Limits on the rate of requests to the enroll, register and tcert endpoints
+	RateLimits ServerRateLimits
+}
+
+// ServerRateLimits contains the rate limits of the endpoints which are
+// expensive to serve
+type ServerRateLimits struct {
+	Enroll   EndpointRateLimits
+	Register EndpointRateLimits
+	TCert    EndpointRateLimits
+}
+
+// EndpointRateLimits contains the rate limits of an endpoint, which are
+// applied to each enrollment ID and to each remote address separately
+type EndpointRateLimits struct {
+	Identity RateLimit
+	IP       RateLimit
+}
+
+// RateLimit is the configuration of a token bucket. A rate of 0 disables
+// the limit.
+type RateLimit struct {
+	Rate  int `def:"0" help:"Number of requests allowed per minute; 0 disables the limit"`
+	Burst int `def:"0" help:"Number of requests allowed at once; defaults to the rate"`
 }
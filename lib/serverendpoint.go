@@ -34,6 +34,10 @@ type serverEndpoint struct {
 	Handler func(ctx *serverRequestContext) (interface{}, error)
 	// Server which hosts this endpoint
 	Server *Server
+	// Optional rate limits of requests to this endpoint
+	limiter *endpointRateLimiter
+	// The action which the caller must be authorized to perform, if any
+	action string
 }
 
 // ServeHTTP encapsulates the call to underlying Handlers to handle the request
@@ -44,6 +48,9 @@ func (se *serverEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("Received request for %s", url)
 	w = newHTTPResponseWriter(r, w, se)
 	err := se.validateMethod(r)
+	if err == nil && se.limiter != nil {
+		err = se.limiter.check(w, r)
+	}
 	if err == nil {
 		// Call the endpoint handler to handle the request.  The handler may
 		// a) return the response in the 'resp' variable below, or
@@ -20,6 +20,7 @@ import (
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/pem"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
@@ -29,6 +30,7 @@ import (
 	cferr "github.com/cloudflare/cfssl/errors"
 	"github.com/cloudflare/cfssl/log"
 	"github.com/cloudflare/cfssl/signer"
+	"github.com/tjfoc/fabric-ca-gm/lib/attr"
 	"github.com/tjfoc/fabric-ca-gm/lib/spi"
 
 	"github.com/tjfoc/fabric-ca-gm/api"
@@ -72,6 +74,7 @@ func newEnrollEndpoint(s *Server) *serverEndpoint {
 		Handler:   enrollHandler,
 		Server:    s,
 		successRC: 201,
+		limiter:   newEndpointRateLimiter(s.Config.RateLimits.Enroll),
 	}
 }
 
@@ -84,18 +87,21 @@ func newReenrollEndpoint(s *Server) *serverEndpoint {
 	}
 }
 
-// Handle an enroll request, guarded by basic authentication
+// Handle an enroll request, guarded by basic authentication or an OIDC ID token
 func enrollHandler(ctx *serverRequestContext) (interface{}, error) {
-	id, err := ctx.BasicAuthentication()
+	id, err := ctx.EnrollmentAuthentication()
 	if err != nil {
 		return nil, err
 	}
-	resp, err := handleEnroll(ctx, id)
+	resp, err := handleEnroll(ctx, id, false)
 	if err != nil {
 		return nil, err
 	}
 	err = ctx.ui.LoginComplete()
 	if err != nil {
+		if errors.Cause(err) == errSecretExpired {
+			return nil, newHTTPErr(401, ErrSecretExpired, "Login failure: %s", err)
+		}
 		return nil, err
 	}
 	return resp, nil
@@ -108,11 +114,11 @@ func reenrollHandler(ctx *serverRequestContext) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	return handleEnroll(ctx, id)
+	return handleEnroll(ctx, id, true)
 }
 
 // Handle the common processing for enroll and reenroll
-func handleEnroll(ctx *serverRequestContext, id string) (interface{}, error) {
+func handleEnroll(ctx *serverRequestContext, id string, reenroll bool) (interface{}, error) {
 	var req api.EnrollmentRequestNet
 	err := ctx.ReadBody(&req)
 	if err != nil {
@@ -152,6 +158,23 @@ func handleEnroll(ctx *serverRequestContext, id string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Make sure the identity does not exceed its maximum number of active certificates
+	caller, err := ctx.GetCaller()
+	if err != nil {
+		return nil, err
+	}
+	maxActive, err := getMaxActiveCertificates(ca, caller)
+	if err != nil {
+		return nil, err
+	}
+	if maxActive > 0 {
+		ca.activeCertsMutex.Lock()
+		defer ca.activeCertsMutex.Unlock()
+		err = checkActiveCertificates(ca, caller.GetName(), maxActive, reenroll)
+		if err != nil {
+			return nil, err
+		}
+	}
 	// Get an attribute extension if one is being requested
 	ext, err := ctx.GetAttrExtension(req.AttrReqs, req.Profile)
 	if err != nil {
@@ -168,6 +191,13 @@ func handleEnroll(ctx *serverRequestContext, id string) (interface{}, error) {
 	if err != nil {
 		return nil, errors.WithMessage(err, "Certificate signing failure")
 	}
+	// The superseded certificates are only revoked once the new one is stored
+	if maxActive > 0 && reenroll && ca.Config.Registry.RevokeSuperseded {
+		err = revokeSupersededCertificates(ca, caller.GetName(), maxActive, cert)
+		if err != nil {
+			return nil, err
+		}
+	}
 	// Add server info to the response
 	resp := &enrollmentResponseNet{
 		Cert: util.B64Encode(cert),
@@ -184,7 +214,7 @@ func handleEnroll(ctx *serverRequestContext, id string) (interface{}, error) {
 // Make any authorization checks needed, depending on the contents
 // of the CSR (Certificate Signing Request).
 // In particular, if the request is for an intermediate CA certificate,
-// the caller must have the "hf.IntermediateCA" attribute.
+// the caller must be authorized to get one.
 // Check to see that CSR values do not exceed the character limit
 // as specified in RFC 3280, page 103.
 // Set the OU fields of the request.
@@ -221,8 +251,8 @@ func processSignRequest(id string, req *signer.SignRequest, ca *CA, ctx *serverR
 	}
 	if isForCACert {
 		// This is a request for a CA certificate, so make sure the caller
-		// has the 'hf.IntermediateCA' attribute
-		err := ca.attributeIsTrue(id, "hf.IntermediateCA")
+		// is authorized to get one
+		err := ctx.Authorize(actionIntermediateCA)
 		if err != nil {
 			return err
 		}
@@ -242,6 +272,76 @@ func processSignRequest(id string, req *signer.SignRequest, ca *CA, ctx *serverR
 	return nil
 }
 
+// Make sure that issuing a new certificate to the identity 'id' does not
+// exceed its maximum number of active (unexpired and unrevoked) certificates.
+// If it would, the request is rejected unless it is a reenroll request and the
+// CA is configured to revoke the superseded certificates, which is done by
+// revokeSupersededCertificates once the new certificate is stored.
+// The caller must hold the CA's activeCertsMutex.
+func checkActiveCertificates(ca *CA, id string, max int, reenroll bool) error {
+	if reenroll && ca.Config.Registry.RevokeSuperseded {
+		return nil
+	}
+	certs, err := ca.certDBAccessor.GetActiveCertificatesByID(id)
+	if err != nil {
+		return newHTTPErr(500, ErrDBGet, "Failed to get active certificates of '%s': %s", id, err)
+	}
+	if len(certs) >= max {
+		return newHTTPErr(403, ErrMaxActiveCerts, "The identity '%s' has %d active certificate(s) and may not have more than %d",
+			id, len(certs), max)
+	}
+	return nil
+}
+
+// Revoke with reason 'superseded' the certificates of the identity 'id' which
+// expire first and exceed its maximum number of active certificates, other
+// than the newly issued certificate 'newCert'.
+// The caller must hold the CA's activeCertsMutex.
+func revokeSupersededCertificates(ca *CA, id string, max int, newCert []byte) error {
+	certs, err := ca.certDBAccessor.GetActiveCertificatesByID(id)
+	if err != nil {
+		return newHTTPErr(500, ErrDBGet, "Failed to get active certificates of '%s': %s", id, err)
+	}
+	excess := len(certs) - max
+	reason := util.RevocationReasonCodes["superseded"]
+	for _, cert := range certs {
+		if excess <= 0 {
+			break
+		}
+		if cert.PEM == string(newCert) {
+			continue
+		}
+		err = ca.certDBAccessor.RevokeCertificate(cert.Serial, cert.AKI, reason)
+		if err != nil {
+			return newHTTPErr(500, ErrRevokeFailure, "Revoke of superseded certificate <%s,%s> failed: %s", cert.Serial, cert.AKI, err)
+		}
+		log.Infof("Revoked certificate <%s,%s> of '%s' because it was superseded", cert.Serial, cert.AKI, id)
+		excess--
+	}
+	return nil
+}
+
+// Get the maximum number of active certificates of an identity, which is the
+// value of its 'hf.MaxActiveCertificates' attribute if it is lower than the
+// maximum configured for the CA. A value less than 1 means there is no limit.
+func getMaxActiveCertificates(ca *CA, user spi.User) (int, error) {
+	max := ca.Config.Registry.MaxActiveCertificates
+	userAttr, err := user.GetAttribute(attr.MaxActiveCerts)
+	if err != nil || userAttr.Value == "" {
+		// The identity does not have its own maximum
+		return max, nil
+	}
+	userMax, err := strconv.Atoi(userAttr.Value)
+	if err != nil {
+		return 0, newHTTPErr(500, ErrInvalidUser, "Invalid value '%s' for attribute '%s' of identity '%s'",
+			userAttr.Value, attr.MaxActiveCerts, user.GetName())
+	}
+	if userMax > 0 && (max <= 0 || userMax < max) {
+		max = userMax
+	}
+	return max, nil
+}
+
 // Check to see if this is a request for a CA signing certificate.
 // This can occur if the profile or the CSR has the IsCA bit set.
 // See the X.509 BasicConstraints extension (RFC 5280, 4.2.1.9).
@@ -163,6 +163,62 @@ const (
 	ErrDBDeleteUser = 65
 	// Certificate that is being revoked has already been revoked
 	ErrCertAlreadyRevoked = 66
+	// Certificate in the revocation request is invalid
+	ErrInvalidRevokeCert = 67
+	// Certificate in the revocation request was not issued by the targeted CA
+	ErrRevokeCertNotIssued = 68
+	// Idemix credential request is invalid
+	ErrBadCredRequest = 69
+	// Nonce in the Idemix credential request is unknown or has expired
+	ErrBadNonce = 70
+	// Failed to issue an Idemix credential
+	ErrIdemixIssueFailure = 71
+	// Failed to get the credential revocation information
+	ErrGetCRIFailure = 72
+	// Certificate was purged from the certificates table after it expired
+	ErrCertPurged = 73
+	// Identity has reached its maximum number of active certificates
+	ErrMaxActiveCerts = 74
+	// Enrollment secret has expired or, if it was a one-time secret, was already used
+	ErrSecretExpired = 75
+	// Failed to reset the enrollment secret of an identity
+	ErrResetSecret = 76
+	// Identity is locked out due to repeated failed logins
+	ErrIdentityLocked = 77
+	// Failed to unlock an identity
+	ErrUnlockIdentity = 78
+	// Failed to import a batch of identities
+	ErrImportIdentities = 79
+	// A registration policy does not allow the registrar's request
+	ErrRegistrationPolicy = 80
+	// Caller does not have authority to get the audit log
+	ErrNoAuditAuth = 81
+	// Failed to get the records of the audit log
+	ErrGettingAuditLog = 82
+	// Identity is suspended
+	ErrIdentitySuspended = 83
+	// Invalid OIDC ID token in authorization header
+	ErrInvalidIDToken = 84
+	// Token in authorization header has already been used
+	ErrTokenReplayed = 85
+	// Too many requests from the same identity or address
+	ErrTooManyRequests = 86
+	// The authorization policy does not allow the caller to perform an action
+	ErrActionNotAuthorized = 87
+	// Pending operation was not found or has expired
+	ErrPendingOpNotFound = 88
+	// Failed to request or confirm an operation which requires approval
+	ErrApproval = 89
+	// LDAP user cache is not enabled or the caller may not invalidate it
+	ErrLDAPCache = 90
+	// The caller is not authorized to back up the state of the server
+	ErrNoBackupAuth = 91
+	// Failed to back up the state of the server
+	ErrBackup = 92
+	// Idemix credential to be revoked was not found
+	ErrRevCredNotFound = 93
+	// Idemix credential to be revoked was already revoked
+	ErrCredAlreadyRevoked = 94
 )
 
 // Construct a new HTTP error.
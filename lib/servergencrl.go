@@ -47,6 +47,7 @@ func newGenCRLEndpoint(s *Server) *serverEndpoint {
 		Methods: []string{"POST"},
 		Handler: genCRLHandler,
 		Server:  s,
+		action:  actionGenCRL,
 	}
 }
 
@@ -71,20 +72,12 @@ func genCRLHandler(ctx *serverRequestContext) (interface{}, error) {
 		return nil, err
 	}
 
-	// Make sure that the user has the "hf.GenCRL" attribute in order to be authorized
-	// to generate CRL. This attribute comes from the user registry, which
-	// is either in the DB if LDAP is not configured, or comes from LDAP if LDAP is
-	// configured.
-	err = ca.attributeIsTrue(id, "hf.GenCRL")
-	if err != nil {
-		return nil, newAuthErr(ErrNoGenCRLAuth, "The identity '%s' does not have authority to generate a CRL", id)
-	}
-
 	crl, err := genCRL(ca, req)
 	if err != nil {
 		return nil, err
 	}
 	log.Debugf("Successfully generated CRL")
+	ctx.audit(auditGenCRL, ca.Config.CA.Name, nil, auditGenCRLRequest(&req))
 
 	resp := &genCRLResponseNet{CRL: util.B64Encode(crl)}
 	return resp, nil
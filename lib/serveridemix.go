@@ -0,0 +1,189 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+// The response to an Idemix nonce request
+type idemixNonceResponseNet struct {
+	// Base64 encoding of the nonce
+	Nonce string
+}
+
+// The response to an Idemix credential request
+type idemixEnrollmentResponseNet struct {
+	// Base64 encoding of the serialized Idemix credential
+	Credential string
+	// The attribute values contained in the credential
+	Attrs map[string]interface{}
+	// Base64 encoding of the JSON-encoded credential revocation information
+	CRI string
+	// The server information
+	ServerInfo serverInfoResponseNet
+}
+
+// The response to a CRI request
+type idemixCRIResponseNet struct {
+	// Base64 encoding of the JSON-encoded credential revocation information
+	CRI string
+}
+
+func newIdemixNonceEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"POST"},
+		Handler: idemixNonceHandler,
+		Server:  s,
+	}
+}
+
+func newIdemixCredentialEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods:   []string{"POST"},
+		Handler:   idemixCredentialHandler,
+		Server:    s,
+		successRC: 201,
+	}
+}
+
+func newIdemixCRIEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods: []string{"GET", "POST"},
+		Handler: idemixCRIHandler,
+		Server:  s,
+	}
+}
+
+// Authenticate a request to an Idemix endpoint by means of either basic or
+// token authentication, depending on the authorization header.
+// Returns the enrollment ID of the caller and whether basic authentication was used.
+func idemixAuthentication(ctx *serverRequestContext) (string, bool, error) {
+	authHdr := ctx.req.Header.Get("authorization")
+	if strings.HasPrefix(authHdr, "Basic ") {
+		id, err := ctx.BasicAuthentication()
+		return id, true, err
+	}
+	id, err := ctx.TokenAuthentication()
+	return id, false, err
+}
+
+// Handle a request for a nonce to be used in an Idemix credential request
+func idemixNonceHandler(ctx *serverRequestContext) (interface{}, error) {
+	_, _, err := idemixAuthentication(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := ca.idemixIssuer.newNonce()
+	if err != nil {
+		return nil, newHTTPErr(500, ErrIdemixIssueFailure, "Failed to generate nonce: %s", err)
+	}
+	return &idemixNonceResponseNet{Nonce: util.B64Encode(nonce)}, nil
+}
+
+// Handle an Idemix credential request, guarded by basic or token authentication
+func idemixCredentialHandler(ctx *serverRequestContext) (interface{}, error) {
+	var req api.IdemixEnrollmentRequestNet
+	err := ctx.ReadBody(&req)
+	if err != nil {
+		return nil, err
+	}
+	if req.CredRequest == nil {
+		return nil, newHTTPErr(400, ErrBadCredRequest, "Credential request is missing")
+	}
+	id, basicAuth, err := idemixAuthentication(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	caller, err := ctx.GetCaller()
+	if err != nil {
+		return nil, err
+	}
+	cred, attrs, err := ca.idemixIssuer.issueCredential(caller, req.CredRequest)
+	if err != nil {
+		return nil, err
+	}
+	credBytes, err := proto.Marshal(cred)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrIdemixIssueFailure, "Failed to marshal credential: %s", err)
+	}
+	cri, err := ca.idemixIssuer.getCRI()
+	if err != nil {
+		return nil, newHTTPErr(500, ErrGetCRIFailure, "Failed to get CRI: %s", err)
+	}
+	criBytes, err := json.Marshal(cri)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrGetCRIFailure, "Failed to marshal CRI: %s", err)
+	}
+	resp := &idemixEnrollmentResponseNet{
+		Credential: util.B64Encode(credBytes),
+		Attrs:      attrs,
+		CRI:        util.B64Encode(criBytes),
+	}
+	err = ca.fillCAInfo(&resp.ServerInfo)
+	if err != nil {
+		return nil, err
+	}
+	// A credential issued with basic authentication counts as an enrollment
+	if basicAuth {
+		err = ctx.ui.LoginComplete()
+		if err != nil {
+			if errors.Cause(err) == errSecretExpired {
+				return nil, newHTTPErr(401, ErrSecretExpired, "Login failure: %s", err)
+			}
+			return nil, err
+		}
+	}
+	log.Debugf("Successfully issued Idemix credential to '%s'", id)
+	return resp, nil
+}
+
+// Handle a request for the current credential revocation information
+func idemixCRIHandler(ctx *serverRequestContext) (interface{}, error) {
+	_, err := ctx.TokenAuthentication()
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	cri, err := ca.idemixIssuer.getCRI()
+	if err != nil {
+		return nil, newHTTPErr(500, ErrGetCRIFailure, "Failed to get CRI: %s", err)
+	}
+	criBytes, err := json.Marshal(cri)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrGetCRIFailure, "Failed to marshal CRI: %s", err)
+	}
+	return &idemixCRIResponseNet{CRI: util.B64Encode(criBytes)}, nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/idemix"
+	fabricmsp "github.com/hyperledger/fabric/msp"
+	mspproto "github.com/hyperledger/fabric/protos/msp"
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func TestIdemixEnroll(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	clientHome, err := ioutil.TempDir("", "idemixclient")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(clientHome)
+	client := &Client{
+		Config:  &ClientConfig{URL: fmt.Sprintf("http://localhost:%d", rootPort)},
+		HomeDir: clientHome,
+	}
+
+	// Enrolling with a bad secret must fail
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "badpw",
+		Type:   "idemix",
+	})
+	assert.Error(t, err, "Idemix enrollment with a bad secret should have failed")
+
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+		Type:   "idemix",
+	})
+	if err != nil {
+		t.Fatalf("Idemix enrollment failed: %s", err)
+	}
+	assert.Nil(t, resp.Identity, "Idemix enrollment should not return an X509 identity")
+	cred := resp.IdemixCredential
+	if assert.NotNil(t, cred, "Idemix enrollment should return a credential") {
+		assert.Equal(t, "admin", cred.GetName())
+		assert.Equal(t, "1", cred.GetRevocationHandle())
+		err = cred.Store()
+		assert.NoError(t, err, "Failed to store Idemix credential")
+		for _, file := range []string{"msp/IssuerPublicKey", "msp/RevocationPublicKey", "user/SignerConfig"} {
+			_, err = os.Stat(filepath.Join(client.Config.MSPDir, file))
+			assert.NoError(t, err, "Idemix MSP file %s was not stored", file)
+		}
+
+		// The stored MSP directory can be loaded by Fabric
+		mspConfig, err := fabricmsp.GetIdemixMspConfig(client.Config.MSPDir, "idemixMSP")
+		if assert.NoError(t, err, "Fabric failed to load the Idemix MSP directory") {
+			idemixConfig := new(mspproto.IdemixMSPConfig)
+			err = proto.Unmarshal(mspConfig.Config, idemixConfig)
+			assert.NoError(t, err, "Failed to unmarshal Idemix MSP configuration")
+			ipk := new(idemix.IssuerPublicKey)
+			assert.NoError(t, proto.Unmarshal(idemixConfig.IPk, ipk), "Failed to unmarshal issuer public key")
+			if assert.NotNil(t, idemixConfig.Signer, "Signer configuration was not loaded") {
+				assert.Equal(t, cred.GetSignerConfig().Cred, idemixConfig.Signer.Cred)
+				assert.Equal(t, cred.GetSignerConfig().Sk, idemixConfig.Signer.Sk)
+				assert.Equal(t, cred.GetSignerConfig().OrganizationalUnitIdentifier, idemixConfig.Signer.OrganizationalUnitIdentifier)
+				assert.Equal(t, cred.GetSignerConfig().IsAdmin, idemixConfig.Signer.IsAdmin)
+				credential := new(idemix.Credential)
+				assert.NoError(t, proto.Unmarshal(idemixConfig.Signer.Cred, credential), "Failed to unmarshal credential")
+			}
+		}
+	}
+
+	// Each credential is issued with a new revocation handle
+	resp, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+		Type:   "idemix",
+	})
+	if err != nil {
+		t.Fatalf("Second Idemix enrollment failed: %s", err)
+	}
+	assert.Equal(t, "2", resp.IdemixCredential.GetRevocationHandle())
+}
+
+func TestIdemixRevokeByRevocationHandle(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	clientHome, err := ioutil.TempDir("", "idemixrevoke")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(clientHome)
+	client := &Client{
+		Config:  &ClientConfig{URL: fmt.Sprintf("http://localhost:%d", rootPort)},
+		HomeDir: clientHome,
+	}
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	if err != nil {
+		t.Fatalf("Failed to enroll admin: %s", err)
+	}
+	admin := resp.Identity
+
+	_, err = admin.Register(&api.RegistrationRequest{Name: "idemixuser", Secret: "idemixuserpw", Affiliation: "org2"})
+	if err != nil {
+		t.Fatalf("Failed to register idemixuser: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = client.Enroll(&api.EnrollmentRequest{Name: "idemixuser", Secret: "idemixuserpw", Type: "idemix"})
+		if err != nil {
+			t.Fatalf("Idemix enrollment of idemixuser failed: %s", err)
+		}
+	}
+	resp, err = client.Enroll(&api.EnrollmentRequest{Name: "idemixuser", Secret: "idemixuserpw"})
+	if err != nil {
+		t.Fatalf("Failed to enroll idemixuser: %s", err)
+	}
+	user := resp.Identity
+
+	_, err = admin.Revoke(&api.RevocationRequest{RevocationHandle: "1", Name: "admin"})
+	assert.Error(t, err, "Revoking a credential of another identity by the wrong name should have failed")
+	_, err = admin.Revoke(&api.RevocationRequest{RevocationHandle: "10"})
+	assert.Error(t, err, "Revoking an unknown revocation handle should have failed")
+
+	// An identity without the hf.Revoker attribute can't revoke a credential
+	_, err = user.Revoke(&api.RevocationRequest{RevocationHandle: "1"})
+	assert.Error(t, err, "Revoking a credential without the hf.Revoker attribute should have failed")
+
+	result, err := admin.Revoke(&api.RevocationRequest{RevocationHandle: "1", Name: "idemixuser"})
+	if assert.NoError(t, err, "Failed to revoke Idemix credential") {
+		assert.Equal(t, []string{"1"}, result.RevokedCredentials)
+		assert.Empty(t, result.RevokedCerts)
+	}
+	_, err = admin.Revoke(&api.RevocationRequest{RevocationHandle: "1"})
+	assert.Error(t, err, "Revoking a revoked credential should have failed")
+
+	caName := srv.CA.Config.CA.Name
+	revoked, err := srv.CA.idemixCredDBAccessor.GetRevokedCredentials(caName)
+	if assert.NoError(t, err) && assert.Len(t, revoked, 1) {
+		assert.Equal(t, "1", revoked[0].RevocationHandle)
+	}
+	revoked, err = srv.CA.idemixCredDBAccessor.GetRevokedCredentials("otherca")
+	assert.NoError(t, err)
+	assert.Empty(t, revoked, "Credentials revoked by another CA should not be returned")
+	info, err := srv.CA.idemixCredDBAccessor.getRevocationAuthorityInfo()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, info.Epoch, "Revoking a credential should advance the epoch")
+	}
+
+	// Revoking the identity revokes its remaining credential
+	result, err = admin.Revoke(&api.RevocationRequest{Name: "idemixuser"})
+	if assert.NoError(t, err, "Failed to revoke idemixuser") {
+		assert.Equal(t, []string{"2"}, result.RevokedCredentials)
+	}
+}
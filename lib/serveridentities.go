@@ -17,11 +17,14 @@ limitations under the License.
 package lib
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cloudflare/cfssl/log"
 	"github.com/tjfoc/fabric-ca-gm/api"
@@ -37,6 +40,7 @@ func newIdentitiesEndpoint(s *Server) *serverEndpoint {
 		Handler:   identitiesHandler,
 		Server:    s,
 		successRC: 200,
+		action:    actionIdentities,
 	}
 }
 
@@ -46,6 +50,27 @@ func newIdentitiesStreamingEndpoint(s *Server) *serverEndpoint {
 		Handler:   identitiesStreamingHandler,
 		Server:    s,
 		successRC: 200,
+		action:    actionIdentities,
+	}
+}
+
+func newIdentitySecretEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods:   []string{"POST"},
+		Handler:   identitySecretHandler,
+		Server:    s,
+		successRC: 200,
+		action:    actionIdentities,
+	}
+}
+
+func newIdentityUnlockEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods:   []string{"POST"},
+		Handler:   identityUnlockHandler,
+		Server:    s,
+		successRC: 200,
+		action:    actionIdentities,
 	}
 }
 
@@ -97,6 +122,48 @@ func identitiesHandler(ctx *serverRequestContext) (interface{}, error) {
 	return resp, nil
 }
 
+// identitySecretHandler replaces the enrollment secret of an identity with a
+// new random secret, which is returned to the caller
+func identitySecretHandler(ctx *serverRequestContext) (interface{}, error) {
+	// Authenticate
+	callerID, err := ctx.TokenAuthentication()
+	log.Debugf("Received secret reset request from %s", callerID)
+	if err != nil {
+		return nil, err
+	}
+	caname, err := ctx.getCAName()
+	if err != nil {
+		return nil, err
+	}
+	// Process Request
+	resp, err := processResetSecretRequest(ctx, caname)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// identityUnlockHandler unlocks an identity which was locked out due to
+// repeated failed logins
+func identityUnlockHandler(ctx *serverRequestContext) (interface{}, error) {
+	// Authenticate
+	callerID, err := ctx.TokenAuthentication()
+	log.Debugf("Received identity unlock request from %s", callerID)
+	if err != nil {
+		return nil, err
+	}
+	caname, err := ctx.getCAName()
+	if err != nil {
+		return nil, err
+	}
+	// Process Request
+	resp, err := processUnlockRequest(ctx, caname, callerID)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
 // processStreamingRequest will process the configuration request
 func processStreamingRequest(ctx *serverRequestContext, caname string, caller spi.User) (interface{}, error) {
 	log.Debug("Processing identity configuration update request")
@@ -170,13 +237,28 @@ func getIDs(ctx *serverRequestContext, caller spi.User, caname string) error {
 		return newAuthErr(ErrGettingUser, "Caller is not a registrar")
 	}
 
+	filter, err := getUserFilter(ctx)
+	if err != nil {
+		return err
+	}
+	limit := filter.Limit
+	if ctx.authzScopes != nil {
+		// Identities outside the scopes of the caller's roles are skipped
+		// below, so the number of rows to get is not known
+		filter.Limit = 0
+	} else if limit > 0 {
+		// Get one more identity than requested to find out if there is another page
+		filter.Limit++
+	}
+
 	// Getting all identities of appropriate affiliation and type
 	callerAff := GetUserAffiliation(caller)
 	registry := ctx.ca.registry
-	rows, err := registry.GetFilteredUsers(callerAff, callerTypes)
+	rows, err := registry.GetFilteredUsers(callerAff, callerTypes, filter)
 	if err != nil {
 		return newHTTPErr(500, ErrGettingUser, "Failed to get users by affiliation and type: %s", err)
 	}
+	defer rows.Close()
 
 	// Get the number of identities to return back to client in a chunk based on the environment variable
 	// If environment variable not set, default to 100 identities
@@ -196,13 +278,24 @@ func getIDs(ctx *serverRequestContext, caller spi.User, caname string) error {
 	w.Write([]byte(`{"identities":[`))
 
 	rowNumber := 0
+	cursor := ""
 	for rows.Next() {
-		rowNumber++
 		var id UserRecord
 		err := rows.StructScan(&id)
 		if err != nil {
 			return newHTTPErr(500, ErrGettingUser, "Failed to get read row: %s", err)
 		}
+		if !ctx.inAuthzScope(id.Affiliation) {
+			continue
+		}
+		rowNumber++
+
+		if limit > 0 && rowNumber > limit {
+			// There is another page, which starts after the last identity of this one
+			cursor = encodeIdentityCursor(cursor)
+			break
+		}
+		cursor = id.Name
 
 		if rowNumber > 1 {
 			w.Write([]byte(","))
@@ -216,6 +309,7 @@ func getIDs(ctx *serverRequestContext, caller spi.User, caname string) error {
 			Type:           id.Type,
 			Affiliation:    id.Affiliation,
 			MaxEnrollments: id.MaxEnrollments,
+			Suspended:      id.Suspended,
 			Attributes:     attrs,
 		}
 
@@ -232,12 +326,70 @@ func getIDs(ctx *serverRequestContext, caller spi.User, caname string) error {
 	}
 
 	// Close the JSON object
-	w.Write([]byte(fmt.Sprintf("], \"caname\":\"%s\"}", caname)))
+	w.Write([]byte(fmt.Sprintf("], \"caname\":\"%s\"", caname)))
+	if limit > 0 && rowNumber > limit {
+		w.Write([]byte(fmt.Sprintf(", \"cursor\":\"%s\"", cursor)))
+	}
+	w.Write([]byte("}"))
 	flusher.Flush()
 
 	return nil
 }
 
+// getUserFilter gets the filter of a request to get identities from its
+// query parameters
+func getUserFilter(ctx *serverRequestContext) (*spi.UserFilter, error) {
+	var err error
+	query := ctx.req.URL.Query()
+	filter := &spi.UserFilter{}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 {
+			return nil, newHTTPErr(400, ErrGettingUser, "Invalid 'limit' query parameter '%s'; it must be a positive integer", limit)
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || len(after) == 0 {
+			return nil, newHTTPErr(400, ErrGettingUser, "Invalid 'cursor' query parameter '%s'", cursor)
+		}
+		filter.After = string(after)
+	}
+	for _, a := range query["attr"] {
+		// The value of an attribute is optional, as in 'name' or 'name:value'
+		parts := strings.SplitN(a, ":", 2)
+		if parts[0] == "" {
+			return nil, newHTTPErr(400, ErrGettingUser, "Invalid 'attr' query parameter '%s'; it must be 'name' or 'name:value'", a)
+		}
+		reqAttr := api.Attribute{Name: parts[0]}
+		if len(parts) == 2 {
+			reqAttr.Value = parts[1]
+		}
+		filter.Attributes = append(filter.Attributes, reqAttr)
+	}
+	if state := query.Get("state"); state != "" {
+		val, err := strconv.Atoi(state)
+		if err != nil {
+			return nil, newHTTPErr(400, ErrGettingUser, "Invalid 'state' query parameter '%s'; it must be an integer", state)
+		}
+		filter.State = &val
+	}
+	if maxEnrollments := query.Get("maxenrollments"); maxEnrollments != "" {
+		val, err := strconv.Atoi(maxEnrollments)
+		if err != nil {
+			return nil, newHTTPErr(400, ErrGettingUser, "Invalid 'maxenrollments' query parameter '%s'; it must be an integer", maxEnrollments)
+		}
+		filter.MaxEnrollments = &val
+	}
+	return filter, nil
+}
+
+// encodeIdentityCursor returns the cursor of the page of identities which
+// starts after identity 'id'
+func encodeIdentityCursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
 func getID(ctx *serverRequestContext, caller spi.User, id, caname string) (*api.GetIDResponse, error) {
 	log.Debugf("Requesting identity '%s'", id)
 
@@ -263,6 +415,7 @@ func getID(ctx *serverRequestContext, caller spi.User, id, caname string) (*api.
 		Affiliation:    GetUserAffiliation(user),
 		Attributes:     allAttributes,
 		MaxEnrollments: user.GetMaxEnrollments(),
+		Suspended:      isSuspended(user),
 		CAName:         caname,
 	}
 
@@ -307,10 +460,25 @@ func processDeleteRequest(ctx *serverRequestContext, caname string) (*api.Identi
 		return nil, err
 	}
 
+	if ctx.needsApproval(opRemoveIdentity) {
+		pending, err := ctx.deferOperation(opRemoveIdentity, removeID, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := getIDResp(userToRemove, "", caname)
+		if err != nil {
+			return nil, err
+		}
+		resp.Pending = pending
+		return resp, nil
+	}
+
+	before := auditIdentity(userToRemove, false)
 	_, err = registry.DeleteUser(removeID)
 	if err != nil {
 		return nil, newHTTPErr(500, ErrRemoveIdentity, "Failed to remove identity: ", err)
 	}
+	ctx.audit(auditRemoveIdentity, removeID, before, nil)
 
 	resp, err := getIDResp(userToRemove, "", caname)
 	if err != nil {
@@ -341,6 +509,8 @@ func processPostRequest(ctx *serverRequestContext, caname string) (*api.Identity
 		Affiliation:    req.Affiliation,
 		Attributes:     req.Attributes,
 		MaxEnrollments: req.MaxEnrollments,
+		SecretExpiry:   req.SecretExpiry,
+		SecretOneTime:  req.SecretOneTime,
 	}
 	log.Debugf("Adding identity: %+v", util.StructToString(addReq))
 
@@ -360,6 +530,7 @@ func processPostRequest(ctx *serverRequestContext, caname string) (*api.Identity
 	if err != nil {
 		return nil, err
 	}
+	ctx.audit(auditAddIdentity, req.ID, nil, auditIdentity(user, true))
 
 	resp, err := getIDResp(user, pass, caname)
 	if err != nil {
@@ -397,7 +568,19 @@ func processPutRequest(ctx *serverRequestContext, caname string) (*api.IdentityR
 	}
 
 	var checkAff, checkType, checkAttrs bool
+	if req.Suspend && req.Resume {
+		return nil, newHTTPErr(400, ErrModifyingIdentity, "An identity cannot be both suspended and resumed")
+	}
 	modReq, setPass := getModifyReq(userToModify, &req)
+	if req.SecretExpiry != "" {
+		modReq.SecretExpiry, err = parseSecretExpiry(req.SecretExpiry)
+		if err != nil {
+			return nil, newHTTPErr(400, ErrModifyingIdentity, "%s", err)
+		}
+	} else if setPass {
+		// The expiry belonged to the secret which is being replaced
+		modReq.SecretExpiry = time.Time{}
+	}
 	log.Debugf("Modify Request: %+v", util.StructToString(modReq))
 
 	if req.Affiliation != "" {
@@ -424,6 +607,18 @@ func processPutRequest(ctx *serverRequestContext, caname string) (*api.IdentityR
 		return nil, err
 	}
 
+	// The registration policies are checked against the modified identity
+	err = ctx.ca.checkRegistrationPolicies(ctx.caller, &policyIdentity{
+		ID:          modReq.Name,
+		Type:        modReq.Type,
+		Affiliation: modReq.Affiliation,
+		Attributes:  modReq.Attributes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	before := auditIdentity(userToModify, false)
 	err = registry.UpdateUser(modReq, setPass)
 	if err != nil {
 		return nil, err
@@ -433,6 +628,7 @@ func processPutRequest(ctx *serverRequestContext, caname string) (*api.IdentityR
 	if err != nil {
 		return nil, err
 	}
+	ctx.audit(auditModifyIdentity, modifyID, before, auditIdentity(userToModify, setPass))
 
 	resp, err := getIDResp(userToModify, req.Secret, caname)
 	if err != nil {
@@ -443,6 +639,105 @@ func processPutRequest(ctx *serverRequestContext, caname string) (*api.IdentityR
 	return resp, nil
 }
 
+func processResetSecretRequest(ctx *serverRequestContext, caname string) (*api.IdentityResponse, error) {
+	log.Debug("Processing secret reset request")
+
+	resetID, err := ctx.GetVar("id")
+	if err != nil {
+		return nil, err
+	}
+
+	if resetID == "" {
+		return nil, newHTTPErr(400, ErrResetSecret, "No ID name specified in secret reset request")
+	}
+
+	log.Debugf("Resetting secret of identity '%s'", resetID)
+	userToReset, err := ctx.GetUser(resetID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.CanManageUser(userToReset)
+	if err != nil {
+		return nil, err
+	}
+
+	var req api.ResetSecretRequest
+	err = ctx.ReadBody(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	secretExpiry, err := parseSecretExpiry(req.SecretExpiry)
+	if err != nil {
+		return nil, newHTTPErr(400, ErrResetSecret, "%s", err)
+	}
+
+	secret := util.RandomString(12)
+	modReq, _ := getModifyReq(userToReset, &api.ModifyIdentityRequest{Secret: secret})
+	modReq.SecretExpiry = secretExpiry
+	modReq.SecretOneTime = req.SecretOneTime
+
+	registry := ctx.ca.registry
+	err = registry.UpdateUser(modReq, true)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrResetSecret, "Failed to reset secret of identity '%s': %s", resetID, err)
+	}
+	ctx.audit(auditResetSecret, resetID, nil, map[string]interface{}{"secret": maskedSecret})
+
+	resp, err := getIDResp(userToReset, secret, caname)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Secret of identity '%s' successfully reset", resetID)
+	return resp, nil
+}
+
+func processUnlockRequest(ctx *serverRequestContext, caname, callerID string) (*api.IdentityResponse, error) {
+	log.Debug("Processing identity unlock request")
+
+	unlockID, err := ctx.GetVar("id")
+	if err != nil {
+		return nil, err
+	}
+
+	if unlockID == "" {
+		return nil, newHTTPErr(400, ErrUnlockIdentity, "No ID name specified in unlock request")
+	}
+
+	userToUnlock, err := ctx.GetUser(unlockID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.CanManageUser(userToUnlock)
+	if err != nil {
+		return nil, err
+	}
+
+	dbUser, ok := userToUnlock.(*DBUser)
+	if !ok {
+		return nil, newHTTPErr(400, ErrUnlockIdentity, "Identity '%s' is not in the database and can't be unlocked", unlockID)
+	}
+	failedAttempts := dbUser.failedAttempts
+	err = dbUser.ResetFailedLogins()
+	if err != nil {
+		return nil, newHTTPErr(500, ErrUnlockIdentity, "Failed to unlock identity '%s': %s", unlockID, err)
+	}
+	log.Infof("Identity '%s' was unlocked by '%s'", unlockID, callerID)
+	ctx.audit(auditUnlockIdentity, unlockID,
+		map[string]interface{}{"failed_attempts": failedAttempts},
+		map[string]interface{}{"failed_attempts": 0})
+
+	resp, err := getIDResp(userToUnlock, "", caname)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
 // Function takes the modification request and fills in missing information with the current user information
 // and parses the modification request to generate the correct input to be stored in the database
 func getModifyReq(user spi.User, req *api.ModifyIdentityRequest) (*spi.UserInfo, bool) {
@@ -482,9 +777,22 @@ func getModifyReq(user spi.User, req *api.ModifyIdentityRequest) (*spi.UserInfo,
 		modifyUserInfo.Attributes = getNewAttributes(modifyUserInfo.Attributes, reqAttrs)
 	}
 
+	if req.Suspend {
+		modifyUserInfo.Suspended = true
+	} else if req.Resume {
+		modifyUserInfo.Suspended = false
+	}
+
 	return &modifyUserInfo, setPass
 }
 
+// isSuspended returns true if the user is suspended; only identities in the
+// database can be suspended
+func isSuspended(user spi.User) bool {
+	dbUser, ok := user.(*DBUser)
+	return ok && dbUser.Suspended
+}
+
 // Get the identity response
 // Note that the secret will be the empty string unless the
 // caller is permitted to see the secret.  For example,
@@ -501,6 +809,7 @@ func getIDResp(user spi.User, secret, caname string) (*api.IdentityResponse, err
 		Affiliation:    GetUserAffiliation(user),
 		Attributes:     allAttributes,
 		MaxEnrollments: user.GetMaxEnrollments(),
+		Suspended:      isSuspended(user),
 		Secret:         secret,
 		CAName:         caname,
 	}, nil
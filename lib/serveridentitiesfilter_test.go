@@ -0,0 +1,103 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+func TestGetFilteredIDs(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	util.FatalError(t, err, "Failed to enroll user 'admin'")
+	admin := resp.Identity
+
+	for i, dept := range []string{"dept1", "dept2", "dept1", "dept_1", "dept1x"} {
+		name := fmt.Sprintf("filtereduser%d", i+1)
+		_, err = admin.Register(&api.RegistrationRequest{
+			Name:        name,
+			Type:        "client",
+			Affiliation: "org2",
+			Attributes:  []api.Attribute{api.Attribute{Name: "dept", Value: dept}},
+		})
+		util.FatalError(t, err, fmt.Sprintf("Failed to register user '%s'", name))
+	}
+
+	getIDs := func(req *api.GetIdentitiesRequest) ([]string, string, error) {
+		ids := []string{}
+		cursor, err := admin.GetIdentities(req, func(decoder *json.Decoder) error {
+			var id api.IdentityInfo
+			err := decoder.Decode(&id)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id.ID)
+			return nil
+		})
+		return ids, cursor, err
+	}
+
+	// The value of the attribute must match exactly; '_' is not a wildcard
+	ids, cursor, err := getIDs(&api.GetIdentitiesRequest{Attributes: []string{"dept:dept1"}})
+	assert.NoError(t, err, "Failed to get identities with attribute 'dept:dept1'")
+	assert.Equal(t, []string{"filtereduser1", "filtereduser3"}, ids)
+	assert.Empty(t, cursor, "Should not have returned a cursor without a limit")
+
+	// Page through the identities with the attribute, two at a time
+	all := []string{}
+	req := &api.GetIdentitiesRequest{Attributes: []string{"dept"}, Limit: 2}
+	for i := 0; i < 3; i++ {
+		ids, req.Cursor, err = getIDs(req)
+		util.FatalError(t, err, "Failed to get a page of identities with attribute 'dept'")
+		all = append(all, ids...)
+		if req.Cursor == "" {
+			break
+		}
+	}
+	assert.Empty(t, req.Cursor, "Should have returned all identities in three pages")
+	assert.Equal(t, []string{"filtereduser1", "filtereduser2", "filtereduser3", "filtereduser4", "filtereduser5"}, all)
+
+	state := 0
+	ids, _, err = getIDs(&api.GetIdentitiesRequest{Attributes: []string{"dept:dept2"}, State: &state})
+	assert.NoError(t, err, "Failed to get identities in state 0")
+	assert.Equal(t, []string{"filtereduser2"}, ids)
+	state = 1
+	ids, _, err = getIDs(&api.GetIdentitiesRequest{Attributes: []string{"dept:dept2"}, State: &state})
+	assert.NoError(t, err, "Failed to get identities in state 1")
+	assert.Empty(t, ids, "Should not have returned identities in state 1")
+
+	_, _, err = getIDs(&api.GetIdentitiesRequest{Cursor: "!!!"})
+	assert.Error(t, err, "Should have failed, invalid cursor")
+}
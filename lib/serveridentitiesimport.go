@@ -0,0 +1,256 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/csv"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/pkg/errors"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+// The columns of a CSV document of identities to import
+var importCSVColumns = []string{"id", "type", "affiliation", "attrs", "max_enrollments", "secret"}
+
+func newIdentitiesImportEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods:   []string{"POST"},
+		Handler:   identitiesImportHandler,
+		Server:    s,
+		successRC: 200,
+		action:    actionRegister,
+	}
+}
+
+// identitiesImportHandler adds a batch of identities
+func identitiesImportHandler(ctx *serverRequestContext) (interface{}, error) {
+	// Authenticate
+	callerID, err := ctx.TokenAuthentication()
+	log.Debugf("Received identities import request from %s", callerID)
+	if err != nil {
+		return nil, err
+	}
+	caname, err := ctx.getCAName()
+	if err != nil {
+		return nil, err
+	}
+	var req api.ImportIdentitiesRequest
+	err = ctx.ReadBody(&req)
+	if err != nil {
+		return nil, err
+	}
+	// Process Request
+	resp, err := processImportRequest(ctx, &req, caname)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// processImportRequest checks that the caller may register each identity of
+// the batch and, only if all of them pass, adds them in a single transaction
+func processImportRequest(ctx *serverRequestContext, req *api.ImportIdentitiesRequest, caname string) (*api.ImportIdentitiesResponse, error) {
+	log.Debug("Processing identities import request")
+
+	ids := req.Identities
+	if req.CSV != "" {
+		if len(ids) != 0 {
+			return nil, newHTTPErr(400, ErrImportIdentities, "Identities can't be given both as a list and as CSV")
+		}
+		var err error
+		ids, err = parseIdentitiesCSV(req.CSV)
+		if err != nil {
+			return nil, newHTTPErr(400, ErrImportIdentities, "Invalid CSV: %s", err)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, newHTTPErr(400, ErrImportIdentities, "No identities in the import request")
+	}
+
+	accessor := ctx.ca.dbRegistry()
+	if accessor == nil {
+		return nil, newHTTPErr(400, ErrImportIdentities, "Identities can only be imported into the database registry")
+	}
+
+	caller, err := ctx.GetCaller()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &api.ImportIdentitiesResponse{
+		Results: make([]api.ImportIdentityResult, len(ids)),
+		CAName:  caname,
+	}
+	users := []*spi.UserInfo{}
+	seen := map[string]bool{}
+	rejected := 0
+	for i := range ids {
+		resp.Results[i].ID = ids[i].ID
+		user, err := getImportUserInfo(ctx, caller, &ids[i], seen)
+		if err != nil {
+			log.Debugf("Import of identity '%s' rejected: %s", ids[i].ID, err)
+			resp.Results[i].Error = err.Error()
+			rejected++
+			continue
+		}
+		resp.Results[i].Secret = user.Pass
+		users = append(users, user)
+	}
+
+	if rejected > 0 {
+		log.Debugf("%d of %d identities rejected, none are imported", rejected, len(ids))
+		for i := range resp.Results {
+			resp.Results[i].Secret = ""
+			if resp.Results[i].Error == "" {
+				resp.Results[i].Error = "Not added because other identities in the batch were rejected"
+			}
+		}
+		return resp, nil
+	}
+
+	err = accessor.InsertUsers(users)
+	if err != nil {
+		return nil, newHTTPErr(500, ErrImportIdentities, "Failed to import identities: %s", err)
+	}
+	resp.Added = true
+	for _, user := range users {
+		ctx.audit(auditImportIdentity, user.Name, nil, auditRegisteredIdentity(ctx.ca, user.Name))
+	}
+
+	log.Debugf("Successfully imported %d identities", len(users))
+	return resp, nil
+}
+
+// getImportUserInfo returns the information of the user to be stored for one
+// identity of an import request, if the caller may register it
+func getImportUserInfo(ctx *serverRequestContext, caller spi.User, id *api.AddIdentityRequest, seen map[string]bool) (*spi.UserInfo, error) {
+	if id.ID == "" {
+		return nil, errors.New("Missing 'ID' of identity")
+	}
+	if seen[id.ID] {
+		return nil, errors.Errorf("Identity '%s' appears more than once in the batch", id.ID)
+	}
+	seen[id.ID] = true
+
+	req := &api.RegistrationRequest{
+		Name:           id.ID,
+		Secret:         id.Secret,
+		Type:           id.Type,
+		Affiliation:    id.Affiliation,
+		Attributes:     id.Attributes,
+		MaxEnrollments: id.MaxEnrollments,
+		SecretExpiry:   id.SecretExpiry,
+		SecretOneTime:  id.SecretOneTime,
+	}
+	normalizeRegistrationRequest(req, caller)
+
+	err := canRegister(caller, req, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = ctx.ca.registry.GetUser(req.Name, nil)
+	if err == nil {
+		return nil, errors.Errorf("Identity '%s' is already registered", req.Name)
+	}
+
+	return getRegistrationUserInfo(req, ctx.ca)
+}
+
+// parseIdentitiesCSV parses a CSV document of identities whose first row names
+// the columns; see api.ImportIdentitiesRequest for the format
+func parseIdentitiesCSV(doc string) ([]api.AddIdentityRequest, error) {
+	r := csv.NewReader(strings.NewReader(doc))
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("Missing header row")
+	}
+
+	cols := map[string]int{}
+	for i, name := range rows[0] {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !util.StrContained(name, importCSVColumns) {
+			return nil, errors.Errorf("Unknown column '%s'; valid columns are %s", name, strings.Join(importCSVColumns, ", "))
+		}
+		cols[name] = i
+	}
+	if _, ok := cols["id"]; !ok {
+		return nil, errors.New("Missing 'id' column")
+	}
+	get := func(row []string, name string) string {
+		i, ok := cols[name]
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	ids := make([]api.AddIdentityRequest, 0, len(rows)-1)
+	for n, row := range rows[1:] {
+		line := n + 2
+		id := api.AddIdentityRequest{
+			ID:          get(row, "id"),
+			Type:        get(row, "type"),
+			Affiliation: get(row, "affiliation"),
+			Secret:      get(row, "secret"),
+		}
+		if v := get(row, "max_enrollments"); v != "" {
+			id.MaxEnrollments, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Errorf("Invalid max_enrollments value '%s' on line %d", v, line)
+			}
+		}
+		id.Attributes, err = parseAttributeList(get(row, "attrs"))
+		if err != nil {
+			return nil, errors.WithMessage(err, "Invalid attrs value on line "+strconv.Itoa(line))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseAttributeList parses a semicolon-separated list of attributes of the
+// form <name>=<value>[:ecert]
+func parseAttributeList(list string) ([]api.Attribute, error) {
+	attrs := []api.Attribute{}
+	for _, item := range strings.Split(list, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ecert := false
+		if strings.HasSuffix(strings.ToLower(item), ":ecert") {
+			ecert = true
+			item = item[:len(item)-len(":ecert")]
+		}
+		nv := strings.SplitN(item, "=", 2)
+		if len(nv) != 2 || nv[0] == "" {
+			return nil, errors.Errorf("Attribute '%s' must be of the form <name>=<value>", item)
+		}
+		attrs = append(attrs, api.Attribute{Name: nv[0], Value: nv[1], ECert: ecert})
+	}
+	return attrs, nil
+}
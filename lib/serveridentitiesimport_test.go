@@ -0,0 +1,128 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+func TestImportIdentities(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	util.FatalError(t, err, "Failed to start server")
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	util.FatalError(t, err, "Failed to enroll user 'admin'")
+	admin := resp.Identity
+
+	// If any identity is rejected, none are added
+	importResp, err := admin.ImportIdentities(&api.ImportIdentitiesRequest{
+		Identities: []api.AddIdentityRequest{
+			api.AddIdentityRequest{ID: "import1", Type: "client", Affiliation: "org2"},
+			api.AddIdentityRequest{ID: "import1", Type: "client", Affiliation: "org2"},
+			api.AddIdentityRequest{ID: "import2", Type: "client", Affiliation: "unknownaff"},
+		},
+	})
+	util.FatalError(t, err, "Failed to import identities")
+	assert.False(t, importResp.Added, "No identities should have been added")
+	if assert.Equal(t, 3, len(importResp.Results)) {
+		for _, result := range importResp.Results {
+			assert.NotEmpty(t, result.Error, "Identity '%s' should not have been added", result.ID)
+			assert.Empty(t, result.Secret, "No secret should be returned for '%s'", result.ID)
+		}
+	}
+	_, err = admin.GetIdentity("import1", "")
+	assert.Error(t, err, "Identity 'import1' should not have been added")
+
+	// All identities of a valid batch are added
+	importResp, err = admin.ImportIdentities(&api.ImportIdentitiesRequest{
+		CSV: "id,type,affiliation,attrs,max_enrollments\n" +
+			"import1,client,org2,foo=bar:ecert;a=b,2\n" +
+			"import2,peer,.,,\n",
+	})
+	util.FatalError(t, err, "Failed to import identities")
+	assert.True(t, importResp.Added, "Identities should have been added")
+	for _, result := range importResp.Results {
+		assert.Empty(t, result.Error, "Identity '%s' should have been added", result.ID)
+		assert.NotEmpty(t, result.Secret, "A secret should be returned for '%s'", result.ID)
+	}
+	id, err := admin.GetIdentity("import1", "")
+	util.FatalError(t, err, "Failed to get identity 'import1'")
+	assert.Equal(t, 2, id.MaxEnrollments)
+	assert.Contains(t, id.Attributes, api.Attribute{Name: "foo", Value: "bar", ECert: true})
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "import2",
+		Secret: importResp.Results[1].Secret,
+	})
+	assert.NoError(t, err, "Failed to enroll imported identity 'import2'")
+
+	// A registrar may only import identities which it could register
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:        "importer",
+		Secret:      "importerpw",
+		Affiliation: "org2",
+		Attributes:  []api.Attribute{api.Attribute{Name: "hf.Registrar.Roles", Value: "client"}},
+	})
+	util.FatalError(t, err, "Failed to register 'importer'")
+	resp, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "importer",
+		Secret: "importerpw",
+	})
+	util.FatalError(t, err, "Failed to enroll 'importer'")
+	importResp, err = resp.Identity.ImportIdentities(&api.ImportIdentitiesRequest{
+		Identities: []api.AddIdentityRequest{
+			api.AddIdentityRequest{ID: "import3", Type: "client", Affiliation: "org2"},
+			api.AddIdentityRequest{ID: "import4", Type: "peer", Affiliation: "org2"},
+		},
+	})
+	util.FatalError(t, err, "Failed to import identities")
+	assert.False(t, importResp.Added, "'importer' may not register peers")
+	assert.NotEmpty(t, importResp.Results[1].Error, "'importer' may not register peers")
+}
+
+func TestParseIdentitiesCSV(t *testing.T) {
+	ids, err := parseIdentitiesCSV("ID, Secret, attrs\nuser1, user1pw, \"a=b;c=d:ecert\"\n")
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(ids)) {
+		assert.Equal(t, "user1", ids[0].ID)
+		assert.Equal(t, "user1pw", ids[0].Secret)
+		assert.Equal(t, []api.Attribute{{Name: "a", Value: "b"}, {Name: "c", Value: "d", ECert: true}}, ids[0].Attributes)
+	}
+
+	_, err = parseIdentitiesCSV("")
+	assert.Error(t, err, "A CSV document without a header row should be rejected")
+	_, err = parseIdentitiesCSV("type,affiliation\nclient,org1\n")
+	assert.Error(t, err, "A CSV document without an id column should be rejected")
+	_, err = parseIdentitiesCSV("id,password\nuser1,pw\n")
+	assert.Error(t, err, "A CSV document with an unknown column should be rejected")
+	_, err = parseIdentitiesCSV("id,max_enrollments\nuser1,many\n")
+	assert.Error(t, err, "An invalid max_enrollments value should be rejected")
+	_, err = parseIdentitiesCSV("id,attrs\nuser1,novalue\n")
+	assert.Error(t, err, "An attribute without a value should be rejected")
+}
@@ -28,6 +28,10 @@ type serverInfoResponseNet struct {
 	CAChain string
 	// Version of the server
 	Version string
+	// Base64 encoding of the Idemix issuer public key
+	IssuerPublicKey string
+	// Base64 encoding of the PEM-encoded Idemix revocation public key
+	IssuerRevocationPublicKey string
 }
 
 func newCAInfoEndpoint(s *Server) *serverEndpoint {
@@ -0,0 +1,73 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"github.com/cloudflare/cfssl/log"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func newLDAPCacheEndpoint(s *Server) *serverEndpoint {
+	return &serverEndpoint{
+		Methods:   []string{"GET", "DELETE"},
+		Handler:   ldapCacheHandler,
+		Server:    s,
+		successRC: 200,
+		action:    actionIdentities,
+	}
+}
+
+// ldapCacheHandler returns the statistics of the cache of LDAP users of a
+// CA, after removing the user of the 'id' query parameter, or all users,
+// from the cache for a DELETE request
+func ldapCacheHandler(ctx *serverRequestContext) (interface{}, error) {
+	// Authenticate
+	callerID, err := ctx.TokenAuthentication()
+	log.Debugf("Received LDAP cache request from %s", callerID)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return nil, err
+	}
+	lc := ca.ldapRegistry()
+	if lc == nil {
+		return nil, newHTTPErr(400, ErrLDAPCache, "LDAP is not enabled for CA '%s'", ca.Config.CA.Name)
+	}
+	if _, enabled := lc.CacheStats(); !enabled {
+		return nil, newHTTPErr(400, ErrLDAPCache, "The LDAP user cache is not enabled for CA '%s'", ca.Config.CA.Name)
+	}
+	resp := &api.LDAPCacheResponse{CAName: ca.Config.CA.Name}
+	if ctx.req.Method == "DELETE" {
+		id := ctx.req.URL.Query().Get("id")
+		// Removing a user from the cache only makes the next lookup search
+		// the directory, but a caller whose authority is limited to some
+		// affiliations can't flush the whole cache
+		if id == "" && ctx.authzScopes != nil {
+			return nil, newAuthErr(ErrLDAPCache, "The identity '%s' may only invalidate the LDAP users of its affiliations", callerID)
+		}
+		resp.Invalidated = lc.InvalidateCache(id)
+		log.Infof("Removed %d entries for '%s' from the LDAP user cache at the request of '%s'", resp.Invalidated, id, callerID)
+	}
+	stats, _ := lc.CacheStats()
+	resp.Entries = stats.Entries
+	resp.Hits = stats.Hits
+	resp.NegativeHits = stats.NegativeHits
+	resp.Misses = stats.Misses
+	return resp, nil
+}
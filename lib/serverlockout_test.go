@@ -0,0 +1,79 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func TestIdentityLockout(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	srv.CA.Config.Registry.Lockout.MaxFailedAttempts = 2
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:        "lockout1",
+		Secret:      "lockout1pw",
+		Affiliation: "org2",
+	})
+	if err != nil {
+		t.Fatalf("Failed to register lockout1: %s", err)
+	}
+
+	// A successful login resets the count of failed logins
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "lockout1", Secret: "badpw"})
+	assert.Error(t, err, "Enrollment with an invalid secret should have failed")
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "lockout1", Secret: "lockout1pw"})
+	assert.NoError(t, err, "Enrollment of lockout1 failed")
+
+	// The identity is locked out after 2 consecutive failed logins
+	for i := 0; i < 2; i++ {
+		_, err = client.Enroll(&api.EnrollmentRequest{Name: "lockout1", Secret: "badpw"})
+		assert.Error(t, err, "Enrollment with an invalid secret should have failed")
+	}
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "lockout1", Secret: "lockout1pw"})
+	assert.Error(t, err, "Enrollment should have failed; lockout1 is locked out")
+
+	// A registrar can unlock the identity
+	_, err = admin.UnlockIdentity(&api.UnlockIdentityRequest{ID: "lockout1"})
+	assert.NoError(t, err, "Failed to unlock lockout1")
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "lockout1", Secret: "lockout1pw"})
+	assert.NoError(t, err, "Enrollment of lockout1 failed after it was unlocked")
+
+	_, err = admin.UnlockIdentity(&api.UnlockIdentityRequest{ID: "unknown"})
+	assert.Error(t, err, "Unlocking an unknown identity should have failed")
+}
@@ -0,0 +1,153 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/attr"
+	"github.com/tjfoc/fabric-ca-gm/lib/oidc"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+	"github.com/tjfoc/fabric-ca-gm/util"
+)
+
+const bearerPrefix = "Bearer "
+
+// EnrollmentAuthentication authenticates the caller of an enroll request
+// with either the OIDC ID token or the username and password found in the
+// authorization header, and returns the enrollment ID
+func (ctx *serverRequestContext) EnrollmentAuthentication() (string, error) {
+	authHdr := ctx.req.Header.Get("authorization")
+	if strings.HasPrefix(authHdr, bearerPrefix) {
+		return ctx.OIDCAuthentication(strings.TrimPrefix(authHdr, bearerPrefix))
+	}
+	return ctx.BasicAuthentication()
+}
+
+// OIDCAuthentication authenticates the caller with an OIDC ID token and
+// returns the enrollment ID to which its claims map. The identity is
+// created in the registry the first time it enrolls, and updated to match
+// the claims each time after that.
+func (ctx *serverRequestContext) OIDCAuthentication(token string) (string, error) {
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return "", err
+	}
+	if ca.oidcVerifier == nil {
+		return "", newAuthErr(ErrInvalidIDToken, "Enrollment with OIDC ID tokens is not enabled")
+	}
+	if ca.Config.Registry.MaxEnrollments == 0 {
+		return "", newAuthErr(ErrEnrollDisabled, "Enroll is disabled")
+	}
+	claims, err := ca.oidcVerifier.Verify(token)
+	if err != nil {
+		return "", newAuthErr(ErrInvalidIDToken, "Invalid ID token in authorization header: %s", err)
+	}
+	id, err := ca.oidcVerifier.GetIdentity(claims)
+	if err != nil {
+		return "", newAuthErr(ErrInvalidIDToken, "Invalid ID token in authorization header: %s", err)
+	}
+	user, before, err := ctx.getOIDCUser(ca, id)
+	if err != nil {
+		return "", err
+	}
+	ctx.ui = user
+	ctx.enrollmentID = id.Name
+	after := auditIdentity(user, false)
+	if before == nil {
+		ctx.audit(auditAddIdentity, id.Name, nil, after)
+	} else if len(getAuditChanges(before, after)) > 0 {
+		ctx.audit(auditModifyIdentity, id.Name, before, after)
+	}
+	log.Debugf("Successful OIDC authentication of '%s'", id.Name)
+	return id.Name, nil
+}
+
+// getOIDCUser returns the identity in the registry to which an ID token maps,
+// creating it if it does not exist or else updating it to match the token.
+// The audit log fields of an existing identity before it was updated are
+// also returned.
+func (ctx *serverRequestContext) getOIDCUser(ca *CA, id *oidc.Identity) (spi.User, map[string]interface{}, error) {
+	issuer := ca.Config.OIDC.Issuer
+	if id.Affiliation != "" {
+		_, err := ca.registry.GetAffiliation(id.Affiliation)
+		if err != nil {
+			return nil, nil, newAuthErr(ErrInvalidUser, "Affiliation '%s' of identity '%s' is not supported", id.Affiliation, id.Name)
+		}
+	}
+	attrs := append([]api.Attribute{}, id.Attributes...)
+	addAttributeToRequest(attr.EnrollmentID, id.Name, &attrs)
+	addAttributeToRequest(attr.Type, id.Type, &attrs)
+	addAttributeToRequest(attr.Affiliation, id.Affiliation, &attrs)
+	attrs = append(attrs, api.Attribute{Name: attr.OIDCIssuer, Value: issuer})
+
+	registry := ca.registry
+	user, err := registry.GetUser(id.Name, nil)
+	if err != nil {
+		// An identity which enrolls with an ID token has no usable secret, and
+		// may enroll as often as the issuer gives it tokens
+		err = registry.InsertUser(&spi.UserInfo{
+			Name:           id.Name,
+			Pass:           util.RandomString(32),
+			Type:           id.Type,
+			Affiliation:    id.Affiliation,
+			Attributes:     attrs,
+			MaxEnrollments: -1,
+			Level:          ca.server.levels.Identity,
+		})
+		if err != nil {
+			return nil, nil, newHTTPErr(500, ErrInvalidUser, "Failed to create identity '%s': %s", id.Name, err)
+		}
+		log.Infof("Created identity '%s' on its first enrollment with an ID token from '%s'", id.Name, issuer)
+		user, err = registry.GetUser(id.Name, nil)
+		if err != nil {
+			return nil, nil, newHTTPErr(500, ErrInvalidUser, "Failed to get identity '%s': %s", id.Name, err)
+		}
+		return user, nil, nil
+	}
+
+	// Identities which were registered, or created for another issuer,
+	// can't be enrolled with an ID token from this issuer
+	owner, err := user.GetAttribute(attr.OIDCIssuer)
+	if err != nil || owner.Value != issuer {
+		return nil, nil, newAuthErr(ErrInvalidUser, "Identity '%s' was not created by enrolling with an ID token from '%s'", id.Name, issuer)
+	}
+	dbUser := user.(*DBUser)
+	if dbUser.State == -1 {
+		return nil, nil, newAuthErr(ErrInvalidUser, "Identity '%s' is revoked", id.Name)
+	}
+	if dbUser.Suspended {
+		return nil, nil, newAuthErr(ErrIdentitySuspended, "Identity '%s' is suspended", id.Name)
+	}
+	before := auditIdentity(user, false)
+	modReq := dbUser.UserInfo
+	modReq.Pass = string(dbUser.pass)
+	modReq.Type = id.Type
+	modReq.Affiliation = id.Affiliation
+	modReq.Attributes = getNewAttributes(modReq.Attributes, attrs)
+	err = registry.UpdateUser(&modReq, false)
+	if err != nil {
+		return nil, nil, newHTTPErr(500, ErrInvalidUser, "Failed to update identity '%s': %s", id.Name, err)
+	}
+	user, err = registry.GetUser(id.Name, nil)
+	if err != nil {
+		return nil, nil, newHTTPErr(500, ErrInvalidUser, "Failed to get identity '%s': %s", id.Name, err)
+	}
+	return user, before, nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/oidc"
+)
+
+const testOIDCIssuer = "https://idp.example.com"
+
+// signTestIDToken returns an ID token with the claims signed with 'key'
+func signTestIDToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest.Sum(nil))
+	if err != nil {
+		t.Fatalf("Failed to sign ID token: %s", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testIDTokenClaims(sub string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    testOIDCIssuer,
+		"aud":    "fabric-ca",
+		"sub":    sub,
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"org":    "org2",
+		"groups": []string{"admins", "users"},
+	}
+}
+
+func TestOIDCEnrollment(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "oidc")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	jwksFile := filepath.Join(dir, "jwks.json")
+	err = ioutil.WriteFile(jwksFile, jwks, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write JWKS: %s", err)
+	}
+
+	srv := TestGetRootServer(t)
+	srv.CA.Config.OIDC = oidc.Config{
+		Enabled:  true,
+		Issuer:   testOIDCIssuer,
+		Audience: "fabric-ca",
+		JWKS:     jwksFile,
+		Claims: oidc.ClaimsConfig{
+			ID:          "sub",
+			DefaultType: "client",
+			Affiliation: "org",
+			Converters: []oidc.NameVal{
+				{Name: "hf.Revoker", Value: `if(claim("groups") =~ "admins", "true", "false")`},
+			},
+		},
+	}
+	err = srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+
+	// The identity is created on its first enrollment with an ID token
+	token := signTestIDToken(t, key, testIDTokenClaims("alice"))
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "alice", IDToken: token})
+	if err != nil {
+		t.Fatalf("Failed to enroll alice with an ID token: %s", err)
+	}
+	idResp, err := admin.GetIdentity("alice", "")
+	if assert.NoError(t, err, "Failed to get alice") {
+		assert.Equal(t, "client", idResp.Type)
+		assert.Equal(t, "org2", idResp.Affiliation)
+		assert.Equal(t, -1, idResp.MaxEnrollments)
+		assert.Contains(t, idResp.Attributes, api.Attribute{Name: "hf.Revoker", Value: "true"})
+	}
+
+	// and updated to match the claims on each enrollment after that
+	claims := testIDTokenClaims("alice")
+	claims["groups"] = "users"
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "alice", IDToken: signTestIDToken(t, key, claims)})
+	assert.NoError(t, err, "Failed to enroll alice again with an ID token")
+	idResp, err = admin.GetIdentity("alice", "")
+	if assert.NoError(t, err, "Failed to get alice") {
+		assert.Contains(t, idResp.Attributes, api.Attribute{Name: "hf.Revoker", Value: "false"})
+	}
+
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "bob", IDToken: token})
+	assert.Error(t, err, "Enrollment should have failed; the ID token maps to alice")
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "admin", IDToken: signTestIDToken(t, key, testIDTokenClaims("admin"))})
+	assert.Error(t, err, "Enrollment should have failed; admin was not created with an ID token")
+
+	claims = testIDTokenClaims("alice")
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "alice", IDToken: signTestIDToken(t, key, claims)})
+	assert.Error(t, err, "Enrollment should have failed; the ID token is expired")
+
+	claims = testIDTokenClaims("carol")
+	claims["org"] = "unknown"
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "carol", IDToken: signTestIDToken(t, key, claims)})
+	assert.Error(t, err, "Enrollment should have failed; the affiliation does not exist")
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "alice", IDToken: signTestIDToken(t, otherKey, testIDTokenClaims("alice"))})
+	assert.Error(t, err, "Enrollment should have failed; the ID token is not signed by the issuer")
+}
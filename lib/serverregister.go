@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -37,6 +38,8 @@ func newRegisterEndpoint(s *Server) *serverEndpoint {
 		Handler:   registerHandler,
 		Server:    s,
 		successRC: 201,
+		limiter:   newEndpointRateLimiter(s.Config.RateLimits.Register),
+		action:    actionRegister,
 	}
 }
 
@@ -64,6 +67,7 @@ func registerHandler(ctx *serverRequestContext) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	ctx.audit(auditRegister, req.Name, nil, auditRegisteredIdentity(ca, req.Name))
 	// Return response
 	resp := &api.RegistrationResponseNet{
 		RegistrationResponse: api.RegistrationResponse{Secret: secret},
@@ -136,6 +140,30 @@ func validateID(req *api.RegistrationRequest, ca *CA) error {
 // registerUserID registers a new user and its enrollmentID, role and state
 func registerUserID(req *api.RegistrationRequest, ca *CA) (string, error) {
 	log.Debugf("Registering user id: %s\n", req.Name)
+
+	insert, err := getRegistrationUserInfo(req, ca)
+	if err != nil {
+		return "", err
+	}
+
+	registry := ca.registry
+
+	_, err = registry.GetUser(req.Name, nil)
+	if err == nil {
+		return "", errors.Errorf("Identity '%s' is already registered", req.Name)
+	}
+
+	err = registry.InsertUser(insert)
+	if err != nil {
+		return "", err
+	}
+
+	return req.Secret, nil
+}
+
+// getRegistrationUserInfo returns the information of the user to be stored
+// for a registration request, generating a secret if none was requested
+func getRegistrationUserInfo(req *api.RegistrationRequest, ca *CA) (*spi.UserInfo, error) {
 	var err error
 
 	if req.Secret == "" {
@@ -144,7 +172,12 @@ func registerUserID(req *api.RegistrationRequest, ca *CA) (string, error) {
 
 	req.MaxEnrollments, err = getMaxEnrollments(req.MaxEnrollments, ca.Config.Registry.MaxEnrollments)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	secretExpiry, err := parseSecretExpiry(req.SecretExpiry)
+	if err != nil {
+		return nil, err
 	}
 
 	// Add attributes containing the enrollment ID, type, and affiliation if not
@@ -153,7 +186,7 @@ func registerUserID(req *api.RegistrationRequest, ca *CA) (string, error) {
 	addAttributeToRequest(attr.Type, req.Type, &req.Attributes)
 	addAttributeToRequest(attr.Affiliation, req.Affiliation, &req.Attributes)
 
-	insert := spi.UserInfo{
+	return &spi.UserInfo{
 		Name:           req.Name,
 		Pass:           req.Secret,
 		Type:           req.Type,
@@ -161,21 +194,33 @@ func registerUserID(req *api.RegistrationRequest, ca *CA) (string, error) {
 		Attributes:     req.Attributes,
 		MaxEnrollments: req.MaxEnrollments,
 		Level:          ca.server.levels.Identity,
-	}
-
-	registry := ca.registry
+		SecretExpiry:   secretExpiry,
+		SecretOneTime:  req.SecretOneTime,
+	}, nil
+}
 
-	_, err = registry.GetUser(req.Name, nil)
+// parseSecretExpiry parses the expiry of an enrollment secret, which is either an
+// RFC3339 timestamp or a duration relative to the current time. An empty value
+// or a zero duration means that the secret does not expire.
+func parseSecretExpiry(expiry string) (time.Time, error) {
+	if expiry == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, expiry)
 	if err == nil {
-		return "", errors.Errorf("Identity '%s' is already registered", req.Name)
+		return t.UTC(), nil
 	}
-
-	err = registry.InsertUser(&insert)
+	d, err := time.ParseDuration(expiry)
 	if err != nil {
-		return "", err
+		return time.Time{}, errors.Errorf("Invalid secret expiry '%s': must be an RFC3339 timestamp or a duration", expiry)
 	}
-
-	return req.Secret, nil
+	if d < 0 {
+		return time.Time{}, errors.Errorf("Invalid secret expiry '%s': duration can't be negative", expiry)
+	}
+	if d == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(d).UTC(), nil
 }
 
 func isValidAffiliation(affiliation string, ca *CA) error {
@@ -233,6 +278,16 @@ func canRegister(registrar spi.User, req *api.RegistrationRequest, ctx *serverRe
 		return newAuthErr(ErrRegAttrAuth, "Failed to register attribute: %s", err)
 	}
 
+	err = ctx.ca.checkRegistrationPolicies(registrar, &policyIdentity{
+		ID:          req.Name,
+		Type:        req.Type,
+		Affiliation: req.Affiliation,
+		Attributes:  req.Attributes,
+	})
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -25,6 +25,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cloudflare/cfssl/config"
 	"github.com/cloudflare/cfssl/log"
@@ -37,6 +38,7 @@ import (
 	"github.com/tjfoc/fabric-ca-gm/util"
 	"github.com/hyperledger/fabric/common/attrmgr"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // serverRequestContext represents an HTTP request/response context in the server
@@ -54,7 +56,14 @@ type serverRequestContext struct {
 		buf  []byte // the body itself
 		err  error  // any error from reading the body
 	}
-	callerRoles map[string]bool
+	// The affiliations at or below which the caller may act, if the action
+	// of the endpoint was granted only by roles with an affiliation scope
+	authzScopes []string
+	// The path variables of the request, if they are not those of 'req';
+	// set when a pending operation is performed
+	vars map[string]string
+	// True when performing a pending operation which has been confirmed
+	approved bool
 }
 
 const (
@@ -100,11 +109,40 @@ func (ctx *serverRequestContext) BasicAuthentication() (string, error) {
 	if err != nil {
 		return "", newAuthErr(ErrInvalidUser, "Failed to get user: %s", err)
 	}
+	// Identities in the database are locked out after repeated failed logins
+	lockout := ca.Config.Registry.Lockout
+	dbUser, lockable := ctx.ui.(*DBUser)
+	lockable = lockable && lockout.MaxFailedAttempts > 0
+	if lockable && dbUser.IsLockedOut(lockout.Duration) {
+		return "", newAuthErr(ErrIdentityLocked, "Identity '%s' is locked out due to repeated failed logins", username)
+	}
 	// Check the user's password and max enrollments if supported by registry
 	err = ctx.ui.Login(password, caMaxEnrollments)
 	if err != nil {
+		if errors.Cause(err) == errSecretExpired {
+			// The password was correct, so the caller may be told why it was rejected
+			return "", newHTTPErr(401, ErrSecretExpired, "Login failure: %s", err)
+		}
+		if lockable && errors.Cause(err) == bcrypt.ErrMismatchedHashAndPassword {
+			locked, err2 := dbUser.LoginFailed(lockout.MaxFailedAttempts)
+			if err2 != nil {
+				log.Errorf("Failed to record failed login of identity '%s': %s", username, err2)
+			} else if locked {
+				log.Warningf("Identity '%s' has been locked out after %d consecutive failed logins from %s", username, lockout.MaxFailedAttempts, r.RemoteAddr)
+			}
+		}
 		return "", newAuthErr(ErrInvalidPass, "Login failure: %s", err)
 	}
+	if lockable {
+		err = dbUser.ResetFailedLogins()
+		if err != nil {
+			log.Errorf("Failed to reset failed logins of identity '%s': %s", username, err)
+		}
+	}
+	err = ctx.checkIdentityRateLimit(username)
+	if err != nil {
+		return "", err
+	}
 	// Store the enrollment ID associated with this server request context
 	ctx.enrollmentID = username
 	// Return the username
@@ -112,7 +150,9 @@ func (ctx *serverRequestContext) BasicAuthentication() (string, error) {
 }
 
 // TokenAuthentication authenticates the caller by token
-// in the authorization header.
+// in the authorization header, or by its TLS client certificate
+// if there is no authorization header and this is enabled.
+// The caller must also be authorized to perform the action of the endpoint.
 // Returns the enrollment ID or error.
 func (ctx *serverRequestContext) TokenAuthentication() (string, error) {
 	r := ctx.req
@@ -120,7 +160,13 @@ func (ctx *serverRequestContext) TokenAuthentication() (string, error) {
 	// Get the authorization header
 	authHdr := r.Header.Get("authorization")
 	if authHdr == "" {
-		return "", newHTTPErr(401, ErrNoAuthHdr, "No authorization header")
+		// Without an authorization header, the caller may be authenticated
+		// by the certificate with which it authenticated to TLS
+		cert := ctx.getTLSClientCert()
+		if cert == nil {
+			return "", newHTTPErr(401, ErrNoAuthHdr, "No authorization header")
+		}
+		return ctx.authenticateAndAuthorize(cert, "TLS client certificate", nil)
 	}
 	// Get the CA
 	ca, err := ctx.GetCA()
@@ -132,13 +178,89 @@ func (ctx *serverRequestContext) TokenAuthentication() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	// Verify the token; the signature is over the header and body
-	cert, err2 := util.VerifyToken(ca.csp, authHdr, body)
-	if err2 != nil {
-		return "", newAuthErr(ErrInvalidToken, "Invalid token in authorization header: %s", err2)
+	// Verify the token; the signature is over the header and body, and
+	// unless it is a legacy token, the method, URI, timestamp and nonce
+	var cert *x509.Certificate
+	var token *util.RequestToken
+	if util.IsLegacyToken(authHdr) {
+		if !ca.Config.Tokens.AllowLegacy {
+			return "", newAuthErr(ErrInvalidToken,
+				"Invalid token in authorization header: legacy tokens, which can be replayed, are not accepted")
+		}
+		cert, err = util.VerifyToken(ca.csp, authHdr, body)
+		if err != nil {
+			return "", newAuthErr(ErrInvalidToken, "Invalid token in authorization header: %s", err)
+		}
+	} else {
+		token, err = ctx.verifyRequestToken(ca, authHdr, body)
+		if err != nil {
+			return "", err
+		}
+		cert = token.Cert
+	}
+	return ctx.authenticateAndAuthorize(cert, "certificate in the authorization header", token)
+}
+
+// authenticateAndAuthorize authenticates the caller as the owner of 'cert'
+// and authorizes it to perform the action of the endpoint
+func (ctx *serverRequestContext) authenticateAndAuthorize(cert *x509.Certificate, source string, token *util.RequestToken) (string, error) {
+	id, err := ctx.certAuthentication(cert, source, token)
+	if err != nil {
+		return "", err
+	}
+	err = ctx.authorizeEndpoint()
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// verifyRequestToken verifies a token which covers the request, and returns
+// its content. The token must have been created within the clock skew of the
+// server's time. Whether it has been used before is checked by
+// certAuthentication once the certificate in it has been verified.
+func (ctx *serverRequestContext) verifyRequestToken(ca *CA, authHdr string, body []byte) (*util.RequestToken, error) {
+	r := ctx.req
+	token, err := util.VerifyRequestToken(ca.csp, authHdr, r.Method, r.RequestURI, body)
+	if err != nil {
+		return nil, newAuthErr(ErrInvalidToken, "Invalid token in authorization header: %s", err)
+	}
+	now := time.Now()
+	skew := ca.Config.Tokens.ClockSkew
+	if token.Timestamp.Before(now.Add(-skew)) || token.Timestamp.After(now.Add(skew)) {
+		return nil, newAuthErr(ErrInvalidToken,
+			"Invalid token in authorization header: it was created at %s, which is not within %s of the server's time",
+			token.Timestamp.UTC().Format(time.RFC3339), skew)
+	}
+	return token, nil
+}
+
+// getTLSClientCert returns the verified TLS client certificate of the caller
+// if authentication with it is enabled, or else nil
+func (ctx *serverRequestContext) getTLSClientCert() *x509.Certificate {
+	if !ctx.endpoint.Server.Config.TLS.ClientAuth.CertAuth {
+		return nil
+	}
+	state := ctx.req.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// certAuthentication authenticates the caller as the owner of 'cert', which
+// must be an unexpired and unrevoked certificate issued by this CA. The
+// 'source' of the certificate is used in error messages. If the certificate
+// is in a request token, the nonce of 'token' is recorded only after the
+// certificate has been verified, so that only the owners of certificates
+// issued by this CA can add nonces to the cache.
+func (ctx *serverRequestContext) certAuthentication(cert *x509.Certificate, source string, token *util.RequestToken) (string, error) {
+	ca, err := ctx.GetCA()
+	if err != nil {
+		return "", err
 	}
 	// Make sure the caller's cert was issued by this CA
-	err2 = ca.VerifyCertificate(cert)
+	err2 := ca.VerifyCertificate(cert)
 	if err2 != nil {
 		return "", newAuthErr(ErrUntrustedCertificate, "Untrusted certificate: %s", err2)
 	}
@@ -151,8 +273,7 @@ func (ctx *serverRequestContext) TokenAuthentication() (string, error) {
 		return "", newHTTPErr(401, ErrCertRevokeCheckFailure, "Failed while checking for revocation")
 	}
 	if expired {
-		return "", newAuthErr(ErrCertExpired,
-			"The certificate in the authorization header is a revoked or expired certificate")
+		return "", newAuthErr(ErrCertExpired, "The %s is a revoked or expired certificate", source)
 	}
 	aki := hex.EncodeToString(cert.AuthorityKeyId)
 	serial := util.GetSerialAsHex(cert.SerialNumber)
@@ -163,16 +284,38 @@ func (ctx *serverRequestContext) TokenAuthentication() (string, error) {
 		return "", newHTTPErr(500, ErrCertNotFound, "Failed searching certificates: %s", err)
 	}
 	if len(certs) == 0 {
+		purged, err := ca.CertDBAccessor().IsCertificatePurged(serial, aki)
+		if err != nil {
+			return "", newHTTPErr(500, ErrCertNotFound, "Failed searching certificates: %s", err)
+		}
+		if purged {
+			return "", newAuthErr(ErrCertPurged, "The %s was purged", source)
+		}
 		return "", newAuthErr(ErrCertNotFound, "Certificate not found with AKI '%s' and serial '%s'", aki, serial)
 	}
 	for _, certificate := range certs {
 		if certificate.Status == "revoked" {
-			return "", newAuthErr(ErrCertRevoked, "The certificate in the authorization header is a revoked certificate")
+			return "", newAuthErr(ErrCertRevoked, "The %s is a revoked certificate", source)
 		}
 	}
+	// The certificates of a suspended identity stay valid, but it cannot use them
+	// to authenticate; LDAP identities cannot be suspended
+	if ca.usesDBRegistry() {
+		user, err := ca.registry.GetUser(id, nil)
+		if err == nil && isSuspended(user) {
+			return "", newAuthErr(ErrIdentitySuspended, "Identity '%s' is suspended", id)
+		}
+	}
+	if token != nil && !ca.nonces.add(token.Nonce, token.Timestamp.Add(ca.Config.Tokens.ClockSkew), time.Now()) {
+		return "", newAuthErr(ErrTokenReplayed, "The token in the authorization header has already been used")
+	}
+	err = ctx.checkIdentityRateLimit(id)
+	if err != nil {
+		return "", err
+	}
 	ctx.enrollmentID = id
 	ctx.enrollmentCert = cert
-	log.Debugf("Successful token authentication of '%s'", id)
+	log.Debugf("Successful authentication of '%s' with its %s", id, source)
 	return id, nil
 }
 
@@ -436,6 +579,11 @@ func (ctx *serverRequestContext) containsAffiliation(affiliation string) (bool,
 		return false, err
 	}
 
+	if !ctx.inAuthzScope(affiliation) {
+		log.Debugf("Affiliation '%s' is not within the scope of the roles which authorized the caller", affiliation)
+		return false, nil
+	}
+
 	callerAffiliationPath := GetUserAffiliation(caller)
 	log.Debugf("Checking to see if affiliation '%s' contains caller's affiliation '%s'", affiliation, callerAffiliationPath)
 
@@ -535,50 +683,12 @@ func (ctx *serverRequestContext) canActOnType(requestedType string) (bool, error
 	return true, nil
 }
 
-// HasRole returns an error if the caller does not have the attribute or the value is false for a boolean attribute
-func (ctx *serverRequestContext) HasRole(role string) error {
-	hasRole, err := ctx.hasRole(role)
-	if err != nil {
-		return err
-	}
-	if !hasRole {
-		return newHTTPErr(400, ErrMissingRole, "Caller has a value of 'false' for attribute/role '%s'", role)
-	}
-	return nil
-}
-
-// HasRole returns true if the caller has the attribute and value of the attribute is true
-func (ctx *serverRequestContext) hasRole(role string) (bool, error) {
-	if ctx.callerRoles == nil {
-		ctx.callerRoles = make(map[string]bool)
-	}
-
-	roleStatus, hasRole := ctx.callerRoles[role]
-	if hasRole {
-		return roleStatus, nil
-	}
-
-	caller, err := ctx.GetCaller()
-	if err != nil {
-		return false, err
-	}
-
-	roleAttr, err := caller.GetAttribute(role)
-	if err != nil {
-		return false, err
-	}
-	roleStatus, err = strconv.ParseBool(roleAttr.Value)
-	if err != nil {
-		return false, errors.Wrap(err, fmt.Sprintf("Failed to get boolean value of '%s'", role))
-	}
-	ctx.callerRoles[role] = roleStatus
-
-	return ctx.callerRoles[role], nil
-}
-
 // GetVar returns the parameter path variable from the URL
 func (ctx *serverRequestContext) GetVar(name string) (string, error) {
-	vars := gmux.Vars(ctx.req)
+	vars := ctx.vars
+	if vars == nil {
+		vars = gmux.Vars(ctx.req)
+	}
 	if vars == nil {
 		return "", newHTTPErr(500, ErrHTTPRequest, "Failed to correctly handle HTTP request")
 	}
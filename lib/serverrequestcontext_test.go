@@ -0,0 +1,46 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Authentication with TLS client certificates requires them to be verified
+func TestTLSClientCertAuthConfig(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+
+	for _, authType := range []string{"NoClientCert", "RequestClientCert", "RequireAnyClientCert"} {
+		srv := TestGetRootServer(t)
+		srv.Config.TLS.Enabled = true
+		srv.Config.TLS.CertFile = "../testdata/tls_server-cert.pem"
+		srv.Config.TLS.KeyFile = "../testdata/tls_server-key.pem"
+		srv.Config.TLS.ClientAuth.Type = authType
+		srv.Config.TLS.ClientAuth.CertFiles = []string{"../testdata/root.pem"}
+		srv.Config.TLS.ClientAuth.CertAuth = true
+		err := srv.Start()
+		if assert.Error(t, err, "Server start should have failed; client auth type %s does not verify certificates", authType) {
+			assert.Contains(t, err.Error(), "client auth type")
+		} else {
+			srv.Stop()
+		}
+	}
+}
@@ -27,8 +27,10 @@ import (
 )
 
 type revocationResponseNet struct {
-	RevokedCerts []api.RevokedCert
-	CRL          string
+	RevokedCerts       []api.RevokedCert
+	RevokedCredentials []string `json:",omitempty"`
+	CRL                string
+	Pending            *api.PendingOperation `json:",omitempty"`
 }
 
 // CertificateStatus represents status of an enrollment certificate
@@ -46,6 +48,7 @@ func newRevokeEndpoint(s *Server) *serverEndpoint {
 		Methods: []string{"POST"},
 		Handler: revokeHandler,
 		Server:  s,
+		action:  actionRevoke,
 	}
 }
 
@@ -57,37 +60,56 @@ func revokeHandler(ctx *serverRequestContext) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	// Authentication
-	id, err := ctx.TokenAuthentication()
+	// Authentication and authorization
+	_, err = ctx.TokenAuthentication()
 	if err != nil {
 		return nil, err
 	}
+	return processRevokeRequest(ctx, &req)
+}
+
+// processRevokeRequest revokes the certificates or identity of an
+// authenticated revoke request
+func processRevokeRequest(ctx *serverRequestContext, req *api.RevocationRequestNet) (*revocationResponseNet, error) {
 	// Get targeted CA
 	ca, err := ctx.GetCA()
 	if err != nil {
 		return nil, err
 	}
-	// Authorization
-	// Make sure that the caller has the "hf.Revoker" attribute.
-	err = ca.attributeIsTrue(id, "hf.Revoker")
-	if err != nil {
-		return nil, newHTTPErr(401, ErrNotRevoker, "Caller does not have authority to revoke")
-	}
-
 	req.AKI = strings.TrimLeft(strings.ToLower(req.AKI), "0")
 	req.Serial = strings.TrimLeft(strings.ToLower(req.Serial), "0")
 
+	if req.Certificate != "" {
+		serial, aki, err := getSerialAndAKIFromPEM(ca, req.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		if (req.Serial != "" && req.Serial != serial) || (req.AKI != "" && req.AKI != aki) {
+			return nil, newHTTPErr(400, ErrInvalidRevokeCert, "Serial %s and AKI %s do not match the certificate in the revocation request",
+				req.Serial, req.AKI)
+		}
+		req.Serial = serial
+		req.AKI = aki
+	}
+
 	certDBAccessor := ca.certDBAccessor
 	registry := ca.registry
 	reason := util.RevocationReasonCodes[req.Reason]
 
 	result := &revocationResponseNet{}
-	if req.Serial != "" && req.AKI != "" {
+	// A certificate issued without an AKI extension is still identified exactly
+	// when it was supplied in the request, so an empty AKI is allowed in that case
+	if req.Serial != "" && (req.AKI != "" || req.Certificate != "") {
 		calleraki := strings.ToLower(strings.TrimLeft(hex.EncodeToString(ctx.enrollmentCert.AuthorityKeyId), "0"))
 		callerserial := strings.ToLower(strings.TrimLeft(util.GetSerialAsHex(ctx.enrollmentCert.SerialNumber), "0"))
 
 		certificate, err := certDBAccessor.GetCertificateWithID(req.Serial, req.AKI)
 		if err != nil {
+			purged, err2 := certDBAccessor.IsCertificatePurged(req.Serial, req.AKI)
+			if err2 == nil && purged {
+				return nil, newHTTPErr(404, ErrCertPurged, "Certificate with serial %s and AKI %s was purged",
+					req.Serial, req.AKI)
+			}
 			return nil, newHTTPErr(404, ErrRevCertNotFound, "Certificate with serial %s and AKI %s was not found: %s",
 				req.Serial, req.AKI, err)
 		}
@@ -114,11 +136,58 @@ func revokeHandler(ctx *serverRequestContext) (interface{}, error) {
 			}
 		}
 
+		if ctx.needsApproval(opRevoke) && isPrivilegedIdentity(userInfo) {
+			return ctx.deferRevocation(req)
+		}
+
 		err = certDBAccessor.RevokeCertificate(req.Serial, req.AKI, reason)
 		if err != nil {
 			return nil, newHTTPErr(500, ErrRevokeFailure, "Revoke of certificate <%s,%s> failed: %s", req.Serial, req.AKI, err)
 		}
 		result.RevokedCerts = append(result.RevokedCerts, api.RevokedCert{Serial: req.Serial, AKI: req.AKI})
+	} else if req.RevocationHandle != "" {
+		credRec, err := ca.idemixCredDBAccessor.GetCredential(req.RevocationHandle, ca.Config.CA.Name)
+		if err != nil {
+			return nil, newHTTPErr(404, ErrRevCredNotFound, "Idemix credential with revocation handle %s was not found: %s",
+				req.RevocationHandle, err)
+		}
+
+		if credRec.Status == string(Revoked) {
+			return nil, newHTTPErr(404, ErrCredAlreadyRevoked, "Idemix credential with revocation handle %s was already revoked",
+				req.RevocationHandle)
+		}
+
+		if req.Name != "" && req.Name != credRec.ID {
+			return nil, newHTTPErr(400, ErrCertWrongOwner, "Idemix credential with revocation handle %s is not owned by %s",
+				req.RevocationHandle, req.Name)
+		}
+
+		userInfo, err := registry.GetUser(credRec.ID, nil)
+		if err != nil {
+			return nil, newHTTPErr(404, ErrRevokeIDNotFound, "Identity %s was not found: %s", credRec.ID, err)
+		}
+
+		caller, err := ctx.GetCaller()
+		if err != nil {
+			return nil, err
+		}
+		if caller.GetName() != credRec.ID {
+			err = ctx.CanManageUser(userInfo)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if ctx.needsApproval(opRevoke) && isPrivilegedIdentity(userInfo) {
+			return ctx.deferRevocation(req)
+		}
+
+		err = ca.idemixCredDBAccessor.RevokeCredential(req.RevocationHandle, ca.Config.CA.Name, reason)
+		if err != nil {
+			return nil, newHTTPErr(500, ErrRevokeFailure, "Revoke of Idemix credential with revocation handle %s failed: %s",
+				req.RevocationHandle, err)
+		}
+		result.RevokedCredentials = append(result.RevokedCredentials, req.RevocationHandle)
 	} else if req.Name != "" {
 
 		user, err := registry.GetUser(req.Name, nil)
@@ -140,6 +209,10 @@ func revokeHandler(ctx *serverRequestContext) (interface{}, error) {
 				}
 			}
 
+			if ctx.needsApproval(opRevoke) && isPrivilegedIdentity(user) {
+				return ctx.deferRevocation(req)
+			}
+
 			err = user.Revoke()
 			if err != nil {
 				return nil, newHTTPErr(500, ErrRevokeUpdateUser, "Failed to revoke user: %s", err)
@@ -153,6 +226,16 @@ func revokeHandler(ctx *serverRequestContext) (interface{}, error) {
 				req.Name, err)
 		}
 
+		credRecs, err := ca.idemixCredDBAccessor.RevokeCredentialsByID(req.Name, ca.Config.CA.Name, reason)
+		if err != nil {
+			return nil, newHTTPErr(500, ErrNoCertsRevoked, "Failed to revoke Idemix credentials for '%s': %s",
+				req.Name, err)
+		}
+		for _, credRec := range credRecs {
+			log.Debugf("Revoked Idemix credential with revocation handle %s owned by '%s'", credRec.RevocationHandle, req.Name)
+			result.RevokedCredentials = append(result.RevokedCredentials, credRec.RevocationHandle)
+		}
+
 		if len(recs) == 0 {
 			log.Warningf("No certificates were revoked for '%s' but the ID was disabled", req.Name)
 		} else {
@@ -162,10 +245,11 @@ func revokeHandler(ctx *serverRequestContext) (interface{}, error) {
 			}
 		}
 	} else {
-		return nil, newHTTPErr(400, ErrMissingRevokeArgs, "Either Name or Serial and AKI are required for a revoke request")
+		return nil, newHTTPErr(400, ErrMissingRevokeArgs, "Either Name, Certificate, RevocationHandle, or Serial and AKI are required for a revoke request")
 	}
 
 	log.Debugf("Revoke was successful: %+v", req)
+	ctx.audit(auditRevoke, getRevokeTarget(req), nil, auditRevocation(req.Reason, result.RevokedCerts, result.RevokedCredentials))
 
 	if req.GenCRL && len(result.RevokedCerts) > 0 {
 		log.Debugf("Generating CRL")
@@ -177,3 +261,36 @@ func revokeHandler(ctx *serverRequestContext) (interface{}, error) {
 	}
 	return result, nil
 }
+
+// deferRevocation stores a revoke request as a pending operation which must
+// be confirmed by a second identity
+func (ctx *serverRequestContext) deferRevocation(req *api.RevocationRequestNet) (*revocationResponseNet, error) {
+	body, err := util.Marshal(req, "RevocationRequest")
+	if err != nil {
+		return nil, err
+	}
+	pending, err := ctx.deferOperation(opRevoke, getRevokeTarget(req), body)
+	if err != nil {
+		return nil, err
+	}
+	return &revocationResponseNet{Pending: pending}, nil
+}
+
+// getSerialAndAKIFromPEM parses the PEM-encoded X.509 or SM2 certificate found in a
+// revocation request, makes sure that it was issued by 'ca', and returns its serial
+// number and AKI in the same normalized form as stored in the certificates table
+func getSerialAndAKIFromPEM(ca *CA, certPEM string) (string, string, error) {
+	cert, err := util.GetCertificateFromPEM([]byte(certPEM))
+	if err != nil {
+		return "", "", newHTTPErr(400, ErrInvalidRevokeCert, "Invalid certificate in revocation request: %s", err)
+	}
+	err = ca.VerifyCertificate(cert)
+	if err != nil {
+		return "", "", newHTTPErr(400, ErrRevokeCertNotIssued, "Certificate in revocation request was not issued by CA '%s': %s",
+			ca.Config.CA.Name, err)
+	}
+	serial := strings.TrimLeft(strings.ToLower(util.GetSerialAsHex(cert.SerialNumber)), "0")
+	aki := strings.TrimLeft(strings.ToLower(hex.EncodeToString(cert.AuthorityKeyId)), "0")
+	log.Debugf("Revocation request certificate has serial %s and AKI %s", serial, aki)
+	return serial, aki, nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func TestRevokeByCertificate(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{Name: "admin", Secret: "adminpw"})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+	regResp, err := admin.Register(&api.RegistrationRequest{Name: "user1", Type: "user", Affiliation: "hyperledger.fabric-ca"})
+	if err != nil {
+		t.Fatalf("Failed to register user1: %s", err)
+	}
+	resp, err = client.Enroll(&api.EnrollmentRequest{Name: "user1", Secret: regResp.Secret})
+	if err != nil {
+		t.Fatalf("Failed to enroll user1: %s", err)
+	}
+	user1 := resp.Identity
+
+	// Revoke user1's enrollment certificate by uploading the certificate itself
+	_, err = admin.Revoke(&api.RevocationRequest{Certificate: "not a certificate"})
+	assert.Error(t, err, "Revoking with an invalid certificate should have failed")
+	revResp, err := admin.Revoke(&api.RevocationRequest{Certificate: string(user1.GetECert().Cert())})
+	if assert.NoError(t, err, "Failed to revoke user1's certificate by PEM") {
+		assert.Len(t, revResp.RevokedCerts, 1, "Exactly one certificate should have been revoked")
+	}
+	_, err = user1.Reenroll(&api.ReenrollmentRequest{})
+	assert.Error(t, err, "User1 should have failed to reenroll with a revoked certificate")
+}
@@ -0,0 +1,217 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+	"github.com/tjfoc/fabric-ca-gm/lib/spi"
+)
+
+func TestSecretExpiry(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+
+	// A one-time secret can't be used to enroll a second time
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:          "onetime1",
+		Secret:        "onetime1pw",
+		Affiliation:   "org2",
+		SecretOneTime: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to register onetime1: %s", err)
+	}
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "onetime1",
+		Secret: "onetime1pw",
+	})
+	assert.NoError(t, err, "Enrollment of onetime1 failed")
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "onetime1",
+		Secret: "onetime1pw",
+	})
+	if assert.Error(t, err, "Enrollment should have failed; the one-time secret was already used") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("Error Code: %d", ErrSecretExpired))
+	}
+
+	// An expired secret can't be used to enroll
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:         "expiry1",
+		Secret:       "expiry1pw",
+		Affiliation:  "org2",
+		SecretExpiry: time.Now().Add(-time.Minute).Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatalf("Failed to register expiry1: %s", err)
+	}
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "expiry1",
+		Secret: "expiry1pw",
+	})
+	if assert.Error(t, err, "Enrollment should have failed; the secret of expiry1 has expired") {
+		assert.Contains(t, err.Error(), fmt.Sprintf("Error Code: %d", ErrSecretExpired))
+	}
+
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:         "expiry2",
+		Secret:       "expiry2pw",
+		Affiliation:  "org2",
+		SecretExpiry: "invalid",
+	})
+	assert.Error(t, err, "Registration with an invalid secret expiry should have failed")
+
+	// A registrar can push out the expiry of the secret
+	_, err = admin.ModifyIdentity(&api.ModifyIdentityRequest{
+		ID:           "expiry1",
+		SecretExpiry: "1h",
+	})
+	assert.NoError(t, err, "Failed to modify the secret expiry of expiry1")
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "expiry1",
+		Secret: "expiry1pw",
+	})
+	assert.NoError(t, err, "Enrollment of expiry1 failed after extending its secret expiry")
+
+	// Resetting the secret returns a new random secret which replaces the old one
+	idResp, err := admin.ResetSecret(&api.ResetSecretRequest{
+		ID:            "onetime1",
+		SecretOneTime: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to reset the secret of onetime1: %s", err)
+	}
+	assert.NotEmpty(t, idResp.Secret, "Reset secret response should contain the new secret")
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "onetime1",
+		Secret: "onetime1pw",
+	})
+	assert.Error(t, err, "Enrollment with the old secret of onetime1 should have failed")
+	_, err = client.Enroll(&api.EnrollmentRequest{
+		Name:   "onetime1",
+		Secret: idResp.Secret,
+	})
+	assert.NoError(t, err, "Enrollment of onetime1 with its new secret failed")
+}
+
+func TestOneTimeSecretConcurrentEnroll(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+
+	// Two logins which both passed the secret check can't both complete
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:           "onetime1",
+		Secret:         "onetime1pw",
+		Affiliation:    "org2",
+		MaxEnrollments: -1,
+		SecretOneTime:  true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to register onetime1: %s", err)
+	}
+	var users []spi.User
+	for i := 0; i < 2; i++ {
+		user, err := srv.CA.registry.GetUser("onetime1", nil)
+		if err != nil {
+			t.Fatalf("Failed to get onetime1: %s", err)
+		}
+		err = user.Login("onetime1pw", -1)
+		if err != nil {
+			t.Fatalf("Failed to login onetime1: %s", err)
+		}
+		users = append(users, user)
+	}
+	assert.NoError(t, users[0].LoginComplete(), "The first login of onetime1 should have completed")
+	err = users[1].LoginComplete()
+	if assert.Error(t, err, "The second login of onetime1 should have failed; the one-time secret was already used") {
+		assert.Equal(t, errSecretExpired, errors.Cause(err))
+	}
+
+	// Only one of several concurrent enrollments with a one-time secret succeeds
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:           "onetime2",
+		Secret:         "onetime2pw",
+		Affiliation:    "org2",
+		MaxEnrollments: -1,
+		SecretOneTime:  true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to register onetime2: %s", err)
+	}
+	const enrollments = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, enrollments)
+	for i := 0; i < enrollments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := getTestClient(rootPort).Enroll(&api.EnrollmentRequest{
+				Name:   "onetime2",
+				Secret: "onetime2pw",
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded, "Exactly one enrollment with the one-time secret of onetime2 should have succeeded")
+}
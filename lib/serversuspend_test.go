@@ -0,0 +1,83 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tjfoc/fabric-ca-gm/api"
+)
+
+func TestIdentitySuspension(t *testing.T) {
+	os.RemoveAll(rootDir)
+	defer os.RemoveAll(rootDir)
+	srv := TestGetRootServer(t)
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Server start failed: %s", err)
+	}
+	defer srv.Stop()
+
+	client := getTestClient(rootPort)
+	resp, err := client.Enroll(&api.EnrollmentRequest{
+		Name:   "admin",
+		Secret: "adminpw",
+	})
+	if err != nil {
+		t.Fatalf("Failed to enroll bootstrap user: %s", err)
+	}
+	admin := resp.Identity
+
+	_, err = admin.Register(&api.RegistrationRequest{
+		Name:        "suspended1",
+		Secret:      "suspended1pw",
+		Affiliation: "org2",
+	})
+	if err != nil {
+		t.Fatalf("Failed to register suspended1: %s", err)
+	}
+	resp, err = client.Enroll(&api.EnrollmentRequest{Name: "suspended1", Secret: "suspended1pw"})
+	if err != nil {
+		t.Fatalf("Failed to enroll suspended1: %s", err)
+	}
+	suspended1 := resp.Identity
+
+	modResp, err := admin.ModifyIdentity(&api.ModifyIdentityRequest{ID: "suspended1", Suspend: true})
+	if assert.NoError(t, err, "Failed to suspend suspended1") {
+		assert.True(t, modResp.Suspended, "suspended1 should have been suspended")
+	}
+
+	// A suspended identity can neither enroll nor authenticate with a token
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "suspended1", Secret: "suspended1pw"})
+	assert.Error(t, err, "Enrollment should have failed; suspended1 is suspended")
+	_, err = suspended1.Reenroll(&api.ReenrollmentRequest{})
+	assert.Error(t, err, "Reenrollment should have failed; suspended1 is suspended")
+
+	// Its certificate is not revoked, so it can be used again once resumed
+	_, err = admin.ModifyIdentity(&api.ModifyIdentityRequest{ID: "suspended1", Suspend: true, Resume: true})
+	assert.Error(t, err, "An identity cannot be both suspended and resumed")
+	modResp, err = admin.ModifyIdentity(&api.ModifyIdentityRequest{ID: "suspended1", Resume: true})
+	if assert.NoError(t, err, "Failed to resume suspended1") {
+		assert.False(t, modResp.Suspended, "suspended1 should have been resumed")
+	}
+	_, err = suspended1.Reenroll(&api.ReenrollmentRequest{})
+	assert.NoError(t, err, "Reenrollment of suspended1 failed after it was resumed")
+	_, err = client.Enroll(&api.EnrollmentRequest{Name: "suspended1", Secret: "suspended1pw"})
+	assert.NoError(t, err, "Enrollment of suspended1 failed after it was resumed")
+}
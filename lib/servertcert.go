@@ -28,6 +28,7 @@ func newTCertEndpoint(s *Server) *serverEndpoint {
 		Methods: []string{"POST"},
 		Handler: tcertHandler,
 		Server:  s,
+		limiter: newEndpointRateLimiter(s.Config.RateLimits.TCert),
 	}
 }
 
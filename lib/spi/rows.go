@@ -0,0 +1,86 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spi
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// Rows is a cursor over the rows returned by a user registry, such as the
+// *sqlx.Rows of a database query
+type Rows interface {
+	// Next prepares the next row for StructScan, and returns false if
+	// there are no more rows
+	Next() bool
+	// StructScan copies the columns of the current row into the fields
+	// of the struct pointed to by dest, matching them by their 'db' tags
+	StructScan(dest interface{}) error
+	// Close releases the resources of the cursor
+	Close() error
+}
+
+// mapRows is a cursor over rows which are held in memory
+type mapRows struct {
+	rows []map[string]interface{}
+	cur  int
+}
+
+// NewRows returns a cursor over rows which map column names to values, for
+// registries whose rows don't come from a database
+func NewRows(rows []map[string]interface{}) Rows {
+	return &mapRows{rows: rows, cur: -1}
+}
+
+func (r *mapRows) Next() bool {
+	if r.cur < len(r.rows) {
+		r.cur++
+	}
+	return r.cur < len(r.rows)
+}
+
+func (r *mapRows) StructScan(dest interface{}) error {
+	if r.cur < 0 || r.cur >= len(r.rows) {
+		return errors.New("No current row; call Next before StructScan")
+	}
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return errors.Errorf("Expected a pointer to a struct but got %T", dest)
+	}
+	v = v.Elem()
+	row := r.rows[r.cur]
+	for i := 0; i < v.NumField(); i++ {
+		col := v.Type().Field(i).Tag.Get("db")
+		val, ok := row[col]
+		if col == "" || !ok || val == nil {
+			continue
+		}
+		field := v.Field(i)
+		rv := reflect.ValueOf(val)
+		if !rv.Type().ConvertibleTo(field.Type()) {
+			return errors.Errorf("Can't store a value of type %T in column '%s' of type %s", val, col, field.Type())
+		}
+		field.Set(rv.Convert(field.Type()))
+	}
+	return nil
+}
+
+func (r *mapRows) Close() error {
+	r.rows = nil
+	return nil
+}
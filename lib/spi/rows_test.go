@@ -0,0 +1,54 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRows(t *testing.T) {
+	type record struct {
+		Name  string `db:"name"`
+		Level int    `db:"level"`
+		Other string
+	}
+	rows := NewRows([]map[string]interface{}{
+		{"name": "org1", "level": 1},
+		{"name": "org2", "unknown": "ignored"},
+	})
+	var rec record
+	assert.Error(t, rows.StructScan(&rec), "StructScan before Next should fail")
+
+	names := []string{}
+	for rows.Next() {
+		rec := record{Other: "unchanged"}
+		if assert.NoError(t, rows.StructScan(&rec)) {
+			names = append(names, rec.Name)
+			assert.Equal(t, "unchanged", rec.Other)
+		}
+	}
+	assert.Equal(t, []string{"org1", "org2"}, names)
+	assert.False(t, rows.Next())
+	assert.NoError(t, rows.Close())
+
+	rows = NewRows([]map[string]interface{}{{"level": "one"}})
+	rows.Next()
+	assert.Error(t, rows.StructScan(&rec), "A string can't be stored in an int field")
+	assert.Error(t, rows.StructScan(rec), "StructScan into a non-pointer should fail")
+}
@@ -21,8 +21,9 @@ limitations under the License.
 package spi
 
 import (
+	"time"
+
 	"github.com/tjfoc/fabric-ca-gm/api"
-	"github.com/jmoiron/sqlx"
 )
 
 // UserInfo contains information about a user
@@ -35,6 +36,31 @@ type UserInfo struct {
 	State          int
 	MaxEnrollments int
 	Level          int
+	// SecretExpiry is the time after which the secret can no longer be
+	// used to enroll; the zero value means the secret never expires
+	SecretExpiry time.Time
+	// SecretOneTime is true if the secret can only be used for one enrollment
+	SecretOneTime bool
+	// Suspended is true if the user can neither enroll nor authenticate
+	// with a token until it is resumed
+	Suspended bool
+}
+
+// UserFilter selects and pages through the identities returned by
+// GetFilteredUsers; the zero value selects all of them
+type UserFilter struct {
+	// Attributes selects the identities which have all of these attributes;
+	// an attribute with an empty value matches any value
+	Attributes []api.Attribute
+	// State selects the identities in this state, if not nil
+	State *int
+	// MaxEnrollments selects the identities with this maximum number of
+	// enrollments, if not nil
+	MaxEnrollments *int
+	// After selects the identities whose names sort after it
+	After string
+	// Limit is the maximum number of identities returned; 0 means no limit
+	Limit int
 }
 
 // DbTxResult returns information on any affiliations and/or identities affected
@@ -79,12 +105,12 @@ type UserRegistry interface {
 	UpdateUser(user *UserInfo, updatePass bool) error
 	DeleteUser(id string) (User, error)
 	GetAffiliation(name string) (Affiliation, error)
-	GetAllAffiliations(name string) (*sqlx.Rows, error)
+	GetAllAffiliations(name string) (Rows, error)
 	InsertAffiliation(name string, prekey string, level int) error
 	// GetProperties returns the properties by name from the database
 	GetProperties(name []string) (map[string]string, error)
 	GetUserLessThanLevel(version int) ([]User, error)
-	GetFilteredUsers(affiliation, types string) (*sqlx.Rows, error)
+	GetFilteredUsers(affiliation, types string, filter *UserFilter) (Rows, error)
 	DeleteAffiliation(name string, force, identityRemoval, isRegistrar bool) (*DbTxResult, error)
 	ModifyAffiliation(oldAffiliation, newAffiliation string, force, isRegistrar bool) (*DbTxResult, error)
 	GetAffiliationTree(name string) (*DbTxResult, error)
@@ -37,6 +37,9 @@ import (
 type SearchElement struct {
 	Path string
 	CB   func(*json.Decoder) error
+	// ValueCB, if set, is called with the value at Path if it is neither
+	// an array nor an object
+	ValueCB func(interface{}) error
 }
 
 // StreamJSONArray searches the JSON stream for an array matching 'path'.
@@ -49,6 +52,18 @@ func StreamJSONArray(decoder *json.Decoder, path string, cb func(*json.Decoder)
 	return StreamJSON(decoder, ses)
 }
 
+// StreamJSONArrayWithValue is like StreamJSONArray, but also calls 'valueCB'
+// with the value of the json element at 'valuePath', if there is one
+func StreamJSONArrayWithValue(decoder *json.Decoder, path string, cb func(*json.Decoder) error,
+	valuePath string, valueCB func(interface{}) error) error {
+	ses := []SearchElement{
+		SearchElement{Path: path, CB: cb},
+		SearchElement{Path: valuePath, ValueCB: valueCB},
+		SearchElement{Path: "errors", CB: errCB},
+	}
+	return StreamJSON(decoder, ses)
+}
+
 // StreamJSON searches the JSON stream for arrays matching a search element.
 // For each array that it finds, it streams them one element at a time.
 func StreamJSON(decoder *json.Decoder, search []SearchElement) error {
@@ -67,15 +82,18 @@ func (js *jsonStream) stream() error {
 	if err != nil {
 		return err
 	}
+	path := strings.Join(js.stack, ".")
+	se := js.getSearchElement(path)
 	if _, ok := t.(json.Delim); !ok {
+		if se != nil && se.ValueCB != nil {
+			return se.ValueCB(t)
+		}
 		return nil
 	}
-	path := strings.Join(js.stack, ".")
-	se := js.getSearchElement(path)
 	d := fmt.Sprintf("%s", t)
 	switch d {
 	case "[":
-		if se != nil {
+		if se != nil && se.CB != nil {
 			for js.decoder.More() {
 				err = se.CB(js.decoder)
 				if err != nil {
@@ -90,7 +108,7 @@ func (js *jsonStream) stream() error {
 	case "]":
 		return errors.Errorf("Unexpected '%s'", d)
 	case "{":
-		if se != nil {
+		if se != nil && se.CB != nil {
 			return errors.Errorf("Expecting array for value of '%s'", path)
 		}
 		for {
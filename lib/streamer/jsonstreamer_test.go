@@ -20,8 +20,8 @@ import (
 	"strings"
 	"testing"
 
-	. "github.com/hyperledger/fabric-ca/lib/streamer"
 	"github.com/stretchr/testify/assert"
+	. "github.com/tjfoc/fabric-ca-gm/lib/streamer"
 )
 
 type element struct {
@@ -0,0 +1,63 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package streamer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONStreamerWithValue(t *testing.T) {
+	identityCount := 0
+	cb := func(decoder *json.Decoder) error {
+		var ele struct {
+			Name string
+			Type string
+		}
+		err := decoder.Decode(&ele)
+		if err != nil {
+			return err
+		}
+		identityCount++
+		return nil
+	}
+	cursor := ""
+	valueCB := func(val interface{}) error {
+		cursor = val.(string)
+		return nil
+	}
+
+	const jsonStream = `{"result": {"identities": [{"name": "id1", "type": "type1"}, {"name": "id2"}], "caname": "ca1", "cursor": "aWQy"}, "errors": []}`
+	dec := json.NewDecoder(strings.NewReader(jsonStream))
+	err := StreamJSONArrayWithValue(dec, "result.identities", cb, "result.cursor", valueCB)
+	if assert.NoError(t, err, "Failed to correctly stream JSON") {
+		assert.Equal(t, 2, identityCount, "Identity function not called correct number of times")
+		assert.Equal(t, "aWQy", cursor, "Value function not called with the cursor")
+	}
+
+	identityCount, cursor = 0, ""
+	const jsonStreamNoValue = `{"result": {"identities": [{"name": "id1"}], "caname": "ca1"}, "errors": []}`
+	dec = json.NewDecoder(strings.NewReader(jsonStreamNoValue))
+	err = StreamJSONArrayWithValue(dec, "result.identities", cb, "result.cursor", valueCB)
+	if assert.NoError(t, err, "Failed to correctly stream JSON") {
+		assert.Equal(t, 1, identityCount, "Identity function not called correct number of times")
+		assert.Empty(t, cursor, "Value function should not have been called")
+	}
+}
@@ -42,6 +42,7 @@ type ServerTLSConfig struct {
 type ClientAuth struct {
 	Type      string   `def:"noclientcert" help:"Policy the server will follow for TLS Client Authentication."`
 	CertFiles []string `help:"A list of comma-separated PEM-encoded trusted certificate files (e.g. root1.pem,root2.pem)"`
+	CertAuth  bool     `help:"Authenticate callers of the API without an authorization header by their verified TLS client certificate"`
 }
 
 // ClientTLSConfig defines the key material for a TLS client
@@ -26,6 +26,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -169,7 +170,24 @@ func IdentityDecoder(decoder *json.Decoder) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Name: %s, Type: %s, Affiliation: %s, Max Enrollments: %d, Attributes: %+v\n", id.ID, id.Type, id.Affiliation, id.MaxEnrollments, id.Attributes)
+	suspended := ""
+	if id.Suspended {
+		suspended = ", Suspended: true"
+	}
+	fmt.Printf("Name: %s, Type: %s, Affiliation: %s, Max Enrollments: %d, Attributes: %+v%s\n", id.ID, id.Type, id.Affiliation, id.MaxEnrollments, id.Attributes, suspended)
+	return nil
+}
+
+// AuditRecordDecoder decodes streams of data coming from the server into an audit record
+func AuditRecordDecoder(decoder *json.Decoder) error {
+	var rec api.AuditRecord
+	err := decoder.Decode(&rec)
+	if err != nil {
+		return err
+	}
+	changes, _ := json.Marshal(rec.Changes)
+	fmt.Printf("Time: %s, Caller: %s, Source: %s, Action: %s, Target: %s, Changes: %s\n",
+		rec.Time.UTC().Format(time.RFC3339), rec.Caller, rec.Source, rec.Action, rec.Target, changes)
 	return nil
 }
 
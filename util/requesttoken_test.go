@@ -0,0 +1,79 @@
+/*
+Copyright IBM Corp. 2018 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestToken(t *testing.T) {
+	cert, _ := ioutil.ReadFile("../testdata/ec.pem")
+	bccsp := GetDefaultBCCSP()
+	privKey, err := ImportBCCSPKeyFromPEM("../testdata/ec-key.pem", bccsp, true)
+	if err != nil {
+		t.Fatalf("Failed importing key %s", err)
+	}
+	body := []byte("request byte array")
+	uri := "/api/v1/identities/user1?ca=ca1"
+
+	token, err := CreateRequestToken(bccsp, cert, privKey, "PUT", uri, body)
+	if err != nil {
+		t.Fatalf("CreateRequestToken failed: %s", err)
+	}
+	assert.False(t, IsLegacyToken(token), "A request token is not a legacy token")
+	rt, err := VerifyRequestToken(bccsp, token, "PUT", uri, body)
+	if assert.NoError(t, err, "VerifyRequestToken failed") {
+		assert.Equal(t, GetEnrollmentIDFromX509Certificate(rt.Cert), "example.com")
+		assert.WithinDuration(t, time.Now(), rt.Timestamp, time.Minute)
+		assert.NotEmpty(t, rt.Nonce)
+	}
+
+	// Each token has its own nonce
+	token2, err := CreateRequestToken(bccsp, cert, privKey, "PUT", uri, body)
+	if assert.NoError(t, err, "CreateRequestToken failed") {
+		rt2, err := VerifyRequestToken(bccsp, token2, "PUT", uri, body)
+		if assert.NoError(t, err, "VerifyRequestToken failed") {
+			assert.NotEqual(t, rt.Nonce, rt2.Nonce)
+		}
+	}
+
+	// The token is only valid for the request for which it was created
+	_, err = VerifyRequestToken(bccsp, token, "DELETE", uri, body)
+	assert.Error(t, err, "VerifyRequestToken should have failed as the method is different")
+	_, err = VerifyRequestToken(bccsp, token, "PUT", "/api/v1/identities/user2?ca=ca1", body)
+	assert.Error(t, err, "VerifyRequestToken should have failed as the URI is different")
+	_, err = VerifyRequestToken(bccsp, token, "PUT", uri, []byte("tampered"))
+	assert.Error(t, err, "VerifyRequestToken should have failed as the body was tampered")
+
+	// The timestamp and nonce can't be changed
+	parts := strings.Split(token, ".")
+	_, err = VerifyRequestToken(bccsp, strings.Join([]string{parts[0], parts[1], "1", parts[3]}, "."), "PUT", uri, body)
+	assert.Error(t, err, "VerifyRequestToken should have failed as the timestamp was changed")
+	_, err = VerifyRequestToken(bccsp, strings.Join([]string{parts[0], parts[1], parts[2], "00"}, "."), "PUT", uri, body)
+	assert.Error(t, err, "VerifyRequestToken should have failed as the nonce was changed")
+
+	_, err = VerifyRequestToken(bccsp, parts[0]+"."+parts[1], "PUT", uri, body)
+	assert.Error(t, err, "VerifyRequestToken should have failed as the token is a legacy token")
+	assert.True(t, IsLegacyToken(parts[0]+"."+parts[1]))
+	_, err = VerifyRequestToken(nil, token, "PUT", uri, body)
+	assert.Error(t, err, "VerifyRequestToken should have failed as no instance of csp is passed")
+}
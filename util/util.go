@@ -19,10 +19,12 @@ package util
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -37,6 +39,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -319,6 +322,115 @@ func DecodeToken(token string) (*x509.Certificate, string, string, error) {
 	return x509Cert, b64cert, parts[1], nil
 }
 
+// CreateRequestToken creates a token like CreateToken, except that the
+// signature also covers the method and URI of the HTTP request, the current
+// time and a random nonce, so that the token can be neither used for another
+// request nor replayed for the same request. The token consists of the
+// base64-encoded certificate and signature, the timestamp in seconds since
+// the epoch and the hex-encoded nonce, separated by periods.
+// @param method The method of the HTTP request
+// @param uri The URI of the HTTP request, i.e. its path and query
+func CreateRequestToken(csp bccsp.BCCSP, cert []byte, key bccsp.Key, method, uri string, body []byte) (string, error) {
+	x509Cert, err := GetX509CertificateFromPEM(cert)
+	if err != nil {
+		return "", err
+	}
+	switch x509Cert.PublicKey.(type) {
+	case *ecdsa.PublicKey, *sm2.PublicKey:
+	default:
+		return "", errors.Errorf("Unsupported public key type %T in certificate", x509Cert.PublicKey)
+	}
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate nonce")
+	}
+	b64cert := B64Encode(cert)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	hexNonce := hex.EncodeToString(nonce)
+	msg := requestTokenMessage(method, uri, body, b64cert, timestamp, hexNonce)
+
+	digest, err := csp.Hash([]byte(msg), &bccsp.SHAOpts{})
+	if err != nil {
+		return "", errors.WithMessage(err, "Hash failed on request token")
+	}
+	sig, err := csp.Sign(key, digest, nil)
+	if err != nil {
+		return "", errors.WithMessage(err, "BCCSP signature generation failure")
+	}
+	if len(sig) == 0 {
+		return "", errors.New("BCCSP signature creation failed. Signature must be different than nil")
+	}
+	return strings.Join([]string{b64cert, B64Encode(sig), timestamp, hexNonce}, "."), nil
+}
+
+// RequestToken is the content of a token created by CreateRequestToken
+type RequestToken struct {
+	Cert      *x509.Certificate
+	Timestamp time.Time
+	Nonce     string
+}
+
+// VerifyRequestToken verifies a token created by CreateRequestToken for an
+// HTTP request, and returns its content. The caller must check that the
+// timestamp is recent and that the nonce has not been used before.
+func VerifyRequestToken(csp bccsp.BCCSP, token, method, uri string, body []byte) (*RequestToken, error) {
+	if csp == nil {
+		return nil, errors.New("BCCSP instance is not present")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return nil, errors.New("Invalid token format; expecting 4 parts separated by '.'")
+	}
+	x509Cert, b64cert, b64sig, err := DecodeToken(parts[0] + "." + parts[1])
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("Invalid timestamp '%s' in token", parts[2])
+	}
+	if parts[3] == "" {
+		return nil, errors.New("Invalid token; the nonce is empty")
+	}
+	sig, err := B64Decode(b64sig)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid base64 encoded signature in token")
+	}
+	pubKey, err := csp.KeyImport(ParseX509Certificate2Sm2(x509Cert), &bccsp.X509PublicKeyImportOpts{Temporary: true})
+	if err != nil {
+		return nil, errors.WithMessage(err, "Public Key import into BCCSP failed with error")
+	}
+	msg := requestTokenMessage(method, uri, body, b64cert, parts[2], parts[3])
+	digest, err := csp.Hash([]byte(msg), &bccsp.SHAOpts{})
+	if err != nil {
+		return nil, errors.WithMessage(err, "Message digest failed")
+	}
+	valid, err := csp.Verify(pubKey, sig, digest, nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Token signature validation failure")
+	}
+	if !valid {
+		return nil, errors.New("Token signature validation failed")
+	}
+	return &RequestToken{
+		Cert:      x509Cert,
+		Timestamp: time.Unix(timestamp, 0),
+		Nonce:     parts[3],
+	}, nil
+}
+
+// IsLegacyToken returns true if the token was created by CreateToken, and
+// so does not cover the method and URI of the request, a timestamp and a nonce
+func IsLegacyToken(token string) bool {
+	return strings.Count(token, ".") == 1
+}
+
+// requestTokenMessage returns the message which is signed by a request token
+func requestTokenMessage(method, uri string, body []byte, b64cert, timestamp, nonce string) string {
+	return strings.Join([]string{method, B64Encode([]byte(uri)), B64Encode(body), b64cert, timestamp, nonce}, ".")
+}
+
 //GetECPrivateKey get *ecdsa.PrivateKey from key pem
 func GetECPrivateKey(raw []byte) (*ecdsa.PrivateKey, error) {
 	decoded, _ := pem.Decode(raw)
@@ -545,6 +657,25 @@ func GetX509CertificatesFromPEM(pemBytes []byte) ([]*x509.Certificate, error) {
 	return certs, nil
 }
 
+// GetCertificateFromPEM returns a certificate from bytes in PEM format.
+// Unlike GetX509CertificateFromPEM, the certificate may be either a standard
+// X.509 certificate or an SM2 certificate, regardless of the configured provider.
+func GetCertificateFromPEM(cert []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(cert)
+	if block == nil {
+		return nil, errors.New("Failed to PEM decode certificate")
+	}
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err == nil {
+		return x509Cert, nil
+	}
+	sm2Cert, err2 := sm2.ParseCertificate(block.Bytes)
+	if err2 != nil {
+		return nil, errors.Errorf("Error parsing certificate as X.509 (%s) or SM2 (%s)", err, err2)
+	}
+	return ParseSm2Certificate2X509(sm2Cert), nil
+}
+
 // GetCertificateDurationFromFile returns the validity duration for a certificate
 // in a file.
 func GetCertificateDurationFromFile(file string) (time.Duration, error) {